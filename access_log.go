@@ -0,0 +1,282 @@
+package gaia
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+// RequestIDHeader identifies a request, it is propagated if the client (or a proxy) provides it,
+// otherwise gaia assigns one. Either way the response carries it.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request ids gaia propagates
+const maxRequestIDLength = 128
+
+// An AccessLogFormat is the form of the line an access log writes per request
+type AccessLogFormat int
+
+const (
+	// CommonLogFormat is the Common Log Format, followed by the request id and the duration in seconds:
+	//
+	//		127.0.0.1 - 5705da4d [04/Apr/2016:17:02:11 -0700] "GET /record/?kind=task HTTP/1.1" 200 512 "8d3b4f..." 0.004120
+	CommonLogFormat AccessLogFormat = iota
+	// JSONLogFormat is a JSON object per request
+	JSONLogFormat
+)
+
+// --- Request IDs {{{
+
+type requestIDContextKey int
+
+const requestIDKey requestIDContextKey = 0
+
+// RequestID retrieves the id of the request of the context, which gaia gives to the actions of its endpoints
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+	return id, ok
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// validRequestID determines whether a request id provided by a client is safe to propagate, and log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID generates a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// --- }}}
+
+// --- Access {{{
+
+// access is what the access log knows of a request as it is handled, the
+// endpoint's handler fills in the user once it is authenticated
+type access struct {
+	mu        sync.Mutex
+	requestID string
+	userID    string
+}
+
+type accessContextKey int
+
+const accessKey accessContextKey = 0
+
+// accessFromRequest retrieves the access of a request which has been through an access log
+func accessFromRequest(r *http.Request) (*access, bool) {
+	a, ok := r.Context().Value(accessKey).(*access)
+	return a, ok
+}
+
+func (a *access) setUser(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.userID = id
+}
+
+func (a *access) user() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.userID
+}
+
+// --- }}}
+
+// --- responseRecorder {{{
+
+// responseRecorder records the status and size of a response as it is written. It passes
+// through the Flusher, CloseNotifier and Hijacker of the ResponseWriter it wraps, which the
+// event stream and websocket endpoints rely on.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rr *responseRecorder) CloseNotify() <-chan bool {
+	if cn, ok := rr.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+
+	// never notifies
+	return make(chan bool)
+}
+
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("gaia: %T is not a http.Hijacker", rr.ResponseWriter)
+	}
+
+	// a hijacked connection is upgraded, e.g. to a websocket
+	if rr.status == 0 {
+		rr.status = http.StatusSwitchingProtocols
+	}
+
+	return h.Hijack()
+}
+
+// --- }}}
+
+// An AccessEntry is the record of a request, written once the request has been handled
+type AccessEntry struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id"`
+	RemoteIP  string        `json:"remote_ip"`
+	UserID    string        `json:"user_id,omitempty"`
+	Method    string        `json:"method"`
+	URL       string        `json:"url"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration_ns"`
+}
+
+// CommonLogFormat formats the entry as a line of the CommonLogFormat
+func (e *AccessEntry) CommonLogFormat() string {
+	user := e.UserID
+	if user == "" {
+		user = "-"
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %q %d %d %q %f",
+		e.RemoteIP, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.URL+" "+e.Proto, e.Status, e.Bytes, e.RequestID, e.Duration.Seconds())
+}
+
+// accessLog is the middleware which assigns (or propagates) the request id, and
+// records the request, calling the entry func once the request has been handled
+func accessLog(entry func(*AccessEntry)) MiddlewareFunc {
+	return func(handle http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+
+			a := &access{requestID: id}
+			rr := &responseRecorder{ResponseWriter: w}
+			handle(rr, r.WithContext(context.WithValue(r.Context(), accessKey, a)))
+
+			ip := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				ip = host
+			}
+
+			status := rr.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			entry(&AccessEntry{
+				Time:      start,
+				RequestID: id,
+				RemoteIP:  ip,
+				UserID:    a.user(),
+				Method:    r.Method,
+				URL:       redact(r.URL),
+				Proto:     r.Proto,
+				Status:    status,
+				Bytes:     rr.bytes,
+				Duration:  time.Since(start),
+			})
+		}
+	}
+}
+
+// AccessLog is middleware which writes a line per request to the out, in the format. It
+// replaces gaia's "log" middleware, which logs each request through the services.Logger:
+//
+//		m := new(gaia.Middleware)
+//		m.Register("log", gaia.AccessLog(os.Stdout, gaia.JSONLogFormat))
+func AccessLog(out io.Writer, format AccessLogFormat) MiddlewareFunc {
+	var mu sync.Mutex
+
+	return accessLog(func(e *AccessEntry) {
+		var line []byte
+		switch format {
+		case JSONLogFormat:
+			line, _ = json.Marshal(e)
+		default:
+			line = []byte(e.CommonLogFormat())
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		out.Write(append(line, '\n'))
+	})
+}
+
+// logRequest is gaia's "log" middleware, it logs each request through the logger
+func logRequest(logger services.Logger) MiddlewareFunc {
+	return accessLog(func(e *AccessEntry) {
+		logger.Info(fmt.Sprintf("%s %s", e.Method, e.URL),
+			"status", e.Status,
+			"bytes", e.Bytes,
+			"duration", e.Duration,
+			"remote_ip", e.RemoteIP,
+			"user_id", e.UserID,
+			"request_id", e.RequestID,
+		)
+	})
+}
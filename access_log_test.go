@@ -0,0 +1,107 @@
+package gaia
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+func TestAccessLog(t *testing.T) {
+	var requestID string
+	e := &Endpoint{
+		Name: "test",
+		Path: "/test/",
+		Actions: map[string]Action{
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				requestID, _ = RequestID(ctx)
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("created"))
+			},
+		},
+	}
+
+	out := new(bytes.Buffer)
+	handle := e.handler(context.Background(), &Services{Logger: services.NewTestLogger(t)}, []MiddlewareFunc{
+		AccessLog(out, JSONLogFormat),
+	})
+
+	cases := []struct {
+		given string
+		kept  bool
+	}{
+		{given: "", kept: false},
+		{given: "c0ffee-42", kept: true},
+		{given: "not\nan id", kept: false},
+	}
+
+	for _, c := range cases {
+		out.Reset()
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("POST", "/test/?public=u&private=p", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "10.0.0.1:4321"
+		if c.given != "" {
+			r.Header.Set(RequestIDHeader, c.given)
+		}
+
+		handle(w, r)
+
+		id := w.Header().Get(RequestIDHeader)
+		if id == "" {
+			t.Fatalf("%q: expected the response to have a request id", c.given)
+		}
+		if (id == c.given) != c.kept {
+			t.Errorf("%q: got request id %q, expected it to be kept: %t", c.given, id, c.kept)
+		}
+		if requestID != id {
+			t.Errorf("%q: the context's request id is %q, the response's is %q", c.given, requestID, id)
+		}
+
+		entry := new(AccessEntry)
+		if err := json.Unmarshal(out.Bytes(), entry); err != nil {
+			t.Fatalf("json.Unmarshal error: %s (%q)", err, out.String())
+		}
+
+		if entry.RequestID != id {
+			t.Errorf("%q: entry request id: got %q, want %q", c.given, entry.RequestID, id)
+		}
+		if entry.Status != http.StatusCreated {
+			t.Errorf("%q: entry status: got %d, want %d", c.given, entry.Status, http.StatusCreated)
+		}
+		if entry.Bytes != int64(len("created")) {
+			t.Errorf("%q: entry bytes: got %d, want %d", c.given, entry.Bytes, len("created"))
+		}
+		if entry.RemoteIP != "10.0.0.1" {
+			t.Errorf("%q: entry remote ip: got %q, want %q", c.given, entry.RemoteIP, "10.0.0.1")
+		}
+		if strings.Contains(entry.URL, "private=p") {
+			t.Errorf("%q: expected the credentials to be redacted from %q", c.given, entry.URL)
+		}
+	}
+}
+
+func TestAccessEntryCommonLogFormat(t *testing.T) {
+	e := &AccessEntry{
+		RequestID: "abc",
+		RemoteIP:  "127.0.0.1",
+		Method:    "GET",
+		URL:       "/record/?kind=task",
+		Proto:     "HTTP/1.1",
+		Status:    http.StatusOK,
+		Bytes:     512,
+	}
+
+	want := `127.0.0.1 - - [01/Jan/0001:00:00:00 +0000] "GET /record/?kind=task HTTP/1.1" 200 512 "abc" 0.000000`
+	if got := e.CommonLogFormat(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
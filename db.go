@@ -1,22 +1,27 @@
 package gaia
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/elos/data"
-	"github.com/elos/data/builtin/mem"
 	"github.com/elos/data/builtin/mongo"
 	"github.com/elos/data/transfer"
 	"github.com/elos/gaia/routes"
 	"github.com/elos/models"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 	"golang.org/x/net/websocket"
 )
 
@@ -38,10 +43,53 @@ func recordChangesEndpoint(host string) string {
 	return host + routes.RecordChanges
 }
 
+func recordBatchEndpoint(host string) string {
+	return host + routes.RecordBatch
+}
+
+// ErrNotApplied is the error of a batch operation which was not
+// applied, or was undone, because another operation in the batch failed
+var ErrNotApplied = errors.New("gaia: operation not applied")
+
+// ErrNotUndone is the error of a batch operation which was applied, but
+// could not be undone when another operation in the batch failed
+var ErrNotUndone = errors.New("gaia: operation applied, and not undone")
+
+// BatchOp is a save or delete of a record, for use with (*DB).Batch
+type BatchOp struct {
+	Delete bool
+	Record data.Record
+}
+
+// SaveOp constructs a *BatchOp which saves the record
+func SaveOp(r data.Record) *BatchOp {
+	return &BatchOp{Record: r}
+}
+
+// DeleteOp constructs a *BatchOp which deletes the record
+func DeleteOp(r data.Record) *BatchOp {
+	return &BatchOp{Delete: true, Record: r}
+}
+
+// The transports over which a DB may receive changes
+const (
+	WebSocketTransport   = "websocket"
+	EventStreamTransport = "event-stream"
+)
+
 // DB implements the data.DB interface, and communicates over HTTP
 // with the gaia server to complete it's actions
 type DB struct {
 	URL, Username, Password string
+
+	// ChangesTransport is the transport of the change feed, either
+	// WebSocketTransport (the default) or EventStreamTransport
+	ChangesTransport string
+
+	// ChangesReset, if given, is called when the change feed couldn't resume after
+	// the last change it received, some changes were missed, so records may be stale
+	ChangesReset func()
+
 	*http.Client
 }
 
@@ -53,6 +101,10 @@ func (db *DB) recordQueryURL(v url.Values) string {
 	return recordQueryEndpoint(db.URL) + "?" + v.Encode()
 }
 
+func (db *DB) recordBatchURL() string {
+	return recordBatchEndpoint(db.URL)
+}
+
 func (db *DB) recordChangesURL(v url.Values) string {
 	return strings.Replace(recordChangesEndpoint(db.URL), "http", "ws", 1) + "?" + v.Encode()
 }
@@ -174,71 +226,272 @@ func (db *DB) deleteRecord(r data.Record) error {
 	return nil
 }
 
+// defaultPageSize is the number of records retrieved per request
+// when iterating over the results of a query without a batch size
+const defaultPageSize = 100
+
 func (db *DB) query(q *query) (data.Iterator, error) {
-	url := db.recordQueryURL(url.Values{
-		"kind":  []string{q.kind.String()},
-		"skip":  []string{fmt.Sprintf("%d", q.skip)},
-		"limit": []string{fmt.Sprintf("%d", q.limit)},
-		"batch": []string{fmt.Sprintf("%d", q.batch)},
-		"order": q.order,
-	})
+	iter := &pageIterator{
+		db:        db,
+		q:         q,
+		remaining: q.limit,
+	}
 
-	resp, err := db.postJSON(url, q.attrs)
-	if err != nil {
+	// request the first page eagerly, so that any error
+	// is returned when the query is executed
+	if err := iter.fetch(); err != nil {
 		return nil, err
 	}
 
+	return iter, nil
+}
+
+// pageIterator implements the data.Iterator interface, requesting the
+// results of a query from gaia one page at a time, and decoding each
+// page incrementally as it is streamed
+type pageIterator struct {
+	db *DB
+	q  *query
+
+	// body and dec are the stream of the current page, they
+	// are nil between pages
+	body   io.ReadCloser
+	dec    *json.Decoder
+	cursor string
+
+	// remaining is the number of records left to retrieve
+	// if the query has a limit, otherwise it is 0
+	remaining int
+	done      bool
+	err       error
+}
+
+// pageSize determines the limit of the next request
+func (i *pageIterator) pageSize() int {
+	size := i.q.batch
+	if size <= 0 {
+		size = defaultPageSize
+	}
+
+	if i.q.limit > 0 && i.remaining < size {
+		size = i.remaining
+	}
+
+	return size
+}
+
+// fetch requests the next page of results
+func (i *pageIterator) fetch() error {
+	params := url.Values{
+		"kind":  []string{i.q.kind.String()},
+		"limit": []string{fmt.Sprintf("%d", i.pageSize())},
+		"batch": []string{fmt.Sprintf("%d", i.q.batch)},
+	}
+
+	if i.cursor != "" {
+		params.Set("cursor", i.cursor)
+	} else {
+		params.Set("skip", fmt.Sprintf("%d", i.q.skip))
+		params["order"] = i.q.order
+	}
+
+	requestBody, err := json.Marshal(i.q.attrs)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", i.db.recordQueryURL(params), bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", routes.NDJSONContentType)
+
+	resp, err := i.db.do(req)
+	if err != nil {
+		return err
+	}
+
 	switch resp.StatusCode {
 	case http.StatusBadRequest:
 		log.Print("gaia db bad request")
 		fallthrough
 	case http.StatusInternalServerError:
-		return nil, data.ErrNoConnection
+		resp.Body.Close()
+		return data.ErrNoConnection
 	case http.StatusUnauthorized:
-		return nil, data.ErrAccessDenial
+		resp.Body.Close()
+		return data.ErrAccessDenial
 	case http.StatusOK:
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+		i.body = resp.Body
+		i.dec = json.NewDecoder(resp.Body)
+		return nil
+	default:
+		resp.Body.Close()
+		log.Printf("Unexpected status code: %d", resp.StatusCode)
+		return data.ErrNoConnection
+	}
+}
+
+// endPage closes the stream of the current page
+func (i *pageIterator) endPage() {
+	if i.body != nil {
+		i.body.Close()
+	}
+	i.body, i.dec = nil, nil
+}
+
+func (i *pageIterator) Next(r data.Record) bool {
+	for i.err == nil {
+		if i.dec == nil {
+			if i.done {
+				return false
+			}
+
+			if i.err = i.fetch(); i.err != nil {
+				return false
+			}
+		}
+
+		var line routes.QueryLine
+		if err := i.dec.Decode(&line); err != nil {
+			// the stream ended without a summary
+			log.Printf("gaia.(*pageIterator).Next Error: decoding line: %s", err)
+			i.err = data.ErrNoConnection
+			break
 		}
 
-		var resultsUntyped []*data.AttrMap
+		switch {
+		case line.Record != nil:
+			var attrs data.AttrMap
+			if i.err = json.Unmarshal(line.Record, &attrs); i.err != nil {
+				break
+			}
+
+			if i.err = transfer.TransferAttrs(&attrs, r); i.err != nil {
+				break
+			}
+
+			if i.q.limit > 0 {
+				i.remaining--
+			}
 
-		if err := json.Unmarshal(body, &resultsUntyped); err != nil {
-			return nil, err
+			return true
+		case line.Error != nil:
+			log.Printf("gaia.(*pageIterator).Next Error: %d %s", line.Error.Status, line.Error.Message)
+			i.err = data.ErrNoConnection
+		case line.Summary != nil:
+			i.endPage()
+			i.cursor = line.Summary.NextCursor
+
+			// there are no more pages if the server didn't give us a cursor,
+			// or we have retrieved as many records as the query was limited to
+			i.done = i.cursor == "" || (i.q.limit > 0 && i.remaining <= 0)
+		default:
+			log.Print("gaia.(*pageIterator).Next Error: empty line")
+			i.err = data.ErrNoConnection
 		}
+	}
+
+	i.endPage()
+	return false
+}
 
-		var results []data.Record
+func (i *pageIterator) Close() error {
+	i.endPage()
+	i.done = true
+	return i.err
+}
+
+func (db *DB) batch(ops []*BatchOp) ([]error, error) {
+	transports := make([]*routes.BatchOperation, len(ops))
+	for i, op := range ops {
+		t := &routes.BatchOperation{
+			Kind: op.Record.Kind(),
+			ID:   op.Record.ID().String(),
+		}
 
-		for _, attrs := range resultsUntyped {
-			r := models.ModelFor(q.kind)
+		if op.Delete {
+			t.Op = routes.BatchDelete
+		} else {
+			t.Op = routes.BatchSave
 
-			if err := transfer.TransferAttrs(attrs, r); err != nil {
+			bytes, err := json.Marshal(op.Record)
+			if err != nil {
 				return nil, err
 			}
+			t.Record = bytes
+		}
 
-			results = append(results, r)
+		transports[i] = t
+	}
+
+	resp, err := db.postJSON(db.recordBatchURL(), transports)
+	if err != nil {
+		log.Printf("gaia.(*DB).batch Error: while making request: %s", err)
+		return nil, data.ErrNoConnection
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		log.Print("gaia.(*DB).batch Error: malformed request")
+		return nil, data.ErrNoConnection
+	case http.StatusInternalServerError:
+		return nil, data.ErrNoConnection
+	case http.StatusUnauthorized:
+		return nil, data.ErrAccessDenial
+	case http.StatusOK:
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Printf("gaia.(*DB).batch Error: reading response body: %s", err)
+			return nil, data.ErrNoConnection
+		}
+
+		var results []*routes.BatchResult
+		if err := json.Unmarshal(body, &results); err != nil {
+			log.Printf("gaia.(*DB).batch Error: unmarshalling JSON into results: %s", err)
+			return nil, data.ErrNoConnection
 		}
 
-		out := make(chan data.Record)
+		if len(results) != len(ops) {
+			log.Printf("gaia.(*DB).batch Error: %d results for %d operations", len(results), len(ops))
+			return nil, data.ErrNoConnection
+		}
 
-		// cache results in another goroutine
-		go func() {
-			// read them off
-			for _, r := range results {
-				out <- r
+		errs := make([]error, len(ops))
+		for i, result := range results {
+			switch result.Status {
+			case http.StatusCreated:
+				fallthrough
+			case http.StatusOK:
+				if err := json.Unmarshal(result.Record, ops[i].Record); err != nil {
+					log.Printf("gaia.(*DB).batch Error: unmarshalling JSON into record: %s", err)
+					errs[i] = data.ErrNoConnection
+				} else if result.Error != "" {
+					errs[i] = ErrNotUndone
+				}
+			case http.StatusNoContent:
+				// the delete has succeeded, unless it wasn't undone
+				if result.Error != "" {
+					errs[i] = ErrNotUndone
+				}
+			case http.StatusUnauthorized:
+				errs[i] = data.ErrAccessDenial
+			case http.StatusNotFound:
+				errs[i] = data.ErrNotFound
+			case http.StatusFailedDependency:
+				errs[i] = ErrNotApplied
+			default:
+				log.Printf("gaia.(*DB).batch Error: operation %d: %d %s", i, result.Status, result.Error)
+				errs[i] = data.ErrNoConnection
 			}
-			close(out)
-		}()
+		}
 
-		return mem.Iter(out), nil
+		return errs, nil
 	default:
-		log.Printf("Unexpected status code: %d", resp.StatusCode)
+		log.Printf("gaia.(*DB).batch Error: unexpected status code: %d", resp.StatusCode)
 		return nil, data.ErrNoConnection
 	}
-
-	return nil, nil
 }
 
 // --- Exported Interface {{{
@@ -260,6 +513,19 @@ func (db *DB) Delete(r data.Record) error {
 	return db.deleteRecord(r)
 }
 
+// Batch saves and deletes the records of the given operations in a single
+// request. Either all of the operations are authorized and applied, or
+// none are, in which case the operations which would have succeeded
+// have the error ErrNotApplied. If an operation fails once those before it
+// have been applied, they are undone. Should an undo fail, the batch was
+// partially applied, and that operation has the error ErrNotUndone.
+//
+// The error slice corresponds to the operations, the returned error
+// indicates the batch could not be carried out at all.
+func (db *DB) Batch(ops ...*BatchOp) ([]error, error) {
+	return db.batch(ops)
+}
+
 func (db *DB) PopulateByID(r data.Record) error {
 	params := url.Values{}
 	params.Set("kind", r.Kind().String())
@@ -367,43 +633,239 @@ func (q *query) Select(attrs data.AttrMap) data.Query {
 	return q
 }
 
+// maxEventSize bounds the length of a line of the change event stream
+const maxEventSize = 1 << 20
+
+// The bounds of the delay between attempts to reconnect to the change feed
+const (
+	minChangesBackoff = 100 * time.Millisecond
+	maxChangesBackoff = 30 * time.Second
+)
+
+// Changes returns a channel of the changes to records the user can read, it is ChangesContext
+// with a context which is never done, so the channel is only closed if gaia refuses the credentials.
 func (db *DB) Changes() *chan *data.Change {
+	return db.ChangesContext(context.Background())
+}
+
+// ChangesContext returns a channel of the changes to records the user can read. If the
+// connection to gaia is lost, it reconnects with exponential backoff and resumes after
+// the last change it received. The channel is closed once the context is done, or if gaia
+// refuses the credentials (data.ErrAccessDenial), which retrying would not change.
+func (db *DB) ChangesContext(ctx context.Context) *chan *data.Change {
 	ch := make(chan *data.Change)
 
 	go func() {
-		// setup Params
-		wsURL := db.recordChangesURL(url.Values{
-			"public":  []string{db.Username},
-			"private": []string{db.Password},
-		})
+		defer close(ch)
 
-		ws, err := websocket.Dial(wsURL, "", db.URL)
-		if err != nil {
-			log.Print("FAILED TO CONNECT TO GAIA")
-			close(ch)
-			return
-		}
-		defer ws.Close()
+		var since uint64
+		backoff := minChangesBackoff
 
-		var change transfer.ChangeTransport
 		for {
-			if err := websocket.JSON.Receive(ws, &change); err != nil {
-				if err == io.EOF {
-					close(ch)
-					return
-				}
-				close(ch)
+			received, err := db.streamChanges(ctx, &since, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == data.ErrAccessDenial {
+				log.Printf("gaia.(*DB).Changes Error: not reconnecting: %s", err)
 				return
 			}
 
-			m := models.ModelFor(change.RecordKind)
-			transfer.TransferAttrs(change.Record, m)
+			if received {
+				// we were connected, so start over
+				backoff = minChangesBackoff
+			}
+
+			log.Printf("gaia.(*DB).Changes Error: reconnecting in %s: %s", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
 
-			ch <- data.NewChange(change.ChangeKind, m)
+			if backoff *= 2; backoff > maxChangesBackoff {
+				backoff = maxChangesBackoff
+			}
 		}
 	}()
 
 	return &ch
 }
 
+// streamChanges connects to the change feed using the DB's transport, resuming after since,
+// and forwards the changes on the channel until the connection fails or the context is done.
+// It records the sequence number of each change it forwards in since. It is true if any change
+// was received.
+func (db *DB) streamChanges(ctx context.Context, since *uint64, ch chan<- *data.Change) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	received := false
+	forward := func(change *routes.ChangeTransport) bool {
+		received = true
+		*since = change.Seq
+
+		if change.Reset {
+			log.Printf("gaia.(*DB).Changes: changes were missed, resuming after %d", change.Seq)
+			if db.ChangesReset != nil {
+				db.ChangesReset()
+			}
+			return true
+		}
+
+		m := models.ModelFor(change.RecordKind)
+		transfer.TransferAttrs(change.Record, m)
+
+		select {
+		case ch <- data.NewChange(change.ChangeKind, m):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var err error
+	switch db.ChangesTransport {
+	case EventStreamTransport:
+		err = db.streamEventStreamChanges(ctx, *since, forward)
+	default:
+		err = db.streamWebSocketChanges(ctx, *since, forward)
+	}
+
+	return received, err
+}
+
+// streamWebSocketChanges receives changes over a websocket until it fails, the context is done,
+// or forward is false. The upgrade request is authenticated with basic auth, as any other request is.
+func (db *DB) streamWebSocketChanges(ctx context.Context, since uint64, forward func(*routes.ChangeTransport) bool) error {
+	params := url.Values{}
+	if since > 0 {
+		params.Set("since", strconv.FormatUint(since, 10))
+	}
+
+	config, err := websocket.NewConfig(db.recordChangesURL(params), db.URL)
+	if err != nil {
+		return err
+	}
+	req := &http.Request{Header: make(http.Header)}
+	req.SetBasicAuth(db.Username, db.Password)
+	config.Header = req.Header
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		// the handshake doesn't give the status of a refusal, so ask without upgrading
+		if dialErr, ok := err.(*websocket.DialError); ok && dialErr.Err == websocket.ErrBadStatus {
+			if refused := db.changesRefused(ctx); refused != nil {
+				return refused
+			}
+		}
+		return err
+	}
+	defer ws.Close()
+
+	// closing the websocket ends the receive
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+
+	for {
+		var change routes.ChangeTransport
+		if err := websocket.JSON.Receive(ws, &change); err != nil {
+			return err
+		}
+
+		if !forward(&change) {
+			return ctx.Err()
+		}
+	}
+}
+
+// changesRefused is data.ErrAccessDenial if gaia refuses the credentials, or an api
+// key which doesn't permit reading changes, a request to the change feed.
+func (db *DB) changesRefused(ctx context.Context) error {
+	req, err := http.NewRequest("GET", recordChangesEndpoint(db.URL), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(db.Username, db.Password)
+
+	resp, err := ctxhttp.Do(ctx, db.Client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return data.ErrAccessDenial
+	default:
+		return nil
+	}
+}
+
+// streamEventStreamChanges receives changes as Server-Sent Events until the stream fails, the context
+// is done, or forward is false. It authenticates as any other request does, so the credentials stay
+// out of the url.
+func (db *DB) streamEventStreamChanges(ctx context.Context, since uint64, forward func(*routes.ChangeTransport) bool) error {
+	req, err := http.NewRequest("GET", recordChangesEndpoint(db.URL), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", routes.EventStreamContentType)
+	if since > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(since, 10))
+	}
+
+	req.SetBasicAuth(db.Username, db.Password)
+	resp, err := ctxhttp.Do(ctx, db.Client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return data.ErrAccessDenial
+	default:
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// accumulate the data of each event, which ends at a blank line
+	var event bytes.Buffer
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if event.Len() == 0 {
+				continue
+			}
+
+			var change routes.ChangeTransport
+			if err := json.Unmarshal(event.Bytes(), &change); err != nil {
+				return err
+			}
+			event.Reset()
+
+			if !forward(&change) {
+				return ctx.Err()
+			}
+		case strings.HasPrefix(line, "data:"):
+			event.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		default:
+			// the id, event name and comments carry nothing the data doesn't
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return io.EOF
+}
+
 // --- }}}
@@ -4,21 +4,29 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/elos/gaia/routes"
 	"github.com/elos/gaia/services"
 	"golang.org/x/net/context"
 )
 
-type Middleware struct {
-}
-
 type Services struct {
 	services.DB
 	services.Logger
+	services.SMSProviders
 	services.SMSCommandSessions
 	services.WebCommandSessions
+	services.MobileCommandSessions
 	services.AppFileSystem
+	services.WellKnownFileSystem
 	services.WebUIClient
 	services.CalWebUIClient
+	services.ChangeJournal
+	services.APIKeys
+	services.RateLimiter
+	services.CORSPolicy
+	services.Metrics
+	services.Readiness
+	services.Admins
 }
 
 type Gaia struct {
@@ -26,11 +34,10 @@ type Gaia struct {
 	*Middleware
 	*Services
 	cancelAll func()
+	requests  inflight
 }
 
 func New(ctx context.Context, m *Middleware, s *Services) *Gaia {
-	mux, cancelAll := router(ctx, m, s)
-
 	if s.DB == nil {
 		log.Fatal("Service DB is nil")
 	}
@@ -43,18 +50,126 @@ func New(ctx context.Context, m *Middleware, s *Services) *Gaia {
 		log.Fatal("Service SMSCommandSessions is nil")
 	}
 
-	return &Gaia{
-		mux:        mux,
+	// the readiness checks gaia's own dependencies, in addition to any the
+	// given readiness checks. It checks the db before it is metered, so that
+	// its probes aren't counted as errors.
+	if s.Readiness == nil {
+		s.Readiness = services.NewReadiness(services.DefaultCheckTimeout)
+	}
+	s.Readiness.Add("db", services.DBCheck(s.DB))
+	s.Readiness.Add("sms_command_sessions", services.RunningCheck(s.SMSCommandSessions.Running))
+	if s.WebCommandSessions != nil {
+		s.Readiness.Add("web_command_sessions", services.RunningCheck(s.WebCommandSessions.Running))
+	}
+	if s.MobileCommandSessions != nil {
+		s.Readiness.Add("mobile_command_sessions", services.RunningCheck(s.MobileCommandSessions.Running))
+	}
+
+	// metrics are always recorded, unless a registry is given it is gaia's own
+	if s.Metrics == nil {
+		s.Metrics = services.NewMetrics()
+	}
+	// the operators of a selection are evaluated by gaia, unless the db does so itself
+	s.DB = services.MeteredDB(services.SelectorDB(s.DB), s.Metrics)
+	s.Metrics.Func(services.SMSSessionsMetric, func() float64 {
+		return float64(s.SMSCommandSessions.Active())
+	})
+	if s.WebCommandSessions != nil {
+		s.Metrics.Func(services.WebSessionsMetric, func() float64 {
+			return float64(s.WebCommandSessions.Active())
+		})
+	}
+	if s.MobileCommandSessions != nil {
+		s.Metrics.Func(services.MobileSessionsMetric, func() float64 {
+			return float64(s.MobileCommandSessions.Active())
+		})
+	}
+
+	// the change journal is an implementation detail of the
+	// change feed, so we provide one if it wasn't given
+	if s.ChangeJournal == nil {
+		j := services.NewChangeJournal(services.DefaultJournalSize)
+		go j.Start(ctx, s.DB)
+		s.ChangeJournal = j
+	}
+
+	// the api keys are kept in the db, unless a store is given
+	if s.APIKeys == nil {
+		s.APIKeys = services.NewAPIKeyStore(s.DB)
+	}
+
+	// authentication is always rate limited, unless a limiter is given
+	if s.RateLimiter == nil {
+		s.RateLimiter = services.NewRateLimiter(services.DefaultFreeAttempts, services.DefaultLockout, services.DefaultMaxLockout)
+	}
+
+	// without a policy, no other origin is allowed
+	if s.CORSPolicy == nil {
+		s.CORSPolicy = services.NewCORSPolicy(nil, services.DefaultCORSMaxAge)
+	}
+
+	if m == nil {
+		m = new(Middleware)
+	}
+
+	g := &Gaia{
 		Middleware: m,
 		Services:   s,
-		cancelAll:  cancelAll,
 	}
+
+	mux, cancelAll, err := router(ctx, m, s, &g.requests)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g.mux, g.cancelAll = mux, cancelAll
+
+	return g
 }
 
+// Close cancels the context of every request, which ends the change feeds
+// and command sessions, it does not wait for them to end
 func (gaia *Gaia) Close() {
 	gaia.cancelAll()
 }
 
+// Shutdown closes gaia, then waits until it has finished handling every request, including
+// websockets, or until the context is done, in which case it returns the context's error.
+//
+// An http.Server does not track the connections which were hijacked, nor end the long-lived
+// requests, such as change feeds. So a graceful shutdown of a server is:
+//
+//	server.RegisterOnShutdown(gaia.Close)
+//	server.Shutdown(ctx) // stops accepting requests and drains those in flight
+//	gaia.Shutdown(ctx)   // waits for the websockets to close
+func (gaia *Gaia) Shutdown(ctx context.Context) error {
+	gaia.Close()
+
+	select {
+	case <-gaia.requests.wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MetricsHandler serves /metrics, in the Prometheus text format. It is not authenticated, so
+// gaia does not serve it itself, it should be served on an address only the monitoring system
+// can reach.
+func (gaia *Gaia) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(routes.Metrics, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		routes.MetricsGET(context.Background(), w, r, gaia.Logger, gaia.Metrics)
+	})
+
+	return mux
+}
+
 func (gaia *Gaia) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	gaia.mux.ServeHTTP(w, r)
 }
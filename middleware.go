@@ -0,0 +1,124 @@
+package gaia
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// A MiddlewareFunc wraps the handling of a request, for example to log, trace or compress it
+type MiddlewareFunc func(http.HandlerFunc) http.HandlerFunc
+
+// Middleware is the configurable chain of middleware gaia applies to its endpoints.
+// The zero value applies only the middleware each endpoint declares (see spec.json).
+//
+// An endpoint's chain is, from outermost to innermost: the global middleware, in the
+// order it was used, then the middleware the endpoint declares, then the middleware used
+// for the endpoint's path, in the order it was used. A name is applied once, where it
+// first appears in the chain.
+//
+//		m := new(gaia.Middleware)
+//		m.Use("trace", trace)
+//		m.UseFor(routes.RecordQuery, "gzip", gzip)
+//
+// The Middleware must be configured before it is given to gaia.New.
+type Middleware struct {
+	named  map[string]MiddlewareFunc
+	global []string
+	routes map[string][]*routeMiddleware
+}
+
+// routeMiddleware is middleware used for a single path
+type routeMiddleware struct {
+	name string
+	fn   MiddlewareFunc
+}
+
+// Register makes the middleware available by name, to the endpoints which declare it. Registering
+// a name gaia provides ("log" or "cors") replaces gaia's implementation.
+func (m *Middleware) Register(name string, fn MiddlewareFunc) {
+	if m.named == nil {
+		m.named = make(map[string]MiddlewareFunc)
+	}
+
+	m.named[name] = fn
+}
+
+// Use registers the middleware and applies it to every endpoint
+func (m *Middleware) Use(name string, fn MiddlewareFunc) {
+	m.Register(name, fn)
+	m.global = append(m.global, name)
+}
+
+// UseFor applies the middleware to the endpoint of the path, such as routes.Record. The name is
+// scoped to the path, the middleware replaces that of the same name for this endpoint only, be it
+// global, declared by the endpoint, or used for the path before.
+func (m *Middleware) UseFor(path, name string, fn MiddlewareFunc) {
+	if m.routes == nil {
+		m.routes = make(map[string][]*routeMiddleware)
+	}
+
+	for _, r := range m.routes[path] {
+		if r.name == name {
+			r.fn = fn
+			return
+		}
+	}
+
+	m.routes[path] = append(m.routes[path], &routeMiddleware{name: name, fn: fn})
+}
+
+// chain composes the middleware of the endpoint, outermost first. The named middleware are
+// gaia's own, the middleware registered with m take precedence over them, and the middleware
+// used for the endpoint's path over both.
+func (m *Middleware) chain(e *Endpoint, named map[string]MiddlewareFunc) ([]MiddlewareFunc, error) {
+	routed := make(map[string]MiddlewareFunc)
+	names := make([]string, 0, len(m.global)+len(e.Middleware)+len(m.routes[e.Path]))
+	names = append(names, m.global...)
+	names = append(names, e.Middleware...)
+	for _, r := range m.routes[e.Path] {
+		routed[r.name] = r.fn
+		names = append(names, r.name)
+	}
+
+	chain := make([]MiddlewareFunc, 0, len(names))
+	applied := make(map[string]bool)
+	for _, name := range names {
+		if applied[name] {
+			continue
+		}
+		applied[name] = true
+
+		fn, ok := routed[name]
+		if !ok {
+			fn, ok = m.named[name]
+		}
+		if !ok {
+			fn, ok = named[name]
+		}
+		if !ok {
+			return nil, fmt.Errorf("endpoint %q: unrecognized middleware %q", e.Name, name)
+		}
+
+		chain = append(chain, fn)
+	}
+
+	return chain, nil
+}
+
+// check ensures the middleware used for a path is used for the path of an endpoint
+func (m *Middleware) check(endpoints []*Endpoint) error {
+	for path := range m.routes {
+		found := false
+		for _, e := range endpoints {
+			if e.Path == path {
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("middleware used for %q, which is not the path of an endpoint", path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package gaia
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var order []string
+	mark := func(name string) MiddlewareFunc {
+		return func(handle http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				handle(w, r)
+			}
+		}
+	}
+
+	e := &Endpoint{
+		Name:       "test",
+		Path:       "/test/",
+		Middleware: []string{"declared"},
+		Actions: map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				order = append(order, "action")
+			},
+		},
+	}
+
+	m := new(Middleware)
+	m.Use("global", mark("global"))
+	m.UseFor("/test/", "route", mark("route"))
+	m.UseFor("/other/", "other", mark("other"))
+
+	// the declared middleware is not recognized
+	if _, err := m.chain(e, map[string]MiddlewareFunc{}); err == nil {
+		t.Fatal("expected chain to fail with unrecognized middleware")
+	}
+
+	// the middleware used for /other/ is not used for an endpoint
+	if err := m.check([]*Endpoint{e}); err == nil {
+		t.Fatal("expected check to fail with middleware used for an unknown path")
+	}
+
+	chain, err := m.chain(e, map[string]MiddlewareFunc{
+		"declared": mark("gaia's declared"),
+	})
+	if err != nil {
+		t.Fatalf("m.chain error: %s", err)
+	}
+
+	r, err := http.NewRequest("GET", "/test/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handler(context.Background(), new(Services), chain)(httptest.NewRecorder(), r)
+
+	if got, want := order, []string{"global", "gaia's declared", "route", "action"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order: got %v, want %v", got, want)
+	}
+
+	// registering replaces gaia's implementation
+	m.Register("declared", mark("declared"))
+	if chain, err = m.chain(e, map[string]MiddlewareFunc{"declared": mark("gaia's declared")}); err != nil {
+		t.Fatalf("m.chain error: %s", err)
+	}
+
+	order = nil
+	e.handler(context.Background(), new(Services), chain)(httptest.NewRecorder(), r)
+
+	if got, want := order, []string{"global", "declared", "route", "action"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order: got %v, want %v", got, want)
+	}
+}
+
+func TestMiddlewareUseForScope(t *testing.T) {
+	var order []string
+	mark := func(name string) MiddlewareFunc {
+		return func(handle http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				handle(w, r)
+			}
+		}
+	}
+
+	endpoint := func(path string) *Endpoint {
+		return &Endpoint{
+			Name:       path,
+			Path:       path,
+			Middleware: []string{"log"},
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					order = append(order, "action")
+				},
+			},
+		}
+	}
+
+	m := new(Middleware)
+	m.Use("global", mark("global"))
+	m.UseFor("/a/", "x", mark("a's x"))
+	m.UseFor("/b/", "x", mark("b's x"))
+	m.UseFor("/b/", "log", mark("b's log"))
+	m.UseFor("/c/", "global", mark("c's global"))
+
+	cases := map[string][]string{
+		"/a/": {"global", "gaia's log", "a's x", "action"},
+		"/b/": {"global", "b's log", "b's x", "action"},
+		"/c/": {"c's global", "gaia's log", "action"},
+	}
+
+	for path, want := range cases {
+		e := endpoint(path)
+		chain, err := m.chain(e, map[string]MiddlewareFunc{"log": mark("gaia's log")})
+		if err != nil {
+			t.Fatalf("%s: m.chain error: %s", path, err)
+		}
+
+		r, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		order = nil
+		e.handler(context.Background(), new(Services), chain)(httptest.NewRecorder(), r)
+
+		if !reflect.DeepEqual(order, want) {
+			t.Errorf("%s: order: got %v, want %v", path, order, want)
+		}
+	}
+}
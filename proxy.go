@@ -0,0 +1,91 @@
+package gaia
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedForHeader is appended to by each proxy a request passes through, with the address of its client
+const ForwardedForHeader = "X-Forwarded-For"
+
+// ParseProxies parses the addresses of trusted proxies, each an ip, or a network in CIDR notation
+func ParseProxies(addrs []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("gaia: proxy %q is not an ip or a network", addr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("gaia: proxy %q is not an ip or a network", addr)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// TrustProxies serves the requests with the handler, a request from one of the proxies is given the
+// remote address of the client it was forwarded for, so that it is the client which is rate limited,
+// and logged. The client is the last address of the X-Forwarded-For header which isn't of a proxy,
+// each proxy appends the address of its client, so those before it may have been forged.
+func TrustProxies(h http.Handler, proxies []*net.IPNet) http.Handler {
+	if len(proxies) == 0 {
+		return h
+	}
+
+	trusted := func(ip net.IP) bool {
+		for _, p := range proxies {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		remote := net.ParseIP(host)
+		if remote == nil || !trusted(remote) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client := remote
+		hops := strings.Split(strings.Join(r.Header[ForwardedForHeader], ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+
+			client = ip
+			if !trusted(ip) {
+				break
+			}
+		}
+
+		forwarded := new(http.Request)
+		*forwarded = *r
+		forwarded.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		h.ServeHTTP(w, forwarded)
+	})
+}
@@ -0,0 +1,50 @@
+package gaia
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustProxies(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("ParseProxies error: %s", err)
+	}
+
+	var remote string
+	h := TrustProxies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	}), proxies)
+
+	cases := map[string]struct {
+		remote, forwarded, want string
+	}{
+		"not from a proxy":          {"203.0.113.9:5000", "198.51.100.1", "203.0.113.9:5000"},
+		"from a proxy":              {"10.0.0.1:5000", "198.51.100.1", "198.51.100.1:0"},
+		"through proxies":           {"10.0.0.1:5000", "198.51.100.1, 192.168.1.1", "198.51.100.1:0"},
+		"forged by the client":      {"10.0.0.1:5000", "127.0.0.1, 198.51.100.1", "198.51.100.1:0"},
+		"malformed":                 {"10.0.0.1:5000", "unknown", "10.0.0.1:0"},
+		"from a proxy, unforwarded": {"192.168.1.1:5000", "", "192.168.1.1:0"},
+	}
+
+	for name, c := range cases {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set(ForwardedForHeader, c.forwarded)
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if remote != c.want {
+			t.Errorf("%s: got %q, want %q", name, remote, c.want)
+		}
+	}
+
+	if _, err := ParseProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid network to be rejected")
+	}
+}
@@ -1,275 +1,718 @@
 package gaia
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/elos/gaia/routes"
 	"github.com/elos/gaia/services"
+	"github.com/elos/models/user"
 	"github.com/elos/x/models/cal"
 	"golang.org/x/net/context"
 	"golang.org/x/net/websocket"
 )
 
-// TODO: re-add CORS to all of these
+// The headers of the CORS protocol
 const (
 	AllowOriginHeader      = "Access-Control-Allow-Origin"
 	AllowCredentialsHeader = "Access-Control-Allow-Credentials"
 	AllowMethodsHeader     = "Access-Control-Allow-Methods"
 	AllowHeadersHeader     = "Access-Control-Allow-Headers"
+	ExposeHeadersHeader    = "Access-Control-Expose-Headers"
+	MaxAgeHeader           = "Access-Control-Max-Age"
+	RequestMethodHeader    = "Access-Control-Request-Method"
+	RequestHeadersHeader   = "Access-Control-Request-Headers"
 )
 
-// basic logging
-func logRequest(handle http.HandlerFunc, logger services.Logger) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Printf("%s %s", r.Method, r.URL)
-		handle(w, r)
+// credentialParams are the url parameters which may hold credentials, see routes.Authenticate
+var credentialParams = []string{"public", "private"}
+
+// redact replaces the values of any credential parameters of the url,
+// so that they are kept out of the logs
+func redact(u *url.URL) string {
+	q := u.Query()
+
+	redacted := false
+	for _, p := range credentialParams {
+		if _, ok := q[p]; ok {
+			q.Set(p, "REDACTED")
+			redacted = true
+		}
 	}
-}
 
-func cors(handle http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add(AllowOriginHeader, r.Header.Get("Origin"))
-		w.Header().Add(AllowCredentialsHeader, "true")
-		w.Header().Add(AllowMethodsHeader, "POST")
-		w.Header().Add(AllowMethodsHeader, "DELETE")
-		w.Header().Add(AllowMethodsHeader, "GET")
-		w.Header().Add(AllowMethodsHeader, "OPTIONS")
-		w.Header().Add(AllowHeadersHeader, "Authorization")
-		handle(w, r)
+	if !redacted {
+		return u.String()
 	}
-}
 
-func router(ctx context.Context, m *Middleware, s *Services) (http.Handler, context.CancelFunc) {
-	mux := http.NewServeMux()
-	requestBackground, cancelAll := context.WithCancel(ctx)
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
 
-	mux.Handle("/app/", http.StripPrefix("/app/", http.FileServer(s.AppFileSystem)))
+// cors applies the policy to the requests to the endpoint. A request from an origin the policy
+// does not allow is handled as if it were not cross origin, so the browser won't let the origin
+// read the response. A preflight request is responded to here, and never reaches the endpoint.
+func cors(policy services.CORSPolicy, e *Endpoint) MiddlewareFunc {
+	rule := policy.Rule(e.Path)
 
-	mux.HandleFunc(routes.Index, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			w.Write([]byte("Who is John Galt?"))
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /records/query/
-	mux.HandleFunc(routes.RecordsQuery, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			routes.Records.QueryGET(ctx, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+	methods := rule.Methods
+	if len(methods) == 0 {
+		for m := range e.Actions {
+			methods = append(methods, m)
 		}
-	}, s.Logger))
-
-	// /records/new/
-	mux.HandleFunc(routes.RecordsNew, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			routes.Records.NewGET(ctx, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /records/create/
-	mux.HandleFunc(routes.RecordsCreate, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			routes.Records.CreateGET(ctx, w, r, s.WebUIClient)
-		case "POST":
-			routes.Records.CreatePOST(ctx, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /records/edit/
-	mux.HandleFunc(routes.RecordsEdit, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			routes.Records.EditGET(ctx, w, r, s.WebUIClient)
-		case "POST":
-			routes.Records.EditPOST(ctx, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /records/view/
-	mux.HandleFunc(routes.RecordsView, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			routes.Records.ViewGET(ctx, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /records/delete/
-	mux.HandleFunc(routes.RecordsDelete, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			routes.Records.DeletePOST(ctx, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /register/
-	mux.HandleFunc(routes.Register, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			routes.RegisterPOST(requestBackground, w, r, s.WebUIClient)
-		case "GET":
-			routes.RegisterGET(requestBackground, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
-
-	// /login/
-	mux.HandleFunc(routes.Login, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			routes.LoginPOST(ctx, w, r, s.WebUIClient)
-		case "GET":
-			routes.LoginGET(requestBackground, w, r, s.WebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
-		}
-	}, s.Logger))
+		sort.Strings(methods)
+	}
 
-	// /record/
-	mux.HandleFunc(routes.Record, logRequest(cors(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "OPTIONS" {
-			routes.RecordOPTIONS(requestBackground, w, r)
-			return
+	allowedMethods := make(map[string]bool)
+	for _, m := range methods {
+		allowedMethods[m] = true
+	}
+	allowedHeaders := make(map[string]bool)
+	for _, h := range rule.Headers {
+		allowedHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+
+	maxAge := strconv.Itoa(int(policy.MaxAge().Seconds()))
+
+	return func(handle http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				handle(w, r)
+				return
+			}
+
+			preflight := r.Method == "OPTIONS" && r.Header.Get(RequestMethodHeader) != ""
+
+			allowed, credentials := policy.AllowOrigin(origin)
+			if !allowed {
+				if preflight {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+
+				handle(w, r)
+				return
+			}
+
+			w.Header().Set(AllowOriginHeader, origin)
+			if credentials {
+				w.Header().Set(AllowCredentialsHeader, "true")
+			}
+
+			if !preflight {
+				if len(rule.ExposedHeaders) > 0 {
+					w.Header().Set(ExposeHeadersHeader, strings.Join(rule.ExposedHeaders, ", "))
+				}
+
+				handle(w, r)
+				return
+			}
+
+			if !allowedMethods[r.Header.Get(RequestMethodHeader)] {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			for _, h := range strings.Split(r.Header.Get(RequestHeadersHeader), ",") {
+				if h = strings.TrimSpace(h); h != "" && !allowedHeaders[http.CanonicalHeaderKey(h)] {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+
+			w.Header().Set(AllowMethodsHeader, strings.Join(methods, ", "))
+			if len(rule.Headers) > 0 {
+				w.Header().Set(AllowHeadersHeader, strings.Join(rule.Headers, ", "))
+			}
+			w.Header().Set(MaxAgeHeader, maxAge)
+			w.WriteHeader(http.StatusNoContent)
 		}
+	}
+}
+
+// --- Endpoints {{{
+
+// An Action responds to a single method of an endpoint. If the endpoint
+// authenticates, the context holds the user. The logger is scoped to the
+// request, it records the request id and the user (if there are
+// any) with every entry.
+type Action func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger)
+
+// An Endpoint is the Go equivalent of an endpoint of spec.json. The router
+// dispatches on the method, responding to any method without an action with
+// StatusMethodNotAllowed, and to OPTIONS (if there is no action for it) with
+// the methods which are allowed.
+type Endpoint struct {
+	Name string
+	Path string
+
+	// Middleware is applied in order, the first is outermost
+	Middleware []string
+	// Services are the names of the services the actions use
+	Services []string
+	// Authenticate determines whether a request is authenticated before its action is
+	// taken. OPTIONS requests without an action are never authenticated.
+	Authenticate bool
+	// Optional endpoints are left out, rather than failing the startup, if one of
+	// their services is missing
+	Optional bool
+
+	Actions map[string]Action
+}
+
+// allowed lists the methods of the endpoint, for the Allow header
+func (e *Endpoint) allowed() string {
+	methods := make([]string, 0, len(e.Actions)+1)
+	for m := range e.Actions {
+		methods = append(methods, m)
+	}
+	if _, ok := e.Actions["OPTIONS"]; !ok {
+		methods = append(methods, "OPTIONS")
+	}
+	sort.Strings(methods)
+
+	return strings.Join(methods, ", ")
+}
+
+// handler dispatches the requests to the endpoint to its actions, through the chain of middleware
+func (e *Endpoint) handler(background context.Context, s *Services, chain []MiddlewareFunc) http.HandlerFunc {
+	allow := e.allowed()
 
-		ctx, ok := routes.Authenticate(requestBackground, w, r, s.Logger, s.DB)
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		action, ok := e.Actions[r.Method]
 		if !ok {
-			return
-		}
+			w.Header().Set("Allow", allow)
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 
-		switch r.Method {
-		case "GET":
-			routes.RecordGET(ctx, w, r, s.Logger, s.DB)
-		case "POST":
-			routes.RecordPOST(ctx, w, r, s.Logger, s.DB)
-		case "DELETE":
-			routes.RecordDELETE(ctx, w, r, s.Logger, s.DB)
-		case "OPTIONS":
-			routes.RecordOPTIONS(ctx, w, r)
-		default:
 			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 			return
 		}
-	}), s.Logger))
 
-	// /record/query/
-	mux.HandleFunc(routes.RecordQuery, logRequest(cors(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "OPTIONS" {
-			routes.RecordOPTIONS(requestBackground, w, r)
-			return
+		ctx, l := background, s.Logger
+		a, logged := accessFromRequest(r)
+		if logged {
+			ctx = withRequestID(ctx, a.requestID)
+			l = l.With("request_id", a.requestID)
 		}
 
-		ctx, ok := routes.Authenticate(requestBackground, w, r, s.Logger, s.DB)
-		if !ok {
-			return
+		if e.Authenticate {
+			if ctx, ok = routes.Authenticate(ctx, w, r, l, s.DB, s.APIKeys, s.RateLimiter); !ok {
+				return
+			}
+
+			if u, ok := user.FromContext(ctx); ok {
+				l = l.With("user_id", u.ID().String())
+				if logged {
+					a.setUser(u.ID().String())
+				}
+			}
 		}
 
-		switch r.Method {
-		case "POST":
-			routes.RecordQueryPOST(ctx, w, r, s.Logger, s.DB)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+		ctx = services.NewLoggerContext(ctx, l)
+		if s.Metrics != nil {
+			ctx = services.NewMetricsContext(ctx, s.Metrics)
 		}
-	}), s.Logger))
 
-	// /event/
-	mux.HandleFunc(routes.Event, logRequest(cors(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := routes.Authenticate(requestBackground, w, r, s.Logger, s.DB)
-		if !ok {
-			return
-		}
+		action(ctx, w, r, l)
+	}
 
-		switch r.Method {
-		case "POST":
-			routes.EventPOST(ctx, w, r, s.DB, s.Logger)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+	for i := len(chain) - 1; i >= 0; i-- {
+		handle = chain[i](handle)
+	}
+
+	return handle
+}
+
+// inflight counts the requests being handled
+type inflight struct {
+	sync.Mutex
+	n    int
+	idle []chan struct{}
+}
+
+func (i *inflight) add() {
+	i.Lock()
+	defer i.Unlock()
+	i.n++
+}
+
+func (i *inflight) done() {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.n--; i.n == 0 {
+		for _, c := range i.idle {
+			close(c)
 		}
-	}), s.Logger))
+		i.idle = nil
+	}
+}
 
-	// /record/changes/
-	mux.HandleFunc(routes.RecordChanges, logRequest(websocket.Handler(
-		routes.ContextualizeRecordChangesGET(requestBackground, s.DB, s.Logger),
-	).ServeHTTP, s.Logger))
+// wait returns a channel which is closed once no request is in flight
+func (i *inflight) wait() <-chan struct{} {
+	i.Lock()
+	defer i.Unlock()
 
-	// /command/sms/
-	mux.HandleFunc(routes.CommandSMS, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		ctx := requestBackground
+	c := make(chan struct{})
+	if i.n == 0 {
+		close(c)
+	} else {
+		i.idle = append(i.idle, c)
+	}
 
-		switch r.Method {
-		case "POST":
-			routes.CommandSMSPOST(ctx, w, r, s.Logger, s.SMSCommandSessions)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+	return c
+}
+
+// track counts the requests as in flight while they are handled
+func track(requests *inflight, handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests.add()
+		defer requests.done()
+
+		handle(w, r)
+	}
+}
+
+// instrument records the requests to the endpoint, and their latency, in the metrics
+func instrument(metrics services.Metrics, e *Endpoint, handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rr := &responseRecorder{ResponseWriter: w}
+		handle(rr, r)
+
+		status := rr.status
+		if status == 0 {
+			status = http.StatusOK
 		}
-	}, s.Logger))
 
-	// /command/web/
-	mux.HandleFunc(routes.CommandWeb, logRequest(websocket.Handler(
-		routes.ContextualizeCommandWebGET(requestBackground, s.DB, s.Logger),
-	).ServeHTTP, s.Logger))
+		code := strconv.Itoa(status)
+		metrics.Inc(services.RequestsMetric, e.Name, r.Method, code)
+		metrics.Observe(services.RequestDurationMetric, time.Since(start).Seconds(), e.Name, code)
+	}
+}
 
-	// /mobile/location/
-	mux.HandleFunc(routes.MobileLocation, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := routes.Authenticate(requestBackground, w, r, s.Logger, s.DB)
-		if !ok {
-			return
+// present maps the name of each service, as spec.json refers to it, to whether it was provided
+func (s *Services) present() map[string]bool {
+	return map[string]bool{
+		"db":                      s.DB != nil,
+		"logger":                  s.Logger != nil,
+		"sms_providers":           s.SMSProviders != nil,
+		"sms_command_sessions":    s.SMSCommandSessions != nil,
+		"web_command_sessions":    s.WebCommandSessions != nil,
+		"mobile_command_sessions": s.MobileCommandSessions != nil,
+		"app_file_system":         s.AppFileSystem != nil,
+		"well_known_file_system":  s.WellKnownFileSystem != nil,
+		"webui":                   s.WebUIClient != nil,
+		"cal_webui":               s.CalWebUIClient != nil,
+		"change_journal":          s.ChangeJournal != nil,
+		"api_keys":                s.APIKeys != nil,
+		"rate_limiter":            s.RateLimiter != nil,
+		"cors_policy":             s.CORSPolicy != nil,
+		"metrics":                 s.Metrics != nil,
+		"readiness":               s.Readiness != nil,
+		"admins":                  s.Admins != nil,
+	}
+}
+
+// middleware maps the name of each middleware gaia provides, as spec.json refers to it, to its implementation for the endpoint
+func middleware(s *Services, e *Endpoint) map[string]MiddlewareFunc {
+	return map[string]MiddlewareFunc{
+		"log":  logRequest(s.Logger),
+		"cors": cors(s.CORSPolicy, e),
+	}
+}
+
+// checkEndpoints ensures every service an endpoint refers to is present. It returns the
+// endpoints which can be served, leaving out optional endpoints whose services are missing.
+func checkEndpoints(endpoints []*Endpoint, s *Services) ([]*Endpoint, error) {
+	present := s.present()
+	served := make([]*Endpoint, 0, len(endpoints))
+
+Endpoints:
+	for _, e := range endpoints {
+		for _, name := range e.Services {
+			p, known := present[name]
+			if !known {
+				return nil, fmt.Errorf("endpoint %q: unrecognized service %q", e.Name, name)
+			}
+
+			if !p {
+				if e.Optional {
+					log.Printf("gaia: not serving optional endpoint %q, service %q is missing", e.Name, name)
+					continue Endpoints
+				}
+
+				return nil, fmt.Errorf("endpoint %q: service %q is missing", e.Name, name)
+			}
 		}
 
-		switch r.Method {
-		case "POST":
-			routes.MobileLocationPOST(ctx, w, r, s.Logger, s.DB)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+		served = append(served, e)
+	}
+
+	return served, nil
+}
+
+// endpoints is the Go equivalent of spec.json, the background is the
+// context of requests, which is cancelled when gaia is closed
+func endpoints(background context.Context, s *Services) []*Endpoint {
+	recordsUI := func(name, path string, actions map[string]Action) *Endpoint {
+		return &Endpoint{
+			Name:       name,
+			Path:       path,
+			Middleware: []string{"log"},
+			Services:   []string{"webui"},
+			Optional:   true,
+			Actions:    actions,
 		}
-	}, s.Logger))
-
-	// /cal/week/
-	mux.HandleFunc(routes.CalWeek, logRequest(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			cal.WeekGET(ctx, w, r, s.CalWebUIClient)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+	}
+
+	serveApp := func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+		http.StripPrefix(routes.App, http.FileServer(s.AppFileSystem)).ServeHTTP(w, r)
+	}
+
+	serveLetsencrypt := func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+		http.FileServer(s.WellKnownFileSystem).ServeHTTP(w, r)
+	}
+
+	return []*Endpoint{
+		{
+			Name:     "app",
+			Path:     routes.App,
+			Services: []string{"app_file_system"},
+			Optional: true,
+			Actions: map[string]Action{
+				"GET":  serveApp,
+				"HEAD": serveApp,
+			},
+		},
+		{
+			Name:       "index",
+			Path:       routes.Index,
+			Middleware: []string{"log"},
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					w.Write([]byte("Who is John Galt?"))
+				},
+			},
+		},
+		recordsUI("records_query", routes.RecordsQuery, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.QueryGET(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("records_new", routes.RecordsNew, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.NewGET(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("records_create", routes.RecordsCreate, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.CreateGET(ctx, w, r, s.WebUIClient)
+			},
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.CreatePOST(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("records_edit", routes.RecordsEdit, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.EditGET(ctx, w, r, s.WebUIClient)
+			},
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.EditPOST(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("records_view", routes.RecordsView, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.ViewGET(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("records_delete", routes.RecordsDelete, map[string]Action{
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.Records.DeletePOST(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("register", routes.Register, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.RegisterGET(ctx, w, r, s.WebUIClient)
+			},
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.RegisterPOST(ctx, w, r, s.WebUIClient)
+			},
+		}),
+		recordsUI("login", routes.Login, map[string]Action{
+			"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.LoginGET(ctx, w, r, s.WebUIClient)
+			},
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				routes.LoginPOST(ctx, w, r, l, s.WebUIClient, s.RateLimiter)
+			},
+		}),
+		{
+			Name:         "record",
+			Path:         routes.Record,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"db"},
+			Authenticate: true,
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.RecordGET(ctx, w, r, l, s.DB)
+				},
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.RecordPOST(ctx, w, r, l, s.DB)
+				},
+				"DELETE": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.RecordDELETE(ctx, w, r, l, s.DB)
+				},
+			},
+		},
+		{
+			Name:         "record_query",
+			Path:         routes.RecordQuery,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"db"},
+			Authenticate: true,
+			Actions: map[string]Action{
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.RecordQueryPOST(ctx, w, r, l, s.DB)
+				},
+			},
+		},
+		{
+			Name:         "record_batch",
+			Path:         routes.RecordBatch,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"db"},
+			Authenticate: true,
+			Actions: map[string]Action{
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.RecordBatchPOST(ctx, w, r, l, s.DB)
+				},
+			},
+		},
+		{
+			Name:         "record_changes",
+			Path:         routes.RecordChanges,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"db", "change_journal", "metrics"},
+			Authenticate: true, // websockets are authenticated before they are upgraded
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && strings.Contains(r.Header.Get("Accept"), routes.EventStreamContentType) {
+						s.Metrics.Add(services.ChangeStreamsMetric, 1, "event_stream")
+						defer s.Metrics.Add(services.ChangeStreamsMetric, -1, "event_stream")
+
+						routes.RecordChangesEventStreamGET(ctx, w, r, s.DB, s.ChangeJournal, l)
+						return
+					}
+
+					s.Metrics.Add(services.ChangeStreamsMetric, 1, "websocket")
+					defer s.Metrics.Add(services.ChangeStreamsMetric, -1, "websocket")
+
+					websocket.Handler(
+						routes.ContextualizeRecordChangesGET(ctx, s.DB, s.ChangeJournal, l),
+					).ServeHTTP(w, r)
+				},
+			},
+		},
+		{
+			Name:         "apikey",
+			Path:         routes.APIKey,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"api_keys"},
+			Authenticate: true,
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.APIKeyGET(ctx, w, r, l, s.APIKeys)
+				},
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.APIKeyPOST(ctx, w, r, l, s.APIKeys)
+				},
+				"DELETE": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.APIKeyDELETE(ctx, w, r, l, s.APIKeys)
+				},
+			},
+		},
+		{
+			Name:         "event",
+			Path:         routes.Event,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"db"},
+			Authenticate: true,
+			Actions: map[string]Action{
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.EventPOST(ctx, w, r, s.DB, l)
+				},
+			},
+		},
+		{
+			Name:       "command_sms",
+			Path:       routes.CommandSMS,
+			Middleware: []string{"log"},
+			Services:   []string{"sms_providers", "sms_command_sessions"},
+			Optional:   true,
+			Actions: map[string]Action{
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.CommandSMSPOST(ctx, w, r, l, s.SMSProviders, s.SMSCommandSessions)
+				},
+			},
+		},
+		{
+			Name:         "admin_sms_sessions",
+			Path:         routes.AdminSMSSessions,
+			Middleware:   []string{"log"},
+			Services:     []string{"sms_command_sessions", "admins"},
+			Optional:     true,
+			Authenticate: true,
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.AdminSMSSessionsGET(ctx, w, r, l, s.Admins, s.SMSCommandSessions)
+				},
+				"DELETE": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.AdminSMSSessionsDELETE(ctx, w, r, l, s.Admins, s.SMSCommandSessions)
+				},
+			},
+		},
+		{
+			Name:         "command_web",
+			Path:         routes.CommandWeb,
+			Middleware:   []string{"log"},
+			Services:     []string{"web_command_sessions"},
+			Optional:     true,
+			Authenticate: true, // websockets are authenticated before they are upgraded
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					// a command session acts on all of the user's records
+					if !routes.Permitted(ctx, services.WriteVerb, routes.CommandWeb) {
+						http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+						return
+					}
+
+					websocket.Handler(
+						routes.ContextualizeCommandWebGET(ctx, s.WebCommandSessions, l),
+					).ServeHTTP(w, r)
+				},
+			},
+		},
+		{
+			Name:         "command_ios",
+			Path:         routes.CommandiOS,
+			Middleware:   []string{"log"},
+			Services:     []string{"mobile_command_sessions"},
+			Optional:     true,
+			Authenticate: true,
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.CommandiOSGET(ctx, w, r, l, s.MobileCommandSessions)
+				},
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.CommandiOSPOST(ctx, w, r, l, s.MobileCommandSessions)
+				},
+			},
+		},
+		{
+			Name:         "mobile_location",
+			Path:         routes.MobileLocation,
+			Middleware:   []string{"log", "cors"},
+			Services:     []string{"db"},
+			Authenticate: true,
+			Actions: map[string]Action{
+				"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.MobileLocationPOST(ctx, w, r, l, s.DB)
+				},
+			},
+		},
+		{
+			Name:       "cal_week",
+			Path:       routes.CalWeek,
+			Middleware: []string{"log"},
+			Services:   []string{"cal_webui"},
+			Optional:   true,
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					cal.WeekGET(ctx, w, r, s.CalWebUIClient)
+				},
+			},
+		},
+		{
+			Name: "health",
+			Path: routes.Health,
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.HealthGET(ctx, w, r)
+				},
+			},
+		},
+		{
+			Name:     "ready",
+			Path:     routes.Ready,
+			Services: []string{"readiness"},
+			Actions: map[string]Action{
+				"GET": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+					routes.ReadyGET(ctx, w, r, l, s.Readiness)
+				},
+			},
+		},
+		{
+			Name:       "letsencrypt",
+			Path:       "/.well-known/",
+			Middleware: []string{"log"},
+			Services:   []string{"well_known_file_system"},
+			Optional:   true,
+			Actions: map[string]Action{
+				"GET":  serveLetsencrypt,
+				"HEAD": serveLetsencrypt,
+			},
+		},
+	}
+}
+
+// --- }}}
+
+// router mounts the endpoints, each through its chain of middleware. It fails if a middleware
+// is not recognized, or if a service an endpoint refers to is missing. The requests are tracked
+// in the wait group until they are handled, including those whose connection is hijacked.
+func router(ctx context.Context, m *Middleware, s *Services, requests *inflight) (http.Handler, context.CancelFunc, error) {
+	mux := http.NewServeMux()
+	requestBackground, cancelAll := context.WithCancel(ctx)
+
+	fail := func(err error) (http.Handler, context.CancelFunc, error) {
+		cancelAll()
+		return nil, nil, err
+	}
+
+	eps := endpoints(requestBackground, s)
+	if err := m.check(eps); err != nil {
+		return fail(err)
+	}
+
+	served, err := checkEndpoints(eps, s)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, e := range served {
+		chain, err := m.chain(e, middleware(s, e))
+		if err != nil {
+			return fail(err)
 		}
-	}, s.Logger))
 
-	// Handle letsencrypt
-	fs := http.FileServer(http.Dir("/var/www/elos/"))
-	mux.Handle("/.well-known/", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		fs.ServeHTTP(w, r)
-	}, s.Logger))
+		mux.HandleFunc(e.Path, track(requests, instrument(s.Metrics, e, e.handler(requestBackground, s, chain))))
+	}
 
-	return mux, cancelAll
+	return mux, cancelAll, nil
 }
@@ -0,0 +1,145 @@
+package gaia
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+// specEndpoint is an endpoint as spec.json describes it
+type specEndpoint struct {
+	Name         string   `json:"name"`
+	Path         string   `json:"path"`
+	Actions      []string `json:"actions"`
+	Middleware   []string `json:"middleware"`
+	Services     []string `json:"services"`
+	Authenticate bool     `json:"authenticate"`
+	Optional     bool     `json:"optional"`
+}
+
+// TestSpecDescribesEndpoints ensures spec.json and the Go endpoints agree
+func TestSpecDescribesEndpoints(t *testing.T) {
+	bytes, err := ioutil.ReadFile("spec.json")
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile error: %s", err)
+	}
+
+	var spec struct {
+		Endpoints []*specEndpoint `json:"endpoints"`
+	}
+	if err := json.Unmarshal(bytes, &spec); err != nil {
+		t.Fatalf("json.Unmarshal error: %s", err)
+	}
+
+	described := make(map[string]*specEndpoint)
+	for _, e := range spec.Endpoints {
+		described[e.Name] = e
+	}
+
+	eps := endpoints(context.Background(), new(Services))
+	if got, want := len(eps), len(spec.Endpoints); got != want {
+		t.Errorf("len(endpoints): got %d, want %d", got, want)
+	}
+
+	for _, e := range eps {
+		d, ok := described[e.Name]
+		if !ok {
+			t.Errorf("endpoint %q is not described by spec.json", e.Name)
+			continue
+		}
+
+		actions := make([]string, 0, len(e.Actions))
+		for m := range e.Actions {
+			actions = append(actions, m)
+		}
+		sort.Strings(actions)
+		sort.Strings(d.Actions)
+
+		got := &specEndpoint{e.Name, e.Path, actions, e.Middleware, e.Services, e.Authenticate, e.Optional}
+		if got.Middleware == nil {
+			got.Middleware = []string{}
+		}
+		if got.Services == nil {
+			got.Services = []string{}
+		}
+
+		if !reflect.DeepEqual(got, d) {
+			t.Errorf("endpoint %q: got %+v, want %+v", e.Name, got, d)
+		}
+	}
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	s := &Services{
+		Logger: services.NewTestLogger(t),
+	}
+	// the db is required
+	if _, err := checkEndpoints(endpoints(context.Background(), s), s); err == nil {
+		t.Fatal("expected checkEndpoints to fail without a db")
+	}
+
+	s.DB = mem.NewDB()
+	s.SMSCommandSessions = services.NewSMSMux()
+	s.ChangeJournal = services.NewChangeJournal(0)
+	s.APIKeys = services.NewAPIKeyStore(s.DB)
+	s.Metrics = services.NewMetrics()
+	s.Readiness = services.NewReadiness(0)
+
+	served, err := checkEndpoints(endpoints(context.Background(), s), s)
+	if err != nil {
+		t.Fatalf("checkEndpoints error: %s", err)
+	}
+
+	// the web uis are optional
+	for _, e := range served {
+		if e.Name == "login" || e.Name == "cal_week" {
+			t.Errorf("endpoint %q should not be served without its service", e.Name)
+		}
+	}
+}
+
+func TestEndpointMethods(t *testing.T) {
+	e := &Endpoint{
+		Name: "test",
+		Path: "/test/",
+		Actions: map[string]Action{
+			"POST": func(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+	}
+	handle := e.handler(context.Background(), new(Services), nil)
+
+	cases := map[string]int{
+		"POST":    http.StatusNoContent,
+		"GET":     http.StatusMethodNotAllowed,
+		"OPTIONS": http.StatusOK,
+	}
+
+	for method, want := range cases {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(method, "/test/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handle(w, r)
+
+		if got := w.Code; got != want {
+			t.Errorf("%s: got %d, want %d", method, got, want)
+		}
+		if want != http.StatusNoContent {
+			if got, want := w.Header().Get("Allow"), "OPTIONS, POST"; got != want {
+				t.Errorf("%s Allow: got %q, want %q", method, got, want)
+			}
+		}
+	}
+}
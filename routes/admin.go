@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/elos/gaia/services"
+	"github.com/elos/gaia/services/sms"
+	"github.com/elos/models/user"
+	"golang.org/x/net/context"
+)
+
+const numberParam = "number"
+
+// admin ensures the authenticated user is an admin, and that the request's api key, if it
+// has one, grants the verb on the endpoint, otherwise it responds with StatusForbidden
+func admin(ctx context.Context, w http.ResponseWriter, l services.Logger, admins services.Admins, verb, endpoint string) bool {
+	if !permit(ctx, w, l, verb, endpoint) {
+		return false
+	}
+
+	u, ok := user.FromContext(ctx)
+	if !ok {
+		l.Print("failed to retrieve user from context")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+
+	if !admins.Admin(u.ID().String()) {
+		l.Printf("%s, who is not an admin, requested %s", u.ID(), endpoint)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// --- AdminSMSSessionsGET {{{
+
+// AdminSMSSessionsResponse is the body of the response to a GET of the '/admin/sms/sessions/' endpoint
+type AdminSMSSessionsResponse struct {
+	Sessions []*services.SMSSession `json:"sessions"`
+}
+
+// AdminSMSSessionsGET implements gaia's response to a GET request to the '/admin/sms/sessions/' endpoint.
+//
+// Assumptions: The user has been authenticated.
+//
+// Proceedings:
+//		Describes the live sms command sessions, in the order of their numbers.
+//
+// Success:
+//		* StatusOK with the AdminSMSSessionsResponse as JSON
+//
+// Errors:
+//		* StatusForbidden: the user is not an admin, or the api key doesn't grant reading the endpoint
+//		* InternalServerError: json marshalling
+func AdminSMSSessionsGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, admins services.Admins, sessions services.SMSCommandSessions) {
+	l := logger.WithPrefix("AdminSMSSessionsGET: ")
+
+	if !admin(ctx, w, l, admins, services.ReadVerb, AdminSMSSessions) {
+		return
+	}
+
+	bytes, err := json.Marshal(&AdminSMSSessionsResponse{Sessions: sessions.Sessions()})
+	if err != nil {
+		l.Printf("error while marshalling json %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// --- }}}
+
+// --- AdminSMSSessionsDELETE {{{
+
+// AdminSMSSessionsDELETE implements gaia's response to a DELETE request to the '/admin/sms/sessions/' endpoint.
+//
+// Assumptions: The user has been authenticated.
+//
+// Proceedings:
+//		Ends the session of the 'number' parameter, whose user is told it has been ended.
+//
+// Success:
+//		* StatusNoContent
+//
+// Errors:
+//		* StatusBadRequest: there is no number parameter
+//		* StatusForbidden: the user is not an admin, or the api key doesn't grant writing the endpoint
+//		* StatusNotFound: the number has no session
+func AdminSMSSessionsDELETE(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, admins services.Admins, sessions services.SMSCommandSessions) {
+	l := logger.WithPrefix("AdminSMSSessionsDELETE: ")
+
+	if !admin(ctx, w, l, admins, services.WriteVerb, AdminSMSSessions) {
+		return
+	}
+
+	number := r.FormValue(numberParam)
+	if number == "" {
+		http.Error(w, "You must specify a number", http.StatusBadRequest)
+		return
+	}
+
+	if !sessions.Kill(sms.PhoneNumber(number)) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	l.Printf("killed the sms command session of %s", number)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- }}}
@@ -0,0 +1,278 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/elos/data"
+	"github.com/elos/gaia/services"
+	"github.com/elos/models"
+	"github.com/elos/models/user"
+	"golang.org/x/net/context"
+)
+
+// --- API Key Context {{{
+
+type apiKeyContextKey int
+
+const apiKeyKey apiKeyContextKey = 0
+
+// withAPIKey records that the request was authenticated by the api key,
+// and so is limited to its scopes
+func withAPIKey(ctx context.Context, k *services.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, k)
+}
+
+// apiKeyFromContext retrieves the api key the request was authenticated by, if it was
+func apiKeyFromContext(ctx context.Context) (*services.APIKey, bool) {
+	k, ok := ctx.Value(apiKeyKey).(*services.APIKey)
+	return k, ok
+}
+
+// Permitted determines whether the request's api key, if it was authenticated by one,
+// grants the verb on any of the targets (kinds or endpoints). A request authenticated
+// any other way acts with the full authority of the user, and is always permitted.
+//
+// It is in addition to, not instead of, the access.CanRead and access.CanWrite checks.
+func Permitted(ctx context.Context, verb string, targets ...string) bool {
+	k, ok := apiKeyFromContext(ctx)
+	if !ok {
+		return true
+	}
+
+	return k.Grants(verb, targets...)
+}
+
+// permit is Permitted, but responds with StatusForbidden if the request is not permitted
+func permit(ctx context.Context, w http.ResponseWriter, l services.Logger, verb string, targets ...string) bool {
+	if Permitted(ctx, verb, targets...) {
+		return true
+	}
+
+	l.Printf("api key does not permit %s on %v", verb, targets)
+	http.Error(w, fmt.Sprintf("The api key does not permit %s on %q", verb, targets[0]), http.StatusForbidden)
+	return false
+}
+
+// authenticateAPIKey loads the owner of the api key token
+func authenticateAPIKey(ctx context.Context, db data.DB, keys services.APIKeys, token string) (context.Context, error) {
+	k, err := keys.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := db.ParseID(k.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+
+	u := models.NewUser()
+	u.SetID(id)
+	if err := db.PopulateByID(u); err != nil {
+		return nil, err
+	}
+
+	return withAPIKey(user.NewContext(ctx, u), k), nil
+}
+
+// --- }}}
+
+// APIKeyRequest is the body of a POST request to the '/apikey/' endpoint
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// APIKeyResponse is the response to a POST request to the '/apikey/' endpoint,
+// it is the only time the token of a key is revealed
+type APIKeyResponse struct {
+	*services.APIKey
+	Token string `json:"token"`
+}
+
+// --- APIKeyGET {{{
+
+// APIKeyGET implements gaia's response to a GET request to the '/apikey/' endpoint.
+//
+// Assumptions: The user has been authenticated, not by an api key.
+//
+// Proceedings: Lists the user's api keys, without their tokens.
+//
+// Success:
+//		* StatusOK with the keys as a JSON array
+//
+// Errors:
+//		* InternalServerError: failure to retrieve the keys, json marshalling
+//		* Forbidden: the request was authenticated by an api key
+func APIKeyGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, keys services.APIKeys) {
+	l := logger.WithPrefix("APIKeyGET: ")
+
+	u, ok := apiKeyUser(ctx, w, l)
+	if !ok {
+		return
+	}
+
+	list, err := keys.List(u.ID().String())
+	if err != nil {
+		l.Printf("keys.List error: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.MarshalIndent(list, "", "	")
+	if err != nil {
+		l.Printf("error while marshalling json %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// --- }}}
+
+// --- APIKeyPOST {{{
+
+// APIKeyPOST implements gaia's response to a POST request to the '/apikey/' endpoint.
+//
+// Assumptions: The user has been authenticated, not by an api key.
+//
+// Proceedings: Reads an APIKeyRequest from the body, and issues a key with its scopes.
+//
+// Success:
+//		* StatusCreated with the APIKeyResponse, holding the token, as JSON
+//
+// Errors:
+//		* InternalServerError: failure to read the body, issue the key, json marshalling
+//		* BadRequest: malformed body, no scopes, invalid scope
+//		* Forbidden: the request was authenticated by an api key
+func APIKeyPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, keys services.APIKeys) {
+	l := logger.WithPrefix("APIKeyPOST: ")
+
+	u, ok := apiKeyUser(ctx, w, l)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		l.Printf("error reading request body: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	req := new(APIKeyRequest)
+	if err := json.Unmarshal(body, req); err != nil {
+		l.Printf("error while unmarshalling request body: %s", err)
+		http.Error(w, "The body must be a JSON object with a name and scopes", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		http.Error(w, "An api key must have at least one scope", http.StatusBadRequest)
+		return
+	}
+
+	scopes := make([]services.Scope, len(req.Scopes))
+	for i, s := range req.Scopes {
+		scope, err := services.ParseScope(s)
+		if err != nil || !validTarget(scope.Target()) {
+			http.Error(w, fmt.Sprintf("The scope %q is invalid", s), http.StatusBadRequest)
+			return
+		}
+		scopes[i] = scope
+	}
+
+	k, token, err := keys.Issue(u.ID().String(), req.Name, scopes)
+	if err != nil {
+		l.Printf("keys.Issue error: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.MarshalIndent(&APIKeyResponse{APIKey: k, Token: token}, "", "	")
+	if err != nil {
+		l.Printf("error while marshalling json %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// validTarget determines whether the target of a scope is a kind, an endpoint or AnyTarget
+func validTarget(target string) bool {
+	return target == services.AnyTarget || models.Kinds[data.Kind(target)] ||
+		(strings.HasPrefix(target, "/") && strings.HasSuffix(target, "/"))
+}
+
+// --- }}}
+
+// --- APIKeyDELETE {{{
+
+// APIKeyDELETE implements gaia's response to a DELETE request to the '/apikey/' endpoint.
+//
+// Assumptions: The user has been authenticated, not by an api key.
+//
+// Proceedings: Revokes the user's key of the id parameter (required).
+//
+// Success:
+//		* StatusNoContent, the key is revoked
+//
+// Errors:
+//		* InternalServerError: failure to revoke the key
+//		* BadRequest: no id parameter
+//		* NotFound: the user has no such key
+//		* Forbidden: the request was authenticated by an api key
+func APIKeyDELETE(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, keys services.APIKeys) {
+	l := logger.WithPrefix("APIKeyDELETE: ")
+
+	u, ok := apiKeyUser(ctx, w, l)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue(idParam)
+	if id == "" {
+		http.Error(w, fmt.Sprintf("You must specify a '%s' parameter", idParam), http.StatusBadRequest)
+		return
+	}
+
+	switch err := keys.Revoke(u.ID().String(), id); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case services.ErrAPIKeyNotFound:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	default:
+		l.Printf("keys.Revoke error: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// --- }}}
+
+// apiKeyUser retrieves the user managing their api keys. An api key can not be
+// used to manage api keys, else a scoped key could issue itself a broader one.
+func apiKeyUser(ctx context.Context, w http.ResponseWriter, l services.Logger) (*models.User, bool) {
+	if _, ok := apiKeyFromContext(ctx); ok {
+		l.Print("api keys can not be managed with an api key")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+
+	u, ok := user.FromContext(ctx)
+	if !ok {
+		l.Print("failed to retrieve user from context")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return u, true
+}
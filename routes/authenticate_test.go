@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/elos/data"
 	"github.com/elos/data/builtin/mem"
@@ -26,7 +27,7 @@ func TestAuthenticateBasicAuth(t *testing.T) {
 	var userContext context.Context
 	var authed bool
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userContext, authed = routes.Authenticate(ctx, w, r, logger, db)
+		userContext, authed = routes.Authenticate(ctx, w, r, logger, db, nil, nil)
 		if authed {
 			w.WriteHeader(http.StatusOK)
 		}
@@ -105,7 +106,7 @@ func TestAuthenticateSession(t *testing.T) {
 	var userContext context.Context
 	var authed bool
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userContext, authed = routes.Authenticate(ctx, w, r, logger, db)
+		userContext, authed = routes.Authenticate(ctx, w, r, logger, db, nil, nil)
 		if authed {
 			w.WriteHeader(http.StatusOK)
 		}
@@ -161,6 +162,73 @@ func TestAuthenticateSession(t *testing.T) {
 
 // --- }}}
 
+// --- TestAuthenticateBearer {{{
+
+func TestAuthenticateBearer(t *testing.T) {
+	ctx := context.Background()
+	db := mem.NewDB()
+	logger := services.NewTestLogger(t)
+
+	var userContext context.Context
+	var authed bool
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userContext, authed = routes.Authenticate(ctx, w, r, logger, db, nil, nil)
+		if authed {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer s.Close()
+
+	u, _, err := user.Create(db, "username", "password")
+	if err != nil {
+		t.Fatalf("user.Create(db, \"username\", \"password\") error: %s", err)
+	}
+	client := new(http.Client)
+
+	req, err := http.NewRequest("GET", s.URL, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("http.NewRequest error: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer garbage")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do(req) error: %s", err)
+	}
+	if got, want := authed, false; got != want {
+		t.Errorf("authed: got %t, want %t", got, want)
+	}
+	if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("resp.StatusCode: got %d, want %d", got, want)
+	}
+
+	sesh := models.NewSessionForUser(u)
+	sesh.SetID(db.NewID())
+	if err := db.Save(sesh); err != nil {
+		t.Fatalf("db.Save(sesh) error: %s", err)
+	}
+	req, err = http.NewRequest("GET", s.URL, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("http.NewRequest error: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+sesh.Token)
+	if _, err = client.Do(req); err != nil {
+		t.Fatalf("client.Do(req) error: %s", err)
+	}
+
+	if got, want := authed, true; got != want {
+		t.Fatalf("authed: got %t, want %t", got, want)
+	}
+	authedU, ok := user.FromContext(userContext)
+	if got, want := ok, true; got != want {
+		t.Fatalf("_, ok := user.FromContext: got %t, want %t", got, want)
+	}
+	if got, want := data.Equivalent(authedU, u), true; got != want {
+		t.Errorf("data.Equivalent(authedU, u): got %t, want %t", got, want)
+	}
+}
+
+// --- }}}
+
 // --- TestAuthenticateQueryParams {{{
 
 func TestAuthenticateQueryParams(t *testing.T) {
@@ -171,7 +239,7 @@ func TestAuthenticateQueryParams(t *testing.T) {
 	var userContext context.Context
 	var authed bool
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userContext, authed = routes.Authenticate(ctx, w, r, logger, db)
+		userContext, authed = routes.Authenticate(ctx, w, r, logger, db, nil, nil)
 		if authed {
 			w.WriteHeader(http.StatusOK)
 		}
@@ -222,7 +290,7 @@ func TestAuthenticatePostForm(t *testing.T) {
 	var userContext context.Context
 	var authed bool
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userContext, authed = routes.Authenticate(ctx, w, r, logger, db)
+		userContext, authed = routes.Authenticate(ctx, w, r, logger, db, nil, nil)
 		if authed {
 			w.WriteHeader(http.StatusOK)
 		}
@@ -252,3 +320,107 @@ func TestAuthenticatePostForm(t *testing.T) {
 }
 
 // --- }}}
+
+// --- TestAuthenticateRateLimited {{{
+
+func TestAuthenticateRateLimited(t *testing.T) {
+	ctx := context.Background()
+	db := mem.NewDB()
+	logger := services.NewTestLogger(t)
+	limiter := services.NewRateLimiter(2, time.Minute, time.Hour)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, authed := routes.Authenticate(ctx, w, r, logger, db, nil, limiter); authed {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer s.Close()
+
+	if _, _, err := user.Create(db, "username", "password"); err != nil {
+		t.Fatalf("user.Create(db, \"username\", \"password\") error: %s", err)
+	}
+	client := new(http.Client)
+
+	attempt := func(private string) *http.Response {
+		req, err := http.NewRequest("GET", s.URL, new(bytes.Buffer))
+		if err != nil {
+			t.Fatalf("http.NewRequest error: %s", err)
+		}
+		req.SetBasicAuth("username", private)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do(req) error: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if got, want := attempt("badpassword").StatusCode, http.StatusUnauthorized; got != want {
+			t.Fatalf("attempt %d resp.StatusCode: got %d, want %d", i, got, want)
+		}
+	}
+
+	// the third failure locks the client out
+	attempt("badpassword")
+
+	resp := attempt("password")
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Fatalf("resp.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get(routes.RetryAfterHeader), "60"; got != want {
+		t.Errorf("resp.Header.Get(routes.RetryAfterHeader): got %q, want %q", got, want)
+	}
+}
+
+// --- }}}
+
+// --- TestAuthenticateRateLimitedTokens {{{
+
+func TestAuthenticateRateLimitedTokens(t *testing.T) {
+	ctx := context.Background()
+	db := mem.NewDB()
+	logger := services.NewTestLogger(t)
+	limiter := services.NewRateLimiter(2, time.Minute, time.Hour)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, authed := routes.Authenticate(ctx, w, r, logger, db, nil, limiter); authed {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer s.Close()
+
+	if _, _, err := user.Create(db, "username", "password"); err != nil {
+		t.Fatalf("user.Create(db, \"username\", \"password\") error: %s", err)
+	}
+	client := new(http.Client)
+
+	attempt := func(auth func(*http.Request)) *http.Response {
+		req, err := http.NewRequest("GET", s.URL, new(bytes.Buffer))
+		if err != nil {
+			t.Fatalf("http.NewRequest error: %s", err)
+		}
+		auth(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do(req) error: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	guess := func(req *http.Request) { req.Header.Set("Authorization", "Bearer guessed") }
+
+	// a client which guesses tokens is locked out, as one which guesses passwords is
+	for i := 0; i < 3; i++ {
+		if got, want := attempt(guess).StatusCode, http.StatusUnauthorized; got != want {
+			t.Fatalf("attempt %d resp.StatusCode: got %d, want %d", i, got, want)
+		}
+	}
+
+	resp := attempt(func(req *http.Request) { req.SetBasicAuth("username", "password") })
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Fatalf("resp.StatusCode: got %d, want %d", got, want)
+	}
+}
+
+// --- }}}
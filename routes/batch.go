@@ -0,0 +1,384 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/elos/data"
+	"github.com/elos/gaia/services"
+	"github.com/elos/models"
+	"github.com/elos/models/access"
+	"github.com/elos/models/user"
+	"golang.org/x/net/context"
+)
+
+// The operations a /record/batch/ request may contain
+const (
+	BatchSave   = "save"
+	BatchDelete = "delete"
+)
+
+// maxBatchOperations bounds the number of operations a single
+// request to the /record/batch/ endpoint may contain
+const maxBatchOperations = 100
+
+// BatchOperation is the wire format of a single operation in a
+// request to the /record/batch/ endpoint.
+//
+// A save requires the kind and the record, the id is optional (as with RecordPOST).
+// A delete requires the kind and the id.
+type BatchOperation struct {
+	Op     string          `json:"op"`
+	Kind   data.Kind       `json:"kind"`
+	ID     string          `json:"id,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// BatchResult is the wire format of the outcome of a single BatchOperation.
+// The status corresponds to the status code the equivalent request to the
+// /record/ endpoint would have received.
+type BatchResult struct {
+	Status int             `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// batchStep is a BatchOperation which has been parsed and authorized
+type batchStep struct {
+	op       string
+	record   data.Record
+	creation bool
+
+	// previous is the record a save replaced, so that it may be restored, it is nil if there was none
+	previous data.Record
+}
+
+// --- RecordBatchPOST {{{
+
+// RecordBatchPOST implements gaia's response to a POST request to the '/record/batch/' endpoint.
+//
+// Assumptions: The user has been authenticated.
+//
+// Proceedings: Reads a JSON array of operations from the body. Every operation is parsed and
+// authorized, using the same access checks as RecordPOST and RecordDELETE, before any is applied.
+// If any operation is rejected, none are applied. Otherwise the operations are applied in order,
+// stopping at the first database error, in which case those already applied are undone, in reverse:
+// a saved record is restored to what it was (or deleted if it was created), a deleted record is saved.
+//
+// Success:
+//		* StatusOK with a JSON array of results, one per operation, in order. Operations which
+//		  were not applied, or were undone, because another operation failed have the status
+//		  StatusFailedDependency. An operation which couldn't be undone keeps its status, with
+//		  an error saying so, the batch was only partially applied.
+//
+// Errors:
+//		* InternalServerError: failure to read the body, retrieve the user, json marshalling
+//		* BadRequest: malformed JSON, too many operations
+func RecordBatchPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, db services.DB) {
+	l := logger.WithPrefix("RecordBatchPOST: ")
+
+	// Retrieve our user
+	u, ok := user.FromContext(ctx)
+	if !ok {
+		l.Print("failed to retrieve user from context")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var requestBody []byte
+	var err error
+
+	defer r.Body.Close()
+	if requestBody, err = ioutil.ReadAll(r.Body); err != nil {
+		l.Printf("error while reading request body: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var ops []*BatchOperation
+	if err = json.Unmarshal(requestBody, &ops); err != nil {
+		l.Printf("info: request body:\n%s", string(requestBody))
+		l.Printf("error: while unmarshalling request body, %s", err)
+		http.Error(w, "The request body must be a JSON array of operations", http.StatusBadRequest)
+		return
+	}
+
+	if len(ops) > maxBatchOperations {
+		l.Printf("too many operations: %d", len(ops))
+		http.Error(w, fmt.Sprintf("A batch may contain at most %d operations", maxBatchOperations), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]*BatchResult, len(ops))
+	steps := make([]*batchStep, len(ops))
+
+	// First, parse and authorize every operation
+	rejected := false
+	for i, op := range ops {
+		if op != nil && !Permitted(ctx, services.WriteVerb, op.Kind.String(), RecordBatch) {
+			results[i] = batchFailure(http.StatusForbidden, fmt.Sprintf("The api key does not permit writing %q", op.Kind))
+		} else {
+			steps[i], results[i] = prepareBatchOperation(ctx, db, u, op)
+		}
+
+		if results[i] != nil {
+			l.Printf("operation %d rejected: %d %s", i, results[i].Status, results[i].Error)
+			rejected = true
+		}
+	}
+
+	// Then, if all were authorized, apply them in order
+	for i, step := range steps {
+		if rejected {
+			if results[i] == nil {
+				results[i] = batchNotApplied()
+			}
+			continue
+		}
+
+		if results[i] = applyBatchStep(db, step); results[i].Status >= http.StatusBadRequest {
+			l.Printf("operation %d failed: %d %s", i, results[i].Status, results[i].Error)
+			rejected = true
+
+			// undo those which were applied, the last first
+			for j := i - 1; j >= 0; j-- {
+				if err := undoBatchStep(db, steps[j]); err != nil {
+					l.Printf("error undoing operation %d: %s", j, err)
+					results[j].Error = "Applied, another operation in the batch failed, but this could not be undone"
+					continue
+				}
+
+				results[j] = batchUndone()
+			}
+		}
+	}
+
+	bytes, err := json.MarshalIndent(results, "", "    ")
+	if err != nil {
+		l.Printf("error marshalling results: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// prepareBatchOperation parses the operation and checks that the user is allowed to carry
+// it out, counting those access control denies. Exactly one of the return values is non-nil.
+func prepareBatchOperation(ctx context.Context, db services.DB, u *models.User, op *BatchOperation) (*batchStep, *BatchResult) {
+	if op == nil {
+		return nil, batchFailure(http.StatusBadRequest, "The operation must be an object")
+	}
+
+	if op.Kind == "" {
+		return nil, batchFailure(http.StatusBadRequest, fmt.Sprintf("You must specify a %q", kindParam))
+	}
+
+	if _, ok := models.Kinds[op.Kind]; !ok {
+		return nil, batchFailure(http.StatusBadRequest, fmt.Sprintf("The kind %q is not recognized", op.Kind))
+	}
+
+	m := models.ModelFor(op.Kind)
+
+	switch op.Op {
+	case BatchSave:
+		if len(op.Record) == 0 {
+			return nil, batchFailure(http.StatusBadRequest, "You must specify a record to save")
+		}
+
+		if err := json.Unmarshal(op.Record, m); err != nil {
+			return nil, batchFailure(http.StatusBadRequest, "The record is malformed")
+		}
+
+		// the id may be given alongside the record, rather than in it
+		if m.ID().String() == "" && op.ID != "" {
+			id, err := db.ParseID(op.ID)
+			if err != nil {
+				return nil, batchFailure(http.StatusBadRequest, fmt.Sprintf("The id %q is invalid", op.ID))
+			}
+			m.SetID(id)
+		}
+
+		creation := false
+		if m.ID().String() == "" {
+			m.SetID(db.NewID())
+			creation = true
+		}
+
+		if is, err := reserved(db, m); err != nil {
+			return nil, batchFailure(http.StatusInternalServerError, "")
+		} else if is {
+			return nil, batchFailure(http.StatusForbidden, "The record is written by gaia, it can't be written by a user")
+		}
+
+		var allowed bool
+		var err error
+		if creation {
+			prop, ok := m.(access.Property)
+			if !ok {
+				return nil, batchFailure(http.StatusUnauthorized, "")
+			}
+
+			allowed, err = access.CanCreate(db, u, prop)
+		} else {
+			allowed, err = access.CanWrite(db, u, m)
+		}
+
+		if err != nil {
+			switch err {
+			case data.ErrAccessDenial:
+				return nil, batchFailure(http.StatusUnauthorized, "")
+			default:
+				return nil, batchFailure(http.StatusInternalServerError, "")
+			}
+		} else if !allowed {
+			denied(ctx, op.Kind, RecordBatch)
+			return nil, batchFailure(http.StatusUnauthorized, "")
+		}
+
+		return &batchStep{op: BatchSave, record: m, creation: creation}, nil
+	case BatchDelete:
+		if op.ID == "" {
+			return nil, batchFailure(http.StatusBadRequest, fmt.Sprintf("You must specify an %q", idParam))
+		}
+
+		id, err := db.ParseID(op.ID)
+		if err != nil {
+			return nil, batchFailure(http.StatusBadRequest, fmt.Sprintf("The id %q is invalid", op.ID))
+		}
+		m.SetID(id)
+
+		if err := db.PopulateByID(m); err != nil {
+			switch err {
+			case data.ErrAccessDenial:
+				fallthrough // don't leak information
+			case data.ErrNotFound:
+				return nil, batchFailure(http.StatusNotFound, "")
+			default:
+				return nil, batchFailure(http.StatusInternalServerError, "")
+			}
+		}
+
+		if is, err := reserved(db, m); err != nil {
+			return nil, batchFailure(http.StatusInternalServerError, "")
+		} else if is {
+			return nil, batchFailure(http.StatusForbidden, "The record is written by gaia, it can't be deleted by a user")
+		}
+
+		if allowed, err := access.CanDelete(db, u, m); err != nil {
+			return nil, batchFailure(http.StatusInternalServerError, "")
+		} else if !allowed {
+			denied(ctx, op.Kind, RecordBatch)
+			// in order to not leak information, we treat this as a not found
+			return nil, batchFailure(http.StatusNotFound, "")
+		}
+
+		return &batchStep{op: BatchDelete, record: m}, nil
+	default:
+		return nil, batchFailure(http.StatusBadRequest, fmt.Sprintf("The op %q is not recognized", op.Op))
+	}
+}
+
+// applyBatchStep commits an authorized operation to the database, a save
+// first retrieves the record it replaces, so that the save may be undone
+func applyBatchStep(db services.DB, step *batchStep) *BatchResult {
+	switch step.op {
+	case BatchSave:
+		if !step.creation {
+			previous := models.ModelFor(step.record.Kind())
+			previous.SetID(step.record.ID())
+			switch err := db.PopulateByID(previous); err {
+			case nil:
+				step.previous = previous
+			case data.ErrNotFound:
+				// the id was given, but the record is new
+			default:
+				return batchFailure(http.StatusInternalServerError, "")
+			}
+		}
+
+		if err := db.Save(step.record); err != nil {
+			switch err {
+			case data.ErrAccessDenial:
+				return batchFailure(http.StatusUnauthorized, "")
+			default:
+				return batchFailure(http.StatusInternalServerError, "")
+			}
+		}
+
+		bytes, err := json.Marshal(step.record)
+		if err != nil {
+			return batchFailure(http.StatusInternalServerError, "")
+		}
+
+		if step.creation {
+			return &BatchResult{Status: http.StatusCreated, Record: bytes}
+		}
+
+		return &BatchResult{Status: http.StatusOK, Record: bytes}
+	case BatchDelete:
+		if err := db.Delete(step.record); err != nil {
+			switch err {
+			case data.ErrAccessDenial:
+				return batchFailure(http.StatusNotFound, "") // don't leak information
+			case data.ErrNotFound:
+				// deleted by another process since we populated it, which is a success
+			default:
+				return batchFailure(http.StatusInternalServerError, "")
+			}
+		}
+
+		return &BatchResult{Status: http.StatusNoContent}
+	default:
+		// prepareBatchOperation only produces saves and deletes
+		return batchFailure(http.StatusInternalServerError, "")
+	}
+}
+
+// undoBatchStep reverses an operation applyBatchStep applied
+func undoBatchStep(db services.DB, step *batchStep) error {
+	switch step.op {
+	case BatchSave:
+		if step.previous != nil {
+			return db.Save(step.previous)
+		}
+
+		if err := db.Delete(step.record); err != nil && err != data.ErrNotFound {
+			return err
+		}
+		return nil
+	case BatchDelete:
+		// the record was populated before it was deleted
+		return db.Save(step.record)
+	default:
+		return nil
+	}
+}
+
+// batchFailure constructs a BatchResult for a failed operation,
+// defaulting the error message to the status text.
+func batchFailure(status int, message string) *BatchResult {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	return &BatchResult{Status: status, Error: message}
+}
+
+// batchNotApplied constructs the BatchResult for a valid operation which
+// was not applied because another operation in the batch failed
+func batchNotApplied() *BatchResult {
+	return batchFailure(http.StatusFailedDependency, "Not applied, another operation in the batch failed")
+}
+
+// batchUndone constructs the BatchResult for an operation which was applied,
+// then undone because a later operation in the batch failed
+func batchUndone() *BatchResult {
+	return batchFailure(http.StatusFailedDependency, "Undone, another operation in the batch failed")
+}
+
+// --- }}}
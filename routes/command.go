@@ -1,107 +1,316 @@
 package routes
 
 import (
-	"io"
-	"log"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/elos/data"
-	"github.com/elos/elos/command"
 	"github.com/elos/gaia/services"
-	"github.com/elos/gaia/services/sms"
-	"github.com/elos/models/access"
 	"github.com/elos/models/user"
 	"golang.org/x/net/context"
 	"golang.org/x/net/websocket"
 )
 
-// Expects: From, To, Body params
-func CommandSMSPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, sessions services.SMSCommandSessions) {
-	m, err := sms.ExtractMessageFromRequest(r)
+// CommandSMSPOST implements gaia's response to a POST to the '/command/sms/' endpoint.
+//
+// Assumptions: The request is the webhook of an sms provider, delivering a message to gaia.
+//
+// Proceedings:
+//		The provider is that named by the remainder of the path, e.g. '/command/sms/plivo/',
+//		or the default provider if there is none. The provider verifies the request's
+//		signature, which proves it is the provider's, then extracts the message, which
+//		is forwarded to the sender's command session. If the sessions refuse it, because
+//		the sender's session has too many messages waiting, there are too many sessions,
+//		or they are stopped, the sender is told elos is busy, and to send it again.
+//
+// Success:
+//		* StatusNoContent, the message was taken, or the sender told it wasn't
+//
+// Errors:
+//		* StatusNotFound: there is no provider of the name
+//		* StatusForbidden: the request's signature is missing or invalid, it may be spoofed
+//		* StatusBadRequest: the provider couldn't extract a message from the request
+func CommandSMSPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, providers services.SMSProviders, sessions services.SMSCommandSessions) {
+	l := logger.WithPrefix("CommandSMSPOST: ")
 
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, CommandSMS), "/")
+	provider, ok := providers.Provider(name)
+	if !ok {
+		l.Warn("no such sms provider", "provider", name)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if err := provider.Verify(r, webhookURL(r)); err != nil {
+		l.Warn("rejected sms request with an invalid signature", "provider", provider.Name(), "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	m, err := provider.Inbound(r)
 	if err != nil {
-		logger.Fatal(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		l.Error("failed to extract message from request", "provider", provider.Name(), "error", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	sessions.Inbound(m)
+	if err := sessions.Inbound(m); err != nil {
+		// the provider doesn't retry a message, but the sender may
+		l.Warn("refused sms", "provider", provider.Name(), "from", string(m.From), "error", err)
+		if err := provider.Send(string(m.From), services.BusyMessage); err != nil {
+			l.Error("failed to tell the sender elos is busy", "provider", provider.Name(), "to", string(m.From), "error", err)
+		}
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func ContextualizeCommandWebGET(ctx context.Context, db data.DB, logger services.Logger) websocket.Handler {
-	return func(c *websocket.Conn) {
+// webhookURL reconstructs the url the provider requested, which its signature covers. Behind a
+// proxy, which terminates TLS, the scheme and host are those of the X-Forwarded-Proto and
+// X-Forwarded-Host headers. They may be forged, but only to fail the verification.
+func webhookURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
 
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// ContextualizeCommandWebGET constructs the websocket handler of the '/command/web/' endpoint.
+//
+// The context must hold the authenticated user, the request should go through
+// Authenticate before it is upgraded.
+func ContextualizeCommandWebGET(ctx context.Context, sessions services.WebCommandSessions, logger services.Logger) websocket.Handler {
+	return func(c *websocket.Conn) {
 		if err := c.Request().ParseForm(); err != nil {
 			logger.Print("Failure parsing form")
 			return
 		}
 
-		public := c.Request().Form.Get("public")
-		private := c.Request().Form.Get("private")
+		CommandWebGET(ctx, c, logger, sessions)
+	}
+}
+
+// CommandWebGET implements gaia's response to a websocket on the '/command/web/' endpoint.
+//
+// Assumptions: The context holds the authenticated user.
+//
+// Proceedings:
+//		Serves a command session over the socket, until either end closes it. A user may
+//		have one session at once, unless the sessions allow one per socket, so a socket of
+//		a user who has a session is refused, unless its 'take_over' parameter is true, in
+//		which case the existing session is ended, and replaced.
+//
+// Errors:
+//		* the socket is refused, with a message saying why, then closed
+func CommandWebGET(ctx context.Context, ws *websocket.Conn, logger services.Logger, sessions services.WebCommandSessions) {
+	l := logger.WithPrefix("CommandWebGET: ")
 
-		if public == "" || private == "" {
-			logger.Print("failed to retrieve credentials")
-			return
-		}
+	u, ok := user.FromContext(ctx)
+	if !ok {
+		l.Print("failed to retrieve user from context")
+		ws.Close()
+		return
+	}
 
-		cred, err := access.Authenticate(db, public, private)
-		if err != nil {
-			logger.Print("failed to auth")
-			return
-		}
+	takeOver, _ := strconv.ParseBool(ws.Request().Form.Get(takeOverParam))
 
-		u, _ := cred.Owner(db)
-		CommandWebGET(user.NewContext(ctx, u), c, logger, db)
+	err := sessions.Serve(ctx, &services.SocketSession{User: u, Conn: ws}, takeOver)
+	switch err {
+	case nil:
+		return
+	case services.ErrWebSessionExists:
+		websocket.Message.Send(ws, err.Error()+", connect with ?"+takeOverParam+"=true to take it over")
+	case services.ErrWebSessionsStopped:
+		websocket.Message.Send(ws, services.GoingAwayMessage)
+	default:
+		l.Printf("failed to serve the session of %s: %s", u.ID(), err)
 	}
+
+	ws.Close()
+}
+
+// takeOverParam is that which asks for the user's existing session to be taken over
+const takeOverParam = "take_over"
+
+// waitParam is how long, in seconds, a GET to the '/command/ios/' endpoint waits for output
+const waitParam = "wait"
+
+// The bounds of how long a GET to the '/command/ios/' endpoint waits for output
+const (
+	DefaultCommandWait = 30 * time.Second
+	MaxCommandWait     = 60 * time.Second
+)
+
+// CommandiOSResponse is the response to a GET request to the '/command/ios/' endpoint
+type CommandiOSResponse struct {
+	Messages []*services.CommandEnvelope `json:"messages"`
+	// Missed is set if output after the since is no longer retained
+	Missed bool `json:"missed,omitempty"`
 }
 
-// Expects: the context to hold the authed user
-func CommandWebGET(ctx context.Context, ws *websocket.Conn, logger services.Logger, db data.DB) {
+// --- CommandiOSPOST {{{
+
+// CommandiOSPOST implements gaia's response to a POST request to the '/command/ios/' endpoint.
+//
+// Assumptions: The user has been authenticated.
+//
+// Proceedings:
+//		Parses the body as a services.CommandEnvelope, and sends its body to the user's
+//		command session, starting one if there is none. An envelope whose id was recently
+//		sent is ignored, so that a client may retry it.
+//
+// Success:
+//		* StatusAccepted, the input was sent
+//		* StatusOK, the input was already sent
+//
+// Errors:
+//		* StatusBadRequest: the body is not an envelope, with an id and a body
+//		* StatusTooManyRequests: the session has too many inputs waiting, the client may retry
+//		* StatusServiceUnavailable: the sessions are stopped, the client may retry
+func CommandiOSPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, sessions services.MobileCommandSessions) {
+	l := logger.WithPrefix("CommandiOSPOST: ")
+
+	// a command session acts on all of the user's records
+	if !permit(ctx, w, l, services.WriteVerb, CommandiOS) {
+		return
+	}
+
 	u, ok := user.FromContext(ctx)
 	if !ok {
-		logger.Print("CommandWebGET Error: failed to retrieve user from context")
+		l.Print("failed to retrieve user from context")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	input := make(chan string)
-	output := make(chan string)
+	input := new(services.CommandEnvelope)
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil || input.ID == "" || input.Body == "" {
+		http.Error(w, "The body must be an envelope with an id and a body", http.StatusBadRequest)
+		return
+	}
 
-	session := command.NewSession(
-		u, db, input, output,
-		func() {
-			log.Print("CommandWebGET bail")
-			close(output)
-		},
-	)
+	sent, err := sessions.Send(u, input)
+	switch err {
+	case nil:
+	case services.ErrMobileBacklog:
+		w.Header().Set(RetryAfterHeader, "1")
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	default:
+		l.Printf("failed to send to the session of %s: %s", u.ID(), err)
+		w.Header().Set(RetryAfterHeader, "60")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
 
-	go session.Start()
+	if sent {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
 
-	go func() {
-		for {
-			var message string
-			err := websocket.Message.Receive(ws, &message)
+// --- }}}
 
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Read fail: %s", err)
-				}
+// --- CommandiOSGET {{{
 
-				close(output) // should this know about output
-				return
-			}
+// CommandiOSGET implements gaia's response to a GET request to the '/command/ios/' endpoint.
+//
+// Assumptions: The user has been authenticated.
+//
+// Proceedings:
+//		Long polls the output of the user's command session. The output numbered after the
+//		'since' parameter, the id of the last output the client received, is returned, or if
+//		there is none, the request waits for some, for the 'wait' parameter, in seconds.
+//
+// Success:
+//		* StatusOK with the CommandiOSResponse as JSON, whose messages are empty if the wait elapsed
+//
+// Errors:
+//		* StatusBadRequest: the since or wait parameter is not a number
+//		* StatusServiceUnavailable: the sessions are stopped, the client may retry
+//		* InternalServerError: json marshalling
+func CommandiOSGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, sessions services.MobileCommandSessions) {
+	l := logger.WithPrefix("CommandiOSGET: ")
 
-			input <- message
-		}
-	}()
+	if !permit(ctx, w, l, services.WriteVerb, CommandiOS) {
+		return
+	}
 
-	for o := range output {
-		err := websocket.Message.Send(ws, o)
+	u, ok := user.FromContext(ctx)
+	if !ok {
+		l.Print("failed to retrieve user from context")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			log.Printf("Write fail: %s", err)
+	var since uint64
+	if s := r.FormValue(sinceParam); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "The since parameter must be the id of an output", http.StatusBadRequest)
 			return
 		}
 	}
+
+	wait := DefaultCommandWait
+	if s := r.FormValue(waitParam); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			http.Error(w, "The wait parameter must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait > MaxCommandWait {
+		wait = MaxCommandWait
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	// the poll ends if the client goes away
+	go func(gone <-chan struct{}) {
+		select {
+		case <-gone:
+			cancel()
+		case <-pollCtx.Done():
+		}
+	}(r.Context().Done())
+
+	output, missed, err := sessions.Poll(pollCtx, u, since)
+	if err != nil {
+		l.Printf("failed to poll the session of %s: %s", u.ID(), err)
+		w.Header().Set(RetryAfterHeader, "60")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if output == nil {
+		output = make([]*services.CommandEnvelope, 0)
+	}
+
+	bytes, err := json.Marshal(&CommandiOSResponse{Messages: output, Missed: missed})
+	if err != nil {
+		l.Printf("error while marshalling json %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
 }
+
+// --- }}}
@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/elos/data"
+)
+
+// The headers with which the /record/query/ endpoint describes pagination
+const (
+	// TotalCountHeader holds the number of records, readable by the user, matching the query,
+	// it is only present if they were counted
+	TotalCountHeader = "X-Total-Count"
+	// NextCursorHeader holds the cursor to the next page, if there is one
+	NextCursorHeader = "X-Next-Cursor"
+)
+
+// ErrInvalidCursor is returned by parseCursor if the token was not produced by a cursor
+var ErrInvalidCursor = errors.New("routes: invalid cursor")
+
+// A cursor is the position of a page of /record/query/ results. A client
+// receives it as an opaque token, and presents it to retrieve the next page.
+//
+// The selection attributes are not recorded, the client re-sends them
+// with each page.
+type cursor struct {
+	Kind  data.Kind `json:"k"`
+	Skip  int       `json:"s"`
+	Limit int       `json:"l"`
+	Order []string  `json:"o,omitempty"`
+	// Count is whether the total is counted, which requires reading every record
+	Count bool `json:"c,omitempty"`
+}
+
+// token encodes the cursor as an opaque, url safe, string
+func (c *cursor) token() string {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		// a cursor is only ever composed of strings and ints
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// parseCursor decodes a token produced by (*cursor).token
+func parseCursor(token string) (*cursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	c := new(cursor)
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.Kind == "" || c.Skip < 0 || c.Limit < 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return c, nil
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -44,6 +45,11 @@ func EventPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, db d
 	// if any tag names have commas, split those
 	tagNames = flatten(mapSplit(tagNames, ","))
 
+	// Verify an api key permits writing events
+	if !permit(ctx, w, l, services.WriteVerb, models.EventKind.String(), Event) {
+		return
+	}
+
 	// Retrieve our user
 	u, ok := user.FromContext(ctx)
 	if !ok {
@@ -77,6 +83,13 @@ func EventPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, db d
 		return
 	}
 
+	// Some events, such as the records of sms deliveries, are only written by gaia
+	if services.ReservedEvent(e.Name) {
+		l.Printf("refused to make an event named %q, which is reserved", e.Name)
+		http.Error(w, fmt.Sprintf("Events named %q are written by gaia, they can't be made by a user", e.Name), http.StatusForbidden)
+		return
+	}
+
 	if e.CreatedAt.IsZero() {
 		e.CreatedAt = time.Now()
 	}
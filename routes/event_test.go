@@ -29,7 +29,7 @@ func TestEventPOST(t *testing.T) {
 	db := mem.NewDB()
 	logger := services.NewTestLogger(t)
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := routes.Authenticate(ctx, w, r, logger, db)
+		ctx, ok := routes.Authenticate(ctx, w, r, logger, db, nil, nil)
 		if !ok {
 			t.Error("routes.Authenticate failed")
 		}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+// ReadyResponse is the response to a GET request to the '/readyz' endpoint
+type ReadyResponse struct {
+	Ready  bool                    `json:"ready"`
+	Checks []*services.CheckResult `json:"checks"`
+}
+
+// --- HealthGET {{{
+
+// HealthGET implements gaia's response to a GET request to the '/healthz' endpoint.
+//
+// Assumptions: None, it is a liveness probe.
+//
+// Proceedings: Responds, without consulting any dependency, so that a
+// failing dependency does not get gaia restarted.
+//
+// Success:
+//		* StatusOK with {"ok":true}
+func HealthGET(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// --- }}}
+
+// --- ReadyGET {{{
+
+// ReadyGET implements gaia's response to a GET request to the '/readyz' endpoint.
+//
+// Assumptions: None, it is a readiness probe.
+//
+// Proceedings: Checks each of gaia's dependencies.
+//
+// Success:
+//		* StatusOK with the ReadyResponse as JSON, every dependency is ready
+//
+// Errors:
+//		* ServiceUnavailable with the ReadyResponse as JSON, a dependency is not ready
+//		* InternalServerError: json marshalling
+func ReadyGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, readiness services.Readiness) {
+	l := logger.WithPrefix("ReadyGET: ")
+
+	resp := &ReadyResponse{
+		Ready:  true,
+		Checks: readiness.Check(ctx),
+	}
+
+	for _, c := range resp.Checks {
+		if !c.Ready {
+			l.Warn("dependency is not ready", "dependency", c.Name, "error", c.Error)
+			resp.Ready = false
+		}
+	}
+
+	bytes, err := json.MarshalIndent(resp, "", "	")
+	if err != nil {
+		l.Printf("error while marshalling json %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+// --- }}}
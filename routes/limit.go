@@ -0,0 +1,60 @@
+package routes
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/elos/gaia/services"
+)
+
+// RetryAfterHeader tells a rate limited client how many seconds to wait before trying again
+const RetryAfterHeader = "Retry-After"
+
+// ipKey is the rate limiter key of the client's ip
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// publicKey is the rate limiter key of a credential's public value
+func publicKey(public string) string {
+	return "public:" + public
+}
+
+// allowed checks the limiter, if there is one, and if the keys are locked out
+// responds with StatusTooManyRequests, and how long to wait before retrying
+func allowed(w http.ResponseWriter, l services.Logger, limiter services.RateLimiter, keys ...string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	wait, ok := limiter.Allow(keys...)
+	if ok {
+		return true
+	}
+
+	l.Printf("rate limited %v for %s", keys, wait)
+	w.Header().Set(RetryAfterHeader, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+// failed records a failed attempt under the keys, if there is a limiter
+func failed(limiter services.RateLimiter, keys ...string) {
+	if limiter != nil {
+		limiter.Fail(keys...)
+	}
+}
+
+// succeeded forgets the failed attempts under the keys, if there is a limiter
+func succeeded(limiter services.RateLimiter, keys ...string) {
+	if limiter != nil {
+		limiter.Succeed(keys...)
+	}
+}
@@ -1,7 +1,6 @@
 package routes
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/elos/data"
@@ -24,7 +23,12 @@ func cookie(s *models.Session) *http.Cookie {
 	}
 }
 
+// session retrieves the session of the request's bearer token, or otherwise of its session cookie
 func session(r *http.Request, db data.DB) (*models.Session, error) {
+	if token, ok := bearerToken(r); ok {
+		return models.SessionForToken(db, token)
+	}
+
 	c, err := r.Cookie(sessionCookie)
 	if err != nil {
 		return nil, err
@@ -32,15 +36,26 @@ func session(r *http.Request, db data.DB) (*models.Session, error) {
 	return models.SessionForToken(db, c.Value)
 }
 
-func LoginPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, webui services.WebUIClient) {
+// LoginPOST forwards the login to the web ui. If the limiter is not nil, failed logins are
+// limited per client ip and per public value. A login is taken to have succeeded if the
+// web ui set the session cookie.
+func LoginPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, webui services.WebUIClient, limiter services.RateLimiter) {
+	l := logger.WithPrefix("LoginPOST: ")
+
 	if err := r.ParseForm(); err != nil {
-		log.Printf("r.ParseForm error: %v", err)
+		l.Printf("r.ParseForm error: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	public := r.FormValue("public")
+	keys := []string{ipKey(r), publicKey(public)}
+	if !allowed(w, l, limiter, keys...) {
+		return
+	}
+
 	resp, err := webui.LoginPOST(ctx, &records.LoginPOSTRequest{
-		Public:  r.FormValue("public"),
+		Public:  public,
 		Private: r.FormValue("private"),
 	})
 	if err != nil {
@@ -48,7 +63,62 @@ func LoginPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, webu
 		return
 	}
 
-	resp.ServeHTTP(w, r)
+	if limiter == nil {
+		resp.ServeHTTP(w, r)
+		return
+	}
+
+	// watch the response, to learn whether the login succeeded
+	lw := &loginWriter{ResponseWriter: w}
+	resp.ServeHTTP(lw, r)
+	if !lw.written {
+		lw.check()
+	}
+
+	if lw.session {
+		succeeded(limiter, keys[1])
+	} else {
+		l.Printf("login of %q failed", public)
+		failed(limiter, keys...)
+	}
+}
+
+// loginWriter is a ResponseWriter which records whether the response set the session cookie
+type loginWriter struct {
+	http.ResponseWriter
+	written, session bool
+}
+
+// check records whether the headers set the session cookie, once they are written
+func (lw *loginWriter) check() {
+	lw.written = true
+	lw.session = setsSession(lw.Header())
+}
+
+func (lw *loginWriter) WriteHeader(status int) {
+	if !lw.written {
+		lw.check()
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loginWriter) Write(b []byte) (int, error) {
+	if !lw.written {
+		lw.check()
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+// setsSession determines whether the headers set the session cookie
+func setsSession(h http.Header) bool {
+	resp := &http.Response{Header: h}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie && c.Value != "" {
+			return true
+		}
+	}
+
+	return false
 }
 
 func LoginGET(ctx context.Context, w http.ResponseWriter, r *http.Request, webui services.WebUIClient) {
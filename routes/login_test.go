@@ -23,7 +23,7 @@ func TestLoginPOST(t *testing.T) {
 	logger := services.NewTestLogger(t)
 	m := http.NewServeMux()
 	m.Handle("/login/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := routes.Authenticate(ctx, w, r, logger, db)
+		ctx, ok := routes.Authenticate(ctx, w, r, logger, db, nil, nil)
 		if !ok {
 			t.Fatal("bad authentication")
 		}
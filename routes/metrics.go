@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/elos/data"
+	"github.com/elos/gaia/services"
+	"github.com/elos/models"
+	"github.com/elos/models/access"
+	"golang.org/x/net/context"
+)
+
+// PrometheusContentType is the content type of the Prometheus text exposition format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// --- MetricsGET {{{
+
+// MetricsGET implements gaia's response to a GET request to the '/metrics' endpoint.
+//
+// Assumptions: The endpoint is only reachable by the monitoring system.
+//
+// Proceedings: Writes every one of gaia's metrics.
+//
+// Success:
+//		* StatusOK with the metrics in the Prometheus text format
+//
+// Errors:
+//		* The response is cut short if writing the metrics fails
+func MetricsGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, metrics services.Metrics) {
+	l := logger.WithPrefix("MetricsGET: ")
+
+	w.Header().Set("Content-Type", PrometheusContentType)
+	w.WriteHeader(http.StatusOK)
+
+	if err := metrics.WritePrometheus(w); err != nil {
+		l.Error("failed to write metrics", "error", err)
+	}
+}
+
+// --- }}}
+
+// denied counts a record of the kind which access control denied a request to the endpoint at the path
+func denied(ctx context.Context, kind data.Kind, path string) {
+	services.MetricsFromContext(ctx).Inc(services.AccessDenialsMetric, kind.String(), path)
+}
+
+// canRead is access.CanRead, counting the records it denies a request to the endpoint at the path
+func canRead(ctx context.Context, db data.DB, u *models.User, r data.Record, path string) (bool, error) {
+	ok, err := access.CanRead(db, u, r)
+	if err == nil && !ok {
+		denied(ctx, r.Kind(), path)
+	}
+
+	return ok, err
+}
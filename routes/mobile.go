@@ -21,6 +21,11 @@ const (
 )
 
 func MobileLocationPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger, db data.DB) {
+	// Verify an api key permits posting locations
+	if !permit(ctx, w, l, services.WriteVerb, MobileLocation) {
+		return
+	}
+
 	// Parse the form value
 	if err := r.ParseForm(); err != nil {
 		l.Printf("MobileLocationPOST Error: %s", err)
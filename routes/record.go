@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/elos/data"
@@ -29,26 +30,64 @@ const (
 	idParam = "id"
 
 	// /record/query/ specific:
-	limitParam = "limit"
-	batchParam = "batch"
-	skipParam  = "skip"
-
-	// /record/changes/ specific:
+	limitParam  = "limit"
+	batchParam  = "batch"
+	skipParam   = "skip"
+	orderParam  = "order"
+	cursorParam = "cursor"
+	countParam  = "count"
+
+	// publicParam and privateParam are the deprecated credential parameters, see Authenticate
 	publicParam  = "public"
 	privateParam = "private"
+
+	// /record/changes/ and /command/ios/ specific:
+	sinceParam = "since"
+)
+
+// The Server-Sent Events the /record/changes/ endpoint uses
+const (
+	// EventStreamContentType is the media type of Server-Sent Events
+	EventStreamContentType = "text/event-stream"
+
+	// lastEventIDHeader is set by an EventSource when it reconnects, to the id of the last event
+	lastEventIDHeader = "Last-Event-ID"
+
+	// changeEvent is the name of the events which carry a change
+	changeEvent = "change"
+	// resetEvent is the name of the event which says changes were missed, see ChangeTransport
+	resetEvent = "reset"
 )
 
 // --- }}}
 
 // --- Authenticate {{{
 
-// Authenticate checks a request's basic authentication, and associates a *models.User with the context
+// bearerScheme is the scheme of an Authorization header carrying a session token
+const bearerScheme = "Bearer"
+
+// Authenticate checks a request's credentials, and associates a *models.User with the context
 // if so. Otherwise it handles responding to and closing the request.
 //
-//		contextWithUser, authWasSuccessful := routes.Authenticate(ctx, w, r, logger, db)
+//		contextWithUser, authWasSuccessful := routes.Authenticate(ctx, w, r, logger, db, keys, limiter)
+//
+// The credentials are considered in order:
+//		* bearer authentication, with the token of an api key (if keys is not nil)
+//		* basic authentication, with a credential's public and private values
+//		* bearer authentication, with the token of a session
+//		* the elos-session-token cookie
+//		* the public and private parameters (deprecated, they end up in logs)
+//
+// Use for any requests which expect to act on behalf of a user (which is most),
+// including websockets, which should be authenticated before they are upgraded.
+//
+// A request authenticated by an api key is limited to the key's scopes, see Permitted.
 //
-// Use for any requests which expect to act on behalf of a user (which is most)
-func Authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger, db services.DB) (context.Context, bool) {
+// If the limiter is not nil, failed attempts are limited per client ip and per credential
+// public value, a client which is locked out receives StatusTooManyRequests. A bearer token
+// or cookie of an api key or session which doesn't exist counts against the client ip.
+func Authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, l services.Logger, db services.DB,
+	keys services.APIKeys, limiter services.RateLimiter) (context.Context, bool) {
 	l = l.WithPrefix("routes.Authenticate: ")
 	var (
 		c   *models.Credential
@@ -56,39 +95,69 @@ func Authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, l
 		err error
 	)
 
+	ip := ipKey(r)
+	if !allowed(w, l, limiter, ip) {
+		return nil, false
+	}
+
+	if token, ok := bearerToken(r); ok && keys != nil && services.IsAPIKeyToken(token) {
+		keyContext, err := authenticateAPIKey(ctx, db, keys, token)
+		switch err {
+		case nil:
+		// the key, or its owner, doesn't exist
+		case services.ErrAPIKeyNotFound, data.ErrNotFound:
+			l.Printf("authentication by api key failed: %s", err)
+			failed(limiter, ip)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return nil, false
+		default:
+			l.Printf("authenticateAPIKey error: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil, false
+		}
+
+		return keyContext, true
+	}
+
 	public, private, ok := r.BasicAuth()
 	if !ok {
 		l.Printf("authentication reverting from basic auth to session")
 		// assume std lib didn't make a mistake, and the BasicAuth simply wasn't given
-		// fall back to cookie
+		// fall back to a bearer token, then to the cookie
 
 		if sesh, err := session(r, db); err != nil {
 			switch err {
 			case http.ErrNoCookie:
-				l.Printf("no session cookie")
+				l.Printf("no session token or cookie")
 			case data.ErrNotFound:
+				// a token which was never issued may be a guess, an expired one isn't counted,
+				// lest a client with a stale cookie be locked out before it logs in again
 				l.Printf("session token not found")
+				failed(limiter, ip)
 			default:
 				l.Printf("session(r, db) error: %s", err)
 			}
 
-			l.Printf("authentication reverting from cookie to form values")
-			public, private = r.FormValue(publicParam), r.FormValue(privateParam)
+			public, private = formCredentials(r, l)
 		} else if sesh.Valid() {
 			if u, err := sesh.Owner(db); err != nil {
 				l.Printf("sesh.Owner(db) error: %s", err)
-				public, private = r.FormValue(publicParam), r.FormValue(privateParam)
+				public, private = formCredentials(r, l)
 			} else {
 				return user.NewContext(ctx, u), true
 			}
 		} else {
 			l.Printf("session no longer valid")
-			public, private = r.FormValue(publicParam), r.FormValue(privateParam)
+			public, private = formCredentials(r, l)
 		}
 	}
 
+	if public != "" && !allowed(w, l, limiter, ip, publicKey(public)) {
+		return nil, false
+	}
+
 	if c, err = access.Authenticate(db, public, private); err != nil {
-		l.Printf("authentication of (%s, %s) failed: couldn't find credential: %s", public, private, err)
+		l.Printf("authentication of %q failed: couldn't find credential: %s", public, err)
 		goto unauthorized // this error is on us, but it manifests as a failure to authenticate
 	}
 
@@ -98,14 +167,42 @@ func Authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, l
 	}
 
 	// successful authentications
+	succeeded(limiter, publicKey(public))
 	return user.NewContext(ctx, u), true
 
 	// rejection
 unauthorized:
+	// only attempts which present credentials count against the client
+	if public != "" {
+		failed(limiter, ip, publicKey(public))
+	}
 	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 	return nil, false
 }
 
+// bearerToken retrieves the token of an 'Authorization: Bearer <token>' header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(bearerScheme)+1 || !strings.EqualFold(auth[:len(bearerScheme)+1], bearerScheme+" ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len(bearerScheme)+1:]), true
+}
+
+// formCredentials retrieves the deprecated public and private parameters. They
+// are still honored, but the request's url ends up in logs, credentials and all.
+func formCredentials(r *http.Request, l services.Logger) (string, string) {
+	l.Printf("authentication reverting from session to form values")
+
+	public, private := r.FormValue(publicParam), r.FormValue(privateParam)
+	if public != "" || private != "" {
+		l.Printf("DEPRECATED: authenticating %q with the public and private parameters, use basic auth, a bearer token or the session cookie", public)
+	}
+
+	return public, private
+}
+
 // --- }}}
 
 // --- RecordGET {{{
@@ -124,6 +221,7 @@ unauthorized:
 //		* InternalServerError: failure to parse the parameters, database connections, json marshalling
 //		* BadRequest: no kind param, no id param, unrecognized kind, invalid id
 //		* NotFound: unauthorized, record actually doesn't exist
+//		* Forbidden: an api key does not permit reading the kind
 func RecordGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, db services.DB) {
 	l := logger.WithPrefix("RecordGet: ")
 
@@ -158,6 +256,11 @@ func RecordGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logg
 		return
 	}
 
+	// Ensure an api key permits reading the kind
+	if !permit(ctx, w, l, services.ReadVerb, kind.String(), Record) {
+		return
+	}
+
 	// Ensure the id is valid
 	id, err := db.ParseID(i)
 	if err != nil {
@@ -200,7 +303,7 @@ func RecordGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logg
 
 	// Now we impose the system access control, beyond the database access control
 	// TODO: limit the domain of errors CanRead returns
-	if allowed, err := access.CanRead(db, u, m); err != nil {
+	if allowed, err := canRead(ctx, db, u, m, Record); err != nil {
 		switch err {
 		// Again, though odd, both of these are arguably expected
 		case data.ErrAccessDenial:
@@ -239,6 +342,54 @@ func RecordGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logg
 
 // --- }}}
 
+// --- Reserved Records {{{
+
+// reserved determines whether the record, or the record it would replace, is an event which
+// only gaia writes, such as the record of an sms delivery
+func reserved(db data.DB, m data.Record) (bool, error) {
+	if m.Kind() != models.EventKind {
+		return false, nil
+	}
+
+	if e, ok := m.(*models.Event); ok && services.ReservedEvent(e.Name) {
+		return true, nil
+	}
+
+	if m.ID().String() == "" {
+		return false, nil
+	}
+
+	stored := models.NewEvent()
+	stored.SetID(m.ID())
+	switch err := db.PopulateByID(stored); err {
+	case nil:
+		return services.ReservedEvent(stored.Name), nil
+	case data.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// refuseReserved responds with StatusForbidden if the record is reserved, see reserved
+func refuseReserved(w http.ResponseWriter, l services.Logger, db data.DB, m data.Record) bool {
+	is, err := reserved(db, m)
+	if err != nil {
+		l.Printf("reserved error: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return true
+	}
+
+	if is {
+		l.Printf("refused to write %s, which is reserved", m.ID())
+		http.Error(w, "The record is written by gaia, it can't be written, or deleted, by a user", http.StatusForbidden)
+	}
+
+	return is
+}
+
+// --- }}}
+
 // --- RecordPOST {{{
 
 // RecordPOST implements gaia's response to a POST request to the '/record/' endpoint.
@@ -258,6 +409,7 @@ func RecordGET(ctx context.Context, w http.ResponseWriter, r *http.Request, logg
 //		* BadRequest: no kind param, unrecognized kind
 //		* NotFound: unauthorized, record actually doesn't exist
 //		* Unauthorized: not authorized to create/update that record, database access denial
+//		* Forbidden: an api key does not permit writing the kind, or the record is gaia's own
 func RecordPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, db services.DB) {
 	l := logger.WithPrefix("RecordPOST: ")
 
@@ -285,6 +437,11 @@ func RecordPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, log
 		return
 	}
 
+	// Verify an api key permits writing the kind
+	if !permit(ctx, w, l, services.WriteVerb, kind.String(), Record) {
+		return
+	}
+
 	m := models.ModelFor(kind)
 
 	var requestBody []byte
@@ -316,6 +473,11 @@ func RecordPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, log
 		creation = true
 	}
 
+	// Some events, such as the records of sms deliveries, are only written by gaia
+	if refuseReserved(w, l, db, m) {
+		return
+	}
+
 	// Retrieve our user
 	u, ok := user.FromContext(ctx)
 	if !ok {
@@ -360,6 +522,7 @@ func RecordPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, log
 		return
 	} else if !allowed {
 		l.Printf("access denied at create/update stage")
+		denied(ctx, kind, Record)
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
@@ -419,6 +582,7 @@ func RecordPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, log
 //		* BadRequest: no kind param, unrecognized kind, no id param, invalid id param
 //		* NotFound: unauthorized, record actually doesn't exist
 //		* Unauthorized: not authorized to delete that record, database access denial
+//		* Forbidden: an api key does not permit writing the kind, or the record is gaia's own
 func RecordDELETE(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, db services.DB) {
 	l := logger.WithPrefix("RecordDELETE: ")
 
@@ -454,6 +618,11 @@ func RecordDELETE(ctx context.Context, w http.ResponseWriter, r *http.Request, l
 		return
 	}
 
+	// Verify an api key permits writing the kind
+	if !permit(ctx, w, l, services.WriteVerb, kind.String(), Record) {
+		return
+	}
+
 	// Verify the id is valid
 	id, err := db.ParseID(i)
 	if err != nil {
@@ -490,6 +659,10 @@ func RecordDELETE(ctx context.Context, w http.ResponseWriter, r *http.Request, l
 		return
 	}
 
+	if refuseReserved(w, l, db, m) {
+		return
+	}
+
 	// check for authorization
 	if allowed, err := access.CanDelete(db, u, m); err != nil {
 		// TODO(nclandolfi) standardize this with the POST and GET where we handle the possible errors
@@ -497,6 +670,7 @@ func RecordDELETE(ctx context.Context, w http.ResponseWriter, r *http.Request, l
 		http.Error(w, "database error", http.StatusInternalServerError)
 		return
 	} else if !allowed {
+		denied(ctx, m.Kind(), Record)
 		// in order to not leak information, we treat this as a not found
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -552,14 +726,26 @@ func RecordOPTIONS(ctx context.Context, w http.ResponseWriter, r *http.Request)
 //
 // Assumptions: The user has been authenticated.
 //
-// Proceedings:
+// Proceedings: Parses the url parameters, retrieving the kind (required), and the limit, skip,
+// batch, order, cursor and count parameters (all optional). The selection attributes are read from the body,
+// they may be exact values or operators (see parseSelection).
+// The limit and skip apply to the records the user can read, in the given order. A cursor, as given in
+// the X-Next-Cursor header of a previous response, replaces the skip, order and count parameters.
+// The query is read until the page is full, and one more record shows there is another page, unless
+// the count parameter asks for the total, which requires reading every record.
 //
 // Success:
-//		* StatusOK
+//		* StatusOK with a JSON array of the records, the X-Total-Count header is the number of records
+//		  the user can read which match the query, if it was counted, or the page is the last. If there
+//		  are more records, the X-Next-Cursor header is the cursor to the next page.
+//		* StatusOK with a stream of QueryLines, if the request accepts application/x-ndjson. Errors
+//		  after the first record has been written are reported by the last line of the stream.
 //
 // Error:
-//		* InternalServerError: parsing url params,
-//		* BadRequest: no kind parameter, unrecognized kind
+//		* InternalServerError: parsing url params, reading the body, database connections, json marshalling
+//		* BadRequest: no kind parameter, unrecognized kind, invalid limit, skip, batch or count, invalid
+//		  cursor, invalid selection
+//		* Forbidden: an api key does not permit reading the kind
 func RecordQueryPOST(ctx context.Context, w http.ResponseWriter, r *http.Request, logger services.Logger, db data.DB) {
 	l := logger.WithPrefix("RecordQueryPOST: ")
 
@@ -586,19 +772,57 @@ func RecordQueryPOST(ctx context.Context, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Retrieve the limit, batch and skip parameters
-	lim := r.FormValue(limitParam)
-	bat := r.FormValue(batchParam)
-	ski := r.FormValue(skipParam)
+	// Verify an api key permits reading the kind
+	if !permit(ctx, w, l, services.ReadVerb, kind.String(), RecordQuery) {
+		return
+	}
+
+	// Retrieve the limit, batch and skip parameters, which all compose
+	page := &cursor{
+		Kind:  kind,
+		Order: r.Form[orderParam],
+	}
+	var batch int
+	for param, into := range map[string]*int{
+		limitParam: &page.Limit,
+		batchParam: &batch,
+		skipParam:  &page.Skip,
+	} {
+		if v := r.FormValue(param); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				l.Printf("invalid %s parameter: %q", param, v)
+				http.Error(w, fmt.Sprintf("The %s %q is invalid", param, v), http.StatusBadRequest)
+				return
+			}
+			*into = i
+		}
+	}
 
-	// Set up the variables to apply to the query
-	var limit, batch, skip int
-	if lim != "" {
-		limit, _ = strconv.Atoi(lim)
-	} else if bat != "" {
-		batch, _ = strconv.Atoi(bat)
-	} else if ski != "" {
-		skip, _ = strconv.Atoi(ski)
+	if v := r.FormValue(countParam); v != "" {
+		count, err := strconv.ParseBool(v)
+		if err != nil {
+			l.Printf("invalid %s parameter: %q", countParam, v)
+			http.Error(w, fmt.Sprintf("The %s %q is invalid", countParam, v), http.StatusBadRequest)
+			return
+		}
+		page.Count = count
+	}
+
+	// A cursor picks up where a previous page left off
+	if token := r.FormValue(cursorParam); token != "" {
+		c, err := parseCursor(token)
+		if err != nil || c.Kind != kind {
+			l.Printf("invalid cursor: %q", token)
+			http.Error(w, fmt.Sprintf("The %s %q is invalid", cursorParam, token), http.StatusBadRequest)
+			return
+		}
+
+		// an explicit limit may change the size of the pages
+		if r.FormValue(limitParam) != "" {
+			c.Limit = page.Limit
+		}
+		page = c
 	}
 
 	// Read the selection attrs from the body
@@ -624,6 +848,14 @@ func RecordQueryPOST(ctx context.Context, w http.ResponseWriter, r *http.Request
 		}
 	}
 
+	// Parse the exact matches and the operators of the selection
+	sel, err := parseSelection(kind, attrs)
+	if err != nil {
+		l.Printf("invalid selection: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Retrieve the user we are acting on behalf
 	u, ok := user.FromContext(ctx)
 	if !ok {
@@ -632,55 +864,121 @@ func RecordQueryPOST(ctx context.Context, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Load our actual query
-	var iter data.Iterator
-	if iter, err = db.Query(kind).Select(attrs).Limit(limit).Batch(batch).Skip(skip).Order(r.Form["order"]...).Execute(); err != nil {
-		l.Printf("db.Query(%q).Select(%v).Limit(%d).Batch(%d).Skip(%d) error: %s", kind, attrs, limit, batch, skip, err)
+	if err := sel.resolveTags(db, u); err != nil {
+		l.Printf("error resolving tags: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprint(w, "[")
-
-	first := true
+	// Load our actual query. The whole of the selection is given to the database, but
+	// the skip and limit can't be, they must count only the records which the user can
+	// read, so it is read only as far as is needed.
+	selector := sel.selector(kind)
+	var iter data.Iterator
+	if iter, err = db.Query(kind).Select(selector).Batch(batch).Order(page.Order...).Execute(); err != nil {
+		l.Printf("db.Query(%q).Select(%v).Batch(%d).Order(%v) error: %s", kind, selector, batch, page.Order, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
-	// Iterator through the results and write the response
+	// Iterate through the results, writing those on the page
+	out := newQueryWriter(w, r)
+	total := 0
+	more := false
 	m := models.ModelFor(kind)
 	for iter.Next(m) {
-		if !first {
-			fmt.Fprint(w, ",")
-		}
-		first = false
-		if ok, err := access.CanRead(db, u, m); err != nil {
+		if ok, err := canRead(ctx, db, u, m, RecordQuery); err != nil {
 			// We've hit an error and need to bail
 			l.Printf("access.CanRead error: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			iter.Close()
+			out.fail(http.StatusInternalServerError)
 			return
-		} else if ok {
+		} else if !ok {
+			continue
+		}
+
+		if total >= page.Skip && (page.Limit == 0 || total < page.Skip+page.Limit) {
 			bytes, err := json.Marshal(m)
 			if err != nil {
 				l.Printf("error marshalling JSON: %s", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				iter.Close()
+				out.fail(http.StatusInternalServerError)
 				return
 			}
-			w.Write(bytes)
+			out.write(bytes)
+		}
+
+		total++
+		m = models.ModelFor(kind)
+
+		// the record after the page proves there is another, unless
+		// the total was asked for, there is no need to read further
+		if !page.Count && page.Limit > 0 && total > page.Skip+page.Limit {
+			more = true
+			break
 		}
 	}
 
 	if err := iter.Close(); err != nil {
 		l.Printf("error closing query, %s", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		out.fail(http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprint(w, "]")
+	var nextCursor string
+	if page.Limit > 0 && page.Skip+page.Limit < total {
+		next := *page
+		next.Skip += page.Limit
+		nextCursor = next.token()
+	}
+
+	// the total is unknown if the query wasn't read to its end
+	if more {
+		total = unknownTotal
+	}
+
+	out.finish(total, nextCursor)
 }
 
 // --- }}}
 
 // --- {Contextualize}RecordChangesGET {{{
 
-func ContextualizeRecordChangesGET(ctx context.Context, db data.DB, logger services.Logger) websocket.Handler {
+// ChangeTransport is the wire format of a change sent on the /record/changes/ endpoint.
+// The seq may be given as the since parameter, to resume after this change.
+//
+// If the changes after the since couldn't be resumed, the first transport is a reset, which
+// carries only its seq. Changes were missed, so the client should reload its records, the
+// changes which follow are those after the reset's seq.
+type ChangeTransport struct {
+	Seq        uint64                 `json:"seq"`
+	Reset      bool                   `json:"reset,omitempty"`
+	ChangeKind data.ChangeKind        `json:"change_kind"`
+	RecordKind data.Kind              `json:"record_kind"`
+	Record     map[string]interface{} `json:"record"`
+}
+
+// changeTransport constructs the wire format of a *services.SequencedChange
+func changeTransport(c *services.SequencedChange) (*ChangeTransport, error) {
+	t := &ChangeTransport{
+		Seq:        c.Seq,
+		ChangeKind: c.ChangeKind,
+		RecordKind: c.Record.Kind(),
+		Record:     make(map[string]interface{}),
+	}
+
+	if err := transfer.TransferAttrs(c.Record, &t.Record); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// ContextualizeRecordChangesGET constructs the websocket handler of the '/record/changes/' endpoint.
+//
+// The context must hold the authenticated user, the request should go through Authenticate
+// before it is upgraded, so that a failure to authenticate is an ordinary StatusUnauthorized.
+func ContextualizeRecordChangesGET(ctx context.Context, db data.DB, changes services.ChangeJournal, logger services.Logger) websocket.Handler {
 	return func(ws *websocket.Conn) {
 		defer ws.Close()
 
@@ -691,29 +989,18 @@ func ContextualizeRecordChangesGET(ctx context.Context, db data.DB, logger servi
 			return
 		}
 
-		public := ws.Request().Form.Get(publicParam)
-		private := ws.Request().Form.Get(privateParam)
-
-		if public == "" || private == "" {
-			l.Print("failed to retrieve credentials")
-			return
-		}
-
-		cred, err := access.Authenticate(db, public, private)
-		if err != nil {
-			l.Print("failed to authenticate")
-			return
-		}
-
-		if u, err := cred.Owner(db); err != nil {
-			l.Print("error retrieving user: %s", err)
-		} else {
-			RecordChangesGET(user.NewContext(ctx, u), ws, db, logger)
-		}
+		RecordChangesGET(ctx, ws, db, changes, logger)
 	}
 }
 
-func RecordChangesGET(ctx context.Context, ws *websocket.Conn, db data.DB, logger services.Logger) {
+// RecordChangesGET implements gaia's response to a websocket connection to the '/record/changes/' endpoint.
+//
+// Assumptions: The user has been authenticated, the request's form has been parsed.
+//
+// Proceedings: Sends each change to a record the user can read, as a ChangeTransport. If the kind
+// parameter is given, only changes to records of that kind are sent. If the since parameter is given,
+// the journaled changes after that sequence number are sent first, or a reset, if they weren't all journaled.
+func RecordChangesGET(ctx context.Context, ws *websocket.Conn, db data.DB, changes services.ChangeJournal, logger services.Logger) {
 	l := logger.WithPrefix("RecordChangesGet: ")
 
 	u, ok := user.FromContext(ctx)
@@ -722,55 +1009,136 @@ func RecordChangesGET(ctx context.Context, ws *websocket.Conn, db data.DB, logge
 		return
 	}
 
-	// Get the db's changes, then filter by updates, then
-	// filter by whether this user can read the record
-	changes := data.Filter(db.Changes(), func(c *data.Change) bool {
-		ok, err := access.CanRead(db, u, c.Record)
-		if err != nil {
-			l.Printf("error checking access control: %s", err)
+	kind, since, err := changesParams(ws.Request())
+	if err != nil {
+		l.Print(err)
+		if err := websocket.Message.Send(ws, err.Error()); err != nil {
+			if err != io.EOF {
+				l.Printf("error sending on websocket: %s", err)
+			}
 		}
-		return ok
+		return
+	}
+
+	streamChanges(ctx, db, changes, u, kind, since, l, func(t *ChangeTransport) error {
+		return websocket.JSON.Send(ws, t)
+	}, func() error {
+		l.Printf("no change in 5 seconds, but still listening")
+		return nil
 	})
+}
 
+// changesParams retrieves the optional kind and since parameters of a request to the
+// /record/changes/ endpoint. The since may also be given by the Last-Event-ID header,
+// which an EventSource sets when it reconnects.
+func changesParams(r *http.Request) (data.Kind, uint64, error) {
 	var kind data.Kind
-	if kindParam := ws.Request().Form.Get(kindParam); kindParam != "" {
-		kind = data.Kind(kindParam)
+	if k := r.FormValue(kindParam); k != "" {
+		kind = data.Kind(k)
 
 		if _, ok := models.Kinds[kind]; !ok {
-			l.Printf("unrecognized kind: %q", kind)
-			if err := websocket.Message.Send(ws, fmt.Sprintf("The kind %q is not recognized", kind)); err != nil {
-				if err != io.EOF {
-					l.Printf("error sending on websocket: %s", err)
-				}
+			return kind, 0, fmt.Errorf("The kind %q is not recognized", kind)
+		}
+	}
+
+	s := r.FormValue(sinceParam)
+	if s == "" {
+		s = r.Header.Get(lastEventIDHeader)
+	}
+
+	var since uint64
+	if s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return kind, 0, fmt.Errorf("The since %q is invalid", s)
+		}
+	}
+
+	return kind, since, nil
+}
+
+// streamChanges sends each change to a record the user can read, of the kind if one is given, after
+// the since if one is given. If the changes after the since can't be resumed, a reset is sent first.
+// It calls heartbeat if there have been no changes for a while. It returns once the context is done,
+// the journal drops the subscription, or either function returns an error.
+func streamChanges(ctx context.Context, db data.DB, changes services.ChangeJournal, u *models.User, kind data.Kind, since uint64,
+	l services.Logger, send func(*ChangeTransport) error, heartbeat func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	backlog, live, reset := changes.Subscribe(ctx, since)
+
+	if reset != 0 {
+		l.Printf("the changes after %d were missed, resetting to %d", since, reset)
+		if err := send(&ChangeTransport{Seq: reset, Reset: true}); err != nil {
+			if err != io.EOF {
+				l.Printf("error sending reset: %s", err)
 			}
 			return
 		}
+	}
+
+	// forward filters the change by kind and by whether this user (and api key) can
+	// read the record, it is false if the change can no longer be sent
+	forward := func(c *services.SequencedChange) bool {
+		if kind != "" && c.Record.Kind() != kind {
+			return true
+		}
+
+		if !Permitted(ctx, services.ReadVerb, c.Record.Kind().String(), RecordChanges) {
+			return true
+		}
+
+		// every user's changes pass through the filter, so most of its denials are of other
+		// users' records, they are counted apart from those of requests for a record
+		if ok, err := canRead(ctx, db, u, c.Record, RecordChanges); err != nil {
+			l.Printf("error checking access control: %s", err)
+			return true
+		} else if !ok {
+			return true
+		}
+
+		l.Printf("recieved change: %+v", c)
+
+		t, err := changeTransport(c)
+		if err != nil {
+			l.Printf("error transferring change: %s", err)
+			return true
+		}
+
+		if err := send(t); err != nil {
+			if err != io.EOF {
+				l.Printf("error sending change: %s", err)
+			}
+
+			return false
+		}
+
+		return true
+	}
 
-		// If a kind was specified, filter by it
-		changes = data.FilterKind(changes, kind)
+	for _, c := range backlog {
+		if !forward(c) {
+			return
+		}
 	}
 
 	for {
 		select {
-		case change, ok := <-*changes:
+		case c, ok := <-live:
 			if !ok {
 				l.Printf("change channel was closed")
 				return
 			}
 
-			l.Printf("recieved change: %+v", change)
-
-			changeTransport := transfer.Change(change)
-
-			if err := websocket.JSON.Send(ws, changeTransport); err != nil {
-				if err != io.EOF {
-					l.Printf("error sending to socket: %s", err)
-				}
-
+			if !forward(c) {
 				return
 			}
 		case <-time.After(5 * time.Second):
-			l.Printf("no change in 5 seconds, but still listening")
+			if err := heartbeat(); err != nil {
+				l.Printf("error sending heartbeat: %s", err)
+				return
+			}
 		case <-ctx.Done():
 			l.Printf("context cancelled")
 			// context was cancelled
@@ -780,3 +1148,98 @@ func RecordChangesGET(ctx context.Context, ws *websocket.Conn, db data.DB, logge
 }
 
 // --- }}}
+
+// --- RecordChangesEventStreamGET {{{
+
+// RecordChangesEventStreamGET implements gaia's response to a GET request to the '/record/changes/'
+// endpoint which accepts text/event-stream, it is the Server-Sent Events alternative to the websocket.
+//
+// Assumptions: The user has been authenticated.
+//
+// Proceedings: Sends the same changes as RecordChangesGET, each as an event whose id is the change's
+// sequence number and whose data is the ChangeTransport. A reset is sent as a reset event.
+//
+// Success:
+//		* StatusOK, followed by the events
+//
+// Errors:
+//		* InternalServerError: the response can not be streamed, failure to retrieve the user
+//		* BadRequest: unrecognized kind, invalid since
+//		* Forbidden: an api key does not permit reading the kind
+func RecordChangesEventStreamGET(ctx context.Context, w http.ResponseWriter, r *http.Request, db data.DB, changes services.ChangeJournal, logger services.Logger) {
+	l := logger.WithPrefix("RecordChangesEventStreamGET: ")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		l.Print("response writer can not flush")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	u, ok := user.FromContext(ctx)
+	if !ok {
+		l.Print("failed to retrieve user from context")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	kind, since, err := changesParams(r)
+	if err != nil {
+		l.Print(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if kind != "" && !permit(ctx, w, l, services.ReadVerb, kind.String(), RecordChanges) {
+		return
+	}
+
+	// the stream ends if the client goes away
+	if cn, ok := w.(http.CloseNotifier); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		go func(closed <-chan bool) {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}(cn.CloseNotify())
+	}
+
+	w.Header().Set("Content-Type", EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	streamChanges(ctx, db, changes, u, kind, since, l, func(t *ChangeTransport) error {
+		bytes, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+
+		event := changeEvent
+		if t.Reset {
+			event = resetEvent
+		}
+
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", t.Seq, event, bytes); err != nil {
+			return err
+		}
+
+		flusher.Flush()
+		return nil
+	}, func() error {
+		// a comment, which keeps proxies from closing the idle connection
+		if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return err
+		}
+
+		flusher.Flush()
+		return nil
+	})
+}
+
+// --- }}}
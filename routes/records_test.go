@@ -70,7 +70,7 @@ func TestRecordsQueryGET(t *testing.T) {
 	db := mem.NewDB()
 	logger := services.NewTestLogger(t)
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := Authenticate(ctx, w, r, logger, db)
+		ctx, ok := Authenticate(ctx, w, r, logger, db, nil, nil)
 		if !ok {
 			t.Fatal("authentication failed")
 		}
@@ -166,7 +166,7 @@ func TestRecordsNewGET(t *testing.T) {
 	db := mem.NewDB()
 	logger := services.NewTestLogger(t)
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := Authenticate(ctx, w, r, logger, db)
+		ctx, ok := Authenticate(ctx, w, r, logger, db, nil, nil)
 		if !ok {
 			t.Fatal("authentication failed")
 		}
@@ -269,7 +269,7 @@ func TestRecordsEditGET(t *testing.T) {
 	db := mem.NewDB()
 	logger := services.NewTestLogger(t)
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, ok := Authenticate(ctx, w, r, logger, db)
+		ctx, ok := Authenticate(ctx, w, r, logger, db, nil, nil)
 		if !ok {
 			t.Fatal("authentication failed")
 		}
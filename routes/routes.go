@@ -7,14 +7,21 @@ const (
 	Record         = "/record/"
 	RecordQuery    = "/record/query/"
 	RecordChanges  = "/record/changes/"
+	RecordBatch    = "/record/batch/"
 	Event          = "/event/"
 	CommandSMS     = "/command/sms/"
 	CommandWeb     = "/command/web/"
 	CommandiOS     = "/command/ios/"
 	MobileLocation = "/mobile/location/"
+	APIKey         = "/apikey/"
 
-	App   = "/app/"
-	Index = "/"
+	AdminSMSSessions = "/admin/sms/sessions/"
+
+	App     = "/app/"
+	Index   = "/"
+	Metrics = "/metrics"
+	Health  = "/healthz"
+	Ready   = "/readyz"
 
 	// Records Web UI
 	RecordsQuery  = "/records/query/"
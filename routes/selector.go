@@ -0,0 +1,306 @@
+package routes
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/gaia/services"
+	"github.com/elos/models"
+	"github.com/elos/models/access"
+)
+
+// The operators a /record/query/ selector may use, with the semantics of mongo's
+// operators of the same name (see services.SelectorDB). A selector is an object
+// of operators to operands:
+//
+//		{ "created_at": { "$gt": "2016-04-04T00:00:00Z", "$lt": "2016-04-11T00:00:00Z" } }
+const (
+	gtOperator  = services.GtOperator
+	gteOperator = services.GteOperator
+	ltOperator  = services.LtOperator
+	lteOperator = services.LteOperator
+	inOperator  = services.InOperator
+	neOperator  = services.NeOperator
+	// existsOperator selects the records whose field is, or is not, set to other than its zero
+	// value. Every field of a record is stored, so this is what it means for one to exist.
+	existsOperator = "$exists"
+
+	// tagsSelector is a top level key of a query, whose operand is a list of tag
+	// names. A record matches if it includes every one of the named tags.
+	tagsSelector = "$tags"
+	// tagsRelation is the relation a kind must have to be selected by tags
+	tagsRelation = "tags"
+	// tagsField is the attribute holding the ids of a record's tags
+	tagsField = "tags_ids"
+)
+
+// A predicate is a single operator applied to a field
+type predicate struct {
+	field, operator string
+	operand         interface{}
+}
+
+// A selection is the parsed body of a request to the /record/query/ endpoint,
+// the whole of it is given to the database, as its selector.
+type selection struct {
+	exact      data.AttrMap
+	predicates []*predicate
+	tags       []string
+
+	// tagIDs maps each tag name to the ids of the tags of that name
+	tagIDs map[string]map[string]bool
+}
+
+// parseSelection separates the exact matches from the operators of the selection
+// attributes. Operators may only be applied to the traits of the kind, and tags may
+// only be selected on kinds which have them. The operands of a time are parsed.
+func parseSelection(kind data.Kind, attrs data.AttrMap) (*selection, error) {
+	s := &selection{
+		exact: make(data.AttrMap),
+	}
+
+	model, ok := models.Metis[kind]
+	if !ok {
+		return nil, fmt.Errorf("The kind %q is not recognized", kind)
+	}
+
+	for field, value := range attrs {
+		if field == tagsSelector {
+			hasTags := false
+			for _, r := range model.Relations {
+				if r.Name == tagsRelation {
+					hasTags = true
+				}
+			}
+			if !hasTags {
+				return nil, fmt.Errorf("The kind %q does not have tags", kind)
+			}
+
+			names, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("The %q selector must be a list of tag names", tagsSelector)
+			}
+			for _, n := range names {
+				name, ok := n.(string)
+				if !ok {
+					return nil, fmt.Errorf("The %q selector must be a list of tag names", tagsSelector)
+				}
+				s.tags = append(s.tags, name)
+			}
+			continue
+		}
+
+		operators, ok := value.(map[string]interface{})
+		if !ok || !services.IsOperatorMap(operators) {
+			// plain values are matched exactly, as they always have been
+			s.exact[field] = value
+			continue
+		}
+
+		isTrait := false
+		for _, t := range model.Traits {
+			if t.Name == field {
+				isTrait = true
+			}
+		}
+		t, hasField := fieldType(kind, field)
+		if !isTrait || !hasField {
+			return nil, fmt.Errorf("The field %q is not a trait of %q", field, kind)
+		}
+
+		for operator, operand := range operators {
+			if err := checkOperand(operator, operand); err != nil {
+				return nil, err
+			}
+
+			operand, err := convertOperand(t, operator, operand)
+			if err != nil {
+				return nil, err
+			}
+
+			s.predicates = append(s.predicates, &predicate{
+				field:    field,
+				operator: operator,
+				operand:  operand,
+			})
+		}
+	}
+
+	return s, nil
+}
+
+// fieldType is the type of the field of the kind's model which holds the attribute
+func fieldType(kind data.Kind, attr string) (reflect.Type, bool) {
+	t := reflect.TypeOf(models.ModelFor(kind))
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name == attr {
+			return f.Type, true
+		}
+	}
+
+	return nil, false
+}
+
+// checkOperand ensures the operator is recognized, and its operand is sensible
+func checkOperand(operator string, operand interface{}) error {
+	switch operator {
+	case gtOperator, gteOperator, ltOperator, lteOperator:
+		switch operand.(type) {
+		case float64, string:
+			return nil
+		default:
+			return fmt.Errorf("The operand of %q must be a number, string or time", operator)
+		}
+	case inOperator:
+		if _, ok := operand.([]interface{}); !ok {
+			return fmt.Errorf("The operand of %q must be a list", operator)
+		}
+		return nil
+	case neOperator:
+		return nil
+	case existsOperator:
+		if _, ok := operand.(bool); !ok {
+			return fmt.Errorf("The operand of %q must be a boolean", operator)
+		}
+		return nil
+	default:
+		return fmt.Errorf("The operator %q is not recognized", operator)
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// convertOperand parses the operands given to a field of the type time, so that
+// a database compares them as times, not as strings
+func convertOperand(t reflect.Type, operator string, operand interface{}) (interface{}, error) {
+	if t != timeType || operator == existsOperator {
+		return operand, nil
+	}
+
+	convert := func(o interface{}) (interface{}, error) {
+		s, ok := o.(string)
+		if !ok {
+			return nil, fmt.Errorf("The operand of %q must be a time", operator)
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("The operand of %q must be a time: %s", operator, err)
+		}
+		return t, nil
+	}
+
+	list, ok := operand.([]interface{})
+	if !ok {
+		return convert(operand)
+	}
+
+	converted := make([]interface{}, len(list))
+	for i, o := range list {
+		c, err := convert(o)
+		if err != nil {
+			return nil, err
+		}
+		converted[i] = c
+	}
+	return converted, nil
+}
+
+// resolveTags looks up the ids of the selection's tags which the user can read
+func (s *selection) resolveTags(db data.DB, u *models.User) error {
+	s.tagIDs = make(map[string]map[string]bool)
+
+	for _, name := range s.tags {
+		iter, err := db.Query(models.TagKind).Select(data.AttrMap{"name": name}).Execute()
+		if err != nil {
+			return err
+		}
+
+		ids := make(map[string]bool)
+		t := models.ModelFor(models.TagKind)
+		for iter.Next(t) {
+			ok, err := access.CanRead(db, u, t)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+
+			if ok {
+				ids[t.ID().String()] = true
+			}
+			t = models.ModelFor(models.TagKind)
+		}
+
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		s.tagIDs[name] = ids
+	}
+
+	return nil
+}
+
+// selector is the selection as the database's selector, in the form of mongo's. The predicates
+// of a field become its object of operators, while $exists and the tags, which each require
+// their own operators, are the terms of an $and. The tags must be resolved first.
+func (s *selection) selector(kind data.Kind) data.AttrMap {
+	selector := make(data.AttrMap)
+	for field, value := range s.exact {
+		selector[field] = value
+	}
+
+	var and []interface{}
+	for _, p := range s.predicates {
+		if p.operator == existsOperator {
+			and = append(and, map[string]interface{}{p.field: exists(kind, p.field, p.operand.(bool))})
+			continue
+		}
+
+		operators, ok := selector[p.field].(map[string]interface{})
+		if !ok {
+			operators = make(map[string]interface{})
+			selector[p.field] = operators
+		}
+		operators[p.operator] = p.operand
+	}
+
+	// the record must include a tag of every name
+	for _, name := range s.tags {
+		ids := make([]interface{}, 0, len(s.tagIDs[name]))
+		for id := range s.tagIDs[name] {
+			ids = append(ids, id)
+		}
+		and = append(and, map[string]interface{}{tagsField: map[string]interface{}{inOperator: ids}})
+	}
+
+	if len(and) > 0 {
+		selector[services.AndOperator] = and
+	}
+
+	return selector
+}
+
+// exists is the operators which select the records whose field is set, or not
+func exists(kind data.Kind, field string, set bool) map[string]interface{} {
+	t, _ := fieldType(kind, field)
+
+	// a field which was never set may be stored as null
+	unset := []interface{}{nil, reflect.Zero(t).Interface()}
+	if t.Kind() == reflect.Slice {
+		unset = append(unset, reflect.MakeSlice(t, 0, 0).Interface())
+	}
+
+	if set {
+		return map[string]interface{}{services.NinOperator: unset}
+	}
+	return map[string]interface{}{inOperator: unset}
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/models"
+)
+
+// --- TestParseSelection {{{
+
+func TestParseSelection(t *testing.T) {
+	s, err := parseSelection(models.TaskKind, data.AttrMap{
+		"name": "exact",
+		"created_at": map[string]interface{}{
+			"$gt": "2016-04-04T00:00:00Z",
+			"$lt": "2016-04-11T00:00:00Z",
+		},
+	})
+	if err != nil {
+		t.Fatalf("parseSelection error: %s", err)
+	}
+
+	if got, want := s.exact["name"], "exact"; got != want {
+		t.Errorf("s.exact[\"name\"]: got %v, want %v", got, want)
+	}
+	if got, want := len(s.predicates), 2; got != want {
+		t.Errorf("len(s.predicates): got %d, want %d", got, want)
+	}
+
+	cases := map[string]data.AttrMap{
+		"unrecognized operator": {"created_at": map[string]interface{}{"$near": 3.0}},
+		"not a trait":           {"not_a_trait": map[string]interface{}{"$exists": true}},
+		"bad $in operand":       {"name": map[string]interface{}{"$in": "task"}},
+		"bad $exists operand":   {"name": map[string]interface{}{"$exists": "yes"}},
+		"bad $tags operand":     {"$tags": "LOCATION"},
+		"bad time operand":      {"created_at": map[string]interface{}{"$gt": "yesterday"}},
+	}
+
+	for name, attrs := range cases {
+		if _, err := parseSelection(models.TaskKind, attrs); err == nil {
+			t.Errorf("%s: expected parseSelection error", name)
+		}
+	}
+}
+
+// --- }}}
+
+// --- TestSelectionSelector {{{
+
+func TestSelectionSelector(t *testing.T) {
+	s, err := parseSelection(models.TaskKind, data.AttrMap{
+		"name":       "exact",
+		"created_at": map[string]interface{}{"$gt": "2016-04-04T00:00:00Z"},
+		"deadline":   map[string]interface{}{"$exists": false},
+		"$tags":      []interface{}{"LOCATION"},
+	})
+	if err != nil {
+		t.Fatalf("parseSelection error: %s", err)
+	}
+	s.tagIDs = map[string]map[string]bool{"LOCATION": {"1": true}}
+
+	selector := s.selector(models.TaskKind)
+
+	if got, want := selector["name"], "exact"; got != want {
+		t.Errorf("selector[\"name\"]: got %v, want %v", got, want)
+	}
+
+	// the operand of a time is a time, so that it is compared as one
+	gt := selector["created_at"].(map[string]interface{})["$gt"]
+	if got, want := gt, time.Date(2016, 4, 4, 0, 0, 0, 0, time.UTC); !reflect.DeepEqual(got, want) {
+		t.Errorf("the $gt of created_at: got %#v, want %#v", got, want)
+	}
+
+	and, ok := selector["$and"].([]interface{})
+	if !ok || len(and) != 2 {
+		t.Fatalf("selector[\"$and\"]: got %#v, want the terms of $exists and $tags", selector["$and"])
+	}
+	for _, term := range and {
+		term := term.(map[string]interface{})
+		if deadline, ok := term["deadline"]; ok {
+			// a deadline which was never set is the zero time, or null
+			in := deadline.(map[string]interface{})["$in"].([]interface{})
+			if len(in) != 2 || in[0] != nil || in[1] != (time.Time{}) {
+				t.Errorf("the $exists of deadline: got %#v, want $in null or the zero time", deadline)
+			}
+		} else if tags, ok := term["tags_ids"]; !ok || !reflect.DeepEqual(tags, map[string]interface{}{"$in": []interface{}{"1"}}) {
+			t.Errorf("the term of $tags: got %#v, want $in the ids of the tags", term)
+		}
+	}
+}
+
+// --- }}}
@@ -0,0 +1,176 @@
+package routes
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NDJSONContentType is the media type of a streamed response from the /record/query/ endpoint,
+// a client which accepts it receives each record on its own line as soon as it is read
+const NDJSONContentType = "application/x-ndjson"
+
+// flushInterval is the number of records written between flushes of a stream
+const flushInterval = 16
+
+// QueryLine is a single line of a streamed response from the /record/query/ endpoint.
+// Exactly one of the fields is set. Every line but the last holds a record. The last
+// line holds either the summary of the query, or an error. If the stream ends without
+// either, the response was cut short.
+type QueryLine struct {
+	Record  json.RawMessage `json:"record,omitempty"`
+	Error   *QueryError     `json:"error,omitempty"`
+	Summary *QuerySummary   `json:"summary,omitempty"`
+}
+
+// QueryError describes the failure which ended a streamed response, the
+// status is the status code the response would have had, were it not streamed
+type QueryError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// QuerySummary concludes a streamed response, it holds the values of the
+// X-Total-Count and X-Next-Cursor headers of the un-streamed response
+type QuerySummary struct {
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// unknownTotal is the total of a query which wasn't read to its end
+const unknownTotal = -1
+
+// accepts determines whether the request's Accept header lists the media type
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || t != mediaType {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// --- queryWriter {{{
+
+// A queryWriter writes the results of a query to the response
+type queryWriter interface {
+	// write writes a single record, marshalled to JSON
+	write(record json.RawMessage)
+	// fail ends the response with an error
+	fail(status int)
+	// finish ends the response successfully, the total may be unknownTotal
+	finish(total int, nextCursor string)
+}
+
+// newQueryWriter negotiates the format of the response
+func newQueryWriter(w http.ResponseWriter, r *http.Request) queryWriter {
+	if accepts(r, NDJSONContentType) {
+		return &ndjsonWriter{w: w}
+	}
+
+	return &arrayWriter{w: w, records: make([]json.RawMessage, 0)}
+}
+
+// arrayWriter buffers the records, so that it can respond with a JSON
+// array on success or with an error status on failure
+type arrayWriter struct {
+	w       http.ResponseWriter
+	records []json.RawMessage
+}
+
+func (a *arrayWriter) write(record json.RawMessage) {
+	a.records = append(a.records, record)
+}
+
+func (a *arrayWriter) fail(status int) {
+	http.Error(a.w, http.StatusText(status), status)
+}
+
+func (a *arrayWriter) finish(total int, nextCursor string) {
+	bytes, err := json.Marshal(a.records)
+	if err != nil {
+		a.fail(http.StatusInternalServerError)
+		return
+	}
+
+	a.w.Header().Set("Content-Type", "application/json")
+	if total != unknownTotal {
+		a.w.Header().Set(TotalCountHeader, strconv.Itoa(total))
+	}
+	if nextCursor != "" {
+		a.w.Header().Set(NextCursorHeader, nextCursor)
+	}
+	a.w.WriteHeader(http.StatusOK)
+	a.w.Write(bytes)
+}
+
+// ndjsonWriter streams the records as they are written. Until the first
+// record is written it can still fail with an error status, afterwards it
+// ends the stream with an error line.
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	written int
+}
+
+func (n *ndjsonWriter) start() {
+	n.w.Header().Set("Content-Type", NDJSONContentType)
+	n.w.WriteHeader(http.StatusOK)
+	n.enc = json.NewEncoder(n.w)
+}
+
+func (n *ndjsonWriter) flush() {
+	if f, ok := n.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (n *ndjsonWriter) write(record json.RawMessage) {
+	if n.enc == nil {
+		n.start()
+	}
+
+	n.enc.Encode(&QueryLine{Record: record})
+
+	if n.written++; n.written%flushInterval == 0 {
+		n.flush()
+	}
+}
+
+func (n *ndjsonWriter) fail(status int) {
+	if n.enc == nil {
+		http.Error(n.w, http.StatusText(status), status)
+		return
+	}
+
+	n.enc.Encode(&QueryLine{Error: &QueryError{Status: status, Message: http.StatusText(status)}})
+	n.flush()
+}
+
+func (n *ndjsonWriter) finish(total int, nextCursor string) {
+	if n.enc == nil {
+		n.start()
+	}
+
+	summary := &QuerySummary{NextCursor: nextCursor}
+	if total != unknownTotal {
+		summary.Total = &total
+	}
+
+	n.enc.Encode(&QueryLine{Summary: summary})
+	n.flush()
+}
+
+// --- }}}
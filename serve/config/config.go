@@ -0,0 +1,712 @@
+// Package config is the configuration of the gaia server, serve.
+//
+// The configuration is loaded from the defaults, then a JSON file, then the environment, each
+// overriding the last. Every value has an environment variable, the GAIA_ prefixed, upper-cased,
+// path of its JSON key, e.g. GAIA_TWILIO_ACCOUNT_SID for twilio.account_sid. A secret may be
+// given directly, or read from a file by its _file key, e.g. twilio.auth_token_file or
+// GAIA_TWILIO_AUTH_TOKEN_FILE, so that it need not appear in the file or the environment.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elos/gaia/services"
+	"github.com/elos/gaia/services/sms"
+)
+
+// EnvPrefix begins the name of every environment variable of the configuration
+const EnvPrefix = "GAIA_"
+
+// MinQueueKeyLength is the fewest characters of sms.queue_key
+const MinQueueKeyLength = 16
+
+// Duration is a time.Duration which is written, in JSON, as a string such as "30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+	return nil
+}
+
+// DB is the configuration of the database
+type DB struct {
+	// Type is mem or mongo
+	Type string `json:"type"`
+	// Addr is the address of mongo
+	Addr string `json:"addr"`
+}
+
+// TLS is the configuration of serving HTTPS, with a static certificate
+type TLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// ACME is the configuration of obtaining certificates automatically, from letsencrypt or another
+// ACME certificate authority, such as pebble when testing. It is enabled by giving the hosts.
+type ACME struct {
+	// Hosts are those certificates may be obtained for
+	Hosts []string `json:"hosts"`
+	// Email is the contact of the account, which the CA warns of problems
+	Email string `json:"email"`
+	// CacheDir is where the account key and certificates are kept between restarts
+	CacheDir string `json:"cache_dir"`
+	// DirectoryURL is that of the CA, if empty it is letsencrypt's
+	DirectoryURL string `json:"directory_url"`
+	// CAFile is of PEM certificates to trust the CA's directory with, in addition to the system's
+	CAFile string `json:"ca_file"`
+}
+
+// Enabled determines whether certificates are obtained automatically
+func (a *ACME) Enabled() bool {
+	return len(a.Hosts) > 0
+}
+
+// HSTS is the Strict-Transport-Security policy of the responses served over HTTPS
+type HSTS struct {
+	// MaxAge is how long a browser should only use HTTPS, zero sends no policy
+	MaxAge            Duration `json:"max_age"`
+	IncludeSubdomains bool     `json:"include_subdomains"`
+}
+
+// Log is the configuration of the logs
+type Log struct {
+	// Format is text or json
+	Format string `json:"format"`
+	// Level is the least severe level logged: debug, info, warn or error
+	Level string `json:"level"`
+	// Access is the format of the access log written to stdout: clf or json.
+	// If empty, requests are logged with the other logs.
+	Access string `json:"access"`
+}
+
+// GRPC are the addresses of the gRPC services gaia uses. The web uis are
+// served by gaia itself, on their addresses, as well as dialed.
+type GRPC struct {
+	AccessDB string `json:"access_db"`
+	Auth     string `json:"auth"`
+	WebUI    string `json:"webui"`
+	CalWebUI string `json:"cal_webui"`
+}
+
+// The sms providers
+const (
+	TwilioProvider   = "twilio"
+	PlivoProvider    = "plivo"
+	NexmoProvider    = "nexmo"
+	LoopbackProvider = "loopback"
+)
+
+// Web is the configuration of the command sessions over websockets, at /command/web/
+type Web struct {
+	// MultipleSessions allows a user a session per websocket, e.g. per tab, rather than one
+	// session, which another websocket may take over
+	MultipleSessions bool `json:"multiple_sessions"`
+}
+
+// SMS is the configuration of the sms providers. Every provider which is configured serves
+// its webhook at /command/sms/<provider>/.
+type SMS struct {
+	// Provider sends the replies of the command sessions, and also serves /command/sms/. It is
+	// twilio, plivo, nexmo or loopback, if empty it is the first of twilio, plivo and nexmo
+	// which is configured. If none is, sms are not served at all. The loopback provider, for
+	// development, accepts unsigned requests, so it is only served if it is named, over HTTP.
+	Provider string `json:"provider"`
+	// LoopbackFile is where the loopback provider writes the messages it sends, if empty stderr
+	LoopbackFile string `json:"loopback_file"`
+
+	// The outbound queue, in front of the provider: a segment is attempted the attempts, the
+	// first retry after the backoff, which doubles up to the max backoff, and the segments to
+	// a number are sent at most one per interval
+	Attempts   int      `json:"attempts"`
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+	Interval   Duration `json:"interval"`
+	// QueueKey signs the segments in the queue, so that only those it queued are resent when
+	// it is next started. If empty, a key is made for each run, and the segments which are
+	// still queued at shutdown are dropped.
+	QueueKey     string `json:"queue_key"`
+	QueueKeyFile string `json:"queue_key_file"`
+
+	// The command sessions: there are at most the max sessions, each is ended once it has been
+	// idle for the idle timeout, unless it is "0s", and may have at most the backlog of messages
+	// waiting for it to read them, beyond which the sender is told elos is busy
+	MaxSessions int      `json:"max_sessions"`
+	IdleTimeout Duration `json:"idle_timeout"`
+	Backlog     int      `json:"backlog"`
+}
+
+// Twilio is the configuration of the twilio account which sends and receives sms
+type Twilio struct {
+	AccountSID    string `json:"account_sid"`
+	AuthToken     string `json:"auth_token"`
+	AuthTokenFile string `json:"auth_token_file"`
+	// From is the number messages are sent from, e.g. +16503810349
+	From string `json:"from"`
+}
+
+// Enabled determines whether twilio is configured at all
+func (t *Twilio) Enabled() bool {
+	return t.AccountSID != "" || t.AuthToken != "" || t.AuthTokenFile != "" || t.From != ""
+}
+
+// Plivo is the configuration of the plivo account which sends and receives sms
+type Plivo struct {
+	AuthID        string `json:"auth_id"`
+	AuthToken     string `json:"auth_token"`
+	AuthTokenFile string `json:"auth_token_file"`
+	From          string `json:"from"`
+}
+
+// Enabled determines whether plivo is configured at all
+func (p *Plivo) Enabled() bool {
+	return p.AuthID != "" || p.AuthToken != "" || p.AuthTokenFile != "" || p.From != ""
+}
+
+// Nexmo is the configuration of the nexmo account which sends and receives sms
+type Nexmo struct {
+	APIKey        string `json:"api_key"`
+	APISecret     string `json:"api_secret"`
+	APISecretFile string `json:"api_secret_file"`
+	// From is the number, or the alphanumeric sender id, messages are sent from
+	From string `json:"from"`
+	// SignatureSecret signs the requests nexmo makes of the webhook, by the SignatureMethod,
+	// md5hash or sha256, both are set in the settings of the nexmo account
+	SignatureSecret     string `json:"signature_secret"`
+	SignatureSecretFile string `json:"signature_secret_file"`
+	SignatureMethod     string `json:"signature_method"`
+}
+
+// Enabled determines whether nexmo is configured at all
+func (n *Nexmo) Enabled() bool {
+	return n.APIKey != "" || n.APISecret != "" || n.APISecretFile != "" || n.From != "" ||
+		n.SignatureSecret != "" || n.SignatureSecretFile != ""
+}
+
+// Bootstrap is a user to create when gaia starts, if it doesn't already exist
+type Bootstrap struct {
+	Public      string `json:"public"`
+	Private     string `json:"private"`
+	PrivateFile string `json:"private_file"`
+}
+
+// Enabled determines whether a bootstrap user is configured at all
+func (b *Bootstrap) Enabled() bool {
+	return b.Public != "" || b.Private != "" || b.PrivateFile != ""
+}
+
+// Config is the configuration of serve
+type Config struct {
+	Addr   string `json:"addr"`
+	Port   int    `json:"port"`
+	DB     DB     `json:"db"`
+	AppDir string `json:"app_dir"`
+	TLS    TLS    `json:"tls"`
+	ACME   ACME   `json:"acme"`
+
+	// RedirectAddr, when serving HTTPS, is listened on for HTTP requests, which are
+	// redirected to HTTPS, or are answers to the ACME CA's challenges
+	RedirectAddr string `json:"redirect_addr"`
+	HSTS         HSTS   `json:"hsts"`
+
+	// MetricsAddr is listened on for /metrics, for a monitoring system to scrape, it should
+	// not be reachable from beyond the monitoring network. If empty, metrics are not served.
+	MetricsAddr string `json:"metrics_addr"`
+
+	// Origins may make cross origin requests
+	Origins []string `json:"origins"`
+	// TrustedProxies are the ips, or networks in CIDR notation, of the proxies in front of gaia,
+	// whose X-Forwarded-For header names the client, as it is rate limited and logged
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Admins are the ids of the users who may administer gaia, such as its sms command sessions
+	Admins []string `json:"admins"`
+	Log    Log      `json:"log"`
+	// Grace is how long to wait, on shutdown, for requests, sessions and agents to end
+	Grace Duration `json:"grace"`
+	GRPC  GRPC     `json:"grpc"`
+
+	// LetsencryptDir is served at /.well-known/, for letsencrypt's challenges
+	LetsencryptDir string `json:"letsencrypt_dir"`
+
+	Web       Web       `json:"web"`
+	SMS       SMS       `json:"sms"`
+	Twilio    Twilio    `json:"twilio"`
+	Plivo     Plivo     `json:"plivo"`
+	Nexmo     Nexmo     `json:"nexmo"`
+	Bootstrap Bootstrap `json:"bootstrap"`
+}
+
+// SMSProvider is the provider which sends sms, see SMS.Provider, it is empty if sms are not served
+func (c *Config) SMSProvider() string {
+	switch {
+	case c.SMS.Provider != "":
+		return c.SMS.Provider
+	case c.Twilio.Enabled():
+		return TwilioProvider
+	case c.Plivo.Enabled():
+		return PlivoProvider
+	case c.Nexmo.Enabled():
+		return NexmoProvider
+	default:
+		return ""
+	}
+}
+
+// HTTPS determines whether gaia is served over HTTPS, with either a static or an obtained certificate
+func (c *Config) HTTPS() bool {
+	return c.TLS.CertFile != "" || c.ACME.Enabled()
+}
+
+// Default is the configuration, before a file or the environment is loaded
+func Default() *Config {
+	return &Config{
+		Addr:   "0.0.0.0",
+		Port:   80,
+		DB:     DB{Type: "mongo", Addr: "0.0.0.0"},
+		AppDir: "app",
+		ACME:   ACME{CacheDir: "/var/lib/gaia/acme"},
+		HSTS:   HSTS{MaxAge: Duration{365 * 24 * time.Hour}},
+		Log:    Log{Format: "text", Level: "info"},
+		SMS: SMS{
+			Attempts:   services.DefaultSMSAttempts,
+			Backoff:    Duration{services.DefaultSMSBackoff},
+			MaxBackoff: Duration{services.DefaultSMSMaxBackoff},
+			Interval:   Duration{services.DefaultSMSInterval},
+
+			MaxSessions: services.DefaultSMSMaxSessions,
+			IdleTimeout: Duration{services.DefaultSMSIdleTimeout},
+			Backlog:     services.DefaultSMSBacklog,
+		},
+		Nexmo: Nexmo{SignatureMethod: sms.NexmoMD5Hash},
+		Grace: Duration{30 * time.Second},
+		GRPC: GRPC{
+			AccessDB: ":3334",
+			Auth:     ":3333",
+			WebUI:    ":1113",
+			CalWebUI: ":1114",
+		},
+		LetsencryptDir: "/var/www/elos/",
+	}
+}
+
+// Load loads the configuration from the defaults, then the file (if it is not empty), then the
+// environment, which is looked up by the getenv (e.g. os.Getenv), and reads the secrets from
+// their files. The configuration is not validated, so that it may be amended (e.g. by flags)
+// first, it should be validated before it is used.
+func Load(file string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	if file != "" {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(bytes, c); err != nil {
+			return nil, fmt.Errorf("config: %s: %s", file, err)
+		}
+	}
+
+	if err := c.LoadEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	if err := c.ReadSecrets(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// --- Environment {{{
+
+// variables maps the name of each environment variable, less the EnvPrefix, to the value it sets
+func (c *Config) variables() map[string]interface{} {
+	return map[string]interface{}{
+		"ADDR":                        &c.Addr,
+		"PORT":                        &c.Port,
+		"DB_TYPE":                     &c.DB.Type,
+		"DB_ADDR":                     &c.DB.Addr,
+		"APP_DIR":                     &c.AppDir,
+		"TLS_CERT_FILE":               &c.TLS.CertFile,
+		"TLS_KEY_FILE":                &c.TLS.KeyFile,
+		"ACME_HOSTS":                  &c.ACME.Hosts,
+		"ACME_EMAIL":                  &c.ACME.Email,
+		"ACME_CACHE_DIR":              &c.ACME.CacheDir,
+		"ACME_DIRECTORY_URL":          &c.ACME.DirectoryURL,
+		"ACME_CA_FILE":                &c.ACME.CAFile,
+		"REDIRECT_ADDR":               &c.RedirectAddr,
+		"HSTS_MAX_AGE":                &c.HSTS.MaxAge,
+		"HSTS_INCLUDE_SUBDOMAINS":     &c.HSTS.IncludeSubdomains,
+		"METRICS_ADDR":                &c.MetricsAddr,
+		"ORIGINS":                     &c.Origins,
+		"TRUSTED_PROXIES":             &c.TrustedProxies,
+		"ADMINS":                      &c.Admins,
+		"LOG_FORMAT":                  &c.Log.Format,
+		"LOG_LEVEL":                   &c.Log.Level,
+		"LOG_ACCESS":                  &c.Log.Access,
+		"GRACE":                       &c.Grace,
+		"GRPC_ACCESS_DB":              &c.GRPC.AccessDB,
+		"GRPC_AUTH":                   &c.GRPC.Auth,
+		"GRPC_WEBUI":                  &c.GRPC.WebUI,
+		"GRPC_CAL_WEBUI":              &c.GRPC.CalWebUI,
+		"LETSENCRYPT_DIR":             &c.LetsencryptDir,
+		"WEB_MULTIPLE_SESSIONS":       &c.Web.MultipleSessions,
+		"SMS_PROVIDER":                &c.SMS.Provider,
+		"SMS_QUEUE_KEY":               &c.SMS.QueueKey,
+		"SMS_QUEUE_KEY_FILE":          &c.SMS.QueueKeyFile,
+		"SMS_LOOPBACK_FILE":           &c.SMS.LoopbackFile,
+		"SMS_ATTEMPTS":                &c.SMS.Attempts,
+		"SMS_BACKOFF":                 &c.SMS.Backoff,
+		"SMS_MAX_BACKOFF":             &c.SMS.MaxBackoff,
+		"SMS_INTERVAL":                &c.SMS.Interval,
+		"SMS_MAX_SESSIONS":            &c.SMS.MaxSessions,
+		"SMS_IDLE_TIMEOUT":            &c.SMS.IdleTimeout,
+		"SMS_BACKLOG":                 &c.SMS.Backlog,
+		"PLIVO_AUTH_ID":               &c.Plivo.AuthID,
+		"PLIVO_AUTH_TOKEN":            &c.Plivo.AuthToken,
+		"PLIVO_AUTH_TOKEN_FILE":       &c.Plivo.AuthTokenFile,
+		"PLIVO_FROM":                  &c.Plivo.From,
+		"NEXMO_API_KEY":               &c.Nexmo.APIKey,
+		"NEXMO_API_SECRET":            &c.Nexmo.APISecret,
+		"NEXMO_API_SECRET_FILE":       &c.Nexmo.APISecretFile,
+		"NEXMO_FROM":                  &c.Nexmo.From,
+		"NEXMO_SIGNATURE_SECRET":      &c.Nexmo.SignatureSecret,
+		"NEXMO_SIGNATURE_SECRET_FILE": &c.Nexmo.SignatureSecretFile,
+		"NEXMO_SIGNATURE_METHOD":      &c.Nexmo.SignatureMethod,
+		"TWILIO_ACCOUNT_SID":          &c.Twilio.AccountSID,
+		"TWILIO_AUTH_TOKEN":           &c.Twilio.AuthToken,
+		"TWILIO_AUTH_TOKEN_FILE":      &c.Twilio.AuthTokenFile,
+		"TWILIO_FROM":                 &c.Twilio.From,
+		"BOOTSTRAP_PUBLIC":            &c.Bootstrap.Public,
+		"BOOTSTRAP_PRIVATE":           &c.Bootstrap.Private,
+		"BOOTSTRAP_PRIVATE_FILE":      &c.Bootstrap.PrivateFile,
+	}
+}
+
+// LoadEnv overrides the configuration with the environment variables which are set
+func (c *Config) LoadEnv(getenv func(string) string) error {
+	for name, v := range c.variables() {
+		s := getenv(EnvPrefix + name)
+		if s == "" {
+			continue
+		}
+
+		if err := set(v, s); err != nil {
+			return fmt.Errorf("config: %s%s: %s", EnvPrefix, name, err)
+		}
+	}
+
+	return nil
+}
+
+// Set sets the value of the environment variable, less the EnvPrefix, such as "DB_TYPE"
+func (c *Config) Set(name, value string) error {
+	v, ok := c.variables()[name]
+	if !ok {
+		return fmt.Errorf("config: unrecognized variable %q", name)
+	}
+
+	return set(v, value)
+}
+
+// set parses the string into the value
+func set(v interface{}, s string) error {
+	switch v := v.(type) {
+	case *string:
+		*v = s
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = i
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Duration = d
+	case *[]string:
+		*v = nil
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				*v = append(*v, e)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+
+	return nil
+}
+
+// --- }}}
+
+// --- Secrets {{{
+
+// ReadSecrets reads each secret which is given by a file
+func (c *Config) ReadSecrets() error {
+	if err := readSecret("twilio.auth_token", &c.Twilio.AuthToken, c.Twilio.AuthTokenFile); err != nil {
+		return err
+	}
+
+	if err := readSecret("plivo.auth_token", &c.Plivo.AuthToken, c.Plivo.AuthTokenFile); err != nil {
+		return err
+	}
+
+	if err := readSecret("nexmo.api_secret", &c.Nexmo.APISecret, c.Nexmo.APISecretFile); err != nil {
+		return err
+	}
+
+	if err := readSecret("nexmo.signature_secret", &c.Nexmo.SignatureSecret, c.Nexmo.SignatureSecretFile); err != nil {
+		return err
+	}
+
+	if err := readSecret("sms.queue_key", &c.SMS.QueueKey, c.SMS.QueueKeyFile); err != nil {
+		return err
+	}
+
+	return readSecret("bootstrap.private", &c.Bootstrap.Private, c.Bootstrap.PrivateFile)
+}
+
+// readSecret reads the secret from the file, if there is one. The secret may not
+// be given both directly and by a file, lest it be unclear which is in effect.
+func readSecret(name string, secret *string, file string) error {
+	if file == "" {
+		return nil
+	}
+
+	if *secret != "" {
+		return fmt.Errorf("config: %s is given both directly and by a file", name)
+	}
+
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("config: %s: %s", name, err)
+	}
+
+	*secret = strings.TrimSpace(string(bytes))
+	return nil
+}
+
+// --- }}}
+
+// --- Validation {{{
+
+// Validate ensures the configuration is complete and consistent, it reports every problem at once
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	if c.Port <= 0 || c.Port > 65535 {
+		invalid("port %d is out of range", c.Port)
+	}
+
+	switch c.DB.Type {
+	case "mem":
+	case "mongo":
+		if c.DB.Addr == "" {
+			invalid("db.addr is required for mongo")
+		}
+	default:
+		invalid("db.type %q is not mem or mongo", c.DB.Type)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		invalid("tls.cert_file and tls.key_file must be given together")
+	}
+
+	if c.ACME.Enabled() {
+		if c.TLS.CertFile != "" {
+			invalid("acme.hosts and tls.cert_file are exclusive, certificates are either obtained or given")
+		}
+		if c.ACME.CacheDir == "" {
+			invalid("acme.cache_dir is required")
+		}
+		if u, err := url.Parse(c.ACME.DirectoryURL); c.ACME.DirectoryURL != "" && (err != nil || u.Scheme != "https") {
+			invalid("acme.directory_url %q is not an https url", c.ACME.DirectoryURL)
+		}
+	}
+
+	if c.RedirectAddr != "" && !c.HTTPS() {
+		invalid("redirect_addr is only listened on when serving HTTPS")
+	}
+
+	if c.MetricsAddr != "" {
+		// the metrics are not authenticated, so they may not be served alongside gaia
+		if _, port, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			invalid("metrics_addr %q is not a host and port, such as 127.0.0.1:9090", c.MetricsAddr)
+		} else if port == strconv.Itoa(c.Port) {
+			invalid("metrics_addr %q may not be on the port gaia is served on", c.MetricsAddr)
+		}
+	}
+
+	if c.HSTS.MaxAge.Duration < 0 {
+		invalid("hsts.max_age %s is negative", c.HSTS.MaxAge)
+	}
+
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			invalid("trusted_proxies %q is not an ip or a network, such as 10.0.0.0/8", p)
+		}
+	}
+
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		invalid("log.format %q is not text or json", c.Log.Format)
+	}
+	if _, err := services.ParseLevel(c.Log.Level); err != nil {
+		invalid("log.level %q is not debug, info, warn or error", c.Log.Level)
+	}
+	switch c.Log.Access {
+	case "", "clf", "json":
+	default:
+		invalid("log.access %q is not clf or json", c.Log.Access)
+	}
+
+	if c.Grace.Duration < 0 {
+		invalid("grace %s is negative", c.Grace)
+	}
+
+	for name, addr := range map[string]string{
+		"grpc.access_db": c.GRPC.AccessDB,
+		"grpc.auth":      c.GRPC.Auth,
+		"grpc.webui":     c.GRPC.WebUI,
+		"grpc.cal_webui": c.GRPC.CalWebUI,
+	} {
+		if addr == "" {
+			invalid("%s is required", name)
+		}
+	}
+
+	if c.Twilio.Enabled() {
+		if !strings.HasPrefix(c.Twilio.AccountSID, "AC") {
+			invalid("twilio.account_sid %q is not an account sid", c.Twilio.AccountSID)
+		}
+		if c.Twilio.AuthToken == "" {
+			invalid("twilio.auth_token is required")
+		}
+		if !strings.HasPrefix(c.Twilio.From, "+") {
+			invalid("twilio.from %q is not an E.164 number, such as +16503810349", c.Twilio.From)
+		}
+	}
+
+	if c.Plivo.Enabled() {
+		if c.Plivo.AuthID == "" {
+			invalid("plivo.auth_id is required")
+		}
+		if c.Plivo.AuthToken == "" {
+			invalid("plivo.auth_token is required")
+		}
+		if c.Plivo.From == "" {
+			invalid("plivo.from is required")
+		}
+	}
+
+	if c.Nexmo.Enabled() {
+		if c.Nexmo.APIKey == "" {
+			invalid("nexmo.api_key is required")
+		}
+		if c.Nexmo.APISecret == "" {
+			invalid("nexmo.api_secret is required")
+		}
+		if c.Nexmo.From == "" {
+			invalid("nexmo.from is required")
+		}
+		if c.Nexmo.SignatureSecret == "" {
+			invalid("nexmo.signature_secret is required, to verify the requests of the webhook")
+		}
+		if m := c.Nexmo.SignatureMethod; m != sms.NexmoMD5Hash && m != sms.NexmoSHA256 {
+			invalid("nexmo.signature_method %q is not %s or %s", m, sms.NexmoMD5Hash, sms.NexmoSHA256)
+		}
+	}
+
+	switch provider := c.SMSProvider(); provider {
+	case "":
+	case LoopbackProvider:
+		// anyone could post to it as any user
+		if c.HTTPS() {
+			invalid("sms.provider loopback accepts unsigned requests, it may not be served over HTTPS")
+		}
+	case TwilioProvider, PlivoProvider, NexmoProvider:
+		if enabled := map[string]bool{
+			TwilioProvider: c.Twilio.Enabled(),
+			PlivoProvider:  c.Plivo.Enabled(),
+			NexmoProvider:  c.Nexmo.Enabled(),
+		}[provider]; !enabled {
+			invalid("sms.provider %s is not configured", provider)
+		}
+	default:
+		invalid("sms.provider %q is not twilio, plivo, nexmo or loopback", provider)
+	}
+
+	if c.SMS.Attempts < 1 {
+		invalid("sms.attempts %d is less than 1", c.SMS.Attempts)
+	}
+	if c.SMS.Backoff.Duration <= 0 || c.SMS.MaxBackoff.Duration < c.SMS.Backoff.Duration {
+		invalid("sms.backoff %s must be positive, and no more than sms.max_backoff %s", c.SMS.Backoff, c.SMS.MaxBackoff)
+	}
+	if c.SMS.Interval.Duration < 0 {
+		invalid("sms.interval %s is negative", c.SMS.Interval)
+	}
+	if k := c.SMS.QueueKey; k != "" && len(k) < MinQueueKeyLength {
+		invalid("sms.queue_key is %d characters, it must be at least %d", len(k), MinQueueKeyLength)
+	}
+	if c.SMS.MaxSessions < 1 {
+		invalid("sms.max_sessions %d is less than 1", c.SMS.MaxSessions)
+	}
+	if c.SMS.IdleTimeout.Duration < 0 {
+		invalid("sms.idle_timeout %s is negative", c.SMS.IdleTimeout)
+	}
+	if c.SMS.Backlog < 1 {
+		invalid("sms.backlog %d is less than 1", c.SMS.Backlog)
+	}
+
+	if c.Bootstrap.Enabled() && (c.Bootstrap.Public == "" || c.Bootstrap.Private == "") {
+		invalid("bootstrap.public and bootstrap.private must be given together")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	return errors.New("config: " + strings.Join(problems, "; "))
+}
+
+// --- }}}
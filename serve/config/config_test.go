@@ -0,0 +1,320 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env is an environment, for Load's getenv
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("Default().Validate error: %s", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaia-config")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "gaia.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"port": 443,
+		"db": { "type": "mongo", "addr": "mongo.internal" },
+		"grace": "10s",
+		"grpc": { "auth": ":4444" },
+		"twilio": {
+			"account_sid": "AC123",
+			"auth_token_file": "`+filepath.Join(dir, "twilio_token")+`",
+			"from": "+16505551234"
+		}
+	}`), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "twilio_token"), []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %s", err)
+	}
+
+	c, err := Load(file, env(map[string]string{
+		"GAIA_DB_ADDR": "mongo.local",
+		"GAIA_ORIGINS": "https://elos.com, https://app.elos.com",
+	}))
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate error: %s", err)
+	}
+
+	if got, want := c.Port, 443; got != want {
+		t.Errorf("c.Port: got %d, want %d", got, want)
+	}
+
+	// the environment overrides the file
+	if got, want := c.DB.Addr, "mongo.local"; got != want {
+		t.Errorf("c.DB.Addr: got %q, want %q", got, want)
+	}
+
+	if got, want := c.Origins, []string{"https://elos.com", "https://app.elos.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("c.Origins: got %v, want %v", got, want)
+	}
+
+	if got, want := c.Grace.Duration, 10*time.Second; got != want {
+		t.Errorf("c.Grace: got %s, want %s", got, want)
+	}
+
+	// the file overrides only the values it gives
+	if got, want := c.GRPC, (GRPC{AccessDB: ":3334", Auth: ":4444", WebUI: ":1113", CalWebUI: ":1114"}); got != want {
+		t.Errorf("c.GRPC: got %+v, want %+v", got, want)
+	}
+
+	if got, want := c.Twilio.AuthToken, "secret"; got != want {
+		t.Errorf("c.Twilio.AuthToken: got %q, want %q", got, want)
+	}
+
+	if c.Bootstrap.Enabled() {
+		t.Error("the bootstrap user should be optional")
+	}
+}
+
+func TestLoadEnvErrors(t *testing.T) {
+	if _, err := Load("", env(map[string]string{"GAIA_PORT": "eighty"})); err == nil {
+		t.Error("expected an error for a port which is not a number")
+	}
+
+	if _, err := Load("", env(map[string]string{"GAIA_GRACE": "forever"})); err == nil {
+		t.Error("expected an error for a grace which is not a duration")
+	}
+}
+
+func TestSecretGivenTwice(t *testing.T) {
+	_, err := Load("", env(map[string]string{
+		"GAIA_BOOTSTRAP_PUBLIC":       "u",
+		"GAIA_BOOTSTRAP_PRIVATE":      "p",
+		"GAIA_BOOTSTRAP_PRIVATE_FILE": "/run/secrets/bootstrap",
+	}))
+	if err == nil {
+		t.Fatal("expected an error for a secret given both directly and by a file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Port = 0
+	c.DB.Type = "postgres"
+	c.TLS.CertFile = "cert.pem"
+	c.Log.Level = "verbose"
+	c.GRPC.Auth = ""
+	c.Twilio.AccountSID = "AC123"
+	c.Bootstrap.Public = "u"
+	c.SMS.Backlog = 0
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected a validation error")
+	}
+
+	for _, problem := range []string{
+		"port 0",
+		"db.type",
+		"tls.cert_file",
+		"log.level",
+		"grpc.auth",
+		"twilio.auth_token",
+		"twilio.from",
+		"bootstrap.private",
+		"sms.backlog",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("the error %q does not report %q", err, problem)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := Default()
+
+	if err := c.Set("DB_TYPE", "mem"); err != nil {
+		t.Fatalf("c.Set error: %s", err)
+	}
+
+	if got, want := c.DB.Type, "mem"; got != want {
+		t.Errorf("c.DB.Type: got %q, want %q", got, want)
+	}
+
+	if err := c.Set("NOT_A_VARIABLE", "x"); err == nil {
+		t.Error("expected an error for an unrecognized variable")
+	}
+}
+
+func TestValidateMetricsAddr(t *testing.T) {
+	c := Default()
+
+	for _, addr := range []string{":80", "0.0.0.0:80", "localhost"} {
+		c.MetricsAddr = addr
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "metrics_addr") {
+			t.Errorf("expected metrics_addr %q to be invalid, got %v", addr, err)
+		}
+	}
+
+	c.MetricsAddr = "127.0.0.1:9090"
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	c := Default()
+
+	if err := c.Set("TRUSTED_PROXIES", "10.0.0.1, 192.168.0.0/16"); err != nil {
+		t.Fatalf("c.Set error: %s", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+
+	c.TrustedProxies = append(c.TrustedProxies, "the load balancer")
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "trusted_proxies") {
+		t.Errorf("expected the trusted_proxies to be invalid, got %v", err)
+	}
+}
+
+func TestValidateHTTPS(t *testing.T) {
+	c := Default()
+	c.RedirectAddr = ":80"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "redirect_addr") {
+		t.Errorf("expected redirect_addr to require HTTPS, got %v", err)
+	}
+
+	if err := c.Set("ACME_HOSTS", "gaia.elos.com,elos.com"); err != nil {
+		t.Fatalf("c.Set error: %s", err)
+	}
+	if err := c.Set("HSTS_INCLUDE_SUBDOMAINS", "true"); err != nil {
+		t.Fatalf("c.Set error: %s", err)
+	}
+	if !c.HTTPS() || !c.HSTS.IncludeSubdomains {
+		t.Fatalf("expected HTTPS, with the subdomains included in the HSTS policy")
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+
+	c.TLS = TLS{CertFile: "cert.pem", KeyFile: "key.pem"}
+	c.ACME.DirectoryURL = "http://localhost:14000/dir"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected a validation error")
+	}
+	for _, problem := range []string{"tls.cert_file", "acme.directory_url"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("the error %q does not report %q", err, problem)
+		}
+	}
+}
+
+func TestSMSProvider(t *testing.T) {
+	c := Default()
+
+	// sms are not served unless a provider is configured, or named
+	if got, want := c.SMSProvider(), ""; got != want {
+		t.Errorf("c.SMSProvider(): got %q, want %q", got, want)
+	}
+
+	c.SMS.Provider = LoopbackProvider
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+
+	// the loopback provider's webhook is unsigned, so it is only for development
+	c.TLS = TLS{CertFile: "cert.pem", KeyFile: "key.pem"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "sms.provider loopback") {
+		t.Errorf("expected the loopback provider to be refused over HTTPS, got %v", err)
+	}
+	c.TLS = TLS{}
+	c.SMS.Provider = ""
+
+	c.Twilio = Twilio{AccountSID: "AC123", AuthToken: "token", From: "+16505551234"}
+	if got, want := c.SMSProvider(), TwilioProvider; got != want {
+		t.Errorf("c.SMSProvider(): got %q, want %q", got, want)
+	}
+
+	c.SMS.Provider = PlivoProvider
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "sms.provider plivo is not configured") {
+		t.Errorf("expected plivo to be required, got %v", err)
+	}
+
+	c.Plivo = Plivo{AuthID: "MA123", AuthToken: "token", From: "+16505551234"}
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+
+	c.SMS.Provider = "pager"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "sms.provider") {
+		t.Errorf("expected an unrecognized provider to be invalid, got %v", err)
+	}
+
+	// the webhook of nexmo can't be verified without its signature secret
+	c.SMS.Provider = NexmoProvider
+	c.Nexmo = Nexmo{APIKey: "key", APISecret: "secret", From: "+16505551234", SignatureMethod: "sha1"}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "nexmo.signature_secret") || !strings.Contains(err.Error(), "nexmo.signature_method") {
+		t.Errorf("expected the signature secret and method to be invalid, got %v", err)
+	}
+
+	c.Nexmo.SignatureSecret, c.Nexmo.SignatureMethod = "signature", "sha256"
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+}
+
+func TestValidateQueueKey(t *testing.T) {
+	c := Default()
+
+	// without a key, the segments queued at shutdown are dropped, but gaia still serves
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+
+	c.SMS.QueueKey = "short"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "sms.queue_key") {
+		t.Errorf("expected a short sms.queue_key to be invalid, got %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "gaia-config")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "queue_key")
+	if err := ioutil.WriteFile(file, []byte("0123456789abcdef\n"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %s", err)
+	}
+
+	c, err = Load("", env(map[string]string{"GAIA_SMS_QUEUE_KEY_FILE": file}))
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+
+	if got, want := c.SMS.QueueKey, "0123456789abcdef"; got != want {
+		t.Errorf("c.SMS.QueueKey: got %q, want %q", got, want)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("c.Validate error: %s", err)
+	}
+}
@@ -2,4 +2,4 @@
 
 set -e
 
-go run main.go --dbtype=mem --port=8080 --seed="./seed.json"
+GAIA_BOOTSTRAP_PUBLIC=u GAIA_BOOTSTRAP_PRIVATE=p GAIA_SMS_PROVIDER=loopback go run main.go --dbtype=mem --port=8080
@@ -0,0 +1,122 @@
+// Package https serves gaia securely: it obtains certificates from an ACME certificate
+// authority, redirects HTTP to HTTPS, and sets the Strict-Transport-Security policy.
+package https
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elos/gaia/serve/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Manager constructs the certificate manager of the configuration. Its TLSConfig serves the
+// certificates, obtaining them when they are first needed, and renewing them before they
+// expire. Its HTTPHandler answers the CA's http-01 challenges.
+func Manager(c *config.ACME) (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.CacheDir),
+		HostPolicy: autocert.HostWhitelist(c.Hosts...),
+		Email:      c.Email,
+	}
+
+	if c.DirectoryURL == "" && c.CAFile == "" {
+		return m, nil
+	}
+
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+
+	if c.CAFile != "" {
+		roots, err := loadRoots(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     &tls.Config{RootCAs: roots},
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		}
+	}
+
+	m.Client = client
+	return m, nil
+}
+
+// loadRoots loads the system's roots, and the PEM certificates of the file
+func loadRoots(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("https: no certificates in %s", file)
+	}
+
+	return roots, nil
+}
+
+// Redirect redirects every request to the same url over HTTPS, on the port. The redirect is
+// permanent, and it preserves the method, so that a client may not fall back to HTTP.
+func Redirect(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // there is no port
+		}
+
+		if host == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// HSTS sets the Strict-Transport-Security policy of every response which is served over TLS.
+// A max age of zero sets no policy.
+func HSTS(h http.Handler, maxAge time.Duration, includeSubdomains bool) http.Handler {
+	if maxAge <= 0 {
+		return h
+	}
+
+	policy := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubdomains {
+		policy += "; includeSubDomains"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a browser ignores the policy of a response served over HTTP
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", policy)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,122 @@
+package https
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/elos/gaia/serve/config"
+)
+
+func TestRedirect(t *testing.T) {
+	cases := []struct {
+		method, url string
+		port        int
+		code        int
+		location    string
+	}{
+		{"GET", "http://gaia.elos.com/record/?kind=task", 443, http.StatusMovedPermanently, "https://gaia.elos.com/record/?kind=task"},
+		{"HEAD", "http://gaia.elos.com:80/", 443, http.StatusMovedPermanently, "https://gaia.elos.com/"},
+		{"POST", "http://gaia.elos.com/record/", 443, http.StatusPermanentRedirect, "https://gaia.elos.com/record/"},
+		{"GET", "http://localhost:5002/app/", 8443, http.StatusMovedPermanently, "https://localhost:8443/app/"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		Redirect(c.port).ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+
+		if w.Code != c.code {
+			t.Errorf("%s %s: code: got %d, want %d", c.method, c.url, w.Code, c.code)
+		}
+
+		if got := w.Header().Get("Location"); got != c.location {
+			t.Errorf("%s %s: Location: got %q, want %q", c.method, c.url, got, c.location)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	h := HSTS(http.NotFoundHandler(), 365*24*time.Hour, true)
+
+	r := httptest.NewRequest("GET", "https://gaia.elos.com/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got, want := w.Header().Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains"; got != want {
+		t.Errorf("Strict-Transport-Security: got %q, want %q", got, want)
+	}
+
+	r = httptest.NewRequest("GET", "http://gaia.elos.com/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Strict-Transport-Security over HTTP: got %q, want none", got)
+	}
+
+	r = httptest.NewRequest("GET", "https://gaia.elos.com/", nil)
+	w = httptest.NewRecorder()
+	HSTS(http.NotFoundHandler(), 0, false).ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Strict-Transport-Security with no max age: got %q, want none", got)
+	}
+}
+
+func TestManagerCAFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaia-https")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := dir + "/ca.pem"
+	if err := ioutil.WriteFile(file, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %s", err)
+	}
+
+	if _, err := Manager(&config.ACME{Hosts: []string{"gaia.test"}, CacheDir: dir, CAFile: file}); err == nil {
+		t.Error("expected an error for a ca file without certificates")
+	}
+}
+
+// TestManagerPebble obtains a certificate from pebble. It runs if GAIA_TEST_ACME_DIRECTORY is the
+// url of pebble's directory (e.g. https://localhost:14000/dir), and GAIA_TEST_ACME_CA is its
+// certificate (pebble.minica.pem). Pebble must be run with PEBBLE_VA_ALWAYS_VALID=1, as it can
+// not reach the test to validate the challenges.
+func TestManagerPebble(t *testing.T) {
+	directory := os.Getenv("GAIA_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("GAIA_TEST_ACME_DIRECTORY is not set")
+	}
+
+	dir, err := ioutil.TempDir("", "gaia-https")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := Manager(&config.ACME{
+		Hosts:        []string{"gaia.test"},
+		CacheDir:     dir,
+		DirectoryURL: directory,
+		CAFile:       os.Getenv("GAIA_TEST_ACME_CA"),
+	})
+	if err != nil {
+		t.Fatalf("Manager error: %s", err)
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "gaia.test"})
+	if err != nil {
+		t.Fatalf("m.GetCertificate error: %s", err)
+	}
+
+	if cert.Leaf == nil || cert.Leaf.VerifyHostname("gaia.test") != nil {
+		t.Errorf("the certificate is not for gaia.test")
+	}
+
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Error("expected an error for a host which is not configured")
+	}
+}
@@ -1,21 +1,31 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 
 	"github.com/elos/data"
 	"github.com/elos/data/builtin/mem"
 	"github.com/elos/gaia"
 	"github.com/elos/gaia/agents"
+	"github.com/elos/gaia/serve/config"
+	"github.com/elos/gaia/serve/https"
 	"github.com/elos/gaia/services"
 	"github.com/elos/models"
+	maccess "github.com/elos/models/access"
 	"github.com/elos/models/user"
 	"github.com/elos/x/auth"
 	"github.com/elos/x/data/access"
@@ -25,156 +35,530 @@ import (
 	"golang.org/x/net/context"
 )
 
-const (
-	TwilioAccountSid = "AC76d4c9975dfb641d9ae711c2f795c5a2"
-	TwilioAuthToken  = "9ab82f10b0b6187d2c71589c46c96da6"
-	TwilioFromNumber = "+16503810349"
-)
-
 var (
-	addr     = flag.String("addr", "0.0.0.0", "address to listen on")
-	port     = flag.Int("port", 80, "port to listen on")
-	dbtype   = flag.String("dbtype", "mongo", "type of database to use: (mem or mongo)")
-	dbaddr   = flag.String("dbaddr", "0.0.0.0", "address of database")
-	appdir   = flag.String("appdir", "app", "directory of maia build")
-	certFile = flag.String("certfile", "", "cert file")
-	keyFile  = flag.String("keyfile", "", "private keY")
+	configFile = flag.String("config", os.Getenv("GAIA_CONFIG"), "JSON configuration file, the GAIA_ environment variables override it, and these flags override both")
+
+	// each of the flags, when it is given, overrides the configuration variable
+	overrides = map[string]string{
+		"addr":        "ADDR",
+		"port":        "PORT",
+		"dbtype":      "DB_TYPE",
+		"dbaddr":      "DB_ADDR",
+		"appdir":      "APP_DIR",
+		"certfile":    "TLS_CERT_FILE",
+		"keyfile":     "TLS_KEY_FILE",
+		"origins":     "ORIGINS",
+		"proxies":     "TRUSTED_PROXIES",
+		"admins":      "ADMINS",
+		"logformat":   "LOG_FORMAT",
+		"loglevel":    "LOG_LEVEL",
+		"grace":       "GRACE",
+		"accesslog":   "LOG_ACCESS",
+		"metricsaddr": "METRICS_ADDR",
+	}
 )
 
+func init() {
+	flag.String("addr", "", "address to listen on (default 0.0.0.0)")
+	flag.String("port", "", "port to listen on (default 80)")
+	flag.String("dbtype", "", "type of database to use: (mem or mongo) (default mongo)")
+	flag.String("dbaddr", "", "address of database (default 0.0.0.0)")
+	flag.String("appdir", "", "directory of maia build (default app)")
+	flag.String("certfile", "", "cert file")
+	flag.String("keyfile", "", "private key")
+	flag.String("origins", "", "comma separated origins allowed to make cross origin requests")
+	flag.String("proxies", "", "comma separated ips, or networks, of the proxies trusted to name the client in X-Forwarded-For")
+	flag.String("admins", "", "comma separated ids of the users who may administer gaia")
+	flag.String("logformat", "", "format of the logs: (text or json) (default text)")
+	flag.String("loglevel", "", "least severe level to log: (debug, info, warn or error) (default info)")
+	flag.String("grace", "", "how long to wait, on shutdown, for requests, sessions and agents to end (default 30s)")
+	flag.String("accesslog", "", "format of the access log written to stdout: (clf or json), if empty requests are logged with the other logs")
+	flag.String("metricsaddr", "", "address to serve /metrics on, for the monitoring system (if empty, metrics are not served)")
+}
+
+// loadConfig loads the configuration file and the environment, then the flags which were given, and validates the result
+func loadConfig() (*config.Config, error) {
+	c, err := config.Load(*configFile, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if name, ok := overrides[f.Name]; ok && err == nil {
+			if err = c.Set(name, f.Value.String()); err != nil {
+				err = fmt.Errorf("-%s: %s", f.Name, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
 func main() {
 	flag.Parse()
 
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	var db data.DB
-	var err error
 
 	log.Printf("== Setting Up Database ==")
-	log.Printf("\tDatabase Type: %s", *dbtype)
-	switch *dbtype {
+	log.Printf("\tDatabase Type: %s", c.DB.Type)
+	switch c.DB.Type {
 	case "mem":
 		db = mem.NewDB()
 	case "mongo":
-		db, err = models.MongoDB(*dbaddr)
+		db, err = models.MongoDB(c.DB.Addr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Printf("\tConnected to mongo@%s", *dbaddr)
+		// mongo evaluates the operators of a /record/query/ selection
+		db = services.NativeSelectors(db)
+		log.Printf("\tConnected to mongo@%s", c.DB.Addr)
 	default:
-		log.Fatal("Unrecognized database type: '%s'", *dbtype)
+		log.Fatalf("Unrecognized database type: '%s'", c.DB.Type)
 	}
 	log.Printf("== Set up Database ==")
 
+	readiness := services.NewReadiness(services.DefaultCheckTimeout)
+
 	// DB CLIENT
-	conn, err := grpc.Dial(":3334", grpc.WithInsecure())
+	conn, err := grpc.Dial(c.GRPC.AccessDB, grpc.WithInsecure())
 	if err != nil {
 		log.Fatalf("failed to dial: %v", err)
 	}
 	defer conn.Close()
 	adbc := access.NewDBClient(conn)
+	readiness.Add("access_db", grpcCheck(conn))
 
 	// AUTH CLIENT
-	conn, err = grpc.Dial(":3333", grpc.WithInsecure())
+	conn, err = grpc.Dial(c.GRPC.Auth, grpc.WithInsecure())
 	if err != nil {
 		log.Fatalf("failed to dial: %v", err)
 	}
 	defer conn.Close()
 	ac := auth.NewAuthClient(conn)
+	readiness.Add("auth", grpcCheck(conn))
 
 	// WEBUI SERVER
-	lis, err := net.Listen("tcp", ":1113")
+	lis, err := net.Listen("tcp", c.GRPC.WebUI)
 	if err != nil {
-		log.Fatalf("failed to listen on :1113: %v", err)
+		log.Fatalf("failed to listen on %s: %v", c.GRPC.WebUI, err)
 	}
 	g := grpc.NewServer()
 	records.RegisterWebUIServer(g, records.Logged(records.NewWebUI(adbc, ac)))
 	go g.Serve(lis)
 
 	// WEB UI CLIENT
-	conn, err = grpc.Dial(":1113", grpc.WithInsecure())
+	conn, err = grpc.Dial(c.GRPC.WebUI, grpc.WithInsecure())
 	if err != nil {
 		log.Fatalf("failed to dial: %v", err)
 	}
 	defer conn.Close()
 	webuiclient := records.NewWebUIClient(conn)
+	readiness.Add("webui", grpcCheck(conn))
 
 	// calendar WEBUI SERVER
-	lis, err = net.Listen("tcp", ":1114")
+	lis, err = net.Listen("tcp", c.GRPC.CalWebUI)
 	if err != nil {
-		log.Fatalf("failed to listen on :1114: %v", err)
+		log.Fatalf("failed to listen on %s: %v", c.GRPC.CalWebUI, err)
 	}
 	g = grpc.NewServer()
 	cal.RegisterWebUIServer(g, cal.NewWebUI(adbc, ac))
 	go g.Serve(lis)
 
 	// cal WEB UI CLIENT
-	conn, err = grpc.Dial(":1114", grpc.WithInsecure())
+	conn, err = grpc.Dial(c.GRPC.CalWebUI, grpc.WithInsecure())
 	if err != nil {
 		log.Fatalf("failed to dial: %v", err)
 	}
 	defer conn.Close()
 	calwebui := cal.NewWebUIClient(conn)
+	readiness.Add("cal_webui", grpcCheck(conn))
 
-	if _, _, err := user.Create(db, "u", "p"); err != nil {
-		log.Fatal("user.Create error: %s", err)
+	if c.Bootstrap.Enabled() {
+		if err := bootstrap(db, c.Bootstrap.Public, c.Bootstrap.Private); err != nil {
+			log.Fatalf("bootstrap error: %s", err)
+		}
 	}
 
-	background := context.Background()
+	// background is the context of the sessions and agents, it is cancelled on shutdown
+	background, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// running are the sessions and agents, which are waited on at shutdown
+	var running sync.WaitGroup
 
-	log.Printf("== Connecting to Twilio ==")
-	twilioClient := twilio.NewClient(TwilioAccountSid, TwilioAuthToken, nil)
-	log.Printf("== Connected to Twilio ==")
+	// the sms queue outlives the sessions, so that it delivers their last replies,
+	// it is stopped once they have ended
+	queueContext, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	var queueRunning sync.WaitGroup
+
+	log.Printf("== Setting Up SMS Providers ==")
+	providers, err := smsProviders(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.Twilio.Enabled() {
+		// so that each probe doesn't make a request of twilio
+		readiness.Add("sms_provider", services.CachedCheck(services.TwilioCheck(c.Twilio.AccountSID, c.Twilio.AuthToken), services.DefaultCheckInterval))
+	}
+	if providers == nil {
+		log.Print("\tNo sms provider is configured, so /command/sms/ is not served")
+	}
+	log.Printf("== Set Up SMS Providers ==")
+
+	// without a provider, the sessions can't be reached, or reply
+	var sender services.SMS = services.NoSMS
+	if providers != nil {
+		log.Printf("== Starting SMS Queue ==")
+		sms, _ := providers.Provider("")
+		log.Printf("\tSending with %s", sms.Name())
+		queueKey := []byte(c.SMS.QueueKey)
+		if len(queueKey) == 0 {
+			log.Print("\tsms.queue_key is not set, so the segments still queued at shutdown won't be resent")
+			queueKey = make([]byte, 32)
+			if _, err := rand.Read(queueKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		smsQueue := services.NewSMSQueue(db, sms, queueKey, c.SMS.Attempts, c.SMS.Backoff.Duration, c.SMS.MaxBackoff.Duration, c.SMS.Interval.Duration)
+		queueRunning.Add(1)
+		go func() {
+			defer queueRunning.Done()
+			smsQueue.Start(queueContext)
+		}()
+		readiness.Add("sms_queue", services.RunningCheck(smsQueue.Running))
+		sender = smsQueue
+		log.Printf("== Started SMS Queue ==")
+	}
 
 	log.Printf("== Starting SMS Command Sessions ==")
-	smsMux := services.NewSMSMux()
-	go smsMux.Start(
-		background,
-		db,
-		services.SMSFromTwilio(twilioClient, TwilioFromNumber),
-	)
+	smsMux := services.NewBoundedSMSMux(c.SMS.MaxSessions, c.SMS.IdleTimeout.Duration, c.SMS.Backlog)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		smsMux.Start(
+			background,
+			db,
+			sender,
+		)
+	}()
 	log.Printf("== Started SMS Command Sessions ==")
 
+	log.Printf("== Starting Web Command Sessions ==")
+	policy := services.ExclusiveWebSessions
+	if c.Web.MultipleSessions {
+		policy = services.MultipleWebSessions
+	}
+	webMux := services.NewWebMuxWithPolicy(policy)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		webMux.Start(background, db)
+	}()
+	log.Printf("== Started Web Command Sessions ==")
+
+	log.Printf("== Starting Mobile Command Sessions ==")
+	mobileMux := services.NewMobileMux(services.DefaultMobileIdleTimeout, services.DefaultMobileOutbox)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		mobileMux.Start(background, db)
+	}()
+	log.Printf("== Started Mobile Command Sessions ==")
+
+	logger, err := newLogger(c.Log.Format, c.Log.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metrics := services.NewMetrics()
+
+	middleware := new(gaia.Middleware)
+	switch c.Log.Access {
+	case "":
+	case "clf":
+		middleware.Register("log", gaia.AccessLog(os.Stdout, gaia.CommonLogFormat))
+	case "json":
+		middleware.Register("log", gaia.AccessLog(os.Stdout, gaia.JSONLogFormat))
+	default:
+		log.Fatalf("Unrecognized access log format: %q", c.Log.Access)
+	}
+
+	// the certificate manager answers the CA's challenges itself
+	var wellKnown services.WellKnownFileSystem
+	if c.LetsencryptDir != "" && !c.ACME.Enabled() {
+		wellKnown = http.Dir(c.LetsencryptDir)
+	}
+
+	// without admins, the admin endpoints are not served
+	var admins services.Admins
+	if len(c.Admins) > 0 {
+		admins = services.NewAdmins(c.Admins...)
+	}
+
 	log.Printf("== Initiliazing Gaia Core ==")
 	ga := gaia.New(
 		context.Background(),
-		new(gaia.Middleware),
+		middleware,
 		&gaia.Services{
-			AppFileSystem:      http.Dir(*appdir),
-			SMSCommandSessions: smsMux,
-			DB:                 db,
-			Logger:             services.NewLogger(os.Stderr),
-			WebUIClient:        webuiclient,
-			CalWebUIClient:     calwebui,
+			AppFileSystem:         http.Dir(c.AppDir),
+			WellKnownFileSystem:   wellKnown,
+			SMSProviders:          providers,
+			SMSCommandSessions:    smsMux,
+			WebCommandSessions:    webMux,
+			MobileCommandSessions: mobileMux,
+			DB:                    db,
+			Logger:                logger,
+			WebUIClient:           webuiclient,
+			CalWebUIClient:        calwebui,
+			CORSPolicy:            services.NewCORSPolicy(c.Origins, services.DefaultCORSMaxAge),
+			Metrics:               metrics,
+			Readiness:             readiness,
+			Admins:                admins,
 		},
 	)
 	log.Printf("== Initiliazed Gaia Core ==")
 
 	log.Printf("== Starting Agents ===")
 	user.Map(db, func(db data.DB, u *models.User) error {
-		go agents.LocationAgent(background, db, u)
-		go agents.TaskAgent(background, db, u)
-		go agents.WebSensorsAgent(background, db, u)
+		runAgent(&running, metrics, "location", func() { agents.LocationAgent(background, db, u) })
+		runAgent(&running, metrics, "task", func() { agents.TaskAgent(background, db, u) })
+		runAgent(&running, metrics, "web_sensors", func() { agents.WebSensorsAgent(background, db, u) })
 		return nil
 	})
 	log.Printf("== Started Agents ===")
 
 	log.Printf("== Starting HTTP Server ==")
-	host := fmt.Sprintf("%s:%d", *addr, *port)
+	host := fmt.Sprintf("%s:%d", c.Addr, c.Port)
 	log.Printf("\tServing on %s", host)
-	if *certFile != "" && *keyFile != "" {
-		if *port != 443 {
+	proxies, err := gaia.ParseProxies(c.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// a request forwarded by a proxy is from the client it names
+	server := &http.Server{Addr: host, Handler: gaia.TrustProxies(ga, proxies)}
+	// the change feeds would otherwise hold up draining the server
+	server.RegisterOnShutdown(ga.Close)
+
+	// redirect, when serving HTTPS, redirects HTTP requests to it
+	var redirect *http.Server
+	var challenges func(http.Handler) http.Handler
+
+	served := make(chan error, 3)
+	if c.HTTPS() {
+		if c.Port != 443 {
 			log.Print("WARNING: serving HTTPS on a port that isn't 443")
 		}
+		server.Handler = https.HSTS(server.Handler, c.HSTS.MaxAge.Duration, c.HSTS.IncludeSubdomains)
 
-		if err = http.ListenAndServeTLS(host, *certFile, *keyFile, ga); err != nil {
-			log.Fatal(err)
+		certFile, keyFile := c.TLS.CertFile, c.TLS.KeyFile
+		if c.ACME.Enabled() {
+			log.Printf("\tObtaining certificates for %s", strings.Join(c.ACME.Hosts, ", "))
+			m, err := https.Manager(&c.ACME)
+			if err != nil {
+				log.Fatalf("https.Manager error: %s", err)
+			}
+			server.TLSConfig = m.TLSConfig()
+			certFile, keyFile = "", "" // the manager's
+			challenges = m.HTTPHandler
+		}
+
+		if c.RedirectAddr != "" {
+			log.Printf("\tRedirecting HTTP on %s", c.RedirectAddr)
+			redirect = &http.Server{Addr: c.RedirectAddr, Handler: https.Redirect(c.Port)}
+			if challenges != nil {
+				redirect.Handler = challenges(redirect.Handler)
+			}
+			go func() { served <- redirect.ListenAndServe() }()
 		}
+
+		go func() { served <- server.ListenAndServeTLS(certFile, keyFile) }()
 	} else {
 		log.Print("NOT SERVING SECURELY")
-		if *port != 80 {
+		if c.Port != 80 {
 			log.Print("WARNING: serving HTTP on a port that isn't 80")
 		}
-		if err = http.ListenAndServe(host, ga); err != nil {
-			log.Fatal(err)
-		}
+		go func() { served <- server.ListenAndServe() }()
+	}
+
+	// the metrics, which aren't authenticated, are served apart from gaia
+	var metricsServer *http.Server
+	if c.MetricsAddr != "" {
+		log.Printf("\tServing metrics on %s", c.MetricsAddr)
+		metricsServer = &http.Server{Addr: c.MetricsAddr, Handler: ga.MetricsHandler()}
+		go func() { served <- metricsServer.ListenAndServe() }()
 	}
 	log.Printf("== Started HTTP Server ==")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("== Shutting Down (%s) ==", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Grace.Duration)
+	defer cancel()
+
+	log.Printf("\tDraining HTTP requests")
+	if redirect != nil {
+		if err := redirect.Shutdown(ctx); err != nil {
+			log.Printf("\tredirect.Shutdown error: %s", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("\tserver.Shutdown error: %s", err)
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			log.Printf("\tmetricsServer.Shutdown error: %s", err)
+		}
+	}
+	log.Printf("\tClosing websockets")
+	if err := ga.Shutdown(ctx); err != nil {
+		log.Printf("\tga.Shutdown error: %s", err)
+	}
+
+	log.Printf("\tEnding command sessions and agents")
+	stop()
+	if err := wait(ctx, &running); err != nil {
+		log.Printf("\tgave up waiting for the command sessions and agents: %s", err)
+	}
+	log.Printf("\tStopping the sms queue")
+	stopQueue()
+	if err := wait(ctx, &queueRunning); err != nil {
+		log.Printf("\tgave up waiting for the sms queue: %s", err)
+	}
+	log.Printf("== Shut Down ==")
+}
+
+// wait waits for the group, or until the context is done
+func wait(ctx context.Context, group *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// grpcCheck checks that the connection is usable, an idle connection connects when it is
+// next used, so it is considered ready. The error is public, so it doesn't name the target.
+func grpcCheck(conn *grpc.ClientConn) services.Check {
+	return func(ctx context.Context) error {
+		switch state := conn.GetState(); state {
+		case connectivity.Ready, connectivity.Idle:
+			return nil
+		default:
+			return fmt.Errorf("grpc connection is %s", state)
+		}
+	}
+}
+
+// runAgent runs the agent, adding it to the running group and counting it in the metrics while it runs
+func runAgent(running *sync.WaitGroup, metrics services.Metrics, name string, agent func()) {
+	running.Add(1)
+	metrics.Add(services.AgentsMetric, 1, name)
+
+	go func() {
+		defer running.Done()
+		defer metrics.Add(services.AgentsMetric, -1, name)
+
+		agent()
+	}()
+}
+
+// newLogger constructs the logger of the format, at the level
+func newLogger(format, level string) (services.Logger, error) {
+	lvl, err := services.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "text":
+		return services.NewLogger(os.Stderr).AtLevel(lvl), nil
+	case "json":
+		return services.NewJSONLogger(os.Stderr).AtLevel(lvl), nil
+	default:
+		return nil, fmt.Errorf("unrecognized log format: %q", format)
+	}
+}
+
+// bootstrap creates the user with the credential, unless the credential already exists
+func bootstrap(db data.DB, public, private string) error {
+	switch _, err := maccess.Authenticate(db, public, private); err {
+	case nil:
+		return nil
+	case data.ErrNotFound:
+		_, _, err := user.Create(db, public, private)
+		return err
+	default:
+		return err
+	}
+}
+
+// smsProviders constructs every provider which is configured, the first,
+// and so the default, is that which the configuration selects. It is nil
+// if there are none, in which case sms are not served.
+func smsProviders(c *config.Config) (services.SMSProviders, error) {
+	var providers []services.SMSProvider
+
+	if c.Twilio.Enabled() {
+		twilioClient := twilio.NewClient(c.Twilio.AccountSID, c.Twilio.AuthToken, nil)
+		providers = append(providers, services.SMSFromTwilio(twilioClient, c.Twilio.From, c.Twilio.AuthToken))
+	}
+
+	if c.Plivo.Enabled() {
+		providers = append(providers, services.NewPlivoSMS(c.Plivo.AuthID, c.Plivo.AuthToken, c.Plivo.From))
+	}
+
+	if c.Nexmo.Enabled() {
+		providers = append(providers, services.NewNexmoSMS(c.Nexmo.APIKey, c.Nexmo.APISecret, c.Nexmo.From, c.Nexmo.SignatureSecret, c.Nexmo.SignatureMethod))
+	}
+
+	if c.SMSProvider() == config.LoopbackProvider {
+		log.Print("WARNING: sms are sent by the loopback provider, which is for development")
+
+		var w io.Writer = os.Stderr
+		if c.SMS.LoopbackFile != "" {
+			f, err := os.OpenFile(c.SMS.LoopbackFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			w = f
+		}
+
+		providers = append(providers, services.NewLoopbackSMS(w))
+	}
+
+	if len(providers) == 0 {
+		return nil, nil
+	}
+
+	// the selected provider is the default
+	for i, p := range providers {
+		if p.Name() == c.SMSProvider() {
+			providers[0], providers[i] = providers[i], providers[0]
+		}
+	}
+
+	return services.NewSMSProviders(providers...), nil
 }
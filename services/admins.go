@@ -0,0 +1,23 @@
+package services
+
+// Admins are the users who may administer gaia, such as by ending the sms command sessions of others
+type Admins interface {
+	// Admin determines whether the user of the id is an admin
+	Admin(userID string) bool
+}
+
+type admins map[string]bool
+
+// NewAdmins constructs the admins, of the user ids
+func NewAdmins(ids ...string) admins {
+	a := make(admins, len(ids))
+	for _, id := range ids {
+		a[id] = true
+	}
+
+	return a
+}
+
+func (a admins) Admin(userID string) bool {
+	return a[userID]
+}
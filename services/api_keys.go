@@ -0,0 +1,318 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/models"
+)
+
+// The verbs of a scope
+const (
+	ReadVerb  = "read"
+	WriteVerb = "write"
+)
+
+// AnyTarget is the target of a scope which applies to every kind and endpoint
+const AnyTarget = "*"
+
+// apiKeyPrefix begins every api key token, so that they are recognizable in the wild
+const apiKeyPrefix = "elos_"
+
+// APIKeyEvent is the name of the events in which the api keys are kept. The events have no
+// owner, so that no user may read them as records, the owner is among their data, and the
+// name is reserved, so that no user may make, alter or delete them.
+// The event's data is the id, owner_id, name, scopes and hash (of the token).
+const APIKeyEvent = "API_KEY"
+
+// apiKeyEventIDLength is how much of the hash of a token is the id of its event, that of
+// an object id. So a key is looked up by its token, rather than found among all the keys.
+const apiKeyEventIDLength = 24
+
+var (
+	// ErrAPIKeyNotFound is returned when a key does not exist, or was revoked
+	ErrAPIKeyNotFound = errors.New("services: api key not found")
+
+	// ErrInvalidScope is returned when issuing a key with a malformed scope
+	ErrInvalidScope = errors.New("services: invalid scope")
+)
+
+// A Scope grants an api key a verb on a target, written "<verb>:<target>". The target
+// is either a kind, such as "read:event", an endpoint, such as "write:/mobile/location/",
+// or AnyTarget. A write scope does not grant reading.
+type Scope string
+
+// ParseScope validates the form of a scope
+func ParseScope(s string) (Scope, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", ErrInvalidScope
+	}
+
+	verb, target := s[:i], s[i+1:]
+	if (verb != ReadVerb && verb != WriteVerb) || target == "" {
+		return "", ErrInvalidScope
+	}
+
+	return Scope(s), nil
+}
+
+// Verb is the verb the scope grants
+func (s Scope) Verb() string {
+	return string(s)[:strings.Index(string(s), ":")]
+}
+
+// Target is the kind or endpoint the scope grants the verb on
+func (s Scope) Target() string {
+	return string(s)[strings.Index(string(s), ":")+1:]
+}
+
+// Grants determines whether the scope permits the verb on the target
+func (s Scope) Grants(verb, target string) bool {
+	return s.Verb() == verb && (s.Target() == AnyTarget || s.Target() == target)
+}
+
+// An APIKey is a long-lived credential of a user, which is limited to its scopes.
+// The token of the key is only known when it is issued, the key retains its hash.
+type APIKey struct {
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"owner_id"`
+	Name      string    `json:"name"`
+	Scopes    []Scope   `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Grants determines whether any of the key's scopes permit the verb on any of the targets
+func (k *APIKey) Grants(verb string, targets ...string) bool {
+	for _, s := range k.Scopes {
+		for _, t := range targets {
+			if s.Grants(verb, t) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// APIKeys issues, lists, revokes and authenticates the api keys of users
+type APIKeys interface {
+	// Issue creates a key, returning it along with its token. The token can not be retrieved again.
+	Issue(ownerID, name string, scopes []Scope) (*APIKey, string, error)
+	// List returns the keys of the owner
+	List(ownerID string) ([]*APIKey, error)
+	// Revoke destroys a key of the owner, it returns ErrAPIKeyNotFound if the owner has no such key
+	Revoke(ownerID, id string) error
+	// Authenticate returns the key of the token, or ErrAPIKeyNotFound
+	Authenticate(token string) (*APIKey, error)
+}
+
+type apiKeyStore struct {
+	db data.DB
+}
+
+// NewAPIKeyStore constructs a key store which keeps the keys in the db, as events
+func NewAPIKeyStore(db data.DB) *apiKeyStore {
+	return &apiKeyStore{db: db}
+}
+
+// IsAPIKeyToken determines whether the token is that of an api key,
+// rather than, for example, the token of a session
+func IsAPIKeyToken(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// hashToken hashes a token for storage, tokens are random so they need no salt
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// random returns n random bytes
+func random(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *apiKeyStore) Issue(ownerID, name string, scopes []Scope) (*APIKey, string, error) {
+	for _, scope := range scopes {
+		if _, err := ParseScope(string(scope)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	id, err := random(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := random(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	k := &APIKey{
+		ID:        hex.EncodeToString(id),
+		OwnerID:   ownerID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+
+	stored := make([]interface{}, len(scopes))
+	for i, scope := range scopes {
+		stored[i] = string(scope)
+	}
+
+	hash := hashToken(token)
+	eventID, err := s.db.ParseID(hash[:apiKeyEventIDLength])
+	if err != nil {
+		return nil, "", err
+	}
+
+	e := models.NewEvent()
+	e.SetID(eventID)
+	e.Name = APIKeyEvent
+	e.CreatedAt, e.UpdatedAt, e.Time = k.CreatedAt, k.CreatedAt, k.CreatedAt
+	e.Data = map[string]interface{}{
+		"id":       k.ID,
+		"owner_id": ownerID,
+		"name":     name,
+		"scopes":   stored,
+		"hash":     hash,
+	}
+
+	if err := s.db.Save(e); err != nil {
+		return nil, "", err
+	}
+
+	return k, token, nil
+}
+
+func (s *apiKeyStore) List(ownerID string) ([]*APIKey, error) {
+	keys := make([]*APIKey, 0)
+	err := s.each(func(e *models.Event, k *APIKey) bool {
+		if k.OwnerID == ownerID {
+			keys = append(keys, k)
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+func (s *apiKeyStore) Revoke(ownerID, id string) error {
+	var revoked *models.Event
+	err := s.each(func(e *models.Event, k *APIKey) bool {
+		if k.OwnerID == ownerID && k.ID == id {
+			revoked = e
+		}
+		return revoked == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if revoked == nil {
+		return ErrAPIKeyNotFound
+	}
+
+	return s.db.Delete(revoked)
+}
+
+func (s *apiKeyStore) Authenticate(token string) (*APIKey, error) {
+	if !IsAPIKeyToken(token) {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	hash := hashToken(token)
+	id, err := s.db.ParseID(hash[:apiKeyEventIDLength])
+	if err != nil {
+		return nil, err
+	}
+
+	e := models.NewEvent()
+	e.SetID(id)
+	if err := s.db.PopulateByID(e); err == data.ErrNotFound {
+		return nil, ErrAPIKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the events which have an owner were not made by the store
+	stored, _ := e.Data["hash"].(string)
+	if e.OwnerId != "" || e.Name != APIKeyEvent || subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) != 1 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	return apiKeyOf(e), nil
+}
+
+// each calls the function with each key, and its event, until it returns false. The events
+// which have an owner were not made by the store, as a user may make an event of any name.
+func (s *apiKeyStore) each(f func(e *models.Event, k *APIKey) bool) error {
+	iter, err := s.db.Query(models.EventKind).Select(data.AttrMap{"name": APIKeyEvent}).Execute()
+	if err != nil {
+		return err
+	}
+
+	e := models.NewEvent()
+	for iter.Next(e) {
+		if e.OwnerId != "" {
+			continue
+		}
+
+		if !f(e, apiKeyOf(e)) {
+			break
+		}
+		e = models.NewEvent()
+	}
+
+	return iter.Close()
+}
+
+// apiKeyOf reads the key of its event
+func apiKeyOf(e *models.Event) *APIKey {
+	id, _ := e.Data["id"].(string)
+	ownerID, _ := e.Data["owner_id"].(string)
+	name, _ := e.Data["name"].(string)
+
+	return &APIKey{
+		ID:        id,
+		OwnerID:   ownerID,
+		Name:      name,
+		Scopes:    dataScopes(e.Data["scopes"]),
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// dataScopes reads the scopes of an event's data, which, depending on
+// the database, may have been retrieved as strings, or as interfaces
+func dataScopes(v interface{}) []Scope {
+	var scopes []Scope
+
+	switch ss := v.(type) {
+	case []string:
+		for _, s := range ss {
+			scopes = append(scopes, Scope(s))
+		}
+	case []interface{}:
+		for _, s := range ss {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, Scope(str))
+			}
+		}
+	}
+
+	return scopes
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/elos/data"
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/models"
+)
+
+func TestScopeGrants(t *testing.T) {
+	cases := []struct {
+		scope        string
+		verb, target string
+		want         bool
+	}{
+		{"read:event", ReadVerb, "event", true},
+		{"read:event", WriteVerb, "event", false},
+		{"read:event", ReadVerb, "task", false},
+		{"write:/mobile/location/", WriteVerb, "/mobile/location/", true},
+		{"write:/mobile/location/", ReadVerb, "/mobile/location/", false},
+		{"read:*", ReadVerb, "task", true},
+	}
+
+	for _, c := range cases {
+		s, err := ParseScope(c.scope)
+		if err != nil {
+			t.Fatalf("ParseScope(%q) error: %s", c.scope, err)
+		}
+
+		if got := s.Grants(c.verb, c.target); got != c.want {
+			t.Errorf("%s grants %s on %s: got %t, want %t", c.scope, c.verb, c.target, got, c.want)
+		}
+	}
+
+	for _, invalid := range []string{"event", "delete:event", "read:"} {
+		if _, err := ParseScope(invalid); err != ErrInvalidScope {
+			t.Errorf("ParseScope(%q): got %v, want %v", invalid, err, ErrInvalidScope)
+		}
+	}
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	db := mem.NewDB()
+	s := NewAPIKeyStore(db)
+
+	k, token, err := s.Issue("owner", "integration", []Scope{"read:event"})
+	if err != nil {
+		t.Fatalf("s.Issue error: %s", err)
+	}
+
+	if _, err := s.Authenticate(token + "x"); err != ErrAPIKeyNotFound {
+		t.Errorf("s.Authenticate(bad token): got %v, want %v", err, ErrAPIKeyNotFound)
+	}
+
+	// the keys outlive the store
+	s = NewAPIKeyStore(db)
+
+	authed, err := s.Authenticate(token)
+	if err != nil {
+		t.Fatalf("s.Authenticate error: %s", err)
+	}
+	if got, want := authed.ID, k.ID; got != want {
+		t.Errorf("authed.ID: got %q, want %q", got, want)
+	}
+	if len(authed.Scopes) != 1 || authed.Scopes[0] != "read:event" {
+		t.Errorf("authed.Scopes: got %v, want [read:event]", authed.Scopes)
+	}
+
+	// an event of a user, which looks like a key, is not one, even at the id of its token
+	forgedID, err := db.ParseID(hashToken(apiKeyPrefix + "forged")[:apiKeyEventIDLength])
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := models.NewEvent()
+	forged.SetID(forgedID)
+	forged.OwnerId = "owner"
+	forged.Name = APIKeyEvent
+	forged.Data = map[string]interface{}{"id": "forged", "owner_id": "owner", "hash": hashToken(apiKeyPrefix + "forged")}
+	if err := db.Save(forged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(apiKeyPrefix + "forged"); err != ErrAPIKeyNotFound {
+		t.Errorf("s.Authenticate(forged token): got %v, want %v", err, ErrAPIKeyNotFound)
+	}
+
+	if keys, _ := s.List("owner"); len(keys) != 1 {
+		t.Errorf("len(s.List(\"owner\")): got %d, want 1", len(keys))
+	}
+	if keys, _ := s.List("other"); len(keys) != 0 {
+		t.Errorf("len(s.List(\"other\")): got %d, want 0", len(keys))
+	}
+
+	if err := s.Revoke("other", k.ID); err != ErrAPIKeyNotFound {
+		t.Errorf("s.Revoke(\"other\", k.ID): got %v, want %v", err, ErrAPIKeyNotFound)
+	}
+	if err := s.Revoke("owner", k.ID); err != nil {
+		t.Fatalf("s.Revoke error: %s", err)
+	}
+	if _, err := s.Authenticate(token); err != ErrAPIKeyNotFound {
+		t.Errorf("s.Authenticate(revoked token): got %v, want %v", err, ErrAPIKeyNotFound)
+	}
+}
+
+// queryCountingDB counts the queries of the db
+type queryCountingDB struct {
+	data.DB
+	queries int
+}
+
+func (db *queryCountingDB) Query(k data.Kind) data.Query {
+	db.queries++
+	return db.DB.Query(k)
+}
+
+func TestAPIKeyAuthenticateByID(t *testing.T) {
+	db := &queryCountingDB{DB: mem.NewDB()}
+	s := NewAPIKeyStore(db)
+
+	var token string
+	for i := 0; i < 10; i++ {
+		_, issued, err := s.Issue("owner", "integration", []Scope{"read:event"})
+		if err != nil {
+			t.Fatalf("s.Issue error: %s", err)
+		}
+		token = issued
+	}
+
+	// a key is looked up by its token, not found among the others
+	db.queries = 0
+	if _, err := s.Authenticate(token); err != nil {
+		t.Fatalf("s.Authenticate error: %s", err)
+	}
+	if _, err := s.Authenticate(apiKeyPrefix + "unknown"); err != ErrAPIKeyNotFound {
+		t.Errorf("s.Authenticate(unknown token): got %v, want %v", err, ErrAPIKeyNotFound)
+	}
+	if got, want := db.queries, 0; got != want {
+		t.Errorf("queries: got %d, want %d", got, want)
+	}
+}
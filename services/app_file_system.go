@@ -5,3 +5,8 @@ import "net/http"
 type AppFileSystem interface {
 	http.FileSystem
 }
+
+// WellKnownFileSystem is served at /.well-known/, e.g. letsencrypt's challenges
+type WellKnownFileSystem interface {
+	http.FileSystem
+}
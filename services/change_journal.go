@@ -0,0 +1,163 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/elos/data"
+	"golang.org/x/net/context"
+)
+
+// DefaultJournalSize is the number of changes a journal retains, if not otherwise specified
+const DefaultJournalSize = 1024
+
+// subscriberBuffer is the number of changes a subscriber may fall behind by before
+// it is dropped. A dropped subscriber can resume from the journal.
+const subscriberBuffer = 64
+
+// SequencedChange is a *data.Change numbered in the order the journal received it
+type SequencedChange struct {
+	Seq uint64
+	*data.Change
+}
+
+// ChangeJournal numbers the changes of a database and retains the most recent of them,
+// so that a subscriber which is disconnected can resume where it left off.
+type ChangeJournal interface {
+	// Subscribe returns the retained changes numbered after since, and a channel of the
+	// changes to come. The channel is closed when the context is done, or if the subscriber
+	// falls too far behind.
+	//
+	// If the changes after since are no longer all retained, or since is from before the journal
+	// was started (by a previous run of the server), the subscriber has missed changes, there is no
+	// backlog and reset is the sequence number after which the channel's changes follow. Otherwise
+	// reset is zero.
+	Subscribe(ctx context.Context, since uint64) (backlog []*SequencedChange, live <-chan *SequencedChange, reset uint64)
+}
+
+type journal struct {
+	sync.Mutex
+	start, seq  uint64
+	size        int
+	changes     []*SequencedChange
+	subscribers map[chan *SequencedChange]bool
+}
+
+// NewChangeJournal constructs a journal which retains the given number of changes.
+//
+// Sequence numbers begin at the time the journal is constructed, in microseconds, so
+// that they continue to increase across restarts of the server.
+func NewChangeJournal(size int) *journal {
+	if size <= 0 {
+		size = DefaultJournalSize
+	}
+
+	start := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	return &journal{
+		start:       start,
+		seq:         start,
+		size:        size,
+		changes:     make([]*SequencedChange, 0, size),
+		subscribers: make(map[chan *SequencedChange]bool),
+	}
+}
+
+// Start numbers and records the changes of the db until the context is done
+func (j *journal) Start(ctx context.Context, db data.DB) {
+	changes := db.Changes()
+
+Run:
+	for {
+		select {
+		case c, ok := <-*changes:
+			if !ok {
+				log.Print("services.(*journal).Start: db changes closed")
+				break Run
+			}
+
+			j.record(c)
+		case <-ctx.Done():
+			break Run
+		}
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	for s := range j.subscribers {
+		delete(j.subscribers, s)
+		close(s)
+	}
+}
+
+// record numbers the change, retains it, and delivers it to the subscribers
+func (j *journal) record(c *data.Change) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.seq++
+	sc := &SequencedChange{Seq: j.seq, Change: c}
+
+	if len(j.changes) == j.size {
+		copy(j.changes, j.changes[1:])
+		j.changes = j.changes[:j.size-1]
+	}
+	j.changes = append(j.changes, sc)
+
+	for s := range j.subscribers {
+		select {
+		case s <- sc:
+		default:
+			// this subscriber has fallen behind, it will have to resume
+			delete(j.subscribers, s)
+			close(s)
+		}
+	}
+}
+
+func (j *journal) Subscribe(ctx context.Context, since uint64) ([]*SequencedChange, <-chan *SequencedChange, uint64) {
+	j.Lock()
+	defer j.Unlock()
+
+	var backlog []*SequencedChange
+	var reset uint64
+	if since > 0 {
+		if j.missed(since) {
+			reset = j.seq
+		} else {
+			for _, c := range j.changes {
+				if c.Seq > since {
+					backlog = append(backlog, c)
+				}
+			}
+		}
+	}
+
+	s := make(chan *SequencedChange, subscriberBuffer)
+	j.subscribers[s] = true
+
+	go func() {
+		<-ctx.Done()
+
+		j.Lock()
+		defer j.Unlock()
+		if j.subscribers[s] {
+			delete(j.subscribers, s)
+			close(s)
+		}
+	}()
+
+	return backlog, s, reset
+}
+
+// missed determines whether changes after since are not retained. The since may be from before the
+// journal started, the changes since were never received, or after its sequence number, which this
+// journal never gave (perhaps it was given by another server), either way it can't be resumed from.
+func (j *journal) missed(since uint64) bool {
+	if since < j.start || since > j.seq {
+		return true
+	}
+
+	// the change after since has been discarded
+	return len(j.changes) > 0 && since < j.changes[0].Seq-1
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+func TestJournalSubscribeSince(t *testing.T) {
+	j := NewChangeJournal(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		j.record(data.NewChange(data.Update, models.NewTask()))
+	}
+
+	first := j.seq - 4
+
+	// only the last three are retained
+	backlog, _, reset := j.Subscribe(ctx, first+1)
+	if got, want := len(backlog), 3; got != want {
+		t.Fatalf("len(backlog): got %d, want %d", got, want)
+	}
+	if got, want := backlog[0].Seq, first+2; got != want {
+		t.Errorf("backlog[0].Seq: got %d, want %d", got, want)
+	}
+	if reset != 0 {
+		t.Errorf("reset: got %d, want 0", reset)
+	}
+
+	backlog, _, _ = j.Subscribe(ctx, j.seq-1)
+	if got, want := len(backlog), 1; got != want {
+		t.Fatalf("len(backlog): got %d, want %d", got, want)
+	}
+
+	// a since of zero means no replay
+	backlog, live, _ := j.Subscribe(ctx, 0)
+	if got, want := len(backlog), 0; got != want {
+		t.Fatalf("len(backlog): got %d, want %d", got, want)
+	}
+
+	j.record(data.NewChange(data.Delete, models.NewTask()))
+
+	select {
+	case c := <-live:
+		if got, want := c.Seq, j.seq; got != want {
+			t.Errorf("c.Seq: got %d, want %d", got, want)
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("Timed out waiting for change")
+	}
+}
+
+func TestJournalDropsSlowSubscriber(t *testing.T) {
+	j := NewChangeJournal(DefaultJournalSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, live, _ := j.Subscribe(ctx, 0)
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		j.record(data.NewChange(data.Update, models.NewTask()))
+	}
+
+	for i := 0; i < subscriberBuffer; i++ {
+		<-live
+	}
+
+	if _, ok := <-live; ok {
+		t.Fatal("The subscriber should have been dropped")
+	}
+}
+
+func TestJournalSubscribeReset(t *testing.T) {
+	j := NewChangeJournal(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		j.record(data.NewChange(data.Update, models.NewTask()))
+	}
+
+	cases := map[string]uint64{
+		"changes were discarded":     j.seq - 4,
+		"before the journal started": j.start - 1,
+		"never given by the journal": j.seq + 1,
+	}
+
+	for name, since := range cases {
+		backlog, _, reset := j.Subscribe(ctx, since)
+		if len(backlog) != 0 || reset != j.seq {
+			t.Errorf("%s: got %d changes and reset %d, want none and reset %d", name, len(backlog), reset, j.seq)
+		}
+	}
+
+	// a subscriber which saw the last change missed nothing
+	if _, _, reset := j.Subscribe(ctx, j.seq); reset != 0 {
+		t.Errorf("reset: got %d, want 0", reset)
+	}
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/elos/data"
+	"github.com/elos/elos/command"
+	"github.com/elos/models"
+)
+
+// sessionStarter runs a command session, it is command.Session's, unless a test replaces it
+type sessionStarter func(u *models.User, db data.DB, input <-chan string, output chan<- string, bail func())
+
+func startCommandSession(u *models.User, db data.DB, input <-chan string, output chan<- string, bail func()) {
+	command.NewSession(u, db, input, output, bail).Start()
+}
+
+// commandQueue is the input of a command session which is waiting to be read. It is
+// guarded by the lock of the mux it belongs to.
+type commandQueue struct {
+	// pending are the inputs waiting to be read, in the order they arrived
+	pending []string
+	// ready signals the pump that an input is pending
+	ready chan struct{}
+	// done is closed once the session is ended
+	done chan struct{}
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// push appends the input, and wakes the pump. The caller must hold the lock.
+func (q *commandQueue) push(text string) {
+	q.pending = append(q.pending, text)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// end closes the done channel, unless it is already closed, it returns whether it closed
+// it. The caller must hold the lock.
+func (q *commandQueue) end() bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	close(q.done)
+	return true
+}
+
+// pump delivers the pending inputs, one at a time, in order, taking the lock to read them.
+// It is the only writer of the input, so it closes it once the session is done.
+func (q *commandQueue) pump(mu sync.Locker, input chan<- string) {
+	defer close(input)
+
+	for {
+		mu.Lock()
+		if len(q.pending) == 0 {
+			mu.Unlock()
+
+			select {
+			case <-q.ready:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		text := q.pending[0]
+		mu.Unlock()
+
+		select {
+		case input <- text:
+			mu.Lock()
+			q.pending = q.pending[1:]
+			mu.Unlock()
+		case <-q.done:
+			return
+		}
+	}
+}
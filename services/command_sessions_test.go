@@ -0,0 +1,60 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/elos/data"
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+// echoSession is a command session which echoes its input, until it is told to exit
+func echoSession(u *models.User, db data.DB, input <-chan string, output chan<- string, bail func()) {
+	defer close(output)
+
+	for text := range input {
+		if text == "exit" {
+			bail()
+			return
+		}
+
+		output <- "echo: " + text
+	}
+}
+
+// stuckSession is a command session which never reads its input
+func stuckSession(u *models.User, db data.DB, input <-chan string, output chan<- string, bail func()) {
+}
+
+// startMux sets the starter of the mux's sessions, and starts it with a db, it returns a
+// function which stops the mux, and waits for it to return
+func startMux(startSession *sessionStarter, starter sessionStarter, start func(context.Context, data.DB)) func() {
+	*startSession = starter
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		start(ctx, mem.NewDB())
+		close(stopped)
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// concurrently runs the routine on n goroutines, each given its index, and waits for them
+// to return. The tests which use it are meant for the race detector.
+func concurrently(n int, routine func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			routine(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"strings"
+	"time"
+)
+
+// AnyOrigin, in the allowlist of a CORS policy, allows any origin to make
+// requests, but not credentialed ones
+const AnyOrigin = "*"
+
+// DefaultCORSMaxAge is how long a browser may cache the response to a preflight request
+const DefaultCORSMaxAge = 10 * time.Minute
+
+// A CORSRule is what a CORS policy allows of an endpoint
+type CORSRule struct {
+	// Methods are the methods other origins may use, if empty the endpoint's methods
+	Methods []string
+	// Headers are the request headers other origins may send
+	Headers []string
+	// ExposedHeaders are the response headers other origins may read
+	ExposedHeaders []string
+}
+
+// A CORSPolicy decides which cross origin requests the API allows
+type CORSPolicy interface {
+	// AllowOrigin determines whether the origin may make requests, and whether
+	// those requests may carry credentials (cookies or basic auth)
+	AllowOrigin(origin string) (allowed bool, credentials bool)
+	// Rule is what the policy allows of the endpoint of the path
+	Rule(path string) *CORSRule
+	// MaxAge is how long a browser may cache the response to a preflight request
+	MaxAge() time.Duration
+}
+
+type corsPolicy struct {
+	origins map[string]bool
+	maxAge  time.Duration
+	rule    *CORSRule
+	routes  map[string]*CORSRule
+}
+
+// NewCORSPolicy constructs a policy which allows the origins, such as "https://elos.io", to make
+// credentialed requests. An AnyOrigin allows any other origin to make uncredentialed requests.
+// Every endpoint is subject to the default rule, unless it is given one with Route.
+func NewCORSPolicy(origins []string, maxAge time.Duration) *corsPolicy {
+	if maxAge <= 0 {
+		maxAge = DefaultCORSMaxAge
+	}
+
+	p := &corsPolicy{
+		origins: make(map[string]bool),
+		maxAge:  maxAge,
+		rule: &CORSRule{
+			Headers:        []string{"Authorization", "Content-Type", "Accept", "Last-Event-ID"},
+			ExposedHeaders: []string{"X-Total-Count", "X-Next-Cursor", "Retry-After", "X-Request-ID"},
+		},
+		routes: make(map[string]*CORSRule),
+	}
+
+	for _, o := range origins {
+		p.origins[strings.TrimSuffix(o, "/")] = true
+	}
+
+	return p
+}
+
+// Route gives the endpoint of the path its own rule, in place of the default
+func (p *corsPolicy) Route(path string, rule *CORSRule) {
+	p.routes[path] = rule
+}
+
+func (p *corsPolicy) AllowOrigin(origin string) (bool, bool) {
+	if p.origins[origin] {
+		return true, true
+	}
+
+	return p.origins[AnyOrigin], false
+}
+
+func (p *corsPolicy) Rule(path string) *CORSRule {
+	if r, ok := p.routes[path]; ok {
+		return r
+	}
+
+	return p.rule
+}
+
+func (p *corsPolicy) MaxAge() time.Duration {
+	return p.maxAge
+}
@@ -5,3 +5,16 @@ import "github.com/elos/data"
 type DB interface {
 	data.DB
 }
+
+// reservedEvents are the names of the events which only gaia writes. A user may read those
+// which are theirs, as any other record, but may not make, alter or delete them.
+var reservedEvents = map[string]bool{
+	APIKeyEvent:      true,
+	SMSDeliveryEvent: true,
+	SMSOutboxEvent:   true,
+}
+
+// ReservedEvent determines whether the name is that of events which only gaia writes
+func ReservedEvent(name string) bool {
+	return reservedEvents[name]
+}
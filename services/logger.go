@@ -1,54 +1,285 @@
 package services
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// A Level is the severity of a log entry
+type Level int
+
+// The levels, in increasing severity
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
 )
 
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// ParseLevel parses the name of a level, as Level.String produces it
+func ParseLevel(s string) (Level, error) {
+	for l := DebugLevel; l <= FatalLevel; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return InfoLevel, fmt.Errorf("services: unrecognized log level %q", s)
+}
+
+// A Logger writes leveled, structured, log entries. The leveled methods take a message
+// and alternating keys and values:
+//
+//		l.Warn("sms send failed", "to", number, "error", err)
+//
+// Print and Printf log at InfoLevel. Only Fatal and Fatalf end the process (or test),
+// Error is the path for errors which the server survives.
 type Logger interface {
 	Fatal(v ...interface{})
 	Fatalf(format string, v ...interface{})
 	Print(v ...interface{})
 	Printf(format string, v ...interface{})
 
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+
+	// WithPrefix returns a logger which prefixes every message
 	WithPrefix(s string) Logger
+	// With returns a logger which adds the keys and values to every entry
+	With(kv ...interface{}) Logger
+	// AtLevel returns a logger which discards entries less severe than the level
+	AtLevel(level Level) Logger
+}
+
+// --- Request Scoped Loggers {{{
+
+type loggerContextKey int
+
+const loggerKey loggerContextKey = 0
+
+// NewLoggerContext associates a logger, usually holding the fields of a request, with the context
+func NewLoggerContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// LoggerFromContext retrieves the logger associated with the context, or the fallback if there is none
+func LoggerFromContext(ctx context.Context, fallback Logger) Logger {
+	if l, ok := ctx.Value(loggerKey).(Logger); ok {
+		return l
+	}
+
+	return fallback
 }
 
+// --- }}}
+
+// --- Fields {{{
+
+// missingValue is the value of a key given without one
+const missingValue = "(MISSING)"
+
+// withFields appends the keys and values to a copy of the fields
+func withFields(fields []interface{}, kv []interface{}) []interface{} {
+	if len(kv)%2 != 0 {
+		kv = append(kv, missingValue)
+	}
+
+	f := make([]interface{}, 0, len(fields)+len(kv))
+	f = append(f, fields...)
+	return append(f, kv...)
+}
+
+// formatValue formats a value of a text entry, quoting it if it would be ambiguous
+func formatValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// formatText formats an entry as a line of text
+func formatText(level Level, prefix, msg string, fields []interface{}) string {
+	var b bytes.Buffer
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteString(" ")
+	b.WriteString(prefix)
+	b.WriteString(msg)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteString(" ")
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteString("=")
+		b.WriteString(formatValue(fields[i+1]))
+	}
+
+	return b.String()
+}
+
+// --- }}}
+
 // --- Logger {{{
 
 type logger struct {
-	*log.Logger
+	mu     *sync.Mutex
+	out    io.Writer
+	std    *log.Logger
+	json   bool
+	level  Level
 	prefix string
+	fields []interface{}
+	exit   func(int)
 }
 
+// NewLogger constructs a logger which writes lines of text to the out, at InfoLevel
 func NewLogger(out io.Writer) Logger {
 	return &logger{
-		Logger: log.New(out, "", log.Ldate|log.Ltime|log.Lshortfile),
+		mu:    new(sync.Mutex),
+		out:   out,
+		std:   log.New(out, "", log.Ldate|log.Ltime|log.Lshortfile),
+		level: InfoLevel,
+		exit:  os.Exit,
+	}
+}
+
+// NewJSONLogger constructs a logger which writes each entry to the out as a JSON object, at InfoLevel
+func NewJSONLogger(out io.Writer) Logger {
+	return &logger{
+		mu:    new(sync.Mutex),
+		out:   out,
+		json:  true,
+		level: InfoLevel,
+		exit:  os.Exit,
+	}
+}
+
+// output writes an entry, the calldepth is that of the caller of the Logger method
+func (l *logger) output(calldepth int, level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = withFields(l.fields, kv)
 	}
+
+	if !l.json {
+		l.std.Output(calldepth+2, formatText(level, l.prefix, msg, fields))
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   l.prefix + msg,
+	}
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		entry["caller"] = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		v := fields[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[fmt.Sprint(fields[i])] = v
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": entry["level"],
+			"msg":   entry["msg"],
+			"error": "unmarshallable fields: " + err.Error(),
+		})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
 }
 
 func (l *logger) Fatal(v ...interface{}) {
-	l.Logger.Output(2, fmt.Sprint(v...))
-	os.Exit(1)
+	l.output(1, FatalLevel, fmt.Sprint(v...), nil)
+	l.exit(1)
 }
 
 func (l *logger) Fatalf(format string, v ...interface{}) {
-	l.Output(2, fmt.Sprint(v...))
-	os.Exit(1)
+	l.output(1, FatalLevel, fmt.Sprintf(format, v...), nil)
+	l.exit(1)
 }
 
-func (l *logger) Print(v ...interface{}) { l.Output(2, fmt.Sprint(v...)) }
+func (l *logger) Print(v ...interface{}) { l.output(1, InfoLevel, fmt.Sprint(v...), nil) }
+
+func (l *logger) Printf(format string, v ...interface{}) {
+	l.output(1, InfoLevel, fmt.Sprintf(format, v...), nil)
+}
 
-func (l *logger) Printf(format string, v ...interface{}) { l.Output(2, fmt.Sprintf(format, v...)) }
+func (l *logger) Debug(msg string, kv ...interface{}) { l.output(1, DebugLevel, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.output(1, InfoLevel, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.output(1, WarnLevel, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.output(1, ErrorLevel, msg, kv) }
 
 func (l *logger) WithPrefix(s string) Logger {
-	return &logger{
-		Logger: l.Logger,
-		prefix: l.prefix + s,
-	}
+	c := *l
+	c.prefix = l.prefix + s
+	return &c
+}
+
+func (l *logger) With(kv ...interface{}) Logger {
+	c := *l
+	c.fields = withFields(l.fields, kv)
+	return &c
+}
+
+func (l *logger) AtLevel(level Level) Logger {
+	c := *l
+	c.level = level
+	return &c
 }
 
 // --- }}}
@@ -58,35 +289,68 @@ func (l *logger) WithPrefix(s string) Logger {
 type testLogger struct {
 	testing.TB
 	prefix string
+	fields []interface{}
+	level  Level
 }
 
+// NewTestLogger constructs a logger which logs to the test, at DebugLevel
 func NewTestLogger(tb testing.TB) Logger {
 	return &testLogger{
-		TB: tb,
+		TB:    tb,
+		level: DebugLevel,
+	}
+}
+
+func (t *testLogger) log(level Level, msg string, kv []interface{}) {
+	if level < t.level {
+		return
 	}
+
+	fields := t.fields
+	if len(kv) > 0 {
+		fields = withFields(t.fields, kv)
+	}
+
+	t.TB.Log(formatText(level, t.prefix, msg, fields))
 }
 
 func (t *testLogger) Print(v ...interface{}) {
-	t.TB.Log(v...)
+	t.log(InfoLevel, fmt.Sprint(v...), nil)
 }
 
 func (t *testLogger) Printf(format string, v ...interface{}) {
-	t.TB.Logf(format, v...)
+	t.log(InfoLevel, fmt.Sprintf(format, v...), nil)
 }
 
 func (t *testLogger) Fatal(v ...interface{}) {
-	t.TB.Fatal(v...)
+	t.TB.Fatal(formatText(FatalLevel, t.prefix, fmt.Sprint(v...), t.fields))
 }
 
 func (t *testLogger) Fatalf(format string, v ...interface{}) {
-	t.TB.Fatalf(format, v...)
+	t.TB.Fatal(formatText(FatalLevel, t.prefix, fmt.Sprintf(format, v...), t.fields))
 }
 
+func (t *testLogger) Debug(msg string, kv ...interface{}) { t.log(DebugLevel, msg, kv) }
+func (t *testLogger) Info(msg string, kv ...interface{})  { t.log(InfoLevel, msg, kv) }
+func (t *testLogger) Warn(msg string, kv ...interface{})  { t.log(WarnLevel, msg, kv) }
+func (t *testLogger) Error(msg string, kv ...interface{}) { t.log(ErrorLevel, msg, kv) }
+
 func (t *testLogger) WithPrefix(s string) Logger {
-	return &testLogger{
-		TB:     t.TB,
-		prefix: t.prefix + s,
-	}
+	c := *t
+	c.prefix = t.prefix + s
+	return &c
+}
+
+func (t *testLogger) With(kv ...interface{}) Logger {
+	c := *t
+	c.fields = withFields(t.fields, kv)
+	return &c
+}
+
+func (t *testLogger) AtLevel(level Level) Logger {
+	c := *t
+	c.level = level
+	return &c
 }
 
 // --- Test Logger }}}
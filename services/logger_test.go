@@ -0,0 +1,89 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	out := new(bytes.Buffer)
+	l := NewLogger(out).AtLevel(WarnLevel).WithPrefix("Test: ")
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Print("print")
+	if out.Len() != 0 {
+		t.Fatalf("expected entries below WarnLevel to be discarded, got: %q", out.String())
+	}
+
+	l.Warn("slow response", "path", "/record/", "error", errors.New("timed out"))
+	got := out.String()
+	for _, want := range []string{"WARN Test: slow response", "path=/record/", `error="timed out"`, "logger_test.go"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q to contain %q", got, want)
+		}
+	}
+}
+
+func TestLoggerFatalf(t *testing.T) {
+	out := new(bytes.Buffer)
+	l := NewLogger(out).(*logger)
+
+	code := 0
+	l.exit = func(c int) { code = c }
+
+	l.Fatalf("failed to listen on %s", ":1113")
+
+	if code != 1 {
+		t.Errorf("exit code: got %d, want 1", code)
+	}
+	if got := out.String(); !strings.Contains(got, "FATAL failed to listen on :1113") {
+		t.Errorf("expected the format to be applied, got: %q", got)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	out := new(bytes.Buffer)
+	l := NewJSONLogger(out).With("user_id", "1", "request_id", "abc").WithPrefix("Test: ")
+
+	l.Error("send failed", "attempt", 2, "dangling")
+
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("json.Unmarshal error: %s (%q)", err, out.String())
+	}
+
+	want := map[string]interface{}{
+		"level":      "error",
+		"msg":        "Test: send failed",
+		"user_id":    "1",
+		"request_id": "abc",
+		"attempt":    float64(2),
+		"dangling":   missingValue,
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s: got %v, want %v", k, entry[k], v)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("expected the entry to have a time")
+	}
+}
+
+func TestLoggerContext(t *testing.T) {
+	fallback := NewTestLogger(t)
+	if LoggerFromContext(context.Background(), fallback) != fallback {
+		t.Error("expected the fallback without a logger in the context")
+	}
+
+	l := fallback.With("user_id", "1")
+	if LoggerFromContext(NewLoggerContext(context.Background(), l), fallback) != l {
+		t.Error("expected the logger of the context")
+	}
+}
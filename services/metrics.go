@@ -0,0 +1,425 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elos/data"
+	"golang.org/x/net/context"
+)
+
+// The metrics gaia records, the comment lists the labels of each
+const (
+	// RequestsMetric counts the requests to each endpoint: route, method, status
+	RequestsMetric = "gaia_http_requests_total"
+	// RequestDurationMetric is the latency of the requests to each endpoint: route, status
+	RequestDurationMetric = "gaia_http_request_duration_seconds"
+	// ChangeStreamsMetric is the number of open /record/changes/ streams: transport (websocket or event_stream)
+	ChangeStreamsMetric = "gaia_record_changes_streams"
+	// SMSSessionsMetric is the number of live sms command sessions
+	SMSSessionsMetric = "gaia_sms_command_sessions"
+	// WebSessionsMetric is the number of live web command sessions
+	WebSessionsMetric = "gaia_web_command_sessions"
+	// MobileSessionsMetric is the number of live mobile command sessions
+	MobileSessionsMetric = "gaia_mobile_command_sessions"
+	// AgentsMetric is the number of running agents: agent
+	AgentsMetric = "gaia_agents"
+	// AccessDenialsMetric counts the records access control denied a request: kind, path (of the endpoint)
+	AccessDenialsMetric = "gaia_access_denials_total"
+	// DBErrorsMetric counts the errors of the database: op, error
+	DBErrorsMetric = "gaia_db_errors_total"
+)
+
+// The types of metric, as the Prometheus text format names them
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// DefaultBuckets are the upper bounds of the buckets of a latency histogram, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics records gaia's metrics, and writes them in the Prometheus text format. The label
+// values are given in the order the metric declares its labels. Recording a metric which
+// was not declared does nothing.
+type Metrics interface {
+	// Inc adds one to the counter
+	Inc(name string, labels ...string)
+	// Add adds the delta, which may be negative, to the gauge
+	Add(name string, delta float64, labels ...string)
+	// Observe records the value in the histogram
+	Observe(name string, v float64, labels ...string)
+	// Func makes the gauge, which has no labels, the value of the fn when the metrics are written
+	Func(name string, fn func() float64)
+	// WritePrometheus writes every metric in the Prometheus text exposition format
+	WritePrometheus(w io.Writer) error
+}
+
+// --- Metrics Context {{{
+
+type metricsContextKey int
+
+const metricsKey metricsContextKey = 0
+
+// NewMetricsContext associates the metrics with the context
+func NewMetricsContext(ctx context.Context, m Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey, m)
+}
+
+// MetricsFromContext retrieves the metrics associated with the context,
+// if there are none it returns metrics which record nothing
+func MetricsFromContext(ctx context.Context) Metrics {
+	if m, ok := ctx.Value(metricsKey).(Metrics); ok {
+		return m
+	}
+
+	return nopMetrics{}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Inc(string, ...string)              {}
+func (nopMetrics) Add(string, float64, ...string)     {}
+func (nopMetrics) Observe(string, float64, ...string) {}
+func (nopMetrics) Func(string, func() float64)        {}
+func (nopMetrics) WritePrometheus(io.Writer) error    { return nil }
+
+// --- }}}
+
+// --- Registry {{{
+
+// series is the value of a metric for one set of label values
+type series struct {
+	labels []string
+	value  float64  // of a counter or gauge, the sum of a histogram
+	counts []uint64 // of a histogram, per bucket, not cumulative
+	count  uint64   // of a histogram
+}
+
+type metric struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+	fn              func() float64
+	series          map[string]*series
+}
+
+type registry struct {
+	sync.Mutex
+	metrics map[string]*metric
+}
+
+// NewMetrics constructs a registry in which every one of gaia's metrics is declared
+func NewMetrics() *registry {
+	r := &registry{
+		metrics: make(map[string]*metric),
+	}
+
+	r.Declare(RequestsMetric, CounterType, "Requests to each endpoint.", nil, "route", "method", "status")
+	r.Declare(RequestDurationMetric, HistogramType, "Latency of the requests to each endpoint, in seconds.", DefaultBuckets, "route", "status")
+	r.Declare(ChangeStreamsMetric, GaugeType, "Open /record/changes/ streams.", nil, "transport")
+	r.Declare(SMSSessionsMetric, GaugeType, "Live sms command sessions.", nil)
+	r.Declare(WebSessionsMetric, GaugeType, "Live web command sessions.", nil)
+	r.Declare(MobileSessionsMetric, GaugeType, "Live mobile command sessions.", nil)
+	r.Declare(AgentsMetric, GaugeType, "Running agents.", nil, "agent")
+	r.Declare(AccessDenialsMetric, CounterType, "Records access control denied a user, by the endpoint.", nil, "kind", "path")
+	r.Declare(DBErrorsMetric, CounterType, "Errors of the database, by the type of data error.", nil, "op", "error")
+
+	return r
+}
+
+// Declare adds a metric to the registry, the buckets are those of a histogram
+func (r *registry) Declare(name, typ, help string, buckets []float64, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.metrics[name] = &metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// get retrieves the series of the metric, which must be of the type, creating it
+// if it did not exist. The caller must hold the lock.
+func (r *registry) get(name, typ string, labels []string) *series {
+	m, ok := r.metrics[name]
+	if !ok || m.typ != typ || len(labels) != len(m.labels) {
+		return nil
+	}
+
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labels...)}
+		if typ == HistogramType {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+func (r *registry) Inc(name string, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if s := r.get(name, CounterType, labels); s != nil {
+		s.value++
+	}
+}
+
+func (r *registry) Add(name string, delta float64, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if s := r.get(name, GaugeType, labels); s != nil {
+		s.value += delta
+	}
+}
+
+func (r *registry) Observe(name string, v float64, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	s := r.get(name, HistogramType, labels)
+	if s == nil {
+		return
+	}
+
+	buckets := r.metrics[name].buckets
+	if i := sort.SearchFloat64s(buckets, v); i < len(buckets) {
+		s.counts[i]++
+	}
+	s.value += v
+	s.count++
+}
+
+func (r *registry) Func(name string, fn func() float64) {
+	r.Lock()
+	defer r.Unlock()
+
+	if m, ok := r.metrics[name]; ok && m.typ == GaugeType && len(m.labels) == 0 {
+		m.fn = fn
+	}
+}
+
+func (r *registry) WritePrometheus(w io.Writer) error {
+	// the funcs may take locks of their own, so they are called without ours
+	r.Lock()
+	funcs := make(map[string]func() float64)
+	for name, m := range r.metrics {
+		if m.fn != nil {
+			funcs[name] = m.fn
+		}
+	}
+	r.Unlock()
+
+	values := make(map[string]float64, len(funcs))
+	for name, fn := range funcs {
+		values[name] = fn()
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for _, name := range names {
+		m := r.metrics[name]
+		fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.typ)
+
+		if v, ok := values[name]; ok {
+			fmt.Fprintf(b, "%s %s\n", m.name, formatFloat(v))
+			continue
+		}
+
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := m.series[k]
+			if m.typ != HistogramType {
+				fmt.Fprintf(b, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+				continue
+			}
+
+			le := append(append([]string(nil), m.labels...), "le")
+			var cumulative uint64
+			for i, upper := range m.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, formatLabels(le, withValue(s.labels, formatFloat(upper))), cumulative)
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, formatLabels(le, withValue(s.labels, "+Inf")), s.count)
+			fmt.Fprintf(b, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+			fmt.Fprintf(b, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labels), s.count)
+		}
+	}
+
+	return b.Flush()
+}
+
+// formatLabels formats the label set of a series, e.g. {route="record",status="200"}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + "=" + strconv.Quote(values[i])
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withValue appends the value to a copy of the label values
+func withValue(values []string, v string) []string {
+	return append(append([]string(nil), values...), v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// --- }}}
+
+// --- Metered DB {{{
+
+// DataErrorType names the type of a data error, for the DBErrorsMetric
+func DataErrorType(err error) string {
+	switch err {
+	case data.ErrNotFound:
+		return "not_found"
+	case data.ErrAccessDenial:
+		return "access_denial"
+	case data.ErrNoConnection:
+		return "no_connection"
+	case data.ErrInvalidID:
+		return "invalid_id"
+	default:
+		return "other"
+	}
+}
+
+type meteredDB struct {
+	data.DB
+	metrics Metrics
+}
+
+// MeteredDB counts the errors of the db's operations, including its queries, in the DBErrorsMetric
+func MeteredDB(db data.DB, m Metrics) data.DB {
+	return &meteredDB{DB: db, metrics: m}
+}
+
+func (db *meteredDB) count(op string, err error) error {
+	if err != nil {
+		db.metrics.Inc(DBErrorsMetric, op, DataErrorType(err))
+	}
+
+	return err
+}
+
+func (db *meteredDB) Save(r data.Record) error {
+	return db.count("save", db.DB.Save(r))
+}
+
+func (db *meteredDB) Delete(r data.Record) error {
+	return db.count("delete", db.DB.Delete(r))
+}
+
+func (db *meteredDB) PopulateByID(r data.Record) error {
+	return db.count("populate_by_id", db.DB.PopulateByID(r))
+}
+
+func (db *meteredDB) PopulateByField(field string, value interface{}, r data.Record) error {
+	return db.count("populate_by_field", db.DB.PopulateByField(field, value, r))
+}
+
+func (db *meteredDB) ParseID(s string) (data.ID, error) {
+	id, err := db.DB.ParseID(s)
+	return id, db.count("parse_id", err)
+}
+
+func (db *meteredDB) Query(k data.Kind) data.Query {
+	return &meteredQuery{Query: db.DB.Query(k), db: db}
+}
+
+// meteredQuery counts the errors of executing the query, and of iterating its results
+type meteredQuery struct {
+	data.Query
+	db *meteredDB
+}
+
+func (q *meteredQuery) Execute() (data.Iterator, error) {
+	iter, err := q.Query.Execute()
+	if err != nil {
+		return nil, q.db.count("query", err)
+	}
+
+	return &meteredIterator{Iterator: iter, db: q.db}, nil
+}
+
+func (q *meteredQuery) Skip(i int) data.Query {
+	q.Query = q.Query.Skip(i)
+	return q
+}
+
+func (q *meteredQuery) Limit(i int) data.Query {
+	q.Query = q.Query.Limit(i)
+	return q
+}
+
+func (q *meteredQuery) Batch(i int) data.Query {
+	q.Query = q.Query.Batch(i)
+	return q
+}
+
+func (q *meteredQuery) Order(fields ...string) data.Query {
+	q.Query = q.Query.Order(fields...)
+	return q
+}
+
+func (q *meteredQuery) Select(attrs data.AttrMap) data.Query {
+	q.Query = q.Query.Select(attrs)
+	return q
+}
+
+// meteredIterator counts the error an iteration ends with, which it returns once closed
+type meteredIterator struct {
+	data.Iterator
+	db *meteredDB
+}
+
+func (i *meteredIterator) Close() error {
+	return i.db.count("query", i.Iterator.Close())
+}
+
+// --- }}}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/elos/data"
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/models"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	m := NewMetrics()
+
+	m.Inc(RequestsMetric, "record", "GET", "200")
+	m.Inc(RequestsMetric, "record", "GET", "200")
+	m.Inc(RequestsMetric, "record", "GET") // the wrong number of labels is ignored
+	m.Inc("undeclared_total")
+	m.Add(ChangeStreamsMetric, 1, "websocket")
+	m.Observe(RequestDurationMetric, 0.02, "record", "200")
+	m.Observe(RequestDurationMetric, 20, "record", "200")
+	m.Func(SMSSessionsMetric, func() float64 { return 3 })
+
+	out := new(bytes.Buffer)
+	if err := m.WritePrometheus(out); err != nil {
+		t.Fatalf("m.WritePrometheus error: %s", err)
+	}
+	got := out.String()
+	t.Log(got)
+
+	for _, want := range []string{
+		"# TYPE gaia_http_requests_total counter\n",
+		`gaia_http_requests_total{route="record",method="GET",status="200"} 2` + "\n",
+		`gaia_record_changes_streams{transport="websocket"} 1` + "\n",
+		`gaia_http_request_duration_seconds_bucket{route="record",status="200",le="0.01"} 0` + "\n",
+		`gaia_http_request_duration_seconds_bucket{route="record",status="200",le="0.025"} 1` + "\n",
+		`gaia_http_request_duration_seconds_bucket{route="record",status="200",le="10"} 1` + "\n",
+		`gaia_http_request_duration_seconds_bucket{route="record",status="200",le="+Inf"} 2` + "\n",
+		`gaia_http_request_duration_seconds_sum{route="record",status="200"} 20.02` + "\n",
+		`gaia_http_request_duration_seconds_count{route="record",status="200"} 2` + "\n",
+		"gaia_sms_command_sessions 3\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the metrics to contain %q", want)
+		}
+	}
+
+	if strings.Contains(got, "undeclared_total") {
+		t.Error("expected an undeclared metric to be ignored")
+	}
+}
+
+func TestMeteredDB(t *testing.T) {
+	m := NewMetrics()
+	db := MeteredDB(mem.NewDB(), m)
+
+	u := models.NewUser()
+	u.SetID(db.NewID())
+	if err := db.PopulateByID(u); err != data.ErrNotFound {
+		t.Fatalf("db.PopulateByID: got %v, want %v", err, data.ErrNotFound)
+	}
+	if err := db.Save(u); err != nil {
+		t.Fatalf("db.Save error: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	if err := m.WritePrometheus(out); err != nil {
+		t.Fatalf("m.WritePrometheus error: %s", err)
+	}
+
+	if want := `gaia_db_errors_total{op="populate_by_id",error="not_found"} 1`; !strings.Contains(out.String(), want) {
+		t.Errorf("expected the metrics to contain %q, got:\n%s", want, out.String())
+	}
+	if strings.Contains(out.String(), `op="save"`) {
+		t.Error("expected successful operations not to be counted")
+	}
+}
+
+// unreachableDB is a db whose queries fail
+type unreachableDB struct {
+	data.DB
+}
+
+func (db *unreachableDB) Query(k data.Kind) data.Query {
+	return &unreachableQuery{}
+}
+
+type unreachableQuery struct {
+	data.Query
+}
+
+func (q *unreachableQuery) Select(data.AttrMap) data.Query {
+	return q
+}
+
+func (q *unreachableQuery) Execute() (data.Iterator, error) {
+	return nil, data.ErrNoConnection
+}
+
+func TestMeteredDBQuery(t *testing.T) {
+	m := NewMetrics()
+	db := MeteredDB(&unreachableDB{DB: mem.NewDB()}, m)
+
+	if _, err := db.Query(models.TaskKind).Select(data.AttrMap{"name": "todo"}).Execute(); err != data.ErrNoConnection {
+		t.Fatalf("Execute: got %v, want %v", err, data.ErrNoConnection)
+	}
+
+	out := new(bytes.Buffer)
+	if err := m.WritePrometheus(out); err != nil {
+		t.Fatalf("m.WritePrometheus error: %s", err)
+	}
+
+	if want := `gaia_db_errors_total{op="query",error="no_connection"} 1`; !strings.Contains(out.String(), want) {
+		t.Errorf("expected the metrics to contain %q, got:\n%s", want, out.String())
+	}
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+// CommandEnvelope is a message of a mobile command session, in either direction. The id of
+// an input is the client's, so that it may be retried, the id of an output is its sequence
+// number, which a client polls since.
+type CommandEnvelope struct {
+	ID   string    `json:"id"`
+	Body string    `json:"body"`
+	Time time.Time `json:"time"`
+}
+
+// MobileCommandSessions are the command sessions of native clients, which send their input,
+// and poll for their output, over plain HTTP requests. A user has one session, whose output
+// is retained, so that a client which reconnects can fetch what it missed.
+type MobileCommandSessions interface {
+	// Send delivers the input to the user's session, starting one if there is none. An input
+	// whose id was recently sent is ignored, it returns whether the input was new.
+	Send(u *models.User, input *CommandEnvelope) (bool, error)
+	// Poll retrieves the output of the user's session numbered after since, or all that is
+	// retained if since is 0, waiting until there is some, or the context is done. Missed
+	// reports whether output after since is no longer retained.
+	Poll(ctx context.Context, u *models.User, since uint64) (output []*CommandEnvelope, missed bool, err error)
+	// Active is the number of live sessions
+	Active() int
+	// Running determines whether the sessions are being served
+	Running() bool
+}
+
+// The defaults of the mobile command sessions
+const (
+	// DefaultMobileIdleTimeout is how long a user's session, and its output, outlast their last request
+	DefaultMobileIdleTimeout = 30 * time.Minute
+	// DefaultMobileOutbox is the number of outputs retained for a client which reconnects
+	DefaultMobileOutbox = 256
+)
+
+// mobileBacklog bounds the inputs waiting for a session to read them
+const mobileBacklog = 10
+
+// mobileSeen is the number of recent input ids remembered, to ignore those which are retried
+const mobileSeen = 64
+
+// The errors of MobileCommandSessions
+var (
+	// ErrMobileSessionsStopped is returned once the sessions are no longer served
+	ErrMobileSessionsStopped = errors.New("mobile command sessions are stopped")
+	// ErrMobileBacklog is returned when the session has as many inputs waiting as are allowed
+	ErrMobileBacklog = errors.New("the mobile command session has too many inputs waiting")
+)
+
+// sequencedEnvelope is an output, and its sequence number
+type sequencedEnvelope struct {
+	seq uint64
+	*CommandEnvelope
+}
+
+// mobileChannel is the state of a user's session, and its output, which outlasts the command session
+type mobileChannel struct {
+	user *models.User
+
+	outbox []*sequencedEnvelope
+	// dropped is the sequence number of the last output which is no longer retained
+	dropped uint64
+	// changed is closed, and replaced, when output is appended
+	changed chan struct{}
+
+	// seen are the ids of the recent inputs, in the order they were sent
+	seen []string
+
+	// live is the command session, nil if there is none
+	live       *commandQueue
+	lastActive time.Time
+}
+
+type mobileMux struct {
+	idleTimeout  time.Duration
+	outbox       int
+	startSession sessionStarter
+
+	mu       sync.Mutex
+	channels map[data.ID]*mobileChannel
+	seq      uint64
+	db       data.DB
+	started  bool
+	stopped  bool
+	running  int32
+}
+
+// NewMobileMux constructs the mobile command sessions, each of which retains its last outbox
+// outputs, and is ended, along with its output, once it has been idle for the idle timeout.
+//
+// Sequence numbers begin at the time the mux is constructed, in microseconds, so that
+// they continue to increase across restarts of the server.
+func NewMobileMux(idleTimeout time.Duration, outbox int) *mobileMux {
+	if outbox <= 0 {
+		outbox = DefaultMobileOutbox
+	}
+
+	return &mobileMux{
+		idleTimeout:  idleTimeout,
+		outbox:       outbox,
+		startSession: startCommandSession,
+		channels:     make(map[data.ID]*mobileChannel),
+		seq:          uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+	}
+}
+
+func (mux *mobileMux) Active() int {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	active := 0
+	for _, c := range mux.channels {
+		if c.live != nil {
+			active++
+		}
+	}
+
+	return active
+}
+
+func (mux *mobileMux) Running() bool {
+	return atomic.LoadInt32(&mux.running) == 1
+}
+
+// channel retrieves the user's channel, constructing it if there is none, and records
+// that it is active. The caller must hold the lock.
+func (mux *mobileMux) channel(u *models.User) *mobileChannel {
+	c, ok := mux.channels[u.ID()]
+	if !ok {
+		c = &mobileChannel{
+			user:    u,
+			changed: make(chan struct{}),
+			// the output before the channel, of one which expired, or of a
+			// previous run of the server, is no longer retained
+			dropped: mux.seq,
+		}
+		mux.channels[u.ID()] = c
+	}
+
+	c.lastActive = time.Now()
+	return c
+}
+
+// Send starts the session of an input which arrives before the mux is started along with it
+func (mux *mobileMux) Send(u *models.User, input *CommandEnvelope) (bool, error) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.stopped {
+		return false, ErrMobileSessionsStopped
+	}
+
+	c := mux.channel(u)
+
+	for _, id := range c.seen {
+		if id == input.ID {
+			return false, nil
+		}
+	}
+
+	if c.live == nil {
+		c.live = newCommandQueue()
+
+		if mux.started {
+			mux.launch(c, c.live)
+		}
+	}
+
+	s := c.live
+	if len(s.pending) >= mobileBacklog {
+		return false, ErrMobileBacklog
+	}
+
+	s.push(input.Body)
+	if c.seen = append(c.seen, input.ID); len(c.seen) > mobileSeen {
+		c.seen = c.seen[1:]
+	}
+
+	return true, nil
+}
+
+func (mux *mobileMux) Poll(ctx context.Context, u *models.User, since uint64) ([]*CommandEnvelope, bool, error) {
+	for {
+		mux.mu.Lock()
+		c := mux.channel(u)
+
+		var output []*CommandEnvelope
+		for _, e := range c.outbox {
+			if e.seq > since {
+				output = append(output, e.CommandEnvelope)
+			}
+		}
+		missed := since > 0 && since < c.dropped
+		changed := c.changed
+		stopped := mux.stopped
+		mux.mu.Unlock()
+
+		if len(output) > 0 || missed {
+			return output, missed, nil
+		}
+
+		if stopped {
+			return nil, false, ErrMobileSessionsStopped
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, nil
+		}
+	}
+}
+
+// Start serves the sessions, with the db. Once the context is done, each session is told
+// the server is going away, and ended.
+func (mux *mobileMux) Start(ctx context.Context, db data.DB) {
+	mux.mu.Lock()
+	mux.db = db
+	mux.started = true
+	atomic.StoreInt32(&mux.running, 1)
+	// the sessions of the inputs which arrived before the mux was started
+	for _, c := range mux.channels {
+		if c.live != nil {
+			mux.launch(c, c.live)
+		}
+	}
+	mux.mu.Unlock()
+
+	defer atomic.StoreInt32(&mux.running, 0)
+
+	var sweep <-chan time.Time
+	if mux.idleTimeout > 0 {
+		ticker := time.NewTicker(mux.idleTimeout / 4)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
+Run:
+	for {
+		select {
+		case now := <-sweep:
+			mux.expire(now)
+		case <-ctx.Done():
+			break Run
+		}
+	}
+
+	// tell each session the server is going away, and end it
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.stopped = true
+	for _, c := range mux.channels {
+		if c.live != nil {
+			mux.end(c, c.live)
+			mux.append(c, GoingAwayMessage)
+		}
+		close(c.changed) // so that every poll returns
+		c.changed = make(chan struct{})
+	}
+}
+
+// expire removes the channels which have been idle for the idle timeout as of now
+func (mux *mobileMux) expire(now time.Time) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	for id, c := range mux.channels {
+		if now.Sub(c.lastActive) >= mux.idleTimeout {
+			if c.live != nil {
+				mux.end(c, c.live)
+			}
+			delete(mux.channels, id)
+		}
+	}
+}
+
+// launch starts the command session of the channel, its pump, which delivers its pending
+// inputs, and the forwarding of its output to the outbox. The caller must hold the lock.
+func (mux *mobileMux) launch(c *mobileChannel, s *commandQueue) {
+	input := make(chan string)
+	output := make(chan string)
+
+	go s.pump(&mux.mu, input)
+
+	go func() {
+		for o := range output {
+			mux.mu.Lock()
+			select {
+			case <-s.done:
+				// the session is over, but it is drained so that it isn't stuck writing to it
+			default:
+				mux.append(c, o)
+			}
+			mux.mu.Unlock()
+		}
+	}()
+
+	// the session bails when it ends itself, the next input starts another
+	go mux.startSession(c.user, mux.db, input, output, func() {
+		mux.mu.Lock()
+		defer mux.mu.Unlock()
+
+		mux.end(c, s)
+	})
+}
+
+// append numbers the output, retains it, and wakes the polls of the channel. The caller must hold the lock.
+func (mux *mobileMux) append(c *mobileChannel, body string) {
+	mux.seq++
+	e := &sequencedEnvelope{
+		seq: mux.seq,
+		CommandEnvelope: &CommandEnvelope{
+			ID:   strconv.FormatUint(mux.seq, 10),
+			Body: body,
+			Time: time.Now(),
+		},
+	}
+
+	if len(c.outbox) == mux.outbox {
+		c.dropped = c.outbox[0].seq
+		copy(c.outbox, c.outbox[1:])
+		c.outbox = c.outbox[:mux.outbox-1]
+	}
+	c.outbox = append(c.outbox, e)
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// end ends the session, if it is still the channel's. The caller must hold the lock.
+func (mux *mobileMux) end(c *mobileChannel, s *commandQueue) {
+	if c.live != s {
+		return
+	}
+
+	if len(s.pending) > 0 {
+		log.Printf("Dropping %d inputs of the mobile session of %s, which has ended", len(s.pending), c.user.ID())
+	}
+
+	s.end()
+	c.live = nil
+}
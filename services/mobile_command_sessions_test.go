@@ -0,0 +1,305 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+func send(t *testing.T, mux *mobileMux, u *models.User, id, body string) {
+	if _, err := mux.Send(u, &CommandEnvelope{ID: id, Body: body}); err != nil {
+		t.Fatalf("mux.Send error: %s", err)
+	}
+}
+
+// poll polls the user's output since the id, it fails if there is none within five seconds
+func poll(t *testing.T, mux *mobileMux, u *models.User, since uint64) []*CommandEnvelope {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, _, err := mux.Poll(ctx, u, since)
+	if err != nil {
+		t.Fatalf("mux.Poll error: %s", err)
+	}
+	if len(output) == 0 {
+		t.Fatal("timed out waiting for output")
+	}
+
+	return output
+}
+
+// last is the sequence number of the last of the output
+func last(t *testing.T, output []*CommandEnvelope) uint64 {
+	seq, err := strconv.ParseUint(output[len(output)-1].ID, 10, 64)
+	if err != nil {
+		t.Fatalf("the id of the output is not its sequence number: %s", err)
+	}
+
+	return seq
+}
+
+func TestMobileMuxOrder(t *testing.T) {
+	mux := NewMobileMux(0, 100)
+	u := webUser()
+
+	// the inputs which arrive before the mux is started wait for it
+	for i := 0; i < 5; i++ {
+		send(t, mux, u, fmt.Sprint(i), fmt.Sprint(i))
+	}
+
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	for i := 5; i < 10; i++ {
+		send(t, mux, u, fmt.Sprint(i), fmt.Sprint(i))
+	}
+
+	var output []*CommandEnvelope
+	var since uint64
+	for len(output) < 10 {
+		more := poll(t, mux, u, since)
+		output = append(output, more...)
+		since = last(t, more)
+	}
+
+	for i, o := range output {
+		if got, want := o.Body, fmt.Sprintf("echo: %d", i); got != want {
+			t.Fatalf("output %d: got %q, want %q", i, got, want)
+		}
+		if i > 0 && o.ID <= output[i-1].ID {
+			t.Errorf("output %d: the id %s doesn't follow %s", i, o.ID, output[i-1].ID)
+		}
+	}
+}
+
+func TestMobileMuxRetry(t *testing.T) {
+	mux := NewMobileMux(0, 100)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	u := webUser()
+
+	if sent, err := mux.Send(u, &CommandEnvelope{ID: "a", Body: "todo"}); !sent || err != nil {
+		t.Fatalf("mux.Send: got %t, %v, want true, nil", sent, err)
+	}
+	// the client didn't hear back, so it retries
+	if sent, err := mux.Send(u, &CommandEnvelope{ID: "a", Body: "todo"}); sent || err != nil {
+		t.Fatalf("mux.Send of a retry: got %t, %v, want false, nil", sent, err)
+	}
+	send(t, mux, u, "b", "again")
+
+	output := poll(t, mux, u, 0)
+	for len(output) < 2 {
+		output = append(output, poll(t, mux, u, last(t, output))...)
+	}
+
+	if len(output) != 2 || output[0].Body != "echo: todo" || output[1].Body != "echo: again" {
+		t.Fatalf("the retry should have been ignored, the output was %+v", output)
+	}
+}
+
+func TestMobileMuxBacklog(t *testing.T) {
+	mux := NewMobileMux(0, 100)
+	stop := startMux(&mux.startSession, stuckSession, mux.Start)
+	defer stop()
+
+	u := webUser()
+
+	for i := 0; i < mobileBacklog; i++ {
+		send(t, mux, u, fmt.Sprint(i), "todo")
+	}
+
+	if _, err := mux.Send(u, &CommandEnvelope{ID: "over", Body: "todo"}); err != ErrMobileBacklog {
+		t.Fatalf("mux.Send: got %v, want %v", err, ErrMobileBacklog)
+	}
+
+	// the backlog is the user's own
+	send(t, mux, webUser(), "0", "todo")
+}
+
+func TestMobileMuxMissed(t *testing.T) {
+	mux := NewMobileMux(0, 2)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	u := webUser()
+
+	send(t, mux, u, "0", "0")
+	first := poll(t, mux, u, 0)
+	since := last(t, first)
+
+	// the client is away while there is more output than is retained
+	for i := 1; i < 5; i++ {
+		send(t, mux, u, fmt.Sprint(i), fmt.Sprint(i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		output, missed, err := mux.Poll(context.Background(), u, since)
+		if err != nil {
+			t.Fatalf("mux.Poll error: %s", err)
+		}
+
+		if output[len(output)-1].Body == "echo: 4" {
+			if !missed || len(output) != 2 || output[0].Body != "echo: 3" {
+				t.Fatalf("got %+v, %t, want the output retained, and that some was missed", output, missed)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the output")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a client which has seen the last output missed nothing
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	output, missed, err := mux.Poll(ctx, u, last(t, poll(t, mux, u, 0)))
+	if len(output) != 0 || missed || err != nil {
+		t.Errorf("mux.Poll: got %+v, %t, %v, want nothing", output, missed, err)
+	}
+}
+
+func TestMobileMuxShutdown(t *testing.T) {
+	mux := NewMobileMux(0, 100)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+
+	u := webUser()
+	send(t, mux, u, "0", "todo")
+	since := last(t, poll(t, mux, u, 0))
+
+	// a poll which is waiting is told the server is going away
+	polled := make(chan []*CommandEnvelope)
+	go func() {
+		output, _, _ := mux.Poll(context.Background(), u, since)
+		polled <- output
+	}()
+
+	stop()
+
+	select {
+	case output := <-polled:
+		if len(output) != 1 || output[0].Body != GoingAwayMessage {
+			t.Fatalf("got %+v, want the going away message", output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the poll to return")
+	}
+
+	if got := mux.Active(); got != 0 {
+		t.Errorf("mux.Active(): got %d, want 0", got)
+	}
+
+	// once stopped, no more input is taken
+	if _, err := mux.Send(u, &CommandEnvelope{ID: "1", Body: "todo"}); err != ErrMobileSessionsStopped {
+		t.Errorf("mux.Send: got %v, want %v", err, ErrMobileSessionsStopped)
+	}
+	if _, _, err := mux.Poll(context.Background(), webUser(), 0); err != ErrMobileSessionsStopped {
+		t.Errorf("mux.Poll: got %v, want %v", err, ErrMobileSessionsStopped)
+	}
+}
+
+func TestMobileMuxIdleTimeout(t *testing.T) {
+	mux := NewMobileMux(50*time.Millisecond, 100)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	u := webUser()
+	send(t, mux, u, "0", "todo")
+	poll(t, mux, u, 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mux.Active() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the session to expire")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the user may start another
+	send(t, mux, u, "0", "again")
+	if got, want := poll(t, mux, u, 0)[0].Body, "echo: again"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestMobileMuxMissedExpired(t *testing.T) {
+	mux := NewMobileMux(50*time.Millisecond, 100)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	u := webUser()
+	send(t, mux, u, "0", "0")
+	since := last(t, poll(t, mux, u, 0))
+
+	// the client is away while there is more output, and the channel expires
+	send(t, mux, u, "1", "1")
+	deadline := time.Now().Add(5 * time.Second)
+	for output := false; ; {
+		mux.mu.Lock()
+		c, ok := mux.channels[u.ID()]
+		if ok && len(c.outbox) == 2 {
+			output = true
+		}
+		mux.mu.Unlock()
+
+		if !ok {
+			if !output {
+				t.Fatal("the channel expired before the output")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the channel to expire")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	output, missed, err := mux.Poll(context.Background(), u, since)
+	if len(output) != 0 || !missed || err != nil {
+		t.Fatalf("mux.Poll: got %+v, %t, %v, want that the output was missed", output, missed, err)
+	}
+
+	// as does a client of a previous run of the server
+	restarted := NewMobileMux(0, 100)
+	stopRestarted := startMux(&restarted.startSession, echoSession, restarted.Start)
+	defer stopRestarted()
+
+	if output, missed, err := restarted.Poll(context.Background(), u, since); len(output) != 0 || !missed || err != nil {
+		t.Fatalf("mux.Poll after a restart: got %+v, %t, %v, want that the output was missed", output, missed, err)
+	}
+}
+
+func TestMobileMuxConcurrent(t *testing.T) {
+	mux := NewMobileMux(time.Millisecond, 10)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+
+	users := []*models.User{webUser(), webUser()}
+
+	concurrently(10, func(i int) {
+		u := users[i%len(users)]
+		for j := 0; j < 50; j++ {
+			body := "todo"
+			if j%10 == 7 {
+				body = "exit"
+			}
+			mux.Send(u, &CommandEnvelope{ID: fmt.Sprintf("%d-%d", i, j), Body: body})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			mux.Poll(ctx, u, 0)
+			cancel()
+			mux.Active()
+		}
+	})
+
+	stop()
+
+	if got := mux.Active(); got != 0 {
+		t.Errorf("mux.Active() once stopped: got %d, want 0", got)
+	}
+}
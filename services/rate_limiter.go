@@ -0,0 +1,139 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// The defaults of a rate limiter, if not otherwise specified
+const (
+	// DefaultFreeAttempts is the number of failures permitted before a key is locked out
+	DefaultFreeAttempts = 5
+	// DefaultLockout is the first lockout, each subsequent failure doubles it
+	DefaultLockout = time.Second
+	// DefaultMaxLockout bounds the lockout, and is how long a key's failures are remembered
+	DefaultMaxLockout = 15 * time.Minute
+)
+
+// A RateLimiter limits failed attempts to authenticate. The keys identify who is
+// attempting, for example the public value of a credential or the client's ip.
+type RateLimiter interface {
+	// Allow determines whether an attempt may be made under every one of the keys,
+	// if not it returns how long until one may be
+	Allow(keys ...string) (time.Duration, bool)
+	// Fail records a failed attempt under each of the keys
+	Fail(keys ...string)
+	// Succeed forgets the failed attempts under each of the keys
+	Succeed(keys ...string)
+}
+
+// attempts are the recent failures under a key
+type attempts struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+type backoffLimiter struct {
+	sync.Mutex
+	free          int
+	lockout, max  time.Duration
+	attempts      map[string]*attempts
+	now           func() time.Time
+	lastCollected time.Time
+}
+
+// NewRateLimiter constructs a limiter which permits the given number of failures under a key, then locks
+// the key out, for the lockout duration, doubling with each subsequent failure up to the max. A key's
+// failures are forgotten once it has gone the max without failing.
+func NewRateLimiter(free int, lockout, max time.Duration) *backoffLimiter {
+	if free < 0 {
+		free = DefaultFreeAttempts
+	}
+	if lockout <= 0 {
+		lockout = DefaultLockout
+	}
+	if max < lockout {
+		max = DefaultMaxLockout
+	}
+
+	return &backoffLimiter{
+		free:     free,
+		lockout:  lockout,
+		max:      max,
+		attempts: make(map[string]*attempts),
+		now:      time.Now,
+	}
+}
+
+func (b *backoffLimiter) Allow(keys ...string) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+
+	var wait time.Duration
+	for _, k := range keys {
+		if a, ok := b.attempts[k]; ok && a.until.After(now) {
+			if w := a.until.Sub(now); w > wait {
+				wait = w
+			}
+		}
+	}
+
+	return wait, wait == 0
+}
+
+func (b *backoffLimiter) Fail(keys ...string) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+	b.collect(now)
+
+	for _, k := range keys {
+		a, ok := b.attempts[k]
+		if !ok || now.Sub(a.last) >= b.max {
+			a = new(attempts)
+			b.attempts[k] = a
+		}
+
+		a.failures++
+		a.last = now
+
+		if over := a.failures - b.free; over > 0 {
+			lockout := b.max
+			// the shift is bounded so that it does not overflow
+			if over < 32 {
+				if d := b.lockout << uint(over-1); d > 0 && d < b.max {
+					lockout = d
+				}
+			}
+			a.until = now.Add(lockout)
+		}
+	}
+}
+
+func (b *backoffLimiter) Succeed(keys ...string) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, k := range keys {
+		delete(b.attempts, k)
+	}
+}
+
+// collect forgets the keys which have not failed for the max lockout,
+// at most once per max lockout. The caller must hold the lock.
+func (b *backoffLimiter) collect(now time.Time) {
+	if now.Sub(b.lastCollected) < b.max {
+		return
+	}
+	b.lastCollected = now
+
+	for k, a := range b.attempts {
+		if now.Sub(a.last) >= b.max {
+			delete(b.attempts, k)
+		}
+	}
+}
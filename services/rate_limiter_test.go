@@ -0,0 +1,61 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBackoff(t *testing.T) {
+	now := time.Now()
+	b := NewRateLimiter(2, time.Second, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// the free attempts
+	for i := 0; i < 2; i++ {
+		if _, ok := b.Allow("ip:1", "public:u"); !ok {
+			t.Fatalf("attempt %d: expected to be allowed", i)
+		}
+		b.Fail("ip:1", "public:u")
+	}
+
+	if _, ok := b.Allow("ip:1"); !ok {
+		t.Fatal("expected to be allowed after the free failures")
+	}
+
+	// the lockout doubles with each failure
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		b.Fail("ip:1", "public:u")
+
+		wait, ok := b.Allow("ip:2", "public:u")
+		if ok {
+			t.Fatal("expected to be locked out")
+		}
+		if got := wait; got != want {
+			t.Errorf("wait: got %s, want %s", got, want)
+		}
+	}
+
+	// other keys are unaffected
+	if _, ok := b.Allow("ip:2", "public:v"); !ok {
+		t.Error("expected other keys to be allowed")
+	}
+
+	// the lockout is bounded
+	for i := 0; i < 40; i++ {
+		b.Fail("public:u")
+	}
+	if wait, _ := b.Allow("public:u"); wait != time.Minute {
+		t.Errorf("wait: got %s, want %s", wait, time.Minute)
+	}
+
+	// once the lockout is over, success forgets the failures
+	now = now.Add(time.Minute)
+	if _, ok := b.Allow("public:u"); !ok {
+		t.Fatal("expected to be allowed once the lockout is over")
+	}
+	b.Succeed("public:u")
+	b.Fail("public:u")
+	if _, ok := b.Allow("public:u"); !ok {
+		t.Error("expected the failures to have been forgotten")
+	}
+}
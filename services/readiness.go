@@ -0,0 +1,175 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+// DefaultCheckTimeout bounds how long a dependency has to respond to a readiness check
+const DefaultCheckTimeout = 2 * time.Second
+
+// DefaultCheckInterval is how long the result of a CachedCheck is reused, if not otherwise specified
+const DefaultCheckInterval = time.Minute
+
+// ErrNotRunning is the error of a check of a component which is not running
+var ErrNotRunning = errors.New("services: not running")
+
+// A Check determines whether a dependency is ready, it should give up when the context is done
+type Check func(ctx context.Context) error
+
+// A CheckResult is the status of a dependency
+type CheckResult struct {
+	Name    string        `json:"name"`
+	Ready   bool          `json:"ready"`
+	Error   string        `json:"error,omitempty"`
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// Readiness checks whether the dependencies gaia needs to serve requests are ready
+type Readiness interface {
+	// Add registers the check of the dependency
+	Add(name string, check Check)
+	// Check runs every check concurrently, reporting on each dependency in the order it was added
+	Check(ctx context.Context) []*CheckResult
+}
+
+type readiness struct {
+	sync.Mutex
+	timeout time.Duration
+	names   []string
+	checks  map[string]Check
+}
+
+// NewReadiness constructs a Readiness which gives each check the timeout to complete
+func NewReadiness(timeout time.Duration) *readiness {
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+
+	return &readiness{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+func (r *readiness) Add(name string, check Check) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.checks[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.checks[name] = check
+}
+
+func (r *readiness) Check(ctx context.Context) []*CheckResult {
+	r.Lock()
+	names := append([]string(nil), r.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = r.checks[name]
+	}
+	r.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	results := make([]*CheckResult, len(names))
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = run(ctx, names[i], checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// run runs the check, abandoning it if the context is done first
+func run(ctx context.Context, name string, check Check) *CheckResult {
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := &CheckResult{
+		Name:    name,
+		Ready:   err == nil,
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// --- Checks {{{
+
+// DBCheck checks that the db is connected, by looking up a record which does not exist
+func DBCheck(db data.DB) Check {
+	return func(ctx context.Context) error {
+		u := models.NewUser()
+		u.SetID(db.NewID())
+
+		switch err := db.PopulateByID(u); err {
+		case nil, data.ErrNotFound:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// RunningCheck checks that the component is running
+func RunningCheck(running func() bool) Check {
+	return func(ctx context.Context) error {
+		if !running() {
+			return ErrNotRunning
+		}
+
+		return nil
+	}
+}
+
+// CachedCheck runs the check at most once per interval, reusing its last result in between, for
+// a dependency which shouldn't be called on every probe, such as a rate limited or metered api.
+// Concurrent probes wait on the one check, rather than each running it.
+func CachedCheck(check Check, interval time.Duration) Check {
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+
+	var mu sync.Mutex
+	var checked time.Time
+	var last error
+
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !checked.IsZero() && time.Since(checked) < interval {
+			return last
+		}
+
+		last, checked = check(ctx), time.Now()
+		return last
+	}
+}
+
+// --- }}}
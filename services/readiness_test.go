@@ -0,0 +1,76 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elos/data/builtin/mem"
+	"golang.org/x/net/context"
+)
+
+func TestReadiness(t *testing.T) {
+	r := NewReadiness(50 * time.Millisecond)
+
+	running := false
+	r.Add("db", DBCheck(mem.NewDB()))
+	r.Add("mux", RunningCheck(func() bool { return running }))
+	r.Add("provider", func(ctx context.Context) error { return errors.New("unreachable") })
+	r.Add("backend", func(ctx context.Context) error {
+		// responds too late
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	results := r.Check(context.Background())
+
+	want := []struct {
+		name  string
+		ready bool
+		err   string
+	}{
+		{"db", true, ""},
+		{"mux", false, ErrNotRunning.Error()},
+		{"provider", false, "unreachable"},
+		{"backend", false, context.DeadlineExceeded.Error()},
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("len(results): got %d, want %d", len(results), len(want))
+	}
+
+	for i, w := range want {
+		got := results[i]
+		if got.Name != w.name || got.Ready != w.ready || got.Error != w.err {
+			t.Errorf("results[%d]: got %+v, want %+v", i, got, w)
+		}
+	}
+
+	running = true
+	if results := r.Check(context.Background()); !results[1].Ready {
+		t.Errorf("expected the mux to be ready once it is running, got %+v", results[1])
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := CachedCheck(func(ctx context.Context) error {
+		calls++
+		return errors.New("unreachable")
+	}, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil || err.Error() != "unreachable" {
+			t.Fatalf("check: got %v, want unreachable", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("calls: got %d, want 1", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	check(context.Background())
+	if calls != 2 {
+		t.Errorf("calls once the interval elapsed: got %d, want 2", calls)
+	}
+}
@@ -0,0 +1,363 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/data/transfer"
+)
+
+// The operators of a selection, with the semantics of mongo's operators of the same
+// name, a field may be given an object of operators to operands in place of a value:
+//
+//		{ "created_at": { "$gt": "2016-04-04T00:00:00Z", "$lt": "2016-04-11T00:00:00Z" } }
+//
+// The $and operator is a top level key, whose operand is a list of selections which must all match.
+const (
+	GtOperator  = "$gt"
+	GteOperator = "$gte"
+	LtOperator  = "$lt"
+	LteOperator = "$lte"
+	InOperator  = "$in"
+	NinOperator = "$nin"
+	NeOperator  = "$ne"
+	AndOperator = "$and"
+)
+
+// --- SelectorDB {{{
+
+type nativeSelectorDB struct {
+	data.DB
+}
+
+// NativeSelectors marks the db as one which evaluates the operators of a selection itself, as
+// mongo does, so that SelectorDB gives them to it
+func NativeSelectors(db data.DB) data.DB {
+	return &nativeSelectorDB{DB: db}
+}
+
+type selectorDB struct {
+	data.DB
+}
+
+// SelectorDB evaluates the operators of its queries' selections, for a db which only matches exact
+// values, such as mem. The exact values are still given to the db, and the operators are evaluated
+// on the records it returns. A db marked by NativeSelectors is given the whole of the selection.
+func SelectorDB(db data.DB) data.DB {
+	if _, ok := db.(*nativeSelectorDB); ok {
+		return db
+	}
+
+	return &selectorDB{DB: db}
+}
+
+func (db *selectorDB) Query(k data.Kind) data.Query {
+	return &selectorQuery{Query: db.DB.Query(k)}
+}
+
+// selectorQuery holds back the skip and limit from the db's query when there are operators
+// to evaluate, they must only count the records which match them
+type selectorQuery struct {
+	data.Query
+	operators   data.AttrMap
+	skip, limit int
+}
+
+func (q *selectorQuery) Execute() (data.Iterator, error) {
+	if len(q.operators) == 0 {
+		query := q.Query
+		if q.skip > 0 {
+			query = query.Skip(q.skip)
+		}
+		if q.limit > 0 {
+			query = query.Limit(q.limit)
+		}
+		return query.Execute()
+	}
+
+	iter, err := q.Query.Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	return &selectorIterator{
+		Iterator:  iter,
+		operators: q.operators,
+		skip:      q.skip,
+		limit:     q.limit,
+	}, nil
+}
+
+func (q *selectorQuery) Skip(i int) data.Query {
+	q.skip = i
+	return q
+}
+
+func (q *selectorQuery) Limit(i int) data.Query {
+	q.limit = i
+	return q
+}
+
+func (q *selectorQuery) Batch(i int) data.Query {
+	q.Query = q.Query.Batch(i)
+	return q
+}
+
+func (q *selectorQuery) Order(fields ...string) data.Query {
+	q.Query = q.Query.Order(fields...)
+	return q
+}
+
+// Select gives the exact values to the db, and keeps the operators. They are normalized to JSON
+// values, as the records' attributes are, so that a time is compared with the string of a time.
+func (q *selectorQuery) Select(attrs data.AttrMap) data.Query {
+	exact := make(data.AttrMap)
+	for field, value := range attrs {
+		if !isOperatorSelection(field, value) {
+			exact[field] = value
+			continue
+		}
+
+		if q.operators == nil {
+			q.operators = make(data.AttrMap)
+		}
+		q.operators[field] = normalize(value)
+	}
+
+	q.Query = q.Query.Select(exact)
+	return q
+}
+
+// isOperatorSelection determines whether the selection of the field is one of operators
+func isOperatorSelection(field string, value interface{}) bool {
+	if field == AndOperator {
+		return true
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		if a, isAttrs := value.(data.AttrMap); isAttrs {
+			m, ok = a, true
+		}
+	}
+
+	return ok && IsOperatorMap(m)
+}
+
+// IsOperatorMap determines whether every key of the map is an operator,
+// otherwise the map is taken to be a value to match exactly
+func IsOperatorMap(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalize converts the value to its JSON form
+func normalize(v interface{}) interface{} {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+
+	var n interface{}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return v
+	}
+
+	return n
+}
+
+type selectorIterator struct {
+	data.Iterator
+	operators   data.AttrMap
+	skip, limit int
+	matched     int
+	err         error
+}
+
+func (i *selectorIterator) Next(r data.Record) bool {
+	for {
+		if i.limit > 0 && i.matched >= i.skip+i.limit {
+			return false
+		}
+
+		if !i.Iterator.Next(r) {
+			return false
+		}
+
+		attrs := make(map[string]interface{})
+		if err := transfer.TransferAttrs(r, &attrs); err != nil {
+			i.err = err
+			return false
+		}
+
+		if !selects(i.operators, attrs) {
+			continue
+		}
+
+		i.matched++
+		if i.matched > i.skip {
+			return true
+		}
+	}
+}
+
+func (i *selectorIterator) Close() error {
+	if err := i.Iterator.Close(); err != nil {
+		return err
+	}
+
+	return i.err
+}
+
+// --- }}}
+
+// --- Evaluation {{{
+
+// selects evaluates the selection against a record's attributes
+func selects(selection map[string]interface{}, attrs map[string]interface{}) bool {
+	for field, value := range selection {
+		if field == AndOperator {
+			selections, _ := value.([]interface{})
+			for _, s := range selections {
+				s, ok := s.(map[string]interface{})
+				if !ok || !selects(s, attrs) {
+					return false
+				}
+			}
+			continue
+		}
+
+		operators, ok := value.(map[string]interface{})
+		if !ok || !IsOperatorMap(operators) {
+			if !equal(attrs[field], value) {
+				return false
+			}
+			continue
+		}
+
+		for operator, operand := range operators {
+			if !evaluate(operator, attrs[field], operand) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// evaluate applies the operator to a value, an absent value is nil. As for mongo, a list
+// value is in the operand of $in if any of its elements is.
+func evaluate(operator string, value, operand interface{}) bool {
+	switch operator {
+	case NeOperator:
+		return !equal(value, operand)
+	case InOperator:
+		return in(value, operand)
+	case NinOperator:
+		return !in(value, operand)
+	}
+
+	c, ok := compare(value, operand)
+	if !ok {
+		return false
+	}
+
+	switch operator {
+	case GtOperator:
+		return c > 0
+	case GteOperator:
+		return c >= 0
+	case LtOperator:
+		return c < 0
+	case LteOperator:
+		return c <= 0
+	default:
+		return false
+	}
+}
+
+// in determines whether the value, or an element of it, is one of the operand's
+func in(value, operand interface{}) bool {
+	operands, _ := operand.([]interface{})
+	for _, o := range operands {
+		if equal(value, o) {
+			return true
+		}
+
+		if elements, ok := value.([]interface{}); ok {
+			for _, e := range elements {
+				if equal(e, o) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// equal compares two JSON values, times are compared as instants
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two JSON values, if they are both numbers, both
+// times or both strings. It is false if they can not be ordered.
+func compare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+
+		at, aErr := time.Parse(time.RFC3339Nano, a)
+		bt, bErr := time.Parse(time.RFC3339Nano, b)
+		if aErr == nil && bErr == nil {
+			switch {
+			case at.Before(bt):
+				return -1, true
+			case at.After(bt):
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+
+		return strings.Compare(a, b), true
+	default:
+		return 0, false
+	}
+}
+
+// --- }}}
@@ -0,0 +1,59 @@
+package services
+
+import "testing"
+
+// --- TestSelects {{{
+
+func TestSelects(t *testing.T) {
+	attrs := map[string]interface{}{
+		"name":       "task",
+		"created_at": "2016-04-06T12:00:00-07:00",
+		"count":      3.0,
+		"deadline":   "0001-01-01T00:00:00Z",
+		"tags_ids":   []interface{}{"1", "2"},
+	}
+
+	unset := []interface{}{nil, "0001-01-01T00:00:00Z"}
+
+	cases := []struct {
+		field, operator string
+		operand         interface{}
+		want            bool
+	}{
+		{"created_at", GtOperator, "2016-04-04T00:00:00Z", true},
+		{"created_at", LtOperator, "2016-04-04T00:00:00Z", false},
+		{"created_at", LteOperator, "2016-04-06T19:00:00Z", true},
+		{"count", GteOperator, 3.0, true},
+		{"count", GtOperator, 3.0, false},
+		{"count", GtOperator, "3", false},
+		{"name", InOperator, []interface{}{"other", "task"}, true},
+		{"name", InOperator, []interface{}{"other"}, false},
+		{"name", NinOperator, []interface{}{"other"}, true},
+		{"name", NeOperator, "task", false},
+		{"missing", NeOperator, "task", true},
+		{"missing", GtOperator, 1.0, false},
+		{"deadline", InOperator, unset, true},
+		{"created_at", NinOperator, unset, true},
+		{"tags_ids", InOperator, []interface{}{"2", "3"}, true},
+		{"tags_ids", InOperator, []interface{}{"3"}, false},
+	}
+
+	for _, c := range cases {
+		selection := map[string]interface{}{c.field: map[string]interface{}{c.operator: c.operand}}
+		if got := selects(selection, attrs); got != c.want {
+			t.Errorf("%s %s %v: got %t, want %t", c.field, c.operator, c.operand, got, c.want)
+		}
+	}
+
+	and := map[string]interface{}{
+		AndOperator: []interface{}{
+			map[string]interface{}{"tags_ids": map[string]interface{}{InOperator: []interface{}{"1"}}},
+			map[string]interface{}{"tags_ids": map[string]interface{}{InOperator: []interface{}{"3"}}},
+		},
+	}
+	if selects(and, attrs) {
+		t.Error("$and: every term must match")
+	}
+}
+
+// --- }}}
@@ -1,24 +1,50 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 
+	"github.com/elos/gaia/services/sms"
 	"github.com/subosito/twilio"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
+// twilioAPI is the base of the url of twilio's REST API
+const twilioAPI = "https://api.twilio.com/2010-04-01"
+
 type SMS interface {
 	Send(to, body string) error
 }
 
+// ErrNoSMSProvider is returned by NoSMS
+var ErrNoSMSProvider = errors.New("no sms provider is configured")
+
+// NoSMS refuses to send every message, it is the sender of a server which doesn't serve sms
+var NoSMS SMS = noSMS{}
+
+type noSMS struct{}
+
+func (noSMS) Send(to, body string) error {
+	return ErrNoSMSProvider
+}
+
 type twilioSMS struct {
-	c    *twilio.Client
-	from string
+	c         *twilio.Client
+	from      string
+	authToken string
 }
 
-func SMSFromTwilio(c *twilio.Client, from string) SMS {
+// SMSFromTwilio constructs the provider of the twilio client, which sends from the
+// number, and verifies the requests to its webhook are signed by the auth token
+func SMSFromTwilio(c *twilio.Client, from, authToken string) SMSProvider {
 	return &twilioSMS{
-		c:    c,
-		from: from,
+		c:         c,
+		from:      from,
+		authToken: authToken,
 	}
 }
 
@@ -27,5 +53,56 @@ func (t *twilioSMS) Send(to, body string) error {
 	if err != nil {
 		log.Printf("*twilioSMS.Send Error: %s", err)
 	}
+
+	// twilio refused the message, only a request which was throttled,
+	// or which twilio failed to handle, may be retried
+	if e, ok := err.(*twilio.Exception); ok {
+		return &ProviderError{
+			Provider: TwilioProvider,
+			Message:  fmt.Sprintf("status %d, code %d: %s", e.Status, e.Code, e.Message),
+			Retry:    e.Status == http.StatusTooManyRequests || e.Status >= 500,
+		}
+	}
+
 	return err
 }
+
+func (t *twilioSMS) Name() string {
+	return TwilioProvider
+}
+
+func (t *twilioSMS) Verify(r *http.Request, url string) error {
+	return sms.VerifyTwilio(r, url, t.authToken)
+}
+
+func (t *twilioSMS) Inbound(r *http.Request) (*sms.Message, error) {
+	return sms.ParseTwilio(r)
+}
+
+// TwilioCheck checks that twilio is reachable, and accepts the account's credentials. It makes
+// a request of twilio each time, so it should be cached, see CachedCheck.
+func TwilioCheck(accountSid, authToken string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", twilioAPI+"/Accounts/"+accountSid+".json", nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(accountSid, authToken)
+
+		resp, err := ctxhttp.Do(ctx, nil, req)
+		if err != nil {
+			// the error of the request names its url, which names the account
+			if uerr, ok := err.(*url.Error); ok {
+				err = uerr.Err
+			}
+			return fmt.Errorf("twilio: %s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("twilio: %s", resp.Status)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The parsers of each provider's webhook, they extract the message it delivers
+
+// ParseTwilio extracts the message from twilio's From, To and Body parameters
+func ParseTwilio(r *http.Request) (*Message, error) {
+	return ExtractMessageFromRequest(r)
+}
+
+// ParsePlivo extracts the message from plivo's From, To and Text parameters
+func ParsePlivo(r *http.Request) (*Message, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	return message(r.Form.Get("From"), r.Form.Get("To"), r.Form.Get("Text"))
+}
+
+// ParseNexmo extracts the message from nexmo's msisdn, to and text parameters,
+// which are either url encoded, or a JSON object if the content type is JSON
+func ParseNexmo(r *http.Request) (*Message, error) {
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "application/json" {
+		var params struct {
+			MSISDN string `json:"msisdn"`
+			To     string `json:"to"`
+			Text   string `json:"text"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			return nil, err
+		}
+
+		return message(params.MSISDN, params.To, params.Text)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	return message(r.Form.Get("msisdn"), r.Form.Get("to"), r.Form.Get("text"))
+}
+
+// message constructs the message, all of whose parts are required
+func message(from, to, body string) (*Message, error) {
+	if from == "" {
+		return nil, fmt.Errorf("missing from parameter")
+	}
+
+	if to == "" {
+		return nil, fmt.Errorf("missing to parameter")
+	}
+
+	if body == "" {
+		return nil, fmt.Errorf("missing body parameter")
+	}
+
+	return &Message{
+		From: E164(from),
+		To:   E164(to),
+		Body: body,
+	}, nil
+}
+
+// E164 prefixes the number with a +, if it is missing. Some providers give numbers, which are
+// in the E.164 format, without the +, whereas twilio, and so the profiles of users, include it.
+func E164(number string) PhoneNumber {
+	if number == "" || strings.HasPrefix(number, "+") {
+		return PhoneNumber(number)
+	}
+
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			// not E.164, e.g. "650 123 4567", so leave it be
+			return PhoneNumber(number)
+		}
+	}
+
+	return PhoneNumber("+" + number)
+}
@@ -0,0 +1,348 @@
+package sms
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The signatures each provider gives the requests of its webhook, which prove they come from it
+
+// ErrInvalidSignature is the error of a request whose signature is missing, or doesn't match,
+// and of every request if the secret is missing, as anyone could sign with an empty secret
+var ErrInvalidSignature = errors.New("sms: invalid signature")
+
+// ErrReplayedNonce is the error of a signed request whose nonce was already used
+var ErrReplayedNonce = errors.New("sms: replayed nonce")
+
+// The headers of the signatures
+const (
+	TwilioSignatureHeader = "X-Twilio-Signature"
+	PlivoSignatureHeader  = "X-Plivo-Signature-V3"
+	PlivoNonceHeader      = "X-Plivo-Signature-V3-Nonce"
+)
+
+// The methods of nexmo's signatures
+const (
+	NexmoMD5Hash = "md5hash"
+	NexmoSHA256  = "sha256"
+)
+
+// NexmoMaxSkew bounds how far the timestamp of a signed nexmo request may be from now
+const NexmoMaxSkew = 5 * time.Minute
+
+// The nonces of plivo's signatures are remembered for the ttl, so that a signed request
+// can't be replayed within it, at most the max are, beyond which the oldest are forgotten
+const (
+	PlivoNonceTTL  = 15 * time.Minute
+	PlivoMaxNonces = 10000
+)
+
+// --- Twilio {{{
+
+// TwilioSignature is the base64 HMAC-SHA1, keyed by the auth token, of the url twilio
+// requested, followed by each POST parameter's name and value, sorted by name
+func TwilioSignature(url string, params url.Values, authToken string) string {
+	var b bytes.Buffer
+	b.WriteString(url)
+
+	sortedParams(params, func(name, value string) {
+		b.WriteString(name)
+		b.WriteString(value)
+	})
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write(b.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyTwilio verifies the X-Twilio-Signature of the request, whose url, as twilio requested it, is given
+func VerifyTwilio(r *http.Request, url, authToken string) error {
+	if authToken == "" {
+		return ErrInvalidSignature
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	return verify(r.Header.Get(TwilioSignatureHeader), TwilioSignature(url, r.PostForm, authToken))
+}
+
+// --- }}}
+
+// --- Plivo {{{
+
+// PlivoSignature is the base64 HMAC-SHA256, keyed by the auth token, of the url plivo requested,
+// with its query parameters sorted, then, of a POST, each POST parameter's name and value,
+// sorted by name, then "." and the nonce. The query and the parameters are separated by
+// "?" and ".", and the parameters of a GET are part of its query.
+func PlivoSignature(method, rawurl string, params url.Values, nonce, authToken string) string {
+	query := url.Values{}
+	if u, err := url.Parse(rawurl); err == nil {
+		query = u.Query()
+		u.RawQuery, u.Fragment = "", ""
+		rawurl = u.String()
+	}
+
+	if method != "POST" {
+		for name, values := range params {
+			query[name] = append(query[name], values...)
+		}
+		params = nil
+	}
+
+	var q []string
+	sortedParams(query, func(name, value string) {
+		q = append(q, name+"="+value)
+	})
+
+	var b bytes.Buffer
+	b.WriteString(rawurl)
+	if len(q) > 0 || len(params) > 0 {
+		b.WriteString("?" + strings.Join(q, "&"))
+	}
+	if len(q) > 0 && len(params) > 0 {
+		b.WriteString(".")
+	}
+	sortedParams(params, func(name, value string) {
+		b.WriteString(name)
+		b.WriteString(value)
+	})
+	b.WriteString("." + nonce)
+
+	mac := hmac.New(sha256.New, []byte(authToken))
+	mac.Write(b.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPlivo verifies the X-Plivo-Signature-V3 of the request, whose url, as plivo requested it,
+// is given, and uses its nonce. The header may have several signatures, separated by commas,
+// of which one must match.
+func VerifyPlivo(r *http.Request, url, authToken string, nonces *Nonces, now time.Time) error {
+	nonce := r.Header.Get(PlivoNonceHeader)
+	if authToken == "" || nonce == "" {
+		return ErrInvalidSignature
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	want := PlivoSignature(r.Method, url, r.PostForm, nonce, authToken)
+
+	err := ErrInvalidSignature
+	for _, signature := range strings.Split(r.Header.Get(PlivoSignatureHeader), ",") {
+		if verify(strings.TrimSpace(signature), want) == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !nonces.Use(nonce, now) {
+		return ErrReplayedNonce
+	}
+
+	return nil
+}
+
+// Nonces remembers the nonces of signed requests for a time, so that each is used only once
+type Nonces struct {
+	ttl time.Duration
+	max int
+
+	mu sync.Mutex
+	// used is when each nonce was, and order the nonces, the oldest first
+	used  map[string]time.Time
+	order []string
+}
+
+// NewNonces constructs the nonces, each of which is remembered for the ttl,
+// at most the max of which are, beyond which the oldest are forgotten
+func NewNonces(ttl time.Duration, max int) *Nonces {
+	return &Nonces{
+		ttl:  ttl,
+		max:  max,
+		used: make(map[string]time.Time),
+	}
+}
+
+// Use records the nonce as used now, it returns false if it was already used
+func (n *Nonces) Use(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for len(n.order) > 0 && now.Sub(n.used[n.order[0]]) >= n.ttl {
+		n.forget()
+	}
+
+	if _, ok := n.used[nonce]; ok {
+		return false
+	}
+
+	for len(n.order) >= n.max {
+		n.forget()
+	}
+
+	n.used[nonce] = now
+	n.order = append(n.order, nonce)
+	return true
+}
+
+// forget forgets the oldest nonce
+func (n *Nonces) forget() {
+	delete(n.used, n.order[0])
+	n.order = n.order[1:]
+}
+
+// --- }}}
+
+// --- Nexmo {{{
+
+// NexmoSignature is the signature of the parameters, less the sig: each is sorted by name, and
+// written "&name=value", with any & or = of the value replaced by _. The md5hash method is the
+// hex MD5 of those followed by the secret, the sha256 method is their hex HMAC-SHA256, keyed
+// by the secret.
+func NexmoSignature(params map[string]string, secret, method string) (string, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "sig" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString("&" + name + "=" + strings.NewReplacer("&", "_", "=", "_").Replace(params[name]))
+	}
+
+	var h hash.Hash
+	switch method {
+	case NexmoMD5Hash:
+		h = md5.New()
+		b.WriteString(secret)
+	case NexmoSHA256:
+		h = hmac.New(sha256.New, []byte(secret))
+	default:
+		return "", fmt.Errorf("sms: unrecognized nexmo signature method %q", method)
+	}
+
+	h.Write(b.Bytes())
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyNexmo verifies the sig parameter of the request, and that its timestamp is recent. The
+// parameters are url encoded, or a JSON object if the content type is JSON, in which case the
+// body is restored, so that it may be parsed again.
+func VerifyNexmo(r *http.Request, secret, method string, now time.Time) error {
+	if secret == "" {
+		return ErrInvalidSignature
+	}
+
+	params, err := nexmoParams(r)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > NexmoMaxSkew || skew < -NexmoMaxSkew {
+		return ErrInvalidSignature
+	}
+
+	want, err := NexmoSignature(params, secret, method)
+	if err != nil {
+		return err
+	}
+
+	// nexmo's hex may be of either case
+	return verify(strings.ToLower(params["sig"]), want)
+}
+
+// nexmoParams retrieves the parameters of the request, as strings
+func nexmoParams(r *http.Request) (map[string]string, error) {
+	params := make(map[string]string)
+
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "application/json" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var values map[string]interface{}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&values); err != nil {
+			return nil, err
+		}
+
+		for name, v := range values {
+			params[name] = fmt.Sprint(v)
+		}
+
+		return params, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	for name := range r.Form {
+		params[name] = r.Form.Get(name)
+	}
+
+	return params, nil
+}
+
+// --- }}}
+
+// sortedParams calls the function with each name and value of the params, sorted by name, then value
+func sortedParams(params url.Values, f func(name, value string)) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := append([]string(nil), params[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			f(name, v)
+		}
+	}
+}
+
+// verify compares the signature to that which it should be, in constant time
+func verify(signature, want string) error {
+	if signature == "" || subtle.ConstantTimeCompare([]byte(signature), []byte(want)) != 1 {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
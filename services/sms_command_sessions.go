@@ -1,93 +1,227 @@
 package services
 
 import (
+	"errors"
 	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elos/data"
-	"github.com/elos/elos/command"
 	"github.com/elos/gaia/services/sms"
 	"github.com/elos/models/user"
 	"golang.org/x/net/context"
 )
 
 type SMSCommandSessions interface {
-	Inbound(m *sms.Message)
+	// Inbound delivers the message to the command session of its sender, starting one if there
+	// is none. It doesn't wait for the session to read it, it fails if the message can't be taken.
+	Inbound(m *sms.Message) error
+	// Active is the number of live sessions
+	Active() int
+	// Running determines whether the sessions are being served
+	Running() bool
+	// Sessions describes the live sessions, in the order of their numbers
+	Sessions() []*SMSSession
+	// Kill ends the session of the number, it returns whether there was one
+	Kill(number sms.PhoneNumber) bool
 }
 
-type smsMux struct {
-	inbound  chan *sms.Message
-	sessions map[sms.PhoneNumber]*commandSessionInfo
+// The defaults of the sms command sessions
+const (
+	// DefaultSMSMaxSessions bounds the number of concurrent sessions
+	DefaultSMSMaxSessions = 1000
+	// DefaultSMSIdleTimeout is how long a session may go without a message, either way, before it is ended
+	DefaultSMSIdleTimeout = 30 * time.Minute
+	// DefaultSMSBacklog bounds the messages of a number which are waiting for its session to read them
+	DefaultSMSBacklog = 10
+)
+
+// The errors of SMSCommandSessions.Inbound
+var (
+	// ErrSMSSessionsStopped is returned once the sessions are no longer served
+	ErrSMSSessionsStopped = errors.New("sms command sessions are stopped")
+	// ErrSMSSessionLimit is returned for the message of a new session, when there are as many sessions as are allowed
+	ErrSMSSessionLimit = errors.New("too many sms command sessions")
+	// ErrSMSBacklog is returned when the session has as many messages waiting as are allowed
+	ErrSMSBacklog = errors.New("the sms command session has too many messages waiting")
+)
+
+// The messages sent to a session which the mux ends, or to the sender of a message it refuses
+const (
+	// GoingAwayMessage is sent to each command session which is ended because the server is shutting down
+	GoingAwayMessage = "elos is restarting, so this session has ended. Send another message to start a new one."
+	// IdleMessage is sent to each command session which is ended because it was idle
+	IdleMessage = "This session has ended, as it was idle. Send another message to start a new one."
+	// KilledMessage is sent to each command session which is killed
+	KilledMessage = "This session has been ended. Send another message to start a new one."
+	// BusyMessage is sent in reply to a message which the sessions refuse
+	BusyMessage = "elos is busy, so your message wasn't received. Please send it again in a minute."
+)
+
+// SMSSession describes a live sms command session
+type SMSSession struct {
+	Number sms.PhoneNumber `json:"number"`
+	// UserID is the id of the user of the number, empty if there is none, or it is yet to be looked up
+	UserID     string    `json:"user_id,omitempty"`
+	Started    time.Time `json:"started"`
+	LastActive time.Time `json:"last_active"`
+	// Pending is the number of messages waiting for the session to read them
+	Pending int `json:"pending"`
 }
 
-func (s *smsMux) Inbound(m *sms.Message) {
-	s.inbound <- m
+// smsSession is the state of a number's session
+type smsSession struct {
+	SMSSession
+	*commandQueue
+
+	// launched is whether the command session has been started, which waits on the mux being started
+	launched bool
 }
 
+type smsMux struct {
+	maxSessions  int
+	idleTimeout  time.Duration
+	backlog      int
+	startSession sessionStarter
+
+	mu       sync.Mutex
+	sessions map[sms.PhoneNumber]*smsSession
+	db       data.DB
+	sender   SMS
+	stopped  bool
+	running  int32
+}
+
+// NewSMSMux constructs the sms command sessions, with the default limits
 func NewSMSMux() *smsMux {
+	return NewBoundedSMSMux(DefaultSMSMaxSessions, DefaultSMSIdleTimeout, DefaultSMSBacklog)
+}
+
+// NewBoundedSMSMux constructs the sms command sessions, of which there are at most the max
+// sessions, each is ended once it has been idle for the idle timeout, unless it is 0, and
+// has at most the backlog of messages waiting for it to read them.
+//
+// Each number's messages are delivered to its session in the order they are received, by one
+// goroutine per session. A message which would exceed a limit is refused, rather than waited
+// on, so that its sender may be told to send it again.
+func NewBoundedSMSMux(maxSessions int, idleTimeout time.Duration, backlog int) *smsMux {
 	return &smsMux{
-		inbound:  make(chan *sms.Message),
-		sessions: make(map[sms.PhoneNumber]*commandSessionInfo),
+		maxSessions:  maxSessions,
+		idleTimeout:  idleTimeout,
+		backlog:      backlog,
+		startSession: startCommandSession,
+		sessions:     make(map[sms.PhoneNumber]*smsSession),
+	}
+}
+
+// Inbound takes messages before the mux is started, their sessions start along with it
+func (mux *smsMux) Inbound(m *sms.Message) error {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.stopped {
+		return ErrSMSSessionsStopped
 	}
+
+	now := time.Now()
+
+	s, exists := mux.sessions[m.From]
+	if !exists {
+		if len(mux.sessions) >= mux.maxSessions {
+			return ErrSMSSessionLimit
+		}
+
+		s = &smsSession{
+			SMSSession: SMSSession{
+				Number:     m.From,
+				Started:    now,
+				LastActive: now,
+			},
+			commandQueue: newCommandQueue(),
+		}
+		mux.sessions[m.From] = s
+
+		if mux.Running() {
+			mux.launch(s)
+		}
+	}
+
+	if len(s.pending) >= mux.backlog {
+		return ErrSMSBacklog
+	}
+
+	s.push(m.Body)
+	s.LastActive = now
+
+	return nil
+}
+
+func (mux *smsMux) Active() int {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	return len(mux.sessions)
+}
+
+func (mux *smsMux) Running() bool {
+	return atomic.LoadInt32(&mux.running) == 1
+}
+
+func (mux *smsMux) Sessions() []*SMSSession {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	sessions := make([]*SMSSession, 0, len(mux.sessions))
+	for _, s := range mux.sessions {
+		info := s.SMSSession
+		info.Pending = len(s.pending)
+		sessions = append(sessions, &info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Number < sessions[j].Number
+	})
+
+	return sessions
 }
 
+func (mux *smsMux) Kill(number sms.PhoneNumber) bool {
+	mux.mu.Lock()
+	s, exists := mux.sessions[number]
+	mux.mu.Unlock()
+
+	return exists && mux.end(s, KilledMessage)
+}
+
+// Start serves the sessions, with the db, and sends their output through the sender. Once the
+// context is done, each session is told the server is going away, and ended.
 func (mux *smsMux) Start(ctx context.Context, db data.DB, sender SMS) {
-	timeouts := make(chan sms.PhoneNumber)
+	mux.mu.Lock()
+	mux.db, mux.sender = db, sender
+	atomic.StoreInt32(&mux.running, 1)
+	// the sessions of the messages which arrived before the mux was started
+	for _, s := range mux.sessions {
+		mux.launch(s)
+	}
+	mux.mu.Unlock()
+
+	defer atomic.StoreInt32(&mux.running, 0)
+
+	var sweep <-chan time.Time
+	if mux.idleTimeout > 0 {
+		ticker := time.NewTicker(mux.idleTimeout / 4)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
 
 Run:
 	for {
 		select {
-		case m := <-mux.inbound:
-			sessionInfo, sessionExists := mux.sessions[m.From]
-
-			// instantiate one
-			if !sessionExists {
-				sessionInput := make(chan string)
-				sessionOutput := make(chan string)
-
-				// We want to forward the strings on the output
-				// channel and send them as SMS
-				go func(out <-chan string, from sms.PhoneNumber, timeouts chan<- sms.PhoneNumber) {
-					for o := range out {
-						// use the SMS interface to send the message
-						err := sender.Send(string(from), o)
-
-						// timeout if error sending message
-						if err != nil {
-							log.Print("Read off bailing")
-							close(sessionInput)
-							timeouts <- from
-							return
-						}
-					}
-				}(sessionOutput, m.From, timeouts)
-
-				u, err := user.ForPhone(db, string(m.From))
-				if err != nil {
-					u = nil
-				}
-
-				session := command.NewSession(
-					u, db, sessionInput, sessionOutput,
-					func() {
-						timeouts <- m.From
-					})
-				go session.Start()
-
-				sessionInfo = &commandSessionInfo{
-					input:   sessionInput,
-					session: session,
-				}
-
-				mux.sessions[m.From] = sessionInfo
-			}
-
-			// forward the message
-			go func(input chan<- string, text string) {
-				input <- text
-			}(sessionInfo.input, m.Body)
-		case number := <-timeouts:
-			if _, exists := mux.sessions[number]; exists {
-				delete(mux.sessions, number)
+		case now := <-sweep:
+			for _, s := range mux.idle(now) {
+				mux.end(s, IdleMessage)
 			}
 		// the context has been cancelled
 		case <-ctx.Done():
@@ -95,13 +229,121 @@ Run:
 		}
 	}
 
-	// close all inputs
-	for _, sessionInfo := range mux.sessions {
-		close(sessionInfo.input)
+	// tell each session the server is going away, and end it
+	mux.mu.Lock()
+	mux.stopped = true
+	sessions := make([]*smsSession, 0, len(mux.sessions))
+	for _, s := range mux.sessions {
+		sessions = append(sessions, s)
+	}
+	mux.mu.Unlock()
+
+	for _, s := range sessions {
+		mux.end(s, GoingAwayMessage)
 	}
 }
 
-type commandSessionInfo struct {
-	input   chan<- string
-	session *command.Session
+// idle retrieves the sessions which have been idle for the idle timeout as of now
+func (mux *smsMux) idle(now time.Time) []*smsSession {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	var idle []*smsSession
+	for _, s := range mux.sessions {
+		if now.Sub(s.LastActive) >= mux.idleTimeout {
+			idle = append(idle, s)
+		}
+	}
+
+	return idle
+}
+
+// launch starts the session's command session, its pump, which delivers its pending
+// messages, and the forwarding of its output. The caller must hold the lock.
+func (mux *smsMux) launch(s *smsSession) {
+	if s.launched {
+		return
+	}
+	s.launched = true
+
+	input := make(chan string)
+	output := make(chan string)
+	db, sender := mux.db, mux.sender
+
+	go s.pump(&mux.mu, input)
+
+	// We want to forward the strings on the output
+	// channel and send them as SMS
+	go func(out <-chan string, from sms.PhoneNumber) {
+		for o := range out {
+			select {
+			case <-s.done:
+				// the session is over, and has said goodbye, but it
+				// is drained so that it isn't stuck writing to it
+				continue
+			default:
+			}
+
+			mux.touch(s)
+
+			// use the SMS interface to send the message, a message which
+			// fails to send is lost, but the session carries on
+			if err := sender.Send(string(from), o); err != nil {
+				log.Printf("Error sending to %s: %s", from, err)
+			}
+		}
+	}(output, s.Number)
+
+	go func() {
+		u, err := user.ForPhone(db, string(s.Number))
+		if err != nil {
+			u = nil
+		} else {
+			mux.mu.Lock()
+			s.UserID = u.ID().String()
+			mux.mu.Unlock()
+		}
+
+		// the session bails when it ends itself, it has nothing more to say
+		mux.startSession(u, db, input, output, func() {
+			mux.end(s, "")
+		})
+	}()
+}
+
+// touch records that the session is active
+func (mux *smsMux) touch(s *smsSession) {
+	mux.mu.Lock()
+	s.LastActive = time.Now()
+	mux.mu.Unlock()
+}
+
+// end ends the session, unless it has already ended, and sends the goodbye message, if there
+// is one. It returns whether it ended the session. A number's session is replaced once it
+// has ended, so it only removes the session if it is still the number's.
+func (mux *smsMux) end(s *smsSession, goodbye string) bool {
+	mux.mu.Lock()
+	if !s.commandQueue.end() {
+		mux.mu.Unlock()
+		return false
+	}
+
+	if mux.sessions[s.Number] == s {
+		delete(mux.sessions, s.Number)
+	}
+	if len(s.pending) > 0 {
+		log.Printf("Dropping %d messages of the session of %s, which has ended", len(s.pending), s.Number)
+	}
+	sender := mux.sender
+	launched := s.launched
+	mux.mu.Unlock()
+
+	// tell the other end of the session it is over
+	if goodbye != "" && launched {
+		if err := sender.Send(string(s.Number), goodbye); err != nil {
+			log.Printf("Error saying goodbye to %s: %s", s.Number, err)
+		}
+	}
+
+	return true
 }
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/elos/data"
+	"github.com/elos/gaia/services/sms"
+	"golang.org/x/net/context"
+)
+
+type sent struct {
+	to, body string
+}
+
+// busSMS forwards each message it sends on its bus
+type busSMS struct {
+	bus chan sent
+}
+
+func newBusSMS() *busSMS {
+	return &busSMS{bus: make(chan sent, 100)}
+}
+
+func (b *busSMS) Send(to, body string) error {
+	b.bus <- sent{to, body}
+	return nil
+}
+
+// next receives the next message sent
+func (b *busSMS) next(t *testing.T) sent {
+	select {
+	case m := <-b.bus:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message to be sent")
+		return sent{}
+	}
+}
+
+// sendingThrough is the Start of the mux, with the sender
+func sendingThrough(mux *smsMux, sender SMS) func(context.Context, data.DB) {
+	return func(ctx context.Context, db data.DB) {
+		mux.Start(ctx, db, sender)
+	}
+}
+
+func inbound(t *testing.T, mux *smsMux, from, body string) {
+	if err := mux.Inbound(&sms.Message{From: sms.PhoneNumber(from), To: "+16505550000", Body: body}); err != nil {
+		t.Fatalf("mux.Inbound error: %s", err)
+	}
+}
+
+func TestSMSMuxOrder(t *testing.T) {
+	mux := NewBoundedSMSMux(10, 0, 100)
+	sender := newBusSMS()
+
+	// the messages which arrive before the mux is started wait for it
+	for i := 0; i < 5; i++ {
+		inbound(t, mux, "+16505551234", fmt.Sprint(i))
+	}
+
+	stop := startMux(&mux.startSession, echoSession, sendingThrough(mux, sender))
+	defer stop()
+
+	for i := 5; i < 50; i++ {
+		inbound(t, mux, "+16505551234", fmt.Sprint(i))
+	}
+
+	for i := 0; i < 50; i++ {
+		if got, want := sender.next(t).body, fmt.Sprintf("echo: %d", i); got != want {
+			t.Fatalf("message %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestSMSMuxMaxSessions(t *testing.T) {
+	mux := NewBoundedSMSMux(2, 0, 10)
+	sender := newBusSMS()
+	stop := startMux(&mux.startSession, echoSession, sendingThrough(mux, sender))
+	defer stop()
+
+	inbound(t, mux, "+16505550001", "one")
+	inbound(t, mux, "+16505550002", "two")
+
+	err := mux.Inbound(&sms.Message{From: "+16505550003", To: "+16505550000", Body: "three"})
+	if err != ErrSMSSessionLimit {
+		t.Fatalf("mux.Inbound: got %v, want %v", err, ErrSMSSessionLimit)
+	}
+
+	// a live session takes more messages
+	inbound(t, mux, "+16505550001", "four")
+
+	if !mux.Kill("+16505550002") {
+		t.Fatal("expected the session to be killed")
+	}
+	inbound(t, mux, "+16505550003", "three")
+
+	if got, want := mux.Active(), 2; got != want {
+		t.Errorf("mux.Active(): got %d, want %d", got, want)
+	}
+}
+
+func TestSMSMuxBacklog(t *testing.T) {
+	mux := NewBoundedSMSMux(10, 0, 2)
+	stop := startMux(&mux.startSession, stuckSession, sendingThrough(mux, newBusSMS()))
+	defer stop()
+
+	inbound(t, mux, "+16505551234", "one")
+	inbound(t, mux, "+16505551234", "two")
+
+	err := mux.Inbound(&sms.Message{From: "+16505551234", To: "+16505550000", Body: "three"})
+	if err != ErrSMSBacklog {
+		t.Fatalf("mux.Inbound: got %v, want %v", err, ErrSMSBacklog)
+	}
+
+	// the backlog is the number's own
+	inbound(t, mux, "+16505554321", "one")
+}
+
+func TestSMSMuxIdleTimeout(t *testing.T) {
+	mux := NewBoundedSMSMux(10, 50*time.Millisecond, 10)
+	sender := newBusSMS()
+	stop := startMux(&mux.startSession, echoSession, sendingThrough(mux, sender))
+	defer stop()
+
+	inbound(t, mux, "+16505551234", "todo")
+
+	if got, want := sender.next(t).body, "echo: todo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if got, want := sender.next(t), (sent{"+16505551234", IdleMessage}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if got := mux.Active(); got != 0 {
+		t.Errorf("mux.Active(): got %d, want 0", got)
+	}
+
+	// the number may start another
+	inbound(t, mux, "+16505551234", "again")
+	if got, want := sender.next(t).body, "echo: again"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSMSMuxSessionsAndKill(t *testing.T) {
+	mux := NewBoundedSMSMux(10, 0, 10)
+	sender := newBusSMS()
+	stop := startMux(&mux.startSession, echoSession, sendingThrough(mux, sender))
+	defer stop()
+
+	inbound(t, mux, "+16505552222", "todo")
+	inbound(t, mux, "+16505551111", "todo")
+	sender.next(t)
+	sender.next(t)
+
+	sessions := mux.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("len(mux.Sessions()): got %d, want 2", len(sessions))
+	}
+	if sessions[0].Number != "+16505551111" || sessions[1].Number != "+16505552222" {
+		t.Errorf("the sessions are not in the order of their numbers: %+v, %+v", sessions[0], sessions[1])
+	}
+	if sessions[0].Started.IsZero() || sessions[0].LastActive.Before(sessions[0].Started) {
+		t.Errorf("the session's times are wrong: %+v", sessions[0])
+	}
+
+	if !mux.Kill("+16505551111") {
+		t.Fatal("expected the session to be killed")
+	}
+	if got, want := sender.next(t), (sent{"+16505551111", KilledMessage}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if mux.Kill("+16505551111") {
+		t.Error("expected there to be no session left to kill")
+	}
+
+	if sessions := mux.Sessions(); len(sessions) != 1 || sessions[0].Number != "+16505552222" {
+		t.Errorf("mux.Sessions(): got %+v", sessions)
+	}
+}
+
+func TestSMSMuxSessionEnds(t *testing.T) {
+	mux := NewBoundedSMSMux(10, 0, 10)
+	sender := newBusSMS()
+	stop := startMux(&mux.startSession, echoSession, sendingThrough(mux, sender))
+	defer stop()
+
+	inbound(t, mux, "+16505551234", "exit")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mux.Active() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the session to end")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	inbound(t, mux, "+16505551234", "todo")
+	if got, want := sender.next(t).body, "echo: todo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSMSMuxConcurrent(t *testing.T) {
+	mux := NewBoundedSMSMux(100, time.Millisecond, 1000)
+	sender := newBusSMS()
+	stop := startMux(&mux.startSession, echoSession, sendingThrough(mux, sender))
+
+	// drain what is sent, it is the races which are under test
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-sender.bus:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	concurrently(10, func(i int) {
+		number := sms.PhoneNumber(fmt.Sprintf("+1650555%04d", i%5))
+		for j := 0; j < 50; j++ {
+			mux.Inbound(&sms.Message{From: number, To: "+16505550000", Body: "todo"})
+			switch j % 10 {
+			case 3:
+				mux.Sessions()
+			case 7:
+				mux.Kill(number)
+			}
+		}
+	})
+
+	stop()
+
+	if err := mux.Inbound(&sms.Message{From: "+16505551234", To: "+16505550000", Body: "todo"}); err != ErrSMSSessionsStopped {
+		t.Errorf("mux.Inbound once stopped: got %v, want %v", err, ErrSMSSessionsStopped)
+	}
+	if got := mux.Active(); got != 0 {
+		t.Errorf("mux.Active() once stopped: got %d, want 0", got)
+	}
+}
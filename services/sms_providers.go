@@ -0,0 +1,289 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elos/gaia/services/sms"
+)
+
+// The names of the sms providers, by which /command/sms/<name>/ routes to them
+const (
+	TwilioProvider   = "twilio"
+	PlivoProvider    = "plivo"
+	NexmoProvider    = "nexmo"
+	LoopbackProvider = "loopback"
+)
+
+// providerTimeout bounds how long a provider's API has to accept a message
+const providerTimeout = 10 * time.Second
+
+// SMSProvider is a service which sends sms, and delivers those it receives to gaia's webhook
+type SMSProvider interface {
+	SMS
+	// Name is that by which /command/sms/<name>/ routes to the provider
+	Name() string
+	// Verify verifies the signature of a request to the webhook, which proves it is from the
+	// provider, the url is that which the provider requested. It fails with sms.ErrInvalidSignature
+	// if the signature is missing, or doesn't match.
+	Verify(r *http.Request, url string) error
+	// Inbound extracts the message from a request of the provider to the webhook
+	Inbound(r *http.Request) (*sms.Message, error)
+}
+
+// SMSProviders are the providers whose webhooks gaia serves
+type SMSProviders interface {
+	// Provider retrieves the provider of the name, the empty name is that of the default provider
+	Provider(name string) (SMSProvider, bool)
+}
+
+type smsProviders struct {
+	def       SMSProvider
+	providers map[string]SMSProvider
+}
+
+// NewSMSProviders constructs the providers, the first is the default, which serves /command/sms/
+func NewSMSProviders(providers ...SMSProvider) *smsProviders {
+	p := &smsProviders{
+		providers: make(map[string]SMSProvider),
+	}
+
+	for _, provider := range providers {
+		if p.def == nil {
+			p.def = provider
+		}
+		p.providers[provider.Name()] = provider
+	}
+
+	return p
+}
+
+func (p *smsProviders) Provider(name string) (SMSProvider, bool) {
+	if name == "" {
+		return p.def, p.def != nil
+	}
+
+	provider, ok := p.providers[name]
+	return provider, ok
+}
+
+// statusError is the error of a response of a provider's API, a request which
+// was throttled, or which the provider failed to handle, may be retried
+func statusError(provider string, resp *http.Response) error {
+	return &ProviderError{
+		Provider: provider,
+		Message:  resp.Status,
+		Retry:    resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+}
+
+// --- Plivo {{{
+
+// plivoAPI is the base of the url of plivo's REST API
+const plivoAPI = "https://api.plivo.com/v1"
+
+type plivoSMS struct {
+	authID, authToken, from string
+	api                     string
+	client                  *http.Client
+	nonces                  *sms.Nonces
+}
+
+// NewPlivoSMS constructs the provider of the plivo account, which sends from the number
+func NewPlivoSMS(authID, authToken, from string) *plivoSMS {
+	return &plivoSMS{
+		authID:    authID,
+		authToken: authToken,
+		from:      from,
+		api:       plivoAPI,
+		client:    &http.Client{Timeout: providerTimeout},
+		nonces:    sms.NewNonces(sms.PlivoNonceTTL, sms.PlivoMaxNonces),
+	}
+}
+
+func (p *plivoSMS) Name() string {
+	return PlivoProvider
+}
+
+func (p *plivoSMS) Send(to, body string) error {
+	payload, err := json.Marshal(map[string]string{
+		"src":  p.from,
+		"dst":  to,
+		"text": body,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.api+"/Account/"+p.authID+"/Message/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.authID, p.authToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return statusError(PlivoProvider, resp)
+	}
+
+	return nil
+}
+
+func (p *plivoSMS) Verify(r *http.Request, url string) error {
+	return sms.VerifyPlivo(r, url, p.authToken, p.nonces, time.Now())
+}
+
+func (p *plivoSMS) Inbound(r *http.Request) (*sms.Message, error) {
+	return sms.ParsePlivo(r)
+}
+
+// --- }}}
+
+// --- Nexmo {{{
+
+// nexmoAPI is the url of nexmo's sms API
+const nexmoAPI = "https://rest.nexmo.com/sms/json"
+
+// nexmoThrottled is the status of a message nexmo refused because it was sent too quickly
+const nexmoThrottled = "1"
+
+type nexmoSMS struct {
+	apiKey, apiSecret, from string
+	// the account's signature secret, and the method of its signatures, sms.NexmoMD5Hash or sms.NexmoSHA256
+	signatureSecret, signatureMethod string
+	api                              string
+	client                           *http.Client
+}
+
+// NewNexmoSMS constructs the provider of the nexmo account, which sends from the number, and
+// verifies the requests to its webhook are signed by the signature secret, with the method
+func NewNexmoSMS(apiKey, apiSecret, from, signatureSecret, signatureMethod string) *nexmoSMS {
+	return &nexmoSMS{
+		apiKey:          apiKey,
+		apiSecret:       apiSecret,
+		from:            from,
+		signatureSecret: signatureSecret,
+		signatureMethod: signatureMethod,
+		api:             nexmoAPI,
+		client:          &http.Client{Timeout: providerTimeout},
+	}
+}
+
+func (n *nexmoSMS) Name() string {
+	return NexmoProvider
+}
+
+func (n *nexmoSMS) Send(to, body string) error {
+	resp, err := n.client.PostForm(n.api, url.Values{
+		"api_key":    {n.apiKey},
+		"api_secret": {n.apiSecret},
+		"from":       {n.from},
+		"to":         {to},
+		"text":       {body},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(NexmoProvider, resp)
+	}
+
+	// nexmo responds 200 regardless, each part of the message has a status, of which 0 is success
+	var result struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			ErrorText string `json:"error-text"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	for _, m := range result.Messages {
+		if m.Status != "0" {
+			return &ProviderError{
+				Provider: NexmoProvider,
+				Message:  fmt.Sprintf("status %s: %s", m.Status, m.ErrorText),
+				Retry:    m.Status == nexmoThrottled,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (n *nexmoSMS) Verify(r *http.Request, url string) error {
+	return sms.VerifyNexmo(r, n.signatureSecret, n.signatureMethod, time.Now())
+}
+
+func (n *nexmoSMS) Inbound(r *http.Request) (*sms.Message, error) {
+	return sms.ParseNexmo(r)
+}
+
+// --- }}}
+
+// --- Loopback {{{
+
+// LoopbackMessage is a message the loopback provider sent
+type LoopbackMessage struct {
+	To   string    `json:"to"`
+	Body string    `json:"body"`
+	Sent time.Time `json:"sent"`
+}
+
+type loopbackSMS struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewLoopbackSMS constructs a provider, for development, which writes the messages it sends to
+// the writer, one LoopbackMessage of JSON per line, and which accepts messages to its webhook
+// in the form of twilio's, without a signature, so that they may be posted by hand:
+//
+//		curl -d From=+16505551234 -d To=+16505550000 -d Body=todo localhost:8080/command/sms/loopback/
+func NewLoopbackSMS(w io.Writer) *loopbackSMS {
+	return &loopbackSMS{w: w}
+}
+
+func (l *loopbackSMS) Name() string {
+	return LoopbackProvider
+}
+
+func (l *loopbackSMS) Send(to, body string) error {
+	line, err := json.Marshal(&LoopbackMessage{To: to, Body: body, Sent: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// Verify accepts every request, the loopback provider is for development, so
+// it must only be served when it is asked for, and never in production
+func (l *loopbackSMS) Verify(r *http.Request, url string) error {
+	return nil
+}
+
+func (l *loopbackSMS) Inbound(r *http.Request) (*sms.Message, error) {
+	return sms.ParseTwilio(r)
+}
+
+// --- }}}
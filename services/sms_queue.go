@@ -0,0 +1,627 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elos/data"
+	"github.com/elos/models"
+	"github.com/elos/models/user"
+	"golang.org/x/net/context"
+)
+
+// SMSDeliveryEvent is the name of the events which record the delivery of each
+// segment of an outbound sms, they may be queried as any other event is:
+//
+//		POST /record/query/?kind=event  {"name": "SMS_DELIVERY"}
+//
+// The event's data is the to, body, segment, segments, status, attempts and error. It is a
+// copy, which the queue writes but never reads, so a user may read it, but not make, alter
+// or delete it.
+const SMSDeliveryEvent = "SMS_DELIVERY"
+
+// SMSOutboxEvent is the name of the events in which the queue keeps the segments it is yet
+// to deliver, each is deleted once its segment is sent, or fails. The events have no owner,
+// and are signed by the queue's key, so a segment is only reloaded if the queue queued it.
+// The event's data is the delivery (the id of its SMSDeliveryEvent), to, body, segment,
+// attempts, queued_at and mac.
+const SMSOutboxEvent = "SMS_OUTBOX"
+
+// The statuses of an SMSDeliveryEvent
+const (
+	SMSQueued = "queued"
+	SMSSent   = "sent"
+	SMSFailed = "failed"
+)
+
+// The defaults of the outbound sms queue
+const (
+	// DefaultSMSAttempts is how many times a segment is sent before it fails
+	DefaultSMSAttempts = 5
+	// DefaultSMSBackoff is the delay before the first retry, it doubles with each retry
+	DefaultSMSBackoff = 2 * time.Second
+	// DefaultSMSMaxBackoff bounds the delay between retries
+	DefaultSMSMaxBackoff = 5 * time.Minute
+	// DefaultSMSInterval is the least time between the segments sent to a number
+	DefaultSMSInterval = time.Second
+	// SMSSegmentLength is the most characters of a segment, that of a part of a concatenated
+	// sms of the GSM 03.38 characters, in septets
+	SMSSegmentLength = 153
+	// SMSUCS2SegmentLength is the most of a segment which has other characters, so is sent as
+	// UCS-2, in UTF-16 code units
+	SMSUCS2SegmentLength = 67
+)
+
+// gsm7 are the characters of the GSM 03.38 alphabet, each of which is a septet, and gsm7Extension
+// those of its extension table, each of which is two. A body of any other character is sent as UCS-2.
+const (
+	gsm7 = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extension = "\f^{}\\[~]|€"
+)
+
+// ProviderError is an error response of a provider's API
+type ProviderError struct {
+	Provider string
+	Message  string
+	// Retry determines whether the request may succeed if it is retried
+	Retry bool
+}
+
+func (e *ProviderError) Error() string {
+	return e.Provider + ": " + e.Message
+}
+
+// Temporary determines whether the request may succeed if it is retried
+func (e *ProviderError) Temporary() bool {
+	return e.Retry
+}
+
+// temporary determines whether the error of a send is worth retrying, an error
+// which doesn't say otherwise, such as that of a network, is considered temporary
+func temporary(err error) bool {
+	if t, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return t.Temporary()
+	}
+
+	return true
+}
+
+// outbound is a segment in the queue
+type outbound struct {
+	outbox   *models.Event // which keeps it, until it is delivered
+	event    *models.Event // which records its delivery
+	to, body string
+	attempts int
+	due      time.Time
+}
+
+type smsQueue struct {
+	db     data.DB
+	sender SMS
+	key    []byte
+
+	attempts            int
+	backoff, maxBackoff time.Duration
+	interval            time.Duration
+
+	mu      sync.Mutex
+	queues  map[string][]*outbound // by number, in the order they are sent
+	sending map[string]bool        // whether a segment to the number is being sent
+	last    map[string]time.Time   // when a segment was last sent to the number
+	queued  map[string]bool        // the ids of the events of the segments which are pending
+	wake    chan struct{}
+	running int32
+}
+
+// NewSMSQueue constructs a durable queue of outbound sms, in front of the sender. Its Send
+// records the message, as the events of its segments, and returns, the queue delivers
+// them once it is started. The segments to each number are delivered in order, at most one
+// per interval, and a segment which fails temporarily is retried, with exponential backoff,
+// until it has been attempted the number of attempts. The segments are signed with the key,
+// the queue only reloads those which were signed with the same key.
+func NewSMSQueue(db data.DB, sender SMS, key []byte, attempts int, backoff, maxBackoff, interval time.Duration) *smsQueue {
+	return &smsQueue{
+		db:         db,
+		sender:     sender,
+		key:        key,
+		attempts:   attempts,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		interval:   interval,
+		queues:     make(map[string][]*outbound),
+		sending:    make(map[string]bool),
+		last:       make(map[string]time.Time),
+		queued:     make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Send enqueues the body, split into segments, it only fails if they couldn't be recorded
+func (q *smsQueue) Send(to, body string) error {
+	// the delivery events belong to the user of the number, if there is one
+	u, err := user.ForPhone(q.db, to)
+	if err != nil {
+		u = nil
+	}
+
+	segments := Segment(body, SegmentLength(body))
+	queued := make([]*outbound, len(segments))
+	now := time.Now()
+
+	for i, segment := range segments {
+		e := models.NewEvent()
+		e.SetID(q.db.NewID())
+		if u != nil {
+			e.SetOwner(u)
+		}
+		e.Name = SMSDeliveryEvent
+		e.CreatedAt, e.UpdatedAt, e.Time = now, now, now
+		e.Data = map[string]interface{}{
+			"to":        to,
+			"body":      segment,
+			"segment":   i + 1,
+			"segments":  len(segments),
+			"status":    SMSQueued,
+			"attempts":  0,
+			"queued_at": now.UnixNano(),
+		}
+
+		if err := q.db.Save(e); err != nil {
+			return err
+		}
+
+		o := models.NewEvent()
+		o.SetID(q.db.NewID())
+		o.Name = SMSOutboxEvent
+		o.CreatedAt, o.UpdatedAt, o.Time = now, now, now
+		o.Data = map[string]interface{}{
+			"delivery":  e.ID().String(),
+			"to":        to,
+			"body":      segment,
+			"segment":   i + 1,
+			"attempts":  0,
+			"queued_at": now.UnixNano(),
+		}
+		o.Data["mac"] = q.sign(o)
+
+		if err := q.db.Save(o); err != nil {
+			return err
+		}
+
+		queued[i] = &outbound{outbox: o, event: e, to: to, body: segment, due: now}
+	}
+
+	q.mu.Lock()
+	for _, o := range queued {
+		q.enqueue(o)
+	}
+	q.mu.Unlock()
+
+	q.signal()
+	return nil
+}
+
+// Pending is the number of segments waiting to be delivered
+func (q *smsQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queued)
+}
+
+// enqueue adds the segment to the queue of its number, unless it is already pending, which
+// it may be if it was reloaded as it was sent. The caller must hold the lock.
+func (q *smsQueue) enqueue(o *outbound) {
+	if q.queued[o.outbox.ID().String()] {
+		return
+	}
+
+	q.queued[o.outbox.ID().String()] = true
+	q.queues[o.to] = append(q.queues[o.to], o)
+}
+
+func (q *smsQueue) Running() bool {
+	return atomic.LoadInt32(&q.running) == 1
+}
+
+func (q *smsQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start delivers the queue, first reloading the segments which were queued but not delivered
+// before the last shutdown. It returns once the context is done, and the sends in flight end,
+// the segments which remain are delivered when it is next started.
+func (q *smsQueue) Start(ctx context.Context) {
+	atomic.StoreInt32(&q.running, 1)
+	defer atomic.StoreInt32(&q.running, 0)
+
+	if err := q.reload(); err != nil {
+		log.Printf("smsQueue: failed to reload the queue: %s", err)
+	}
+
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		next := q.dispatch(&inflight)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch sends the segment at the head of each number's queue which is due, and not
+// held back by the rate limit. It returns when the next segment will be due, if any is waiting.
+func (q *smsQueue) dispatch(inflight *sync.WaitGroup) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var next time.Time
+
+	for to, queue := range q.queues {
+		if len(queue) == 0 || q.sending[to] {
+			continue
+		}
+
+		o := queue[0]
+		due := o.due
+		if limit := q.last[to].Add(q.interval); limit.After(due) {
+			due = limit
+		}
+
+		if due.After(now) {
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+			continue
+		}
+
+		q.sending[to] = true
+		inflight.Add(1)
+		go func(o *outbound) {
+			defer inflight.Done()
+			q.deliver(o)
+		}(o)
+	}
+
+	return next
+}
+
+// deliver sends the segment, then records the outcome. The number's next segment isn't
+// sent until it is recorded, so only one delivery at a time touches a number's events.
+func (q *smsQueue) deliver(o *outbound) {
+	err := q.sender.Send(o.to, o.body)
+	now := time.Now()
+
+	q.mu.Lock()
+	o.attempts++
+	status := SMSSent
+	switch {
+	case err == nil:
+		q.last[o.to] = now
+	case temporary(err) && o.attempts < q.attempts:
+		status = SMSQueued
+		o.due = now.Add(q.delay(o.attempts))
+	default:
+		status = SMSFailed
+	}
+
+	if status != SMSQueued {
+		q.queues[o.to] = q.queues[o.to][1:]
+		if len(q.queues[o.to]) == 0 {
+			delete(q.queues, o.to)
+		}
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		log.Printf("smsQueue: sending segment %s to %s failed (attempt %d, %s): %s", o.outbox.ID(), o.to, o.attempts, status, err)
+	}
+
+	// the segment remains in the outbox until it is sent, or fails
+	if status == SMSQueued {
+		o.outbox.Data["attempts"] = o.attempts
+		o.outbox.UpdatedAt = now
+		if err := q.db.Save(o.outbox); err != nil {
+			log.Printf("smsQueue: failed to record the attempt of %s: %s", o.outbox.ID(), err)
+		}
+	} else if err := q.db.Delete(o.outbox); err != nil {
+		log.Printf("smsQueue: failed to remove %s from the outbox: %s", o.outbox.ID(), err)
+	}
+
+	if o.event != nil {
+		o.event.Data["status"] = status
+		o.event.Data["attempts"] = o.attempts
+		if err != nil {
+			o.event.Data["error"] = err.Error()
+		}
+		if status == SMSSent {
+			o.event.Data["sent_at"] = now.UnixNano()
+		}
+		o.event.UpdatedAt = now
+
+		if err := q.db.Save(o.event); err != nil {
+			log.Printf("smsQueue: failed to record the delivery of %s: %s", o.event.ID(), err)
+		}
+	}
+
+	q.mu.Lock()
+	q.sending[o.to] = false
+	if status != SMSQueued {
+		delete(q.queued, o.outbox.ID().String()) // once it is recorded
+	}
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// delay is the backoff before the retry which follows the attempts
+func (q *smsQueue) delay(attempts int) time.Duration {
+	d := q.backoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+
+	return d
+}
+
+// reload queues the segments which remain in the outbox. A segment whose event has an
+// owner, or isn't signed by the queue's key, wasn't queued by the queue, so it is ignored,
+// and if it has no owner, removed.
+func (q *smsQueue) reload() error {
+	iter, err := q.db.Query(models.EventKind).Select(data.AttrMap{"name": SMSOutboxEvent}).Execute()
+	if err != nil {
+		return err
+	}
+
+	var queued []*outbound
+	var forgotten []*models.Event
+	o := models.NewEvent()
+	for iter.Next(o) {
+		mac, _ := o.Data["mac"].(string)
+		if o.OwnerId != "" || !hmac.Equal([]byte(mac), []byte(q.sign(o))) {
+			log.Printf("smsQueue: ignoring %s, which the queue didn't sign", o.ID())
+			// it was queued with another key, or forged, either way it won't be sent
+			if o.OwnerId == "" {
+				forgotten = append(forgotten, o)
+			}
+			o = models.NewEvent()
+			continue
+		}
+
+		to, _ := o.Data["to"].(string)
+		body, _ := o.Data["body"].(string)
+		queued = append(queued, &outbound{
+			outbox:   o,
+			to:       to,
+			body:     body,
+			attempts: int(dataInt(o.Data["attempts"])),
+		})
+		o = models.NewEvent()
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, o := range forgotten {
+		if err := q.db.Delete(o); err != nil {
+			log.Printf("smsQueue: failed to remove %s from the outbox: %s", o.ID(), err)
+		}
+	}
+
+	for _, o := range queued {
+		o.event = q.delivery(o.outbox)
+	}
+
+	// in the order they were queued
+	sort.SliceStable(queued, func(i, j int) bool {
+		a, b := queued[i].outbox.Data, queued[j].outbox.Data
+		if qa, qb := dataInt(a["queued_at"]), dataInt(b["queued_at"]); qa != qb {
+			return qa < qb
+		}
+		return dataInt(a["segment"]) < dataInt(b["segment"])
+	})
+
+	q.mu.Lock()
+	for _, o := range queued {
+		q.enqueue(o)
+	}
+	q.mu.Unlock()
+
+	return nil
+}
+
+// delivery retrieves the delivery event of the segment in the outbox, or nil if it is gone,
+// in which case the segment is still delivered, but its delivery isn't recorded
+func (q *smsQueue) delivery(outbox *models.Event) *models.Event {
+	delivery, _ := outbox.Data["delivery"].(string)
+	id, err := q.db.ParseID(delivery)
+	if err != nil {
+		log.Printf("smsQueue: the delivery of %s is invalid: %s", outbox.ID(), err)
+		return nil
+	}
+
+	e := models.NewEvent()
+	e.SetID(id)
+	if err := q.db.PopulateByID(e); err != nil {
+		log.Printf("smsQueue: failed to retrieve the delivery of %s: %s", outbox.ID(), err)
+		return nil
+	}
+
+	return e
+}
+
+// sign computes the mac, by the queue's key, of the segment in the outbox. It covers what is
+// sent, and to whom, not the attempts, which change as it is retried, nor when it was queued,
+// which, depending on the database, may not be retrieved exactly.
+func (q *smsQueue) sign(outbox *models.Event) string {
+	delivery, _ := outbox.Data["delivery"].(string)
+	to, _ := outbox.Data["to"].(string)
+	body, _ := outbox.Data["body"].(string)
+
+	signed, _ := json.Marshal([]interface{}{
+		outbox.ID().String(),
+		delivery,
+		to,
+		body,
+		dataInt(outbox.Data["segment"]),
+	})
+
+	mac := hmac.New(sha256.New, q.key)
+	mac.Write(signed)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// dataInt reads an integer of an event's data, which, depending on the
+// database, may have been stored, and retrieved, as any type of number
+func dataInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	default:
+		return 0
+	}
+}
+
+// GSM7 determines whether the body is of the GSM 03.38 alphabet, so is sent as septets
+func GSM7(body string) bool {
+	for _, r := range body {
+		if !strings.ContainsRune(gsm7, r) && !strings.ContainsRune(gsm7Extension, r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SegmentLength is the most a segment of the body may be, which depends on its encoding
+func SegmentLength(body string) int {
+	if GSM7(body) {
+		return SMSSegmentLength
+	}
+
+	return SMSUCS2SegmentLength
+}
+
+// Segment splits the body into segments of at most the length, breaking it at whitespace where
+// it can. The length is in septets, if the body is of the GSM 03.38 alphabet, in which the
+// characters of the extension table count twice, otherwise it is in UTF-16 code units. If
+// there is more than one segment, each is prefixed by its position, e.g. "(1/3) ", which
+// counts toward the length.
+func Segment(body string, length int) []string {
+	gsm := GSM7(body)
+	if smsLength(body, gsm) <= length {
+		return []string{body}
+	}
+
+	// reserve room for the prefix, supposing there are fewer than 100 segments
+	const prefix = len("(99/99) ")
+	parts := split(body, length-prefix, gsm)
+
+	segments := make([]string, len(parts))
+	for i, part := range parts {
+		segments[i] = fmt.Sprintf("(%d/%d) %s", i+1, len(parts), part)
+	}
+
+	return segments
+}
+
+// split splits the text into parts of at most the length, see Segment
+func split(text string, length int, gsm bool) []string {
+	var parts []string
+
+	for smsLength(text, gsm) > length {
+		runes := []rune(text)
+
+		// fit is how many of the runes fit in the part
+		fit, n := 0, 0
+		for ; n+runeLength(runes[fit], gsm) <= length; fit++ {
+			n += runeLength(runes[fit], gsm)
+		}
+		cut := fit
+
+		// break at the last whitespace, unless a word is longer than the part
+		if i := strings.LastIndexAny(string(runes[:fit+1]), " \n\t"); i > 0 {
+			cut = utf8.RuneCountInString(string(runes[:fit+1])[:i])
+		}
+		if cut == 0 {
+			cut = 1
+		}
+
+		parts = append(parts, strings.TrimRight(string(runes[:cut]), " \n\t"))
+		text = strings.TrimLeft(string(runes[cut:]), " \n\t")
+	}
+
+	if text = strings.TrimRight(text, " \n\t"); text != "" {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
+
+// smsLength is the length of the text, in septets if gsm, otherwise in UTF-16 code units
+func smsLength(text string, gsm bool) int {
+	n := 0
+	for _, r := range text {
+		n += runeLength(r, gsm)
+	}
+
+	return n
+}
+
+// runeLength is the length of the character, in septets if gsm, otherwise in UTF-16 code units
+func runeLength(r rune, gsm bool) int {
+	if gsm && strings.ContainsRune(gsm7Extension, r) {
+		return 2
+	}
+	if !gsm && r > 0xFFFF {
+		return 2
+	}
+
+	return 1
+}
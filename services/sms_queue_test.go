@@ -0,0 +1,414 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elos/data"
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/models"
+	"github.com/subosito/twilio"
+	"golang.org/x/net/context"
+)
+
+// testQueueKey signs the segments of the queues of the tests
+var testQueueKey = []byte("0123456789abcdef")
+
+// scriptedSMS fails each send with the next of its errors, until they run out
+type scriptedSMS struct {
+	sync.Mutex
+	errs []error
+	sent []string
+	at   []time.Time
+	done chan struct{}
+	want int
+}
+
+func newScriptedSMS(want int, errs ...error) *scriptedSMS {
+	return &scriptedSMS{errs: errs, done: make(chan struct{}), want: want}
+}
+
+func (s *scriptedSMS) Send(to, body string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+
+	s.sent = append(s.sent, body)
+	s.at = append(s.at, time.Now())
+	if len(s.sent) == s.want {
+		close(s.done)
+	}
+	return nil
+}
+
+func (s *scriptedSMS) wait(t *testing.T) {
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the messages to be sent")
+	}
+}
+
+// deliveries retrieves the data of the delivery events
+func deliveries(t *testing.T, db data.DB) []map[string]interface{} {
+	iter, err := db.Query(models.EventKind).Select(data.AttrMap{"name": SMSDeliveryEvent}).Execute()
+	if err != nil {
+		t.Fatalf("db.Query error: %s", err)
+	}
+
+	var ds []map[string]interface{}
+	e := models.NewEvent()
+	for iter.Next(e) {
+		ds = append(ds, e.Data)
+		e = models.NewEvent()
+	}
+
+	if err := iter.Close(); err != nil {
+		t.Fatalf("iter.Close error: %s", err)
+	}
+
+	return ds
+}
+
+// settle waits until the queue has nothing pending
+func settle(t *testing.T, q *smsQueue) {
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the queue to settle, %d pending", q.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	if got := Segment("todo", SMSSegmentLength); len(got) != 1 || got[0] != "todo" {
+		t.Errorf("Segment of a short body: got %q", got)
+	}
+
+	body := strings.Repeat("elos is a personal ontology. ", 20)
+	segments := Segment(body, SMSSegmentLength)
+	if len(segments) < 2 {
+		t.Fatalf("expected the body to be segmented, got %d segments", len(segments))
+	}
+
+	var rejoined []string
+	for i, s := range segments {
+		if n := utf8.RuneCountInString(s); n > SMSSegmentLength {
+			t.Errorf("segment %d is %d characters, want at most %d", i, n, SMSSegmentLength)
+		}
+
+		prefix := "(" + string(rune('1'+i)) + "/"
+		if !strings.HasPrefix(s, prefix) {
+			t.Errorf("segment %d: %q doesn't begin %q", i, s, prefix)
+		}
+
+		rejoined = append(rejoined, s[strings.Index(s, ") ")+2:])
+	}
+
+	// no word is broken
+	if got, want := strings.Join(rejoined, " "), strings.TrimSpace(body); got != want {
+		t.Errorf("the segments rejoined:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestSegmentEncodings(t *testing.T) {
+	cases := []struct {
+		name, body string
+		length     int
+		// size is the length of the text, in septets or UTF-16 code units
+		size func(string) int
+	}{
+		{
+			"gsm", strings.Repeat("élos, ", 60), SMSSegmentLength,
+			func(s string) int { return utf8.RuneCountInString(s) },
+		},
+		{
+			// the characters of the extension table are two septets
+			"gsm extension", strings.Repeat("{elos} ", 60), SMSSegmentLength,
+			func(s string) int { return utf8.RuneCountInString(s) + strings.Count(s, "{") + strings.Count(s, "}") },
+		},
+		{
+			"ucs-2", strings.Repeat("элос ", 60), SMSUCS2SegmentLength,
+			func(s string) int { return utf8.RuneCountInString(s) },
+		},
+		{
+			// a character beyond the basic multilingual plane is two code units
+			"ucs-2 surrogates", strings.Repeat("elos \U0001F4C5 ", 40), SMSUCS2SegmentLength,
+			func(s string) int { return utf8.RuneCountInString(s) + strings.Count(s, "\U0001F4C5") },
+		},
+	}
+
+	for _, c := range cases {
+		if got, want := SegmentLength(c.body), c.length; got != want {
+			t.Errorf("%s: SegmentLength: got %d, want %d", c.name, got, want)
+		}
+
+		segments := Segment(c.body, SegmentLength(c.body))
+		if len(segments) < 2 {
+			t.Fatalf("%s: expected the body to be segmented, got %d segments", c.name, len(segments))
+		}
+
+		var rejoined []string
+		for i, s := range segments {
+			if n := c.size(s); n > c.length {
+				t.Errorf("%s: segment %d is %d long, want at most %d", c.name, i, n, c.length)
+			}
+			rejoined = append(rejoined, s[strings.Index(s, ") ")+2:])
+		}
+
+		if got, want := strings.Join(rejoined, " "), strings.TrimSpace(c.body); got != want {
+			t.Errorf("%s: the segments rejoined:\ngot  %q\nwant %q", c.name, got, want)
+		}
+	}
+}
+
+func TestSMSQueueRetries(t *testing.T) {
+	db := mem.NewDB()
+	sender := newScriptedSMS(1, errors.New("connection reset"), &ProviderError{Provider: "test", Message: "503", Retry: true})
+	q := NewSMSQueue(db, sender, testQueueKey, 5, time.Millisecond, 10*time.Millisecond, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Start(ctx)
+
+	if err := q.Send("+16505551234", "todo"); err != nil {
+		t.Fatalf("q.Send error: %s", err)
+	}
+
+	sender.wait(t)
+	settle(t, q)
+
+	ds := deliveries(t, db)
+	if len(ds) != 1 {
+		t.Fatalf("len(deliveries): got %d, want 1", len(ds))
+	}
+	if got, want := ds[0]["status"], SMSSent; got != want {
+		t.Errorf("status: got %v, want %v", got, want)
+	}
+	if got, want := dataInt(ds[0]["attempts"]), int64(3); got != want {
+		t.Errorf("attempts: got %d, want %d", got, want)
+	}
+}
+
+func TestSMSQueuePermanentFailure(t *testing.T) {
+	db := mem.NewDB()
+	sender := newScriptedSMS(1, &ProviderError{Provider: "test", Message: "400 Bad Request"})
+	q := NewSMSQueue(db, sender, testQueueKey, 5, time.Millisecond, 10*time.Millisecond, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Start(ctx)
+
+	if err := q.Send("+16505551234", "unsendable"); err != nil {
+		t.Fatalf("q.Send error: %s", err)
+	}
+	// the failure doesn't hold up the next message
+	if err := q.Send("+16505551234", "todo"); err != nil {
+		t.Fatalf("q.Send error: %s", err)
+	}
+
+	sender.wait(t)
+	settle(t, q)
+
+	statuses := make(map[interface{}]interface{})
+	for _, d := range deliveries(t, db) {
+		statuses[d["body"]] = d["status"]
+	}
+
+	if got, want := statuses["unsendable"], SMSFailed; got != want {
+		t.Errorf("status of the unsendable message: got %v, want %v", got, want)
+	}
+	if got, want := statuses["todo"], SMSSent; got != want {
+		t.Errorf("status of the next message: got %v, want %v", got, want)
+	}
+}
+
+func TestTwilioSMSTemporary(t *testing.T) {
+	status := http.StatusBadRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"status": %d, "code": 21211, "message": "refused"}`, status)
+	}))
+	defer s.Close()
+
+	c := twilio.NewClient("AC123", "token", nil)
+	c.BaseURL, _ = url.Parse(s.URL)
+	sender := SMSFromTwilio(c, "+16505550000", "token")
+
+	cases := map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusTooManyRequests:     true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusInternalServerError: true,
+	}
+
+	for code, want := range cases {
+		status = code
+
+		err := sender.Send("+16505551234", "todo")
+		if _, ok := err.(*ProviderError); !ok {
+			t.Errorf("%d: got %v, want a *ProviderError", code, err)
+			continue
+		}
+		if got := temporary(err); got != want {
+			t.Errorf("%d: temporary(%v): got %t, want %t", code, err, got, want)
+		}
+	}
+}
+
+func TestSMSQueueOrderAndRateLimit(t *testing.T) {
+	db := mem.NewDB()
+	sender := newScriptedSMS(3)
+	interval := 50 * time.Millisecond
+	q := NewSMSQueue(db, sender, testQueueKey, 5, time.Millisecond, 10*time.Millisecond, interval)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Start(ctx)
+
+	for _, body := range []string{"one", "two", "three"} {
+		if err := q.Send("+16505551234", body); err != nil {
+			t.Fatalf("q.Send error: %s", err)
+		}
+	}
+
+	sender.wait(t)
+
+	sender.Lock()
+	defer sender.Unlock()
+
+	if got, want := strings.Join(sender.sent, ","), "one,two,three"; got != want {
+		t.Errorf("sent: got %s, want %s", got, want)
+	}
+
+	for i := 1; i < len(sender.at); i++ {
+		if d := sender.at[i].Sub(sender.at[i-1]); d < interval {
+			t.Errorf("message %d was sent %s after the last, want at least %s", i, d, interval)
+		}
+	}
+}
+
+func TestSMSQueueIsDurable(t *testing.T) {
+	db := mem.NewDB()
+
+	// a queue which is never started, as if the server stopped before it could deliver
+	stopped := NewSMSQueue(db, newScriptedSMS(0), testQueueKey, 5, time.Millisecond, 10*time.Millisecond, 0)
+	for _, body := range []string{"one", "two"} {
+		if err := stopped.Send("+16505551234", body); err != nil {
+			t.Fatalf("stopped.Send error: %s", err)
+		}
+	}
+
+	sender := newScriptedSMS(2)
+	q := NewSMSQueue(db, sender, testQueueKey, 5, time.Millisecond, 10*time.Millisecond, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Start(ctx)
+
+	sender.wait(t)
+
+	sender.Lock()
+	defer sender.Unlock()
+
+	if got, want := strings.Join(sender.sent, ","), "one,two"; got != want {
+		t.Errorf("sent: got %s, want %s", got, want)
+	}
+}
+
+func TestSMSQueueIgnoresForgedSegments(t *testing.T) {
+	db := mem.NewDB()
+
+	forge := func(owner string, data map[string]interface{}) *models.Event {
+		e := models.NewEvent()
+		e.SetID(db.NewID())
+		e.OwnerId = owner
+		e.Name = SMSOutboxEvent
+		e.Data = data
+		if err := db.Save(e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	// a segment queued by a queue of another key
+	other := NewSMSQueue(db, newScriptedSMS(0), []byte("fedcba9876543210"), 5, time.Millisecond, 10*time.Millisecond, 0)
+	if err := other.Send("+16505551234", "other"); err != nil {
+		t.Fatalf("other.Send error: %s", err)
+	}
+
+	// a segment whose mac is of another body
+	stopped := NewSMSQueue(db, newScriptedSMS(0), testQueueKey, 5, time.Millisecond, 10*time.Millisecond, 0)
+	altered := forge("", map[string]interface{}{"to": "+16505550000", "body": "signed", "segment": 1})
+	altered.Data["mac"] = stopped.sign(altered)
+	altered.Data["body"] = "altered"
+	if err := db.Save(altered); err != nil {
+		t.Fatal(err)
+	}
+
+	// a segment of a user, which is correctly signed
+	owned := forge("user", map[string]interface{}{"to": "+16505550000", "body": "owned", "segment": 1})
+	owned.Data["mac"] = stopped.sign(owned)
+	if err := db.Save(owned); err != nil {
+		t.Fatal(err)
+	}
+
+	// and one which was queued, so that we know when the queue has reloaded
+	if err := stopped.Send("+16505551234", "queued"); err != nil {
+		t.Fatalf("stopped.Send error: %s", err)
+	}
+
+	sender := newScriptedSMS(1)
+	q := NewSMSQueue(db, sender, testQueueKey, 5, time.Millisecond, 10*time.Millisecond, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Start(ctx)
+
+	sender.wait(t)
+	settle(t, q)
+	time.Sleep(20 * time.Millisecond)
+
+	sender.Lock()
+	if got, want := strings.Join(sender.sent, ","), "queued"; got != want {
+		t.Errorf("sent: got %s, want %s", got, want)
+	}
+	sender.Unlock()
+
+	// the unsigned segments without an owner are removed, the user's is left alone
+	iter, err := db.Query(models.EventKind).Select(data.AttrMap{"name": SMSOutboxEvent}).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	e := models.NewEvent()
+	for iter.Next(e) {
+		remaining = append(remaining, e.Data["body"].(string))
+		e = models.NewEvent()
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(remaining, ","), "owned"; got != want {
+		t.Errorf("remaining in the outbox: got %s, want %s", got, want)
+	}
+}
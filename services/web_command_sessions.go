@@ -1,10 +1,12 @@
 package services
 
 import (
+	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
 
 	"github.com/elos/data"
-	"github.com/elos/elos/command"
 	"github.com/elos/models"
 	"golang.org/x/net/context"
 	"golang.org/x/net/websocket"
@@ -16,111 +18,259 @@ type SocketSession struct {
 }
 
 type WebCommandSessions interface {
-	Inbound(w *SocketSession)
+	// Serve runs a command session over the socket, until either end closes it, the context is
+	// done, or the session is taken over. If the user already has a session, and only one is
+	// allowed, the socket takes it over if take over is set, otherwise it is refused.
+	Serve(ctx context.Context, socket *SocketSession, takeOver bool) error
+	// Active is the number of live sessions
+	Active() int
+	// Running determines whether the sessions are being served
+	Running() bool
 }
 
-type webMux struct {
-	inbound  chan *SocketSession
-	sessions map[data.ID]*commandSessionInfo
+// WebSessionPolicy determines how many command sessions a user may have over websockets
+type WebSessionPolicy int
+
+const (
+	// ExclusiveWebSessions allows a user one session, which another socket may take over
+	ExclusiveWebSessions WebSessionPolicy = iota
+	// MultipleWebSessions allows a user a session per socket, e.g. per tab
+	MultipleWebSessions
+)
+
+// The errors of WebCommandSessions.Serve
+var (
+	// ErrWebSessionsStopped is returned once the sessions are no longer served
+	ErrWebSessionsStopped = errors.New("web command sessions are stopped")
+	// ErrWebSessionExists is returned when the user has a session, which wasn't taken over
+	ErrWebSessionExists = errors.New("a user may only have one command session at once")
+)
+
+// TakenOverMessage is sent to a web command session which another socket took over
+const TakenOverMessage = "This session has been taken over by another window."
+
+// webSession is the state of a socket's session
+type webSession struct {
+	*SocketSession
+	// done is closed once the session is ended
+	done chan struct{}
 }
 
-func (w *webMux) Inbound(session *SocketSession) {
-	w.inbound <- session
+type webMux struct {
+	policy       WebSessionPolicy
+	startSession sessionStarter
+
+	mu       sync.Mutex
+	sessions map[data.ID][]*webSession // by user, in the order they started
+	db       data.DB
+	started  chan struct{}
+	stopped  bool
+	running  int32
 }
 
+// NewWebMux constructs the web command sessions, which allow a user one session at once
 func NewWebMux() *webMux {
+	return NewWebMuxWithPolicy(ExclusiveWebSessions)
+}
+
+// NewWebMuxWithPolicy constructs the web command sessions, which allow a user those of the policy
+func NewWebMuxWithPolicy(policy WebSessionPolicy) *webMux {
 	return &webMux{
-		inbound:  make(chan *SocketSession),
-		sessions: make(map[data.ID]*commandSessionInfo),
+		policy:       policy,
+		startSession: startCommandSession,
+		sessions:     make(map[data.ID][]*webSession),
+		started:      make(chan struct{}),
 	}
 }
 
-type message string
+func (mux *webMux) Active() int {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	active := 0
+	for _, sessions := range mux.sessions {
+		active += len(sessions)
+	}
+
+	return active
+}
 
+func (mux *webMux) Running() bool {
+	return atomic.LoadInt32(&mux.running) == 1
+}
+
+// Start serves the sessions, with the db. Once the context is done, each session is told the
+// server is going away, and ended.
 func (mux *webMux) Start(ctx context.Context, db data.DB) {
-	timeouts := make(chan data.ID)
-
-Run:
-	for {
-		select {
-		case socket := <-mux.inbound:
-			sessionInfo, sessionExists := mux.sessions[socket.User.ID()]
-
-			if sessionExists {
-				websocket.Message.Send(socket.Conn, "A user may only have one command session at once")
-				if err := socket.Conn.Close(); err != nil {
-					log.Printf("Error closing socket: %s", err)
-				}
-				return
-			}
+	mux.mu.Lock()
+	mux.db = db
+	atomic.StoreInt32(&mux.running, 1)
+	close(mux.started)
+	mux.mu.Unlock()
+
+	defer atomic.StoreInt32(&mux.running, 0)
 
-			// otherwise instantiate one
+	<-ctx.Done()
 
-			sessionInput := make(chan string)
-			sessionOutput := make(chan string)
+	// tell each session the server is going away, and end it
+	mux.mu.Lock()
+	mux.stopped = true
+	var sessions []*webSession
+	for _, s := range mux.sessions {
+		sessions = append(sessions, s...)
+	}
+	mux.mu.Unlock()
+
+	for _, s := range sessions {
+		mux.end(s, GoingAwayMessage)
+	}
+}
 
-			var bail = func() {
-				timeouts <- socket.User.ID()
+// Serve waits for the mux to be started, if it hasn't been
+func (mux *webMux) Serve(ctx context.Context, socket *SocketSession, takeOver bool) error {
+	select {
+	case <-mux.started:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s := &webSession{
+		SocketSession: socket,
+		done:          make(chan struct{}),
+	}
+	uid := socket.User.ID()
+
+	mux.mu.Lock()
+	if mux.stopped {
+		mux.mu.Unlock()
+		return ErrWebSessionsStopped
+	}
+
+	var replaced []*webSession
+	if existing := mux.sessions[uid]; len(existing) > 0 && mux.policy == ExclusiveWebSessions {
+		if !takeOver {
+			mux.mu.Unlock()
+			return ErrWebSessionExists
+		}
+
+		replaced = existing
+		delete(mux.sessions, uid)
+	}
+
+	mux.sessions[uid] = append(mux.sessions[uid], s)
+	db := mux.db
+	mux.mu.Unlock()
+
+	for _, r := range replaced {
+		mux.end(r, TakenOverMessage)
+	}
+
+	mux.run(ctx, s, db)
+	return nil
+}
+
+// run runs the session over its socket, it returns once the session has ended, and the
+// socket has been read for the last time
+func (mux *webMux) run(ctx context.Context, s *webSession, db data.DB) {
+	input := make(chan string)
+	output := make(chan string)
+
+	// the session bails when it ends itself
+	go mux.startSession(s.User, db, input, output, func() {
+		mux.end(s, "")
+	})
+
+	// Forward the socket to the input, the reader is the only
+	// writer of the input, so it is closed once the reader returns
+	var reading sync.WaitGroup
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+
+		for {
+			var incoming string
+			if err := websocket.Message.Receive(s.Conn, &incoming); err != nil {
+				mux.end(s, "")
+				return
+			}
+
+			select {
+			case input <- incoming:
+			case <-s.done:
+				return
 			}
+		}
+	}()
 
-			// We want to forward strings on output channel
-			// to the websocket
-			go func(out <-chan string, uid data.ID) {
-				for o := range out {
-					log.Printf("Forwarding: %s", o)
-					err := websocket.Message.Send(socket.Conn, o)
-
-					// timeout if error sending message
-					if err != nil {
-						log.Print("Read off bailing")
-						bail()
-						return
-					}
-					log.Print("Forwarded")
-				}
-			}(sessionOutput, socket.User.ID())
-
-			// Foward input
-			go func(in chan<- string) {
-				for {
-					var incoming string
-					err := websocket.Message.Receive(socket.Conn, &incoming)
-
-					if err != nil {
-						log.Printf("Error reading from socket: %s", err)
-						bail()
-						return
-					}
-
-					in <- incoming
-				}
-			}(sessionInput)
-
-			session := command.NewSession(
-				socket.User, db, sessionInput, sessionOutput,
-				func() {
-					timeouts <- socket.User.ID()
-				})
-			go session.Start()
-
-			sessionInfo = &commandSessionInfo{
-				input:   sessionInput,
-				session: session,
+	// We want to forward strings on the output channel to the
+	// websocket, the session owns the output, so it is drained,
+	// rather than closed, once the session has ended
+	go func() {
+		for o := range output {
+			select {
+			case <-s.done:
+				continue
+			default:
 			}
 
-			mux.sessions[socket.User.ID()] = sessionInfo
-		case uid := <-timeouts:
-			if session, exists := mux.sessions[uid]; exists {
-				close(session.input)
-				delete(mux.sessions, uid)
+			if err := websocket.Message.Send(s.Conn, o); err != nil {
+				log.Printf("Error sending to socket: %s", err)
+				mux.end(s, "")
 			}
-		case <-ctx.Done():
-			break Run
 		}
+
+		// the session closed its output, so it is over
+		mux.end(s, "")
+	}()
+
+	select {
+	case <-s.done:
+	// the request's context is done when gaia is closed
+	case <-ctx.Done():
+		mux.end(s, GoingAwayMessage)
 	}
 
-	// close all inputs
-	for _, sessionInfo := range mux.sessions {
-		close(sessionInfo.input)
+	reading.Wait()
+	close(input)
+}
+
+// end ends the session, unless it has already ended: it sends the goodbye message, if there
+// is one, and closes the socket. It returns whether it ended the session.
+func (mux *webMux) end(s *webSession, goodbye string) bool {
+	mux.mu.Lock()
+	select {
+	case <-s.done:
+		mux.mu.Unlock()
+		return false
+	default:
 	}
+
+	close(s.done)
+
+	uid := s.User.ID()
+	sessions := mux.sessions[uid]
+	for i, other := range sessions {
+		if other == s {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(mux.sessions, uid)
+	} else {
+		mux.sessions[uid] = sessions
+	}
+	mux.mu.Unlock()
+
+	// tell the other end of the session it is over
+	if goodbye != "" {
+		if err := websocket.Message.Send(s.Conn, goodbye); err != nil {
+			log.Printf("Error saying goodbye: %s", err)
+		}
+	}
+	if err := s.Conn.Close(); err != nil {
+		log.Printf("Error closing socket: %s", err)
+	}
+
+	return true
 }
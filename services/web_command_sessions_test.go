@@ -0,0 +1,211 @@
+package services
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// webServer serves the mux's sessions of the user, over websockets, those
+// with the take_over parameter take over the user's session
+func webServer(mux *webMux, u *models.User) *httptest.Server {
+	return httptest.NewServer(websocket.Handler(func(c *websocket.Conn) {
+		takeOver := c.Request().URL.Query().Get("take_over") == "true"
+		if err := mux.Serve(context.Background(), &SocketSession{User: u, Conn: c}, takeOver); err != nil {
+			websocket.Message.Send(c, err.Error())
+			c.Close()
+		}
+	}))
+}
+
+func dial(t *testing.T, s *httptest.Server, query string) *websocket.Conn {
+	ws, err := websocket.Dial(strings.Replace(s.URL, "http", "ws", 1)+"/"+query, "", s.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %s", err)
+	}
+
+	return ws
+}
+
+func receive(t *testing.T, ws *websocket.Conn) string {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var message string
+	if err := websocket.Message.Receive(ws, &message); err != nil {
+		t.Fatalf("websocket.Message.Receive error: %s", err)
+	}
+
+	return message
+}
+
+func echo(t *testing.T, ws *websocket.Conn, text string) {
+	if err := websocket.Message.Send(ws, text); err != nil {
+		t.Fatalf("websocket.Message.Send error: %s", err)
+	}
+
+	if got, want := receive(t, ws), "echo: "+text; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// waitActive waits until the mux has the number of active sessions
+func waitActive(t *testing.T, mux *webMux, active int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for mux.Active() != active {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d active sessions, there are %d", active, mux.Active())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func webUser() *models.User {
+	u := models.NewUser()
+	u.SetID(mem.NewDB().NewID())
+	return u
+}
+
+func TestWebMuxExclusive(t *testing.T) {
+	mux := NewWebMux()
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	s := webServer(mux, webUser())
+	defer s.Close()
+
+	first := dial(t, s, "")
+	defer first.Close()
+	echo(t, first, "todo")
+
+	// a second is refused
+	second := dial(t, s, "")
+	defer second.Close()
+	if got, want := receive(t, second), ErrWebSessionExists.Error(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// the first carries on
+	echo(t, first, "again")
+
+	// a third takes over
+	third := dial(t, s, "?take_over=true")
+	defer third.Close()
+	if got, want := receive(t, first), TakenOverMessage; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	echo(t, third, "todo")
+
+	if got := mux.Active(); got != 1 {
+		t.Errorf("mux.Active(): got %d, want 1", got)
+	}
+}
+
+func TestWebMuxMultiple(t *testing.T) {
+	mux := NewWebMuxWithPolicy(MultipleWebSessions)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	s := webServer(mux, webUser())
+	defer s.Close()
+
+	first, second := dial(t, s, ""), dial(t, s, "")
+	defer first.Close()
+	defer second.Close()
+
+	echo(t, first, "one")
+	echo(t, second, "two")
+	waitActive(t, mux, 2)
+
+	// closing one tab leaves the other
+	first.Close()
+	waitActive(t, mux, 1)
+	echo(t, second, "three")
+}
+
+func TestWebMuxShutdown(t *testing.T) {
+	mux := NewWebMuxWithPolicy(MultipleWebSessions)
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+
+	s := webServer(mux, webUser())
+	defer s.Close()
+
+	ws := dial(t, s, "")
+	defer ws.Close()
+	echo(t, ws, "todo")
+
+	stop()
+
+	if got, want := receive(t, ws), GoingAwayMessage; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := mux.Active(); got != 0 {
+		t.Errorf("mux.Active(): got %d, want 0", got)
+	}
+
+	// once stopped, no more are served
+	refused := dial(t, s, "")
+	defer refused.Close()
+	if got, want := receive(t, refused), ErrWebSessionsStopped.Error(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestWebMuxSessionEnds(t *testing.T) {
+	mux := NewWebMux()
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+	defer stop()
+
+	s := webServer(mux, webUser())
+	defer s.Close()
+
+	ws := dial(t, s, "")
+	defer ws.Close()
+	websocket.Message.Send(ws, "exit")
+
+	// the session ended itself, so the socket is closed
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message string
+	if err := websocket.Message.Receive(ws, &message); err == nil {
+		t.Fatalf("expected the socket to be closed, received %q", message)
+	}
+
+	waitActive(t, mux, 0)
+
+	// the user may start another
+	another := dial(t, s, "")
+	defer another.Close()
+	echo(t, another, "todo")
+}
+
+func TestWebMuxConcurrent(t *testing.T) {
+	mux := NewWebMux()
+	stop := startMux(&mux.startSession, echoSession, mux.Start)
+
+	s := webServer(mux, webUser())
+	defer s.Close()
+
+	concurrently(10, func(int) {
+		ws, err := websocket.Dial(strings.Replace(s.URL, "http", "ws", 1)+"/?take_over=true", "", s.URL)
+		if err != nil {
+			t.Errorf("websocket.Dial error: %s", err)
+			return
+		}
+		defer ws.Close()
+
+		for j := 0; j < 10; j++ {
+			if err := websocket.Message.Send(ws, "todo"); err != nil {
+				return // taken over
+			}
+			mux.Active()
+		}
+	})
+
+	stop()
+	waitActive(t, mux, 0)
+}
@@ -0,0 +1,276 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elos/gaia/routes"
+	"github.com/elos/gaia/services"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+
+	task := models.NewTask()
+	task.SetID(db.NewID())
+	task.CreatedAt = time.Now()
+	task.OwnerId = u.Id
+	task.Name = "task an event key can't read"
+	task.UpdatedAt = time.Now()
+	if err := db.Save(task); err != nil {
+		t.Fatal(err)
+	}
+
+	// issue a key which may only read events
+	body, err := json.Marshal(&routes.APIKeyRequest{
+		Name:   "integration",
+		Scopes: []string{"read:event"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", s.URL+routes.APIKey, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Code: %d", resp.StatusCode)
+	t.Logf("Body:\n%s", body)
+
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("resp.StatusCode: got %d, want %d", got, want)
+	}
+
+	key := new(routes.APIKeyResponse)
+	if err := json.Unmarshal(body, key); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, endpoint string) int {
+		req, err := http.NewRequest(method, endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key.Token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		t.Logf("%s %s: %d", method, endpoint, resp.StatusCode)
+		return resp.StatusCode
+	}
+
+	params := url.Values{}
+	params.Set("kind", models.TaskKind.String())
+	params.Set("id", task.ID().String())
+	if got, want := do("GET", s.URL+routes.Record+"?"+params.Encode()), http.StatusForbidden; got != want {
+		t.Errorf("GET task: got %d, want %d", got, want)
+	}
+
+	params.Set("kind", models.EventKind.String())
+	params.Set("id", db.NewID().String())
+	if got, want := do("GET", s.URL+routes.Record+"?"+params.Encode()), http.StatusNotFound; got != want {
+		t.Errorf("GET event: got %d, want %d", got, want)
+	}
+
+	// the key is read only
+	if got, want := do("DELETE", s.URL+routes.Record+"?"+params.Encode()), http.StatusForbidden; got != want {
+		t.Errorf("DELETE event: got %d, want %d", got, want)
+	}
+
+	// a key can not manage keys
+	if got, want := do("GET", s.URL+routes.APIKey), http.StatusForbidden; got != want {
+		t.Errorf("GET keys: got %d, want %d", got, want)
+	}
+
+	// revoke it
+	req, err = http.NewRequest("DELETE", s.URL+routes.APIKey+"?id="+key.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Fatalf("revoking resp.StatusCode: got %d, want %d", got, want)
+	}
+
+	if got, want := do("GET", s.URL+routes.Record+"?"+params.Encode()), http.StatusUnauthorized; got != want {
+		t.Errorf("GET event with revoked key: got %d, want %d", got, want)
+	}
+}
+
+// TestAPIKeyEventsReserved ensures a user can't make, or alter, the events which keep the keys
+func TestAPIKeyEventsReserved(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+
+	issued := postAPIKey(t, s.URL, cred.Public, cred.Private, []string{"read:event"})
+
+	stored := models.NewEvent()
+	if err := db.PopulateByField("name", services.APIKeyEvent, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key of every scope, whose token the user knows the hash of
+	token := "elos_forged"
+	sum := sha256.Sum256([]byte(token))
+	forged := []byte(`{"name": "` + services.APIKeyEvent + `", "owner_id": "` + u.ID().String() + `", "data": ` +
+		`{"id": "forged", "owner_id": "` + u.ID().String() + `", "scopes": ["write:*", "read:*"], "hash": "` + hex.EncodeToString(sum[:]) + `"}}`)
+
+	send := func(method, endpoint string, body []byte) (int, []byte) {
+		req, err := http.NewRequest(method, s.URL+endpoint, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(cred.Public, cred.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Logf("%s %s: %d %s", method, endpoint, resp.StatusCode, body)
+		return resp.StatusCode, body
+	}
+
+	do := func(method, endpoint string, body []byte) int {
+		code, _ := send(method, endpoint, body)
+		return code
+	}
+
+	// create
+	if got, want := do("POST", routes.Record+"?kind=event", forged), http.StatusForbidden; got != want {
+		t.Errorf("POST a new key: got %d, want %d", got, want)
+	}
+
+	// overwrite
+	params := url.Values{"kind": {models.EventKind.String()}, "id": {stored.ID().String()}}
+	if got, want := do("POST", routes.Record+"?"+params.Encode(), forged), http.StatusForbidden; got != want {
+		t.Errorf("POST over an issued key: got %d, want %d", got, want)
+	}
+
+	if got, want := do("POST", routes.Event+"?name="+services.APIKeyEvent, forged), http.StatusForbidden; got != want {
+		t.Errorf("POST a key to %s: got %d, want %d", routes.Event, got, want)
+	}
+
+	// batch, both a new one and over the issued one
+	overwrite := append([]byte(`{"id": "`+stored.ID().String()+`", `), forged[1:]...)
+	ops, err := json.Marshal([]*routes.BatchOperation{
+		{Op: routes.BatchSave, Kind: models.EventKind, Record: json.RawMessage(forged)},
+		{Op: routes.BatchSave, Kind: models.EventKind, Record: json.RawMessage(overwrite)},
+		{Op: routes.BatchDelete, Kind: models.EventKind, ID: stored.ID().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, body := send("POST", routes.RecordBatch, ops)
+	var results []*routes.BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(results), 3; got != want {
+		t.Fatalf("len(results): got %d, want %d", got, want)
+	}
+	for i, r := range results {
+		if got, want := r.Status, http.StatusForbidden; got != want {
+			t.Errorf("results[%d].Status: got %d, want %d", i, got, want)
+		}
+	}
+
+	// the forged token is unknown, the issued one is intact
+	authenticate := func(token string) int {
+		req, err := http.NewRequest("GET", s.URL+routes.Record+"?kind=event&id="+db.NewID().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got, want := authenticate(token), http.StatusUnauthorized; got != want {
+		t.Errorf("the forged token: got %d, want %d", got, want)
+	}
+	if got, want := authenticate(issued.Token), http.StatusNotFound; got != want {
+		t.Errorf("the issued token: got %d, want %d", got, want)
+	}
+}
+
+// postAPIKey issues a key of the scopes to the user of the credential
+func postAPIKey(t *testing.T, endpoint, public, private string, scopes []string) *routes.APIKeyResponse {
+	body, err := json.Marshal(&routes.APIKeyRequest{Name: "integration", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", endpoint+routes.APIKey, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(public, private)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("issuing a key: got %d, want %d: %s", got, want, body)
+	}
+
+	key := new(routes.APIKeyResponse)
+	if err := json.Unmarshal(body, key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
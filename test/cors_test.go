@@ -0,0 +1,99 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/gaia"
+	"github.com/elos/gaia/routes"
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	g := gaia.New(
+		context.Background(),
+		new(gaia.Middleware),
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 mem.NewDB(),
+			SMSCommandSessions: services.NewSMSMux(),
+			WebCommandSessions: services.NewWebMux(),
+			CORSPolicy:         services.NewCORSPolicy([]string{"https://elos.io"}, time.Minute),
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	preflight := func(path, origin, method, headers string) *http.Response {
+		req, err := http.NewRequest("OPTIONS", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set(gaia.RequestMethodHeader, method)
+		if headers != "" {
+			req.Header.Set(gaia.RequestHeadersHeader, headers)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		t.Logf("OPTIONS %s from %s for %s: %d %v", path, origin, method, resp.StatusCode, resp.Header)
+		return resp
+	}
+
+	resp := preflight(routes.Event, "https://elos.io", "POST", "authorization")
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Fatalf("resp.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get(gaia.AllowOriginHeader), "https://elos.io"; got != want {
+		t.Errorf("Allow-Origin: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get(gaia.AllowCredentialsHeader), "true"; got != want {
+		t.Errorf("Allow-Credentials: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get(gaia.AllowMethodsHeader), "POST"; got != want {
+		t.Errorf("Allow-Methods: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get(gaia.MaxAgeHeader), "60"; got != want {
+		t.Errorf("Max-Age: got %q, want %q", got, want)
+	}
+
+	// /event/ has no GET
+	if got, want := preflight(routes.Event, "https://elos.io", "GET", "").StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("preflight GET: got %d, want %d", got, want)
+	}
+
+	// a header outside the policy
+	if got, want := preflight(routes.Record, "https://elos.io", "GET", "X-Evil").StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("preflight X-Evil: got %d, want %d", got, want)
+	}
+
+	// an origin outside the allowlist
+	if got, want := preflight(routes.Record, "https://evil.com", "GET", "").StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("preflight from evil: got %d, want %d", got, want)
+	}
+
+	// an origin outside the allowlist is not reflected back
+	req, err := http.NewRequest("GET", s.URL+routes.Record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://evil.com")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(gaia.AllowOriginHeader); got != "" {
+		t.Errorf("Allow-Origin: got %q, want none", got)
+	}
+}
@@ -160,3 +160,89 @@ func TestDB(t *testing.T) {
 		t.Fatalf("Timed out waiting for change")
 	}
 }
+
+func TestDBQueryPages(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	gdb := &gaia.DB{
+		URL:      s.URL,
+		Username: cred.Public,
+		Password: cred.Private,
+		Client:   http.DefaultClient,
+	}
+
+	for i := 0; i < 5; i++ {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = time.Now()
+		task.OwnerId = user.Id
+		task.Name = "task"
+		task.UpdatedAt = time.Now()
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter, err := gdb.Query(models.TaskKind).Batch(2).Skip(1).Limit(3).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	task := models.NewTask()
+	for iter.Next(task) {
+		count++
+	}
+
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := count, 3; got != want {
+		t.Fatalf("count: got %d, want %d", got, want)
+	}
+}
+
+func TestDBChangesContext(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	_, cred := testUser(t, db)
+
+	closed := func(changes *chan *data.Change) bool {
+		select {
+		case _, ok := <-*changes:
+			return !ok
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+
+	for _, transport := range []string{gaia.WebSocketTransport, gaia.EventStreamTransport} {
+		gdb := &gaia.DB{
+			URL:              s.URL,
+			Username:         cred.Public,
+			Password:         cred.Private,
+			ChangesTransport: transport,
+			Client:           http.DefaultClient,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		changes := gdb.ChangesContext(ctx)
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		if !closed(changes) {
+			t.Errorf("%s: the changes should have been closed once the context was done", transport)
+		}
+
+		// retrying would be refused again
+		gdb.Password = "wrong"
+		if !closed(gdb.Changes()) {
+			t.Errorf("%s: the changes should have been closed once the credentials were refused", transport)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/gaia"
+	"github.com/elos/gaia/routes"
+	"github.com/elos/gaia/services"
+	"golang.org/x/net/context"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	db := mem.NewDB()
+	smsMux := services.NewSMSMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failing := errors.New("unreachable")
+	readiness := services.NewReadiness(time.Second)
+	readiness.Add("sms_provider", func(ctx context.Context) error { return failing })
+
+	g := gaia.New(
+		ctx,
+		new(gaia.Middleware),
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 db,
+			SMSCommandSessions: smsMux,
+			Readiness:          readiness,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + routes.Health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("%s: got %d, want %d", routes.Health, got, want)
+	}
+
+	ready := func() (int, map[string]*services.CheckResult) {
+		resp, err := http.Get(s.URL + routes.Ready)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body := new(routes.ReadyResponse)
+		if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+			t.Fatalf("json decoding error: %s", err)
+		}
+
+		checks := make(map[string]*services.CheckResult)
+		for _, c := range body.Checks {
+			checks[c.Name] = c
+		}
+
+		return resp.StatusCode, checks
+	}
+
+	// the sms mux isn't running, and the sms provider is failing
+	status, checks := ready()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("%s: got %d, want %d", routes.Ready, status, http.StatusServiceUnavailable)
+	}
+	if c := checks["db"]; c == nil || !c.Ready {
+		t.Errorf("expected the db to be ready, got %+v", c)
+	}
+	if c := checks["sms_command_sessions"]; c == nil || c.Ready {
+		t.Errorf("expected the sms command sessions not to be ready, got %+v", c)
+	}
+	if c := checks["sms_provider"]; c == nil || c.Ready || c.Error != failing.Error() {
+		t.Errorf("expected the sms provider not to be ready, got %+v", c)
+	}
+
+	go smsMux.Start(ctx, db, newMockSMS())
+	readiness.Add("sms_provider", func(ctx context.Context) error { return nil })
+
+	// the mux starts asynchronously
+	deadline := time.Now().Add(time.Second)
+	for {
+		if status, checks = ready(); status == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %d, want %d (%+v)", routes.Ready, status, http.StatusOK, checks["sms_command_sessions"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsServedApart(t *testing.T) {
+	_, g, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + routes.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(body), services.RequestsMetric) {
+		t.Fatalf("%s should not be served by gaia itself", routes.Metrics)
+	}
+
+	metrics := httptest.NewServer(g.MetricsHandler())
+	defer metrics.Close()
+
+	resp, err = http.Get(metrics.URL + routes.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("%s: got %d, want %d", routes.Metrics, got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), routes.PrometheusContentType; got != want {
+		t.Errorf("Content-Type: got %q, want %q", got, want)
+	}
+	if !strings.Contains(string(body), services.RequestsMetric) {
+		t.Errorf("expected the metrics to contain %s, got:\n%s", services.RequestsMetric, body)
+	}
+}
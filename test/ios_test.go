@@ -0,0 +1,191 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/gaia"
+	"github.com/elos/gaia/routes"
+	"github.com/elos/gaia/services"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+)
+
+func TestCommandiOS(t *testing.T) {
+	db := mem.NewDB()
+	mobileMux := services.NewMobileMux(services.DefaultMobileIdleTimeout, services.DefaultMobileOutbox)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mobileMux.Start(ctx, db)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:                services.NewTestLogger(t),
+			DB:                    db,
+			SMSCommandSessions:    services.NewSMSMux(),
+			MobileCommandSessions: mobileMux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	_, cred := testUser(t, db)
+
+	resp, err := http.Post(s.URL+routes.CommandiOS, "application/json", strings.NewReader(`{"id": "1", "body": "todo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status code of %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	do := func(method, query, body string) (int, []byte) {
+		req, err := http.NewRequest(method, s.URL+routes.CommandiOS+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(cred.Public, cred.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Logf("%s %s: %d\n%s", method, query, resp.StatusCode, b)
+		return resp.StatusCode, b
+	}
+
+	if code, _ := do("POST", "", `{"id": "1", "body": "todo"}`); code != http.StatusAccepted {
+		t.Fatalf("Expected status code of %d", http.StatusAccepted)
+	}
+
+	// the client didn't hear back, so it retries
+	if code, _ := do("POST", "", `{"id": "1", "body": "todo"}`); code != http.StatusOK {
+		t.Fatalf("Expected status code of %d", http.StatusOK)
+	}
+
+	if code, _ := do("POST", "", `{"body": "todo"}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected status code of %d", http.StatusBadRequest)
+	}
+
+	code, body := do("GET", "?wait=5", "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code of %d", http.StatusOK)
+	}
+
+	response := new(routes.CommandiOSResponse)
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Messages) == 0 {
+		t.Fatal("Expected the session to have replied")
+	}
+	if !strings.Contains(response.Messages[0].Body, "elos") {
+		t.Fatalf("The message should have almost certainly contained the word elos, it was %q", response.Messages[0].Body)
+	}
+
+	// having reconnected, the client fetches what it missed, since the last it received
+	first := response.Messages[0].ID
+	code, body = do("GET", "?wait=0&since="+first, "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code of %d", http.StatusOK)
+	}
+
+	response = new(routes.CommandiOSResponse)
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Messages == nil {
+		t.Fatal("Expected the messages to be an array, even if empty")
+	}
+	for _, m := range response.Messages {
+		if m.ID <= first {
+			t.Errorf("Expected only the messages after %s, got %s", first, m.ID)
+		}
+	}
+
+	if code, _ := do("GET", "?since=now", ""); code != http.StatusBadRequest {
+		t.Fatalf("Expected status code of %d", http.StatusBadRequest)
+	}
+}
+
+// pollWatcher tells of each poll of the sessions which returns
+type pollWatcher struct {
+	services.MobileCommandSessions
+	returned chan struct{}
+}
+
+func (p *pollWatcher) Poll(ctx context.Context, u *models.User, since uint64) ([]*services.CommandEnvelope, bool, error) {
+	defer func() { p.returned <- struct{}{} }()
+	return p.MobileCommandSessions.Poll(ctx, u, since)
+}
+
+// TestCommandiOSClientGone ensures a long poll ends once its client goes away, rather than once it times out
+func TestCommandiOSClientGone(t *testing.T) {
+	db := mem.NewDB()
+	mobileMux := services.NewMobileMux(services.DefaultMobileIdleTimeout, services.DefaultMobileOutbox)
+	sessions := &pollWatcher{MobileCommandSessions: mobileMux, returned: make(chan struct{}, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mobileMux.Start(ctx, db)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:                services.NewTestLogger(t),
+			DB:                    db,
+			SMSCommandSessions:    services.NewSMSMux(),
+			MobileCommandSessions: sessions,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	_, cred := testUser(t, db)
+
+	reqCtx, leave := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", s.URL+routes.CommandiOS+"?wait=30", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(reqCtx)
+	req.SetBasicAuth(cred.Public, cred.Private)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		leave()
+	}()
+
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the request to be canceled, got %d", resp.StatusCode)
+	}
+
+	select {
+	case <-sessions.returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the poll outlived its client")
+	}
+}
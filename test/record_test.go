@@ -1,12 +1,16 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -32,10 +36,11 @@ func testInstance(t *testing.T, ctx context.Context) (data.DB, *gaia.Gaia, *http
 		ctx,
 		&gaia.Middleware{},
 		&gaia.Services{
-			Logger:             services.NewTestLogger(t),
-			DB:                 db,
-			SMSCommandSessions: services.NewSMSMux(),
-			WebCommandSessions: services.NewWebMux(),
+			Logger:                services.NewTestLogger(t),
+			DB:                    db,
+			SMSCommandSessions:    services.NewSMSMux(),
+			WebCommandSessions:    services.NewWebMux(),
+			MobileCommandSessions: services.NewMobileMux(services.DefaultMobileIdleTimeout, services.DefaultMobileOutbox),
 		},
 	)
 
@@ -443,69 +448,1062 @@ func TestRecordQuerySkip(t *testing.T) {
 	}
 }
 
-// --- }}}
+func TestRecordQueryPagination(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
 
-func TestRecordChanges(t *testing.T) {
-	ctx, cancelAllConnections := context.WithCancel(context.Background())
-	defer cancelAllConnections()
+	user, cred := testUser(t, db)
 
-	db, _, s := testInstance(t, ctx)
+	for _, name := range []string{"task1", "task2", "task3", "task4", "task5"} {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = time.Now()
+		task.OwnerId = user.Id
+		task.Name = name
+		task.UpdatedAt = time.Now()
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("kind", models.TaskKind.String())
+	params.Set("skip", "1")
+	params.Set("limit", "2")
+	params.Set("count", "true") // the cursor carries it to the following pages
+
+	names := make([]string, 0)
+	for i := 0; params != nil; i++ {
+		if i > 5 {
+			t.Fatal("Too many pages")
+		}
+
+		endpoint := s.URL + "/record/query/?" + params.Encode()
+		t.Logf("Constructed URL: %s", endpoint)
+
+		req, err := http.NewRequest("POST", endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(cred.Public, cred.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Logf("Code: %d", resp.StatusCode)
+		t.Logf("Body:\n%s", body)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code of %d", http.StatusOK)
+		}
+
+		if got, want := resp.Header.Get(routes.TotalCountHeader), "5"; got != want {
+			t.Errorf("%s: got %q, want %q", routes.TotalCountHeader, got, want)
+		}
+
+		var page []*models.Task
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, task := range page {
+			names = append(names, task.Name)
+		}
+
+		if next := resp.Header.Get(routes.NextCursorHeader); next != "" {
+			params = url.Values{}
+			params.Set("kind", models.TaskKind.String())
+			params.Set("cursor", next)
+		} else {
+			params = nil
+		}
+	}
+
+	// the first of the five tasks was skipped
+	if got, want := len(names), 4; got != want {
+		t.Fatalf("len(names): got %d, want %d", got, want)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			t.Fatalf("%s appeared on more than one page", name)
+		}
+		seen[name] = true
+	}
+}
+
+// TestRecordQueryCursor follows the cursor, without a limit, through several pages,
+// which keep their size, and are read only as far as is needed, so aren't counted
+func TestRecordQueryCursor(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
 	defer s.Close()
 
 	user, cred := testUser(t, db)
 
-	serverURL := s.URL
-	origin := serverURL
-	wsURL := strings.Replace(serverURL, "http", "ws", 1)
+	for i := 0; i < 7; i++ {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = time.Now()
+		task.OwnerId = user.Id
+		task.Name = fmt.Sprintf("task%d", i)
+		task.UpdatedAt = time.Now()
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
 
 	params := url.Values{}
-	params.Set("public", cred.Public)
-	params.Set("private", cred.Private)
 	params.Set("kind", models.TaskKind.String())
-	wsURL += routes.RecordChanges + "?" + params.Encode()
-	t.Logf("Constructed URL: %s", wsURL)
+	params.Set("limit", "2")
 
-	t.Log("Opening websocket")
-	ws, err := websocket.Dial(wsURL, "", origin)
+	var sizes []int
+	seen := make(map[string]bool)
+	for params != nil {
+		if len(sizes) > 4 {
+			t.Fatal("Too many pages")
+		}
+
+		req, err := http.NewRequest("POST", s.URL+"/record/query/?"+params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(cred.Public, cred.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code of %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+
+		var page []*models.Task
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(page))
+
+		for _, task := range page {
+			if seen[task.Name] {
+				t.Fatalf("%s appeared on more than one page", task.Name)
+			}
+			seen[task.Name] = true
+		}
+
+		next := resp.Header.Get(routes.NextCursorHeader)
+		total := resp.Header.Get(routes.TotalCountHeader)
+
+		// only the last page is read to the end of the query
+		if next != "" && total != "" {
+			t.Errorf("page %d: %s should have been absent, it was %q", len(sizes), routes.TotalCountHeader, total)
+		}
+		if next == "" && total != "7" {
+			t.Errorf("last page: %s: got %q, want %q", routes.TotalCountHeader, total, "7")
+		}
+
+		if next != "" {
+			params = url.Values{}
+			params.Set("kind", models.TaskKind.String())
+			params.Set("cursor", next)
+		} else {
+			params = nil
+		}
+	}
+
+	if got, want := fmt.Sprint(sizes), "[2 2 2 1]"; got != want {
+		t.Errorf("the sizes of the pages: got %s, want %s", got, want)
+	}
+}
+
+func TestRecordQueryUnreadable(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+	other, _, err := user.Create(db, "other", "private")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer ws.Close()
-	t.Log("Websocket openened")
 
-	time.Sleep(500 * time.Millisecond)
+	for _, owner := range []*models.User{other, u, other} {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = time.Now()
+		task.OwnerId = owner.Id
+		task.Name = "task of " + owner.ID().String()
+		task.UpdatedAt = time.Now()
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	t.Log("Creating task")
-	taskName := "task to retreive"
-	task := models.NewTask()
-	task.SetID(db.NewID())
-	task.CreatedAt = time.Now()
-	task.OwnerId = user.Id
-	task.Name = taskName
-	task.UpdatedAt = time.Now()
-	if err := db.Save(task); err != nil {
+	params := url.Values{}
+	params.Set("kind", models.TaskKind.String())
+	req, err := http.NewRequest("POST", s.URL+"/record/query/?"+params.Encode(), nil)
+	if err != nil {
 		t.Fatal(err)
 	}
-	t.Log("Task created")
+	req.SetBasicAuth(cred.Public, cred.Private)
 
-	var ct transfer.ChangeTransport
-	if err := websocket.JSON.Receive(ws, &ct); err != nil {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	tc := transfer.ChangeFrom(&ct, models.ModelFor(ct.RecordKind))
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	t.Logf("Task Change Recieved: %++v", tc)
+	t.Logf("Code: %d", resp.StatusCode)
+	t.Logf("Body:\n%s", body)
 
-	t.Log("Cancelling the connection")
-	cancelAllConnections()
-	t.Log("\tcancelled")
+	// the other user's tasks must be skipped, without corrupting the array
+	var tasks []*models.Task
+	if err := json.Unmarshal(body, &tasks); err != nil {
+		t.Fatalf("Response body should have been a JSON array: %s", err)
+	}
 
-	if tc.ChangeKind != data.Update {
-		t.Fatal("Expected ChangeKind to be Update")
+	if got, want := len(tasks), 1; got != want {
+		t.Fatalf("len(tasks): got %d, want %d", got, want)
 	}
+}
 
-	if tc.Record.(*models.Task).Name != taskName {
-		t.Fatalf("Expected task name to be: '%s'", taskName)
+func TestRecordQueryOperators(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+
+	location := models.NewTag()
+	location.SetID(db.NewID())
+	location.CreatedAt = time.Now()
+	location.OwnerId = u.Id
+	location.Name = "LOCATION"
+	location.UpdatedAt = time.Now()
+	if err := db.Save(location); err != nil {
+		t.Fatal(err)
+	}
+
+	week := time.Date(2016, 4, 4, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = week.AddDate(0, 0, i)
+		task.OwnerId = u.Id
+		task.Name = fmt.Sprintf("task%d", i)
+		task.UpdatedAt = time.Now()
+		if i == 1 {
+			task.Deadline = week.AddDate(0, 0, 7)
+		}
+		if i%2 == 0 {
+			task.TagsIds = []string{location.Id}
+		}
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := map[string]string{
+		`{"created_at": {"$gt": "2016-04-05T00:00:00Z"}}`:                                "[task2 task3]",
+		`{"created_at": {"$gte": "2016-04-05T00:00:00Z"}}`:                               "[task1 task2 task3]",
+		`{"created_at": {"$lt": "2016-04-05T00:00:00Z"}}`:                                "[task0]",
+		`{"created_at": {"$lte": "2016-04-05T00:00:00Z"}}`:                               "[task0 task1]",
+		`{"created_at": {"$gt": "2016-04-04T00:00:00Z", "$lt": "2016-04-07T00:00:00Z"}}`: "[task1 task2]",
+		`{"name": {"$in": ["task0", "task3", "task9"]}}`:                                 "[task0 task3]",
+		`{"name": {"$ne": "task0"}}`:                                                     "[task1 task2 task3]",
+		`{"deadline": {"$exists": true}}`:                                                "[task1]",
+		`{"deadline": {"$exists": false}}`:                                               "[task0 task2 task3]",
+		`{"$tags": ["LOCATION"]}`:                                                        "[task0 task2]",
+		`{"$tags": ["LOCATION"], "name": {"$ne": "task0"}}`:                              "[task2]",
+		`{"$tags": ["UNKNOWN"]}`:                                                         "[]",
+	}
+
+	for selector, want := range cases {
+		params := url.Values{}
+		params.Set("kind", models.TaskKind.String())
+		req, err := http.NewRequest("POST", s.URL+"/record/query/?"+params.Encode(), strings.NewReader(selector))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(cred.Public, cred.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected status code of %d, got %d\n%s", selector, http.StatusOK, resp.StatusCode, body)
+			continue
+		}
+
+		var tasks []*models.Task
+		if err := json.Unmarshal(body, &tasks); err != nil {
+			t.Fatal(err)
+		}
+
+		names := make([]string, len(tasks))
+		for i, task := range tasks {
+			names[i] = task.Name
+		}
+		sort.Strings(names)
+
+		if got := fmt.Sprint(names); got != want {
+			t.Errorf("%s: got %s, want %s", selector, got, want)
+		}
+	}
+}
+
+func TestRecordQueryNDJSON(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	for _, name := range []string{"task1", "task2", "task3"} {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = time.Now()
+		task.OwnerId = user.Id
+		task.Name = name
+		task.UpdatedAt = time.Now()
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("kind", models.TaskKind.String())
+	params.Set("limit", "2")
+	params.Set("count", "true")
+	req, err := http.NewRequest("POST", s.URL+"/record/query/?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+	req.Header.Set("Accept", routes.NDJSONContentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	t.Logf("Code: %d", resp.StatusCode)
+
+	if got, want := resp.Header.Get("Content-Type"), routes.NDJSONContentType; got != want {
+		t.Fatalf("Content-Type: got %q, want %q", got, want)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	records := 0
+	var summary *routes.QuerySummary
+	for summary == nil {
+		var line routes.QueryLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("The stream should have ended with a summary: %s", err)
+		}
+
+		switch {
+		case line.Record != nil:
+			records++
+		case line.Error != nil:
+			t.Fatalf("Unexpected error line: %+v", line.Error)
+		case line.Summary != nil:
+			summary = line.Summary
+		}
+	}
+
+	if got, want := records, 2; got != want {
+		t.Errorf("records: got %d, want %d", got, want)
+	}
+
+	if summary.Total == nil {
+		t.Fatal("summary.Total should have been counted")
+	}
+	if got, want := *summary.Total, 3; got != want {
+		t.Errorf("summary.Total: got %d, want %d", got, want)
+	}
+
+	if summary.NextCursor == "" {
+		t.Error("summary.NextCursor should have been set")
+	}
+}
+
+// --- }}}
+
+// --- Test `POST /record/batch/` {{{
+
+func TestRecordBatch(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	existing := models.NewTask()
+	existing.SetID(db.NewID())
+	existing.CreatedAt = time.Now()
+	existing.OwnerId = user.Id
+	existing.Name = "task to delete"
+	existing.UpdatedAt = time.Now()
+	if err := db.Save(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []*routes.BatchOperation{
+		{
+			Op:     routes.BatchSave,
+			Kind:   models.TaskKind,
+			Record: json.RawMessage(`{"name": "created task", "owner_id": "` + user.ID().String() + `"}`),
+		},
+		{
+			Op:   routes.BatchDelete,
+			Kind: models.TaskKind,
+			ID:   existing.ID().String(),
+		},
+	}
+
+	requestBody, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := s.URL + routes.RecordBatch
+	t.Logf("Constructed URL: %s", url)
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Code: %d", resp.StatusCode)
+	t.Logf("Body:\n%s", body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code of %d", http.StatusOK)
+	}
+
+	var results []*routes.BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(results), len(ops); got != want {
+		t.Fatalf("len(results): got %d, want %d", got, want)
 	}
+
+	if got, want := results[0].Status, http.StatusCreated; got != want {
+		t.Errorf("results[0].Status: got %d, want %d", got, want)
+	}
+
+	if got, want := results[1].Status, http.StatusNoContent; got != want {
+		t.Errorf("results[1].Status: got %d, want %d", got, want)
+	}
+
+	if err := db.PopulateByID(existing); err != data.ErrNotFound {
+		t.Fatal("Task should have been deleted")
+	}
+
+	created := models.NewTask()
+	if err := db.PopulateByField("name", "created task", created); err != nil {
+		t.Fatalf("Task should have been created: %s", err)
+	}
+}
+
+func TestRecordBatchRejected(t *testing.T) {
+	db, g, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+	other, _, err := user.Create(db, "other", "private")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	othersTask := models.NewTask()
+	othersTask.SetID(db.NewID())
+	othersTask.CreatedAt = time.Now()
+	othersTask.OwnerId = other.Id
+	othersTask.Name = "someone else's task"
+	othersTask.UpdatedAt = time.Now()
+	if err := db.Save(othersTask); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []*routes.BatchOperation{
+		{
+			Op:     routes.BatchSave,
+			Kind:   models.TaskKind,
+			Record: json.RawMessage(`{"name": "created task", "owner_id": "` + u.ID().String() + `"}`),
+		},
+		{
+			Op:   routes.BatchDelete,
+			Kind: models.TaskKind,
+			ID:   othersTask.ID().String(),
+		},
+	}
+
+	requestBody, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", s.URL+routes.RecordBatch, bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Code: %d", resp.StatusCode)
+	t.Logf("Body:\n%s", body)
+
+	var results []*routes.BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := results[0].Status, http.StatusFailedDependency; got != want {
+		t.Errorf("results[0].Status: got %d, want %d", got, want)
+	}
+
+	if got, want := results[1].Status, http.StatusNotFound; got != want {
+		t.Errorf("results[1].Status: got %d, want %d", got, want)
+	}
+
+	if err := db.PopulateByField("name", "created task", models.NewTask()); err != data.ErrNotFound {
+		t.Fatal("No operation should have been applied")
+	}
+
+	// the delete access control denied is counted
+	metricsReq, err := http.NewRequest("GET", routes.Metrics, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := httptest.NewRecorder()
+	g.MetricsHandler().ServeHTTP(metrics, metricsReq)
+
+	if want := `gaia_access_denials_total{kind="task",path="/record/batch/"} 1`; !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("expected the metrics to contain %q, got:\n%s", want, metrics.Body.String())
+	}
+}
+
+// failingDB fails to save the records of the name
+type failingDB struct {
+	data.DB
+	name string
+}
+
+func (db *failingDB) Save(r data.Record) error {
+	if t, ok := r.(*models.Task); ok && t.Name == db.name {
+		return data.ErrNoConnection
+	}
+
+	return db.DB.Save(r)
+}
+
+func TestRecordBatchUndone(t *testing.T) {
+	db := mem.NewDB()
+
+	g := gaia.New(
+		context.Background(),
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 &failingDB{DB: db, name: "unsaveable"},
+			SMSCommandSessions: services.NewSMSMux(),
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+
+	tasks := make([]*models.Task, 2)
+	for i := range tasks {
+		tasks[i] = models.NewTask()
+		tasks[i].SetID(db.NewID())
+		tasks[i].CreatedAt = time.Now()
+		tasks[i].OwnerId = u.Id
+		tasks[i].Name = fmt.Sprintf("original %d", i)
+		tasks[i].UpdatedAt = time.Now()
+		if err := db.Save(tasks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owner := `, "owner_id": "` + u.ID().String() + `"}`
+	ops := []*routes.BatchOperation{
+		{
+			Op:     routes.BatchSave,
+			Kind:   models.TaskKind,
+			ID:     tasks[0].ID().String(),
+			Record: json.RawMessage(`{"name": "updated"` + owner),
+		},
+		{
+			Op:     routes.BatchSave,
+			Kind:   models.TaskKind,
+			Record: json.RawMessage(`{"name": "created"` + owner),
+		},
+		{
+			Op:   routes.BatchDelete,
+			Kind: models.TaskKind,
+			ID:   tasks[1].ID().String(),
+		},
+		{
+			Op:     routes.BatchSave,
+			Kind:   models.TaskKind,
+			Record: json.RawMessage(`{"name": "unsaveable"` + owner),
+		},
+	}
+
+	requestBody, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", s.URL+routes.RecordBatch, bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Code: %d", resp.StatusCode)
+	t.Logf("Body:\n%s", body)
+
+	var results []*routes.BatchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusFailedDependency, http.StatusInternalServerError}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("results[%d].Status: got %d, want %d", i, result.Status, want[i])
+		}
+	}
+
+	// the operations before the failure were undone
+	for i, task := range tasks {
+		restored := models.NewTask()
+		restored.SetID(task.ID())
+		if err := db.PopulateByID(restored); err != nil {
+			t.Fatalf("task %d should have been restored: %s", i, err)
+		}
+		if got, want := restored.Name, task.Name; got != want {
+			t.Errorf("the name of task %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	if err := db.PopulateByField("name", "created", models.NewTask()); err != data.ErrNotFound {
+		t.Fatal("The created task should have been deleted")
+	}
+}
+
+// --- }}}
+
+func TestRecordChanges(t *testing.T) {
+	ctx, cancelAllConnections := context.WithCancel(context.Background())
+	defer cancelAllConnections()
+
+	db, _, s := testInstance(t, ctx)
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	serverURL := s.URL
+	origin := serverURL
+	wsURL := strings.Replace(serverURL, "http", "ws", 1)
+
+	params := url.Values{}
+	params.Set("public", cred.Public)
+	params.Set("private", cred.Private)
+	params.Set("kind", models.TaskKind.String())
+	wsURL += routes.RecordChanges + "?" + params.Encode()
+	t.Logf("Constructed URL: %s", wsURL)
+
+	t.Log("Opening websocket")
+	ws, err := websocket.Dial(wsURL, "", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	t.Log("Websocket openened")
+
+	time.Sleep(500 * time.Millisecond)
+
+	t.Log("Creating task")
+	taskName := "task to retreive"
+	task := models.NewTask()
+	task.SetID(db.NewID())
+	task.CreatedAt = time.Now()
+	task.OwnerId = user.Id
+	task.Name = taskName
+	task.UpdatedAt = time.Now()
+	if err := db.Save(task); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Task created")
+
+	var ct transfer.ChangeTransport
+	if err := websocket.JSON.Receive(ws, &ct); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := transfer.ChangeFrom(&ct, models.ModelFor(ct.RecordKind))
+
+	t.Logf("Task Change Recieved: %++v", tc)
+
+	t.Log("Cancelling the connection")
+	cancelAllConnections()
+	t.Log("\tcancelled")
+
+	if tc.ChangeKind != data.Update {
+		t.Fatal("Expected ChangeKind to be Update")
+	}
+
+	if tc.Record.(*models.Task).Name != taskName {
+		t.Fatalf("Expected task name to be: '%s'", taskName)
+	}
+}
+
+// basicAuthHeader constructs the headers of a request authenticated with basic auth
+func basicAuthHeader(public, private string) http.Header {
+	req := &http.Request{Header: make(http.Header)}
+	req.SetBasicAuth(public, private)
+	return req.Header
+}
+
+func TestRecordChangesUnauthorized(t *testing.T) {
+	ctx, cancelAllConnections := context.WithCancel(context.Background())
+	defer cancelAllConnections()
+
+	db, _, s := testInstance(t, ctx)
+	defer s.Close()
+
+	_, cred := testUser(t, db)
+
+	wsURL := strings.Replace(s.URL, "http", "ws", 1) + routes.RecordChanges
+	t.Logf("Constructed URL: %s", wsURL)
+
+	config, err := websocket.NewConfig(wsURL, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header = basicAuthHeader(cred.Public, "not the private")
+
+	if ws, err := websocket.DialConfig(config); err == nil {
+		ws.Close()
+		t.Fatal("Expected the websocket upgrade to be refused")
+	}
+
+	// the upgrade is refused as an ordinary request
+	req, err := http.NewRequest("GET", s.URL+routes.RecordChanges, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	t.Logf("Code: %d", resp.StatusCode)
+
+	if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+		t.Fatalf("resp.StatusCode: got %d, want %d", got, want)
+	}
+}
+
+func TestRecordChangesSince(t *testing.T) {
+	ctx, cancelAllConnections := context.WithCancel(context.Background())
+	defer cancelAllConnections()
+
+	db, _, s := testInstance(t, ctx)
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	origin := s.URL
+	dial := func(since uint64) *websocket.Conn {
+		params := url.Values{}
+		params.Set("kind", models.TaskKind.String())
+		if since > 0 {
+			params.Set("since", strconv.FormatUint(since, 10))
+		}
+		wsURL := strings.Replace(s.URL, "http", "ws", 1) + routes.RecordChanges + "?" + params.Encode()
+		t.Logf("Constructed URL: %s", wsURL)
+
+		config, err := websocket.NewConfig(wsURL, origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header = basicAuthHeader(cred.Public, cred.Private)
+
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	ws := dial(0)
+	time.Sleep(500 * time.Millisecond)
+
+	save := func(name string) {
+		task := models.NewTask()
+		task.SetID(db.NewID())
+		task.CreatedAt = time.Now()
+		task.OwnerId = user.Id
+		task.Name = name
+		task.UpdatedAt = time.Now()
+		if err := db.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save("first")
+
+	var first routes.ChangeTransport
+	if err := websocket.JSON.Receive(ws, &first); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Change Recieved: %++v", first)
+
+	// disconnect, and miss a change
+	ws.Close()
+	save("missed")
+	time.Sleep(100 * time.Millisecond)
+
+	ws = dial(first.Seq)
+	defer ws.Close()
+
+	var missed routes.ChangeTransport
+	if err := websocket.JSON.Receive(ws, &missed); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Change Recieved: %++v", missed)
+
+	if got, want := missed.Record["name"], "missed"; got != want {
+		t.Fatalf("missed.Record[\"name\"]: got %v, want %v", got, want)
+	}
+
+	if missed.Seq <= first.Seq {
+		t.Fatalf("missed.Seq (%d) should be after first.Seq (%d)", missed.Seq, first.Seq)
+	}
+}
+
+func TestRecordChangesReset(t *testing.T) {
+	ctx, cancelAllConnections := context.WithCancel(context.Background())
+	defer cancelAllConnections()
+
+	db, _, s := testInstance(t, ctx)
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	// a since of a previous run of the server, whose changes the journal never had
+	params := url.Values{}
+	params.Set("kind", models.TaskKind.String())
+	params.Set("since", "1")
+	config, err := websocket.NewConfig(strings.Replace(s.URL, "http", "ws", 1)+routes.RecordChanges+"?"+params.Encode(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header = basicAuthHeader(cred.Public, cred.Private)
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var reset routes.ChangeTransport
+	if err := websocket.JSON.Receive(ws, &reset); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Reset Recieved: %++v", reset)
+
+	if !reset.Reset || reset.Seq <= 1 {
+		t.Fatalf("Expected a reset to the journal's sequence number, got %++v", reset)
+	}
+
+	task := models.NewTask()
+	task.SetID(db.NewID())
+	task.CreatedAt = time.Now()
+	task.OwnerId = user.Id
+	task.Name = "after the reset"
+	task.UpdatedAt = time.Now()
+	if err := db.Save(task); err != nil {
+		t.Fatal(err)
+	}
+
+	var change routes.ChangeTransport
+	if err := websocket.JSON.Receive(ws, &change); err != nil {
+		t.Fatal(err)
+	}
+
+	if change.Reset || change.Seq <= reset.Seq || change.Record["name"] != task.Name {
+		t.Fatalf("Expected the change after the reset, got %++v", change)
+	}
+
+	// an EventSource is told by a reset event
+	req, err := http.NewRequest("GET", s.URL+routes.RecordChanges, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+	req.Header.Set("Accept", routes.EventStreamContentType)
+	req.Header.Set("Last-Event-ID", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		t.Logf("Line: %s", line)
+
+		if strings.HasPrefix(line, "event: ") {
+			if got, want := line, "event: reset"; got != want {
+				t.Fatalf("The first event: got %q, want %q", got, want)
+			}
+			return
+		}
+	}
+
+	t.Fatalf("The stream ended without a reset: %v", scanner.Err())
+}
+
+func TestRecordChangesEventStream(t *testing.T) {
+	ctx, cancelAllConnections := context.WithCancel(context.Background())
+	defer cancelAllConnections()
+
+	db, _, s := testInstance(t, ctx)
+	defer s.Close()
+
+	user, cred := testUser(t, db)
+
+	params := url.Values{}
+	params.Set("kind", models.TaskKind.String())
+	req, err := http.NewRequest("GET", s.URL+routes.RecordChanges+"?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(cred.Public, cred.Private)
+	req.Header.Set("Accept", routes.EventStreamContentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	t.Logf("Code: %d", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code of %d", http.StatusOK)
+	}
+
+	if got, want := resp.Header.Get("Content-Type"), routes.EventStreamContentType; got != want {
+		t.Fatalf("Content-Type: got %q, want %q", got, want)
+	}
+
+	taskName := "task to retreive"
+	task := models.NewTask()
+	task.SetID(db.NewID())
+	task.CreatedAt = time.Now()
+	task.OwnerId = user.Id
+	task.Name = taskName
+	task.UpdatedAt = time.Now()
+	if err := db.Save(task); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		t.Logf("Line: %s", line)
+
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var ct routes.ChangeTransport
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ct); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := ct.Record["name"], taskName; got != want {
+			t.Fatalf("ct.Record[\"name\"]: got %v, want %v", got, want)
+		}
+
+		return
+	}
+
+	t.Fatalf("The stream ended without a change: %v", scanner.Err())
 }
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elos/data/builtin/mem"
+	"github.com/elos/gaia/routes"
+	"github.com/elos/gaia/services"
+	"github.com/elos/gaia/services/sms"
+	"github.com/elos/models"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+func TestShutdownClosesChangeFeeds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, g, s := testInstance(t, ctx)
+	defer s.Close()
+
+	_, cred := testUser(t, db)
+
+	config, err := websocket.NewConfig(strings.Replace(s.URL, "http", "ws", 1)+routes.RecordChanges, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header = basicAuthHeader(cred.Public, cred.Private)
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// let the feed subscribe
+	time.Sleep(100 * time.Millisecond)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+
+	if err := g.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("g.Shutdown error: %s", err)
+	}
+
+	// the server closed the websocket
+	var message string
+	if err := websocket.Message.Receive(ws, &message); err != io.EOF {
+		t.Errorf("websocket.Message.Receive: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestShutdownEndsSMSSessions(t *testing.T) {
+	db := mem.NewDB()
+	mock := newMockSMS()
+	mux := services.NewSMSMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		mux.Start(ctx, db, mock)
+		close(stopped)
+	}()
+
+	u, _ := testUser(t, db)
+	p := models.NewProfile()
+	p.SetID(db.NewID())
+	p.Phone = "650 123 4567"
+	p.SetOwner(u)
+	if err := db.Save(p); err != nil {
+		t.Fatal(err)
+	}
+
+	mux.Inbound(&sms.Message{From: "650 123 4567", To: "650 123 4567", Body: "todo"})
+
+	// the session's response to the message
+	select {
+	case <-mock.bus:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the session to respond")
+	}
+
+	cancel()
+
+	// the session may have more to say, but it must say goodbye
+	timeout := time.After(time.Second)
+Goodbye:
+	for {
+		select {
+		case msg := <-mock.bus:
+			if msg.body == services.GoingAwayMessage {
+				if msg.to != "650 123 4567" {
+					t.Errorf("the going away message was sent to %q", msg.to)
+				}
+				break Goodbye
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the going away message")
+		}
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the mux to stop")
+	}
+	if mux.Running() {
+		t.Error("expected the mux not to be running")
+	}
+}
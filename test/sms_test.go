@@ -1,18 +1,25 @@
 package test
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/elos/data/builtin/mem"
 	"github.com/elos/gaia"
+	"github.com/elos/gaia/routes"
 	"github.com/elos/gaia/services"
+	"github.com/elos/gaia/services/sms"
 	"github.com/elos/models"
+	"github.com/elos/models/user"
+	"github.com/subosito/twilio"
 	"golang.org/x/net/context"
 )
 
@@ -62,6 +69,7 @@ func TestCommandSMS(t *testing.T) {
 		&gaia.Services{
 			Logger:             services.NewTestLogger(t),
 			DB:                 db,
+			SMSProviders:       services.NewSMSProviders(services.NewLoopbackSMS(ioutil.Discard)),
 			SMSCommandSessions: mux,
 			WebCommandSessions: services.NewWebMux(),
 		},
@@ -148,6 +156,7 @@ func TestCommandSMSInput(t *testing.T) {
 		&gaia.Services{
 			Logger:             services.NewTestLogger(t),
 			DB:                 db,
+			SMSProviders:       services.NewSMSProviders(services.NewLoopbackSMS(ioutil.Discard)),
 			SMSCommandSessions: mux,
 			WebCommandSessions: services.NewWebMux(),
 		},
@@ -232,6 +241,348 @@ func TestCommandSMSInput(t *testing.T) {
 	t.Logf("Task:\n%+v", task)
 }
 
+// TestCommandSMSProviders ensures /command/sms/<provider>/ verifies, then parses, the webhook of the provider
+func TestCommandSMSProviders(t *testing.T) {
+	db := mem.NewDB()
+
+	sender := newMockSMS()
+	mux := services.NewSMSMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mux.Start(ctx, db, sender)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger: services.NewTestLogger(t),
+			DB:     db,
+			SMSProviders: services.NewSMSProviders(
+				services.NewLoopbackSMS(ioutil.Discard),
+				services.SMSFromTwilio(twilio.NewClient("AC123", "token", nil), "+16505550000", "token"),
+				services.NewPlivoSMS("MA123", "token", "+16505550000"),
+				services.NewNexmoSMS("key", "secret", "+16505550000", "signature", sms.NexmoMD5Hash),
+			),
+			SMSCommandSessions: mux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	u, _ := testUser(t, db)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nexmoSig, err := sms.NexmoSignature(map[string]string{
+		"msisdn": "16507654321", "to": "16505550000", "text": "todo", "type": "text", "timestamp": timestamp,
+	}, "signature", sms.NexmoMD5Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twilioParams := url.Values{"From": {"+16501112222"}, "To": {"+16505550000"}, "Body": {"todo"}}
+	plivoParams := url.Values{"From": {"16501234567"}, "To": {"16505550000"}, "Text": {"todo"}}
+
+	cases := []struct {
+		provider, phone, contentType, body string
+		sign                               func(r *http.Request)
+	}{
+		{
+			services.TwilioProvider, "+16501112222", "application/x-www-form-urlencoded",
+			twilioParams.Encode(),
+			func(r *http.Request) {
+				r.Header.Set(sms.TwilioSignatureHeader, sms.TwilioSignature(r.URL.String(), twilioParams, "token"))
+			},
+		},
+		{
+			services.PlivoProvider, "+16501234567", "application/x-www-form-urlencoded",
+			plivoParams.Encode(),
+			func(r *http.Request) {
+				r.Header.Set(sms.PlivoNonceHeader, "12345")
+				r.Header.Set(sms.PlivoSignatureHeader, sms.PlivoSignature("POST", r.URL.String(), plivoParams, "12345", "token"))
+			},
+		},
+		{
+			services.NexmoProvider, "+16507654321", "application/json",
+			`{"msisdn": "16507654321", "to": "16505550000", "text": "todo", "type": "text", "timestamp": "` + timestamp + `", "sig": "` + nexmoSig + `"}`,
+			func(r *http.Request) {},
+		},
+	}
+
+	for _, c := range cases {
+		p := models.NewProfile()
+		p.SetID(db.NewID())
+		p.Phone = c.phone
+		p.SetOwner(u)
+		if err := db.Save(p); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", s.URL+"/command/sms/"+c.provider+"/", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		c.sign(req)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("%s: status code: got %d, want %d", c.provider, resp.StatusCode, http.StatusNoContent)
+		}
+
+		select {
+		case m := <-sender.bus:
+			if m.to != c.phone {
+				t.Errorf("%s: the reply was to %q, want %q", c.provider, m.to, c.phone)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("%s: timed out waiting for sms message", c.provider)
+		}
+	}
+
+	resp, err := http.Post(s.URL+"/command/sms/carrier-pigeon/", "application/x-www-form-urlencoded", strings.NewReader("From=1&To=2&Body=todo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown provider: status code: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// TestCommandSMSSpoofed ensures a request whose signature is missing, or
+// doesn't match, never reaches the command sessions
+func TestCommandSMSSpoofed(t *testing.T) {
+	db := mem.NewDB()
+
+	sender := newMockSMS()
+	mux := services.NewSMSMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mux.Start(ctx, db, sender)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger: services.NewTestLogger(t),
+			DB:     db,
+			SMSProviders: services.NewSMSProviders(
+				services.SMSFromTwilio(twilio.NewClient("AC123", "token", nil), "+16505550000", "token"),
+			),
+			SMSCommandSessions: mux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	u, _ := testUser(t, db)
+
+	p := models.NewProfile()
+	p.SetID(db.NewID())
+	p.Phone = "+16501112222"
+	p.SetOwner(u)
+	if err := db.Save(p); err != nil {
+		t.Fatal(err)
+	}
+
+	params := url.Values{"From": {"+16501112222"}, "To": {"+16505550000"}, "Body": {"todo"}}
+
+	for name, signature := range map[string]string{
+		"missing": "",
+		"forged":  sms.TwilioSignature(s.URL+"/command/sms/", params, "not the token"),
+		"altered": sms.TwilioSignature(s.URL+"/command/sms/", url.Values{"From": {"+16501112222"}, "Body": {"todo"}}, "token"),
+	} {
+		req, err := http.NewRequest("POST", s.URL+"/command/sms/", strings.NewReader(params.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if signature != "" {
+			req.Header.Set(sms.TwilioSignatureHeader, signature)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s signature: status code: got %d, want %d", name, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	select {
+	case m := <-sender.bus:
+		t.Fatalf("a spoofed request reached the command session, which replied %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestCommandSMSPlivoReplayed ensures a signed plivo request is accepted only once, and
+// that its signature doesn't cover a request whose parameters were altered
+func TestCommandSMSPlivoReplayed(t *testing.T) {
+	db := mem.NewDB()
+
+	sender := newMockSMS()
+	mux := services.NewSMSMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mux.Start(ctx, db, sender)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 db,
+			SMSProviders:       services.NewSMSProviders(services.NewPlivoSMS("MA123", "token", "+16505550000")),
+			SMSCommandSessions: mux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	u, _ := testUser(t, db)
+
+	for _, phone := range []string{"+16501112222", "+16503334444"} {
+		p := models.NewProfile()
+		p.SetID(db.NewID())
+		p.Phone = phone
+		p.SetOwner(u)
+		if err := db.Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	endpoint := s.URL + "/command/sms/" + services.PlivoProvider + "/"
+	params := url.Values{"From": {"16501112222"}, "To": {"16505550000"}, "Text": {"todo"}}
+	signature := sms.PlivoSignature("POST", endpoint, params, "12345", "token")
+
+	post := func(params url.Values, nonce string) int {
+		req, err := http.NewRequest("POST", endpoint, strings.NewReader(params.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(sms.PlivoNonceHeader, nonce)
+		req.Header.Set(sms.PlivoSignatureHeader, signature)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got, want := post(params, "12345"), http.StatusNoContent; got != want {
+		t.Fatalf("signed request: status code: got %d, want %d", got, want)
+	}
+
+	select {
+	case m := <-sender.bus:
+		if got, want := m.to, "+16501112222"; got != want {
+			t.Errorf("the reply was to %q, want %q", got, want)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for sms message")
+	}
+
+	altered := url.Values{"From": {"16503334444"}, "To": {"16505550000"}, "Text": {"todo"}}
+
+	for name, c := range map[string]struct {
+		params url.Values
+		nonce  string
+	}{
+		"replayed":                    {params, "12345"},
+		"replayed, altered":           {altered, "12345"},
+		"altered, with another nonce": {altered, "67890"},
+	} {
+		if got, want := post(c.params, c.nonce), http.StatusForbidden; got != want {
+			t.Errorf("%s request: status code: got %d, want %d", name, got, want)
+		}
+	}
+
+	select {
+	case m := <-sender.bus:
+		t.Fatalf("a replayed request reached the command session, which replied %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestCommandSMSUnconfigured ensures that, without a provider, /command/sms/ isn't
+// served at all, so that no unsigned request can reach the command sessions
+func TestCommandSMSUnconfigured(t *testing.T) {
+	db := mem.NewDB()
+
+	sender := newMockSMS()
+	mux := services.NewSMSMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mux.Start(ctx, db, sender)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 db,
+			SMSCommandSessions: mux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	u, _ := testUser(t, db)
+
+	p := models.NewProfile()
+	p.SetID(db.NewID())
+	p.Phone = "+16501112222"
+	p.SetOwner(u)
+	if err := db.Save(p); err != nil {
+		t.Fatal(err)
+	}
+
+	params := url.Values{"From": {"+16501112222"}, "To": {"+16505550000"}, "Body": {"todo"}}
+	for _, path := range []string{"/command/sms/", "/command/sms/loopback/", "/command/sms/twilio/"} {
+		resp, err := http.Post(s.URL+path, "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// the path falls through to the index, which only takes a GET
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status code: got %d, want %d", path, resp.StatusCode, http.StatusMethodNotAllowed)
+		}
+	}
+
+	select {
+	case m := <-sender.bus:
+		t.Fatalf("an unsigned request reached the command session, which replied %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 func fakeSMS(t *testing.T, s *httptest.Server, from, to, body string) {
 	params := url.Values{}
 	params.Set("To", to) // /command/ ignores this, twilio sends it though
@@ -267,3 +618,297 @@ func fakePostSMS(t *testing.T, url string) {
 		t.Fatalf("Expected status code of %d", http.StatusNoContent)
 	}
 }
+
+// lineWriter receives each line written to it
+type lineWriter chan string
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+// TestCommandSMSBusy ensures a message which the sessions refuse is answered, and its
+// sender told to send it again, rather than the provider being told to retry it
+func TestCommandSMSBusy(t *testing.T) {
+	db := mem.NewDB()
+
+	// the mux isn't started, so the messages it takes wait
+	mux := services.NewBoundedSMSMux(1, 0, 1)
+	sent := make(lineWriter, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 db,
+			SMSProviders:       services.NewSMSProviders(services.NewLoopbackSMS(sent)),
+			SMSCommandSessions: mux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	cases := []struct {
+		from string
+		busy bool
+	}{
+		{"+16501112222", false},
+		{"+16501112222", true}, // its session has a message waiting
+		{"+16503334444", true}, // there are too many sessions
+	}
+
+	for i, c := range cases {
+		params := url.Values{"From": {c.from}, "To": {"+16505550000"}, "Body": {"todo"}}
+		fakePostSMS(t, s.URL+"/command/sms/loopback/?"+params.Encode())
+
+		if !c.busy {
+			continue
+		}
+
+		select {
+		case line := <-sent:
+			m := new(services.LoopbackMessage)
+			if err := json.Unmarshal([]byte(line), m); err != nil {
+				t.Fatal(err)
+			}
+
+			if m.To != c.from || m.Body != services.BusyMessage {
+				t.Errorf("message %d: got a reply of %q to %s, want %q to %s", i, m.Body, m.To, services.BusyMessage, c.from)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("message %d: timed out waiting for the sender to be told elos is busy", i)
+		}
+	}
+
+	select {
+	case line := <-sent:
+		t.Errorf("unexpected reply: %s", line)
+	default:
+	}
+}
+
+// TestAdminSMSSessions ensures an admin, and only an admin, may list and kill the sms command sessions
+func TestAdminSMSSessions(t *testing.T) {
+	db := mem.NewDB()
+
+	// the mux isn't started, so the sessions remain until they are killed
+	mux := services.NewSMSMux()
+
+	_, cred := testUser(t, db)
+	admin, adminCred, err := user.Create(db, "admin", "private")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 db,
+			SMSCommandSessions: mux,
+			Admins:             services.NewAdmins(admin.ID().String()),
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	number := "+16501112222"
+	if err := mux.Inbound(&sms.Message{From: sms.PhoneNumber(number), Body: "todo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, c *models.Credential) (int, []byte) {
+		req, err := http.NewRequest(method, s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(c.Public, c.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, body
+	}
+
+	kill := routes.AdminSMSSessions + "?" + url.Values{"number": {number}}.Encode()
+
+	if status, _ := do("GET", routes.AdminSMSSessions, cred); status != http.StatusForbidden {
+		t.Errorf("GET by a user: got %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := do("DELETE", kill, cred); status != http.StatusForbidden {
+		t.Errorf("DELETE by a user: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	status, body := do("GET", routes.AdminSMSSessions, adminCred)
+	if status != http.StatusOK {
+		t.Fatalf("GET: got %d, want %d", status, http.StatusOK)
+	}
+
+	listed := new(routes.AdminSMSSessionsResponse)
+	if err := json.Unmarshal(body, listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Sessions) != 1 || string(listed.Sessions[0].Number) != number || listed.Sessions[0].Pending != 1 {
+		t.Fatalf("GET: got sessions %+v, want the one of %s, with a message pending", listed.Sessions, number)
+	}
+
+	if status, _ := do("DELETE", kill, adminCred); status != http.StatusNoContent {
+		t.Errorf("DELETE: got %d, want %d", status, http.StatusNoContent)
+	}
+	if status, _ := do("DELETE", kill, adminCred); status != http.StatusNotFound {
+		t.Errorf("DELETE of a killed session: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	if got := mux.Active(); got != 0 {
+		t.Errorf("mux.Active(): got %d, want 0", got)
+	}
+}
+
+// TestSMSQueueUserEvents ensures a user can't write the records of the sms queue, and
+// that only the segments gaia queued are sent when the queue is next started
+func TestSMSQueueUserEvents(t *testing.T) {
+	db, _, s := testInstance(t, context.Background())
+	defer s.Close()
+
+	u, cred := testUser(t, db)
+
+	p := models.NewProfile()
+	p.SetID(db.NewID())
+	p.Phone = "+16501112222"
+	p.SetOwner(u)
+	if err := db.Save(p); err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("0123456789abcdef")
+
+	// a queue which is stopped before it sends, its delivery record belongs to the user
+	stopped := services.NewSMSQueue(db, newMockSMS(), key, 5, time.Millisecond, 10*time.Millisecond, 0)
+	if err := stopped.Send(p.Phone, "queued by gaia"); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := models.NewEvent()
+	if err := db.PopulateByField("name", services.SMSDeliveryEvent, delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, endpoint string, body []byte) (int, []byte) {
+		req, err := http.NewRequest(method, s.URL+endpoint, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(cred.Public, cred.Private)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Logf("%s %s: %d %s", method, endpoint, resp.StatusCode, body)
+		return resp.StatusCode, body
+	}
+
+	do := func(method, endpoint string, body []byte) int {
+		code, _ := send(method, endpoint, body)
+		return code
+	}
+
+	forged := func(name string) []byte {
+		return []byte(`{"name": "` + name + `", "owner_id": "` + u.ID().String() + `", "data": ` +
+			`{"to": "+16503334444", "body": "forged", "segment": 1, "status": "queued", "queued_at": 0}}`)
+	}
+
+	for _, name := range []string{services.SMSDeliveryEvent, services.SMSOutboxEvent} {
+		if got, want := do("POST", routes.Record+"?kind=event", forged(name)), http.StatusForbidden; got != want {
+			t.Errorf("POST a new %s: got %d, want %d", name, got, want)
+		}
+
+		if got, want := do("POST", routes.Event+"?name="+name, forged(name)), http.StatusForbidden; got != want {
+			t.Errorf("POST a %s to %s: got %d, want %d", name, routes.Event, got, want)
+		}
+
+		ops, err := json.Marshal([]*routes.BatchOperation{
+			{Op: routes.BatchSave, Kind: models.EventKind, Record: json.RawMessage(forged(name))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, body := send("POST", routes.RecordBatch, ops)
+		var results []*routes.BatchResult
+		if err := json.Unmarshal(body, &results); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := results[0].Status, http.StatusForbidden; got != want {
+			t.Errorf("POST a %s in a batch: got %d, want %d", name, got, want)
+		}
+	}
+
+	// the user's copy of the delivery record is read only
+	params := url.Values{"kind": {models.EventKind.String()}, "id": {delivery.ID().String()}}
+	if got, want := do("POST", routes.Record+"?"+params.Encode(), forged(services.SMSDeliveryEvent)), http.StatusForbidden; got != want {
+		t.Errorf("POST over the delivery record: got %d, want %d", got, want)
+	}
+	if got, want := do("DELETE", routes.Record+"?"+params.Encode(), nil), http.StatusForbidden; got != want {
+		t.Errorf("DELETE the delivery record: got %d, want %d", got, want)
+	}
+	if got, want := do("GET", routes.Record+"?"+params.Encode(), nil), http.StatusOK; got != want {
+		t.Errorf("GET the delivery record: got %d, want %d", got, want)
+	}
+
+	// even a queued delivery record which was written directly isn't sent
+	direct := models.NewEvent()
+	direct.SetID(db.NewID())
+	direct.SetOwner(u)
+	direct.Name = services.SMSDeliveryEvent
+	direct.Data = map[string]interface{}{"to": "+16503334444", "body": "forged", "segment": 1, "status": services.SMSQueued}
+	if err := db.Save(direct); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	sender := newMockSMS()
+	q := services.NewSMSQueue(db, sender, key, 5, time.Millisecond, 10*time.Millisecond, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Start(ctx)
+
+	select {
+	case m := <-sender.bus:
+		if m.to != p.Phone || m.body != "queued by gaia" {
+			t.Errorf("sent %q to %s, want %q to %s", m.body, m.to, "queued by gaia", p.Phone)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for the queued segment to be sent")
+	}
+
+	select {
+	case m := <-sender.bus:
+		t.Errorf("sent %q to %s, which gaia didn't queue", m.body, m.to)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
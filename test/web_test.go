@@ -2,9 +2,9 @@ package test
 
 import (
 	"net/http/httptest"
-	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/elos/data/builtin/mem"
 	"github.com/elos/gaia"
@@ -51,14 +51,17 @@ func TestCommandWeb(t *testing.T) {
 	origin := serverURL
 	wsURL := strings.Replace(serverURL, "http", "ws", 1)
 
-	params := url.Values{}
-	params.Set("public", cred.Public)
-	params.Set("private", cred.Private)
-	wsURL += "/command/web/?" + params.Encode()
+	wsURL += "/command/web/"
 	t.Logf("Constructed URL: %s", wsURL)
 
+	config, err := websocket.NewConfig(wsURL, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header = basicAuthHeader(cred.Public, cred.Private)
+
 	t.Log("Opening websocket")
-	ws, err := websocket.Dial(wsURL, "", origin)
+	ws, err := websocket.DialConfig(config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,3 +86,81 @@ func TestCommandWeb(t *testing.T) {
 	}
 	t.Log("Verified")
 }
+
+// TestCommandWebTakeOver ensures a user has one session, which another socket may take over
+func TestCommandWebTakeOver(t *testing.T) {
+	db := mem.NewDB()
+	webMux := services.NewWebMux()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go webMux.Start(ctx, db)
+
+	g := gaia.New(
+		ctx,
+		&gaia.Middleware{},
+		&gaia.Services{
+			Logger:             services.NewTestLogger(t),
+			DB:                 db,
+			SMSCommandSessions: services.NewSMSMux(),
+			WebCommandSessions: webMux,
+		},
+	)
+
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	_, cred := testUser(t, db)
+
+	dial := func(query string) *websocket.Conn {
+		config, err := websocket.NewConfig(strings.Replace(s.URL, "http", "ws", 1)+"/command/web/"+query, s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header = basicAuthHeader(cred.Public, cred.Private)
+
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	first := dial("")
+	defer first.Close()
+
+	websocket.Message.Send(first, "todo")
+	var received string
+	if err := websocket.Message.Receive(first, &received); err != nil {
+		t.Fatal(err)
+	}
+
+	second := dial("")
+	defer second.Close()
+	if err := websocket.Message.Receive(second, &received); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(received, "take_over") {
+		t.Errorf("the refusal should have said how to take over the session, it was %q", received)
+	}
+
+	third := dial("?take_over=true")
+	defer third.Close()
+
+	// the first may have more to say, but it must be told it was taken over
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	for received != services.TakenOverMessage {
+		if err := websocket.Message.Receive(first, &received); err != nil {
+			t.Fatalf("waiting for the session to be taken over: %s", err)
+		}
+	}
+
+	websocket.Message.Send(third, "todo")
+	if err := websocket.Message.Receive(third, &received); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(received, "elos") {
+		t.Errorf("The message should have almost certainly contained the word elos, it was %q", received)
+	}
+}